@@ -0,0 +1,64 @@
+package dq
+
+import "strings"
+
+// ACLRole is the role of a redis ACL user of the queue.
+type ACLRole int
+
+const (
+	// ACLProducer produces, cancels and restores messages only.
+	ACLProducer ACLRole = iota
+	// ACLConsumer consumes messages, runs the daemon and inspects the queue.
+	ACLConsumer
+)
+
+// producerKeys are the keys of the queue used by producing,
+// their patterns match both the key and its per message or tenant keys.
+// Retry is only written by canceling, which removes the message from it.
+var producerKeys = []redisKey{kReady, kDelay, kCold, kData, kToken, kQuota, kGroup, kBatch, kTrash, kJob, kMeta, kAudit, kRetry}
+
+// KeyPatterns returns the patterns of all the keys the queue uses,
+// e.g. to be granted by redis ACL, see ACLRule.
+func (q *Queue) KeyPatterns() []string {
+	ks := make([]redisKey, 0, numKey)
+	for k := redisKey(0); k < numKey; k++ {
+		ks = append(ks, k)
+	}
+	return q.keyPatterns(ks)
+}
+
+// ProducerKeyPatterns returns the patterns of the keys used by producing.
+func (q *Queue) ProducerKeyPatterns() []string {
+	return q.keyPatterns(producerKeys)
+}
+
+func (q *Queue) keyPatterns(ks []redisKey) []string {
+	patterns := make([]string, 0, 2*len(ks))
+	for _, k := range ks {
+		patterns = append(patterns, q.key(k), q.key(k)+":*")
+	}
+	return patterns
+}
+
+// ACLRule returns the ACL SETUSER command granting user the minimum keys of
+// role, the password and the on flag are left to be appended.
+// Commands are granted by category as most of them run in scripts.
+func (q *Queue) ACLRule(user string, role ACLRole) string {
+	patterns := q.ProducerKeyPatterns()
+	if role == ACLConsumer {
+		patterns = q.KeyPatterns()
+	}
+
+	var b strings.Builder
+	b.WriteString("ACL SETUSER " + user + " resetkeys")
+	for _, p := range patterns {
+		b.WriteString(" ~" + p)
+	}
+	b.WriteString(" resetchannels &" + q.doneChannel("*") + " &" + q.tailChannel())
+	b.WriteString(" -@all +@connection +@read +@write +@scripting +@transaction +@pubsub -@dangerous")
+	if role == ACLConsumer {
+		// Destroy and inspection scan the keys
+		b.WriteString(" +scan")
+	}
+	return b.String()
+}
@@ -0,0 +1,140 @@
+package dq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DeadLetterAlert tells dead letters crossed a threshold.
+type DeadLetterAlert struct {
+	Queue string `json:"queue"`
+	// Total is the number of dead letters.
+	Total int64 `json:"total"`
+	// Recent is the number of messages dead within Window.
+	Recent int64         `json:"recent"`
+	Window time.Duration `json:"window"`
+	// Reason tells the crossed threshold.
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+func (a DeadLetterAlert) String() string {
+	return fmt.Sprintf("dq queue %s: %s, %d dead letters, %d within %s", a.Queue, a.Reason, a.Total, a.Recent, a.Window)
+}
+
+// Notifier sends alerts, e.g. by email, SMS or chat.
+type Notifier interface {
+	Notify(ctx context.Context, a DeadLetterAlert) error
+}
+
+// DeadLetterThreshold alerts when dead letters grow, zero thresholds are disabled.
+type DeadLetterThreshold struct {
+	// Total alerts once the number of dead letters reaches Total.
+	Total int64
+	// Rate alerts once Rate or more messages are dead within Window.
+	Rate int64
+	// Window defaults to 5m.
+	Window time.Duration
+	// Interval between checks, defaults to 1m.
+	Interval time.Duration
+}
+
+// WatchDeadLetters checks dead letters every interval until ctx is done and
+// notifies n when a threshold is crossed, it notifies again only after the
+// dead letters fell below the threshold. Run it by one instance per queue.
+func (q *Queue) WatchDeadLetters(ctx context.Context, n Notifier, th DeadLetterThreshold) error {
+	if th.Total <= 0 && th.Rate <= 0 {
+		return fmt.Errorf("no threshold")
+	}
+	if th.Window <= 0 {
+		th.Window = 5 * time.Minute
+	}
+	if th.Interval <= 0 {
+		th.Interval = time.Minute
+	}
+
+	ticker := time.NewTicker(th.Interval)
+	defer ticker.Stop()
+
+	var totalCrossed, rateCrossed bool
+	for {
+		now := time.Now()
+		pipe := q.rdb.reader().Pipeline()
+		total := pipe.ZCard(ctx, q.key(kDead))
+		recent := pipe.ZCount(ctx, q.key(kDead), strconv.FormatInt(now.Add(-th.Window).UnixMilli(), 10), "+inf")
+		if _, err := pipe.Exec(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			q.log(ctx, Warn, "watch dead letters failed, err: %v", err)
+		} else {
+			a := DeadLetterAlert{Queue: q.name, Total: total.Val(), Recent: recent.Val(), Window: th.Window, At: now}
+
+			crossed := th.Total > 0 && a.Total >= th.Total
+			if crossed && !totalCrossed {
+				a.Reason = fmt.Sprintf("dead letters reached %d", th.Total)
+				q.notify(ctx, n, a)
+			}
+			totalCrossed = crossed
+
+			crossed = th.Rate > 0 && a.Recent >= th.Rate
+			if crossed && !rateCrossed {
+				a.Reason = fmt.Sprintf("%d or more dead letters within %s", th.Rate, th.Window)
+				q.notify(ctx, n, a)
+			}
+			rateCrossed = crossed
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *Queue) notify(ctx context.Context, n Notifier, a DeadLetterAlert) {
+	q.log(ctx, Warn, "%s", a)
+	if err := n.Notify(ctx, a); err != nil {
+		q.log(ctx, Warn, "notify dead letter alert failed, err: %v", err)
+	}
+}
+
+// WebhookNotifier posts alerts to URL as JSON, the text field makes it
+// a Slack incoming webhook payload, the alert field has the details.
+type WebhookNotifier struct {
+	URL string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+func (w WebhookNotifier) Notify(ctx context.Context, a DeadLetterAlert) error {
+	bs, err := json.Marshal(map[string]interface{}{"text": a.String(), "alert": a})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notify response status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package dq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// KindAMQP is the Kind of messages produced by RetryAMQP.
+const KindAMQP = "dq.amqp"
+
+// AMQPDelivery is the part of a RabbitMQ delivery to be published again,
+// header values must be JSON encodable.
+type AMQPDelivery struct {
+	Exchange    string                 `json:"exchange"`
+	RoutingKey  string                 `json:"routing_key"`
+	ContentType string                 `json:"content_type,omitempty"`
+	MessageID   string                 `json:"message_id,omitempty"`
+	Headers     map[string]interface{} `json:"headers,omitempty"`
+	Body        []byte                 `json:"body"`
+}
+
+// AMQPPublisher publishes deliveries to RabbitMQ, e.g. by
+// amqp.Channel.PublishWithContext of github.com/rabbitmq/amqp091-go.
+type AMQPPublisher interface {
+	Publish(ctx context.Context, d AMQPDelivery) error
+}
+
+// AMQPRetryHeader counts the retries of a delivery by dq.
+const AMQPRetryHeader = "x-dq-retry"
+
+// RetryAMQP schedules the failed delivery d to be published again to its
+// exchange after delay by the handler returned by AMQPRepublisher,
+// so the RabbitMQ consumer can ack d instead of relying on TTL and DLX.
+// The message is deduplicated by the message ID and the retry of d if set.
+func (q *Queue) RetryAMQP(ctx context.Context, d AMQPDelivery, delay time.Duration) (*Receipt, error) {
+	retry := 0
+	switch v := d.Headers[AMQPRetryHeader].(type) {
+	case int:
+		retry = v
+	case int32:
+		retry = int(v)
+	case int64:
+		retry = int(v)
+	case float64:
+		retry = int(v)
+	}
+	headers := make(map[string]interface{}, len(d.Headers)+1)
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[AMQPRetryHeader] = retry + 1
+	d.Headers = headers
+
+	bs, err := json.Marshal(d)
+	if err != nil {
+		return nil, fmt.Errorf("amqp delivery marshal failed, err: %v", err)
+	}
+
+	at := time.Now().Add(delay)
+	m := &ProducerMessage{Payload: bs, DeliverAt: &at, Kind: KindAMQP}
+	if d.MessageID != "" {
+		return q.ProduceWithToken(ctx, fmt.Sprintf("amqp:%s:%d", d.MessageID, retry), m)
+	}
+	return q.Produce(ctx, m)
+}
+
+// AMQPRepublisher returns the handler publishing messages produced by RetryAMQP
+// to their original exchange, publish errors are retried by the queue.
+func AMQPRepublisher(p AMQPPublisher) Handler {
+	return HandlerFunc(func(ctx context.Context, m *Message) error {
+		if m.Kind != KindAMQP {
+			return Classify(fmt.Errorf("kind mismatch, want: %s, got: %s", KindAMQP, m.Kind), ErrorClassValidation)
+		}
+		var d AMQPDelivery
+		if err := json.Unmarshal(m.Payload, &d); err != nil {
+			return Classify(fmt.Errorf("amqp delivery unmarshal failed, err: %v", err), ErrorClassValidation)
+		}
+		if err := p.Publish(ctx, d); err != nil {
+			return fmt.Errorf("amqp publish failed, err: %v", err)
+		}
+		return nil
+	})
+}
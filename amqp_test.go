@@ -0,0 +1,49 @@
+package dq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type amqpPublisher chan AMQPDelivery
+
+func (p amqpPublisher) Publish(ctx context.Context, d AMQPDelivery) error {
+	p <- d
+	return nil
+}
+
+func TestAMQPRepublisher(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	d := AMQPDelivery{Exchange: "orders", RoutingKey: "created", MessageID: "m1", Body: []byte("amqp")}
+	r, err := q.RetryAMQP(context.Background(), d, 0)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	r2, err := q.RetryAMQP(context.Background(), d, 0)
+	require.NoError(t, err)
+	require.NotNil(t, r2)
+	assert.True(t, r2.Deduplicated)
+	assert.Equal(t, r.ID, r2.ID)
+
+	// consume
+	p := make(amqpPublisher, 1)
+	q.Consume(AMQPRepublisher(p))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("publish timeout")
+	case got := <-p:
+		assert.Equal(t, "orders", got.Exchange)
+		assert.Equal(t, "created", got.RoutingKey)
+		assert.Equal(t, []byte("amqp"), got.Body)
+		assert.Equal(t, float64(1), got.Headers[AMQPRetryHeader])
+	}
+}
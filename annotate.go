@@ -0,0 +1,54 @@
+package dq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// annotationPrefix prefixes the fields of annotations in the message data.
+const annotationPrefix = "annotation:"
+
+// limits of annotations, they are meant to be small
+const (
+	maxAnnotations      = 16
+	maxAnnotationLength = 256
+)
+
+// Annotate attaches the annotation to the message, e.g. how far the handler
+// got, it is saved at once, so later attempts see it in Annotations.
+// It can only be called by handlers.
+func (m *Message) Annotate(ctx context.Context, key, value string) error {
+	if m.save == nil {
+		return errors.New("message is not being processed")
+	}
+	if _, ok := m.Annotations[key]; !ok && len(m.Annotations) >= maxAnnotations {
+		return fmt.Errorf("message has %d annotations already", len(m.Annotations))
+	}
+	if len(key)+len(value) > maxAnnotationLength {
+		return fmt.Errorf("annotation %s is longer than %d", key, maxAnnotationLength)
+	}
+	if err := m.save(ctx, annotationPrefix+key, value); err != nil {
+		return fmt.Errorf("annotate message failed, err: %v", err)
+	}
+	if m.Annotations == nil {
+		m.Annotations = map[string]string{}
+	}
+	m.Annotations[key] = value
+	return nil
+}
+
+// saver returns the function saving a field of the message data,
+// e.g. annotations and checkpoints of handlers, unless the message is gone.
+func (q *Queue) saver(id string) func(context.Context, string, string) error {
+	return func(ctx context.Context, field, value string) error {
+		ok, err := q.rdb.runSaveFields(ctx, q.key(kData), id, field, value)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("message %s not found", id)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,84 @@
+package dq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// EventType is a state transition of a message.
+type EventType string
+
+const (
+	EventProduced  EventType = "produced"
+	EventDue       EventType = "due"
+	EventTaken     EventType = "taken"
+	EventCommitted EventType = "committed"
+	EventRetried   EventType = "retried"
+	EventDead      EventType = "dead"
+	EventDropped   EventType = "dropped"
+	EventCanceled  EventType = "canceled"
+)
+
+// Event records a state transition of a message.
+type Event struct {
+	Type EventType
+	ID   string
+	At   time.Time
+}
+
+// audit appends events to the audit log stream if enabled by WithAuditLog,
+// and publishes them to Tail if enabled by WithLiveTail.
+func (q *Queue) audit(ctx context.Context, t EventType, ids ...string) {
+	if (q.auditMaxLen <= 0 && !q.liveTail) || len(ids) == 0 {
+		return
+	}
+
+	at := time.Now().UnixMilli()
+	pipe := q.rdb.Pipeline()
+	for _, id := range ids {
+		if q.auditMaxLen > 0 {
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: q.key(kAudit),
+				MaxLen: q.auditMaxLen,
+				Approx: true,
+				Values: []interface{}{"type", string(t), "id", id, "at", at},
+			})
+		}
+		if q.liveTail {
+			bs, _ := json.Marshal(Event{Type: t, ID: id, At: time.UnixMilli(at)})
+			pipe.Publish(ctx, q.tailChannel(), bs)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		q.log(ctx, Warn, "audit %s failed, err: %v", t, err)
+	}
+}
+
+// AuditLog returns the latest count events of the audit log, newest first,
+// only events of the message are returned if id is not empty.
+func (q *Queue) AuditLog(ctx context.Context, id string, count int64) ([]Event, error) {
+	msgs, err := q.rdb.reader().XRevRangeN(ctx, q.key(kAudit), "+", "-", count).Result()
+	if err != nil {
+		return nil, fmt.Errorf("read audit log failed, err: %v", err)
+	}
+
+	events := make([]Event, 0, len(msgs))
+	for _, msg := range msgs {
+		e := Event{
+			Type: EventType(fmt.Sprint(msg.Values["type"])),
+			ID:   fmt.Sprint(msg.Values["id"]),
+		}
+		if id != "" && e.ID != id {
+			continue
+		}
+		at, _ := strconv.ParseInt(fmt.Sprint(msg.Values["at"]), 10, 64)
+		e.At = time.UnixMilli(at)
+		events = append(events, e)
+	}
+	return events, nil
+}
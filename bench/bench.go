@@ -0,0 +1,225 @@
+// Package bench produces and consumes synthetic workloads against a redis,
+// reporting throughput and latency percentiles to size redis for a queue.
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mzcabc/dq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Config defines a workload.
+type Config struct {
+	Redis *redis.Client
+
+	Messages    int
+	PayloadSize int
+	// Delay schedules messages after Delay, 0 produces realtime messages.
+	Delay time.Duration
+	// FailureRate is the probability the handler fails, failed messages are retried.
+	FailureRate float64
+
+	Producers     int
+	Consumers     int
+	RetryInterval time.Duration
+	Timeout       time.Duration
+}
+
+func (c *Config) setDefaults() {
+	if c.Redis == nil {
+		c.Redis = redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+	}
+	if c.Messages <= 0 {
+		c.Messages = 10000
+	}
+	if c.PayloadSize <= 0 {
+		c.PayloadSize = 128
+	}
+	if c.Producers <= 0 {
+		c.Producers = 10
+	}
+	if c.Consumers <= 0 {
+		c.Consumers = 10
+	}
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = 100 * time.Millisecond
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 1 * time.Minute
+	}
+}
+
+// Result reports a finished workload.
+type Result struct {
+	Produced int
+	Consumed int
+	Failed   int
+
+	ProduceDuration time.Duration
+	ConsumeDuration time.Duration
+
+	// Latency is measured from the time a message is due to the time it is consumed.
+	P50, P90, P99, Max time.Duration
+
+	// CloseErr and DestroyErr report the teardown of the bench queue.
+	CloseErr, DestroyErr error
+}
+
+// ProduceThroughput returns produced messages per second.
+func (r *Result) ProduceThroughput() float64 {
+	return float64(r.Produced) / r.ProduceDuration.Seconds()
+}
+
+// ConsumeThroughput returns consumed messages per second.
+func (r *Result) ConsumeThroughput() float64 {
+	return float64(r.Consumed) / r.ConsumeDuration.Seconds()
+}
+
+func (r *Result) String() string {
+	return fmt.Sprintf("produced: %d in %v (%.0f/s), consumed: %d in %v (%.0f/s), failed: %d, latency p50: %v, p90: %v, p99: %v, max: %v",
+		r.Produced, r.ProduceDuration, r.ProduceThroughput(),
+		r.Consumed, r.ConsumeDuration, r.ConsumeThroughput(),
+		r.Failed, r.P50, r.P90, r.P99, r.Max) + r.teardown()
+}
+
+func (r *Result) teardown() string {
+	var s string
+	if r.CloseErr != nil {
+		s += fmt.Sprintf(", close err: %v", r.CloseErr)
+	}
+	if r.DestroyErr != nil {
+		s += fmt.Sprintf(", destroy err: %v", r.DestroyErr)
+	}
+	return s
+}
+
+var errMock = errors.New("bench mock failure")
+
+// Run produces and consumes the workload on a new queue, which is destroyed
+// once it finishes. Closing and destroying the queue is bounded by Timeout.
+func Run(ctx context.Context, c Config) (out *Result, err error) {
+	c.setDefaults()
+
+	q := dq.New(
+		dq.WithName("bench_"+uuid.NewString()[:8]),
+		dq.WithRedis(c.Redis),
+		dq.WithConsumerWorkerNum(c.Consumers),
+		dq.WithRetryInterval(c.RetryInterval),
+		// failed messages are retried until consumed, none is dead-lettered
+		dq.WithRetryTimes(math.MaxInt32),
+		dq.WithMessageSaveTime(c.Timeout),
+	)
+
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, c.Messages)
+		res       Result
+		done      = make(chan struct{})
+	)
+
+	start := time.Now()
+	q.Consume(dq.HandlerFunc(func(ctx context.Context, m *dq.Message) error {
+		at := m.CreateAt
+		if m.DeliverAt != nil {
+			at = *m.DeliverAt
+		}
+		latency := time.Since(at)
+
+		if rand.Float64() < c.FailureRate {
+			mu.Lock()
+			res.Failed++
+			mu.Unlock()
+			return errMock
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if res.Consumed == c.Messages {
+			return nil
+		}
+		latencies = append(latencies, latency)
+		res.Consumed++
+		if res.Consumed == c.Messages {
+			res.ConsumeDuration = time.Since(start)
+			close(done)
+		}
+		return nil
+	}))
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		defer cancel()
+		closeErr := q.Close(ctx)
+		destroyErr := q.Destroy(ctx)
+		if out != nil {
+			out.CloseErr, out.DestroyErr = closeErr, destroyErr
+		} else if closeErr != nil || destroyErr != nil {
+			err = fmt.Errorf("%v, close err: %v, destroy err: %v", err, closeErr, destroyErr)
+		}
+	}()
+
+	payload := make([]byte, c.PayloadSize)
+	rand.Read(payload)
+
+	var wg sync.WaitGroup
+	var produceErr error
+	for i := 0; i < c.Producers; i++ {
+		n := c.Messages / c.Producers
+		if i < c.Messages%c.Producers {
+			n++
+		}
+
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				pm := &dq.ProducerMessage{Payload: payload}
+				if c.Delay > 0 {
+					at := time.Now().Add(c.Delay)
+					pm.DeliverAt = &at
+				}
+				if _, err := q.Produce(ctx, pm); err != nil {
+					mu.Lock()
+					produceErr = err
+					mu.Unlock()
+					return
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+	res.ProduceDuration = time.Since(start)
+	res.Produced = c.Messages
+	if produceErr != nil {
+		return nil, fmt.Errorf("produce failed, err: %v", produceErr)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(c.Timeout):
+		mu.Lock()
+		defer mu.Unlock()
+		return nil, fmt.Errorf("consume timeout, consumed: %d", res.Consumed)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	res.P50 = percentile(latencies, 0.5)
+	res.P90 = percentile(latencies, 0.9)
+	res.P99 = percentile(latencies, 0.99)
+	res.Max = latencies[len(latencies)-1]
+	return &res, nil
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
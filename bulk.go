@@ -0,0 +1,128 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// BulkOptions paces bulk operations in batches, so running them on a large
+// queue does not block redis. They stop between batches once ctx is done.
+type BulkOptions struct {
+	// BatchSize is the number of messages of a batch, 100 by default.
+	BatchSize int
+	// Rate limits the batches per second, unlimited if zero.
+	Rate rate.Limit
+	// Progress is called after every batch with the number of messages done so far.
+	Progress func(done int)
+}
+
+// bulk runs batch until it reports no more messages, and returns the number
+// of messages done.
+func (o BulkOptions) bulk(ctx context.Context, batch func(size int) (n int, more bool, err error)) (int, error) {
+	size := o.BatchSize
+	if size <= 0 {
+		size = 100
+	}
+	lim := rate.NewLimiter(rate.Inf, 1)
+	if o.Rate > 0 {
+		lim = rate.NewLimiter(o.Rate, 1)
+	}
+
+	var done int
+	for {
+		if err := lim.Wait(ctx); err != nil {
+			return done, err
+		}
+		n, more, err := batch(size)
+		done += n
+		if err != nil {
+			return done, err
+		}
+		if n > 0 && o.Progress != nil {
+			o.Progress(done)
+		}
+		if !more {
+			return done, nil
+		}
+	}
+}
+
+// RequeueAllDead moves the dead letters back to ready with their delivery
+// counts reset, dead letters whose data expired are dropped.
+func (q *Queue) RequeueAllDead(ctx context.Context, opts BulkOptions) (int, error) {
+	return opts.bulk(ctx, func(size int) (int, bool, error) {
+		n, err := q.rdb.runRequeueDead(ctx, q.key(kDead), q.key(kData), q.key(kReady), size)
+		if err != nil {
+			return 0, false, fmt.Errorf("requeue dead messages failed, err: %v", err)
+		}
+		return n, n == size, nil
+	})
+}
+
+// Purge cancels all the messages ready or delayed, they are kept in the
+// trash like canceled messages. Messages taken or dead are left.
+func (q *Queue) Purge(ctx context.Context, opts BulkOptions) (int, error) {
+	var done int
+	for _, src := range []struct {
+		key  string
+		list bool
+	}{{q.key(kReady), true}, {q.key(kDelay), false}, {q.key(kCold), false}} {
+		n, err := opts.bulk(ctx, func(size int) (int, bool, error) {
+			n, ids, err := q.rdb.runPurge(ctx, src.key, q.key(kData), q.key(kTrash), src.list, size, time.Now(), q.trashWindow)
+			if err != nil {
+				return 0, false, fmt.Errorf("purge messages failed, err: %v", err)
+			}
+			q.audit(ctx, EventCanceled, ids...)
+			q.complete(ctx, OutcomeCanceled, ids...)
+			return n, n == size, nil
+		})
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+	q.log(ctx, Info, "queue %s purged %d messages", q.name, done)
+	return done, nil
+}
+
+// CancelWhere cancels the pending messages match reports, match gets the
+// messages without payload. It returns the number of canceled messages.
+func (q *Queue) CancelWhere(ctx context.Context, match func(m *Message) bool, opts BulkOptions) (int, error) {
+	var cursor uint64
+	return opts.bulk(ctx, func(size int) (int, bool, error) {
+		keys, next, err := q.rdb.Scan(ctx, cursor, q.key(kData)+":*", int64(size)).Result()
+		if err != nil {
+			return 0, false, fmt.Errorf("scan messages failed, err: %v", err)
+		}
+		cursor = next
+
+		pipe := q.rdb.Pipeline()
+		envelopes := make([]*redis.SliceCmd, len(keys))
+		for i, key := range keys {
+			envelopes[i] = pipe.HMGet(ctx, key, envelopeFields...)
+		}
+		if _, err = pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return 0, false, fmt.Errorf("get envelopes failed, err: %v", err)
+		}
+
+		var n int
+		for _, cmd := range envelopes {
+			m, err := parseEnvelope(cmd.Val())
+			if err != nil {
+				return n, false, err
+			}
+			if m == nil || m.DeadAt != nil || !match(m) {
+				continue
+			}
+			if err = q.Cancel(ctx, m.ID); err != nil {
+				return n, false, err
+			}
+			n++
+		}
+		return n, cursor != 0, nil
+	})
+}
@@ -0,0 +1,103 @@
+package dq
+
+import (
+	"time"
+)
+
+// Calendar tells the business hours of a day.
+type Calendar interface {
+	// Hours returns the business hours of date as offsets from midnight,
+	// ok is false if date is not a business day.
+	Hours(date time.Time) (start, end time.Duration, ok bool)
+}
+
+// WeekdayCalendar is open from Start to End on Weekdays, except Holidays.
+type WeekdayCalendar struct {
+	Start time.Duration
+	End   time.Duration
+	// Weekdays defaults to Monday to Friday.
+	Weekdays []time.Weekday
+	// Holidays are compared by date only.
+	Holidays []time.Time
+}
+
+func (c WeekdayCalendar) Hours(date time.Time) (start, end time.Duration, ok bool) {
+	weekdays := c.Weekdays
+	if len(weekdays) == 0 {
+		weekdays = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	}
+	if !(Window{Weekdays: weekdays}).onDay(date.Weekday()) {
+		return 0, 0, false
+	}
+
+	y, m, d := date.Date()
+	for _, h := range c.Holidays {
+		if hy, hm, hd := h.Date(); hy == y && hm == m && hd == d {
+			return 0, 0, false
+		}
+	}
+	return c.Start, c.End, true
+}
+
+// business hours are looked up within a year
+const maxCalendarDays = 366
+
+// NextBusinessHour returns t if it is within the business hours in tz,
+// otherwise the start of the next business hours.
+// t is returned if there are no business hours within a year.
+func NextBusinessHour(t time.Time, tz *time.Location, cal Calendar) time.Time {
+	return nextBusinessHour(t, tz, cal, false)
+}
+
+// NextBusinessDay returns the start of the business hours of the first
+// business day after the day of t in tz, e.g. "tomorrow morning".
+// t is returned if there are no business hours within a year.
+func NextBusinessDay(t time.Time, tz *time.Location, cal Calendar) time.Time {
+	return nextBusinessHour(t, tz, cal, true)
+}
+
+// DeliverAtNextBusinessHour returns the DeliverAt of a message to be sent
+// during business hours.
+func DeliverAtNextBusinessHour(tz *time.Location, cal Calendar) *time.Time {
+	at := NextBusinessHour(time.Now(), tz, cal)
+	return &at
+}
+
+// DeliverAtNextBusinessDay returns the DeliverAt of a message to be sent
+// at the start of the next business day.
+func DeliverAtNextBusinessDay(tz *time.Location, cal Calendar) *time.Time {
+	at := NextBusinessDay(time.Now(), tz, cal)
+	return &at
+}
+
+func nextBusinessHour(t time.Time, tz *time.Location, cal Calendar, skipToday bool) time.Time {
+	if tz == nil {
+		tz = time.Local
+	}
+	local := t.In(tz)
+
+	y, m, d := local.Date()
+	for i := 0; i <= maxCalendarDays; i++ {
+		if i == 0 && skipToday {
+			continue
+		}
+		midnight := time.Date(y, m, d+i, 0, 0, 0, 0, tz)
+		start, end, ok := cal.Hours(midnight)
+		if !ok {
+			continue
+		}
+
+		open := midnight.Add(start)
+		closing := midnight.Add(end)
+		if i == 0 {
+			if !local.Before(closing) {
+				continue
+			}
+			if !local.Before(open) {
+				return t
+			}
+		}
+		return open
+	}
+	return t
+}
@@ -0,0 +1,29 @@
+package dq
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// maxCheckpointSize limits the size of checkpoints.
+const maxCheckpointSize = 1 << 20
+
+// SaveCheckpoint saves data as the checkpoint of the message, replacing the
+// previous one, so later attempts resume from Checkpoint instead of starting
+// over. It is saved at once, e.g. before the handler fails.
+// It can only be called by handlers.
+func (m *Message) SaveCheckpoint(ctx context.Context, data []byte) error {
+	if m.save == nil {
+		return errors.New("message is not being processed")
+	}
+	if len(data) > maxCheckpointSize {
+		return fmt.Errorf("checkpoint size %d exceeds %d", len(data), maxCheckpointSize)
+	}
+	if err := m.save(ctx, "checkpoint", base64.StdEncoding.EncodeToString(data)); err != nil {
+		return fmt.Errorf("save checkpoint failed, err: %v", err)
+	}
+	m.Checkpoint = data
+	return nil
+}
@@ -0,0 +1,38 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the CRC-32C of the encoded payload.
+func checksum(payload []byte) string {
+	return strconv.FormatUint(uint64(crc32.Checksum(payload, castagnoli)), 16)
+}
+
+// verifyChecksum verifies the encoded payload of m if it has a checksum.
+func verifyChecksum(m *Message) error {
+	if m.checksum == "" {
+		return nil
+	}
+	if sum := checksum(m.Payload); sum != m.checksum {
+		return fmt.Errorf("checksum mismatch, want: %s, got: %s", m.checksum, sum)
+	}
+	return nil
+}
+
+// quarantine moves the taken message to dead letter without processing it.
+func (q *Queue) quarantine(ctx context.Context, m *Message, reason string) error {
+	q.counters.failed.Add(1)
+	if err := q.deadLetter(ctx, m, reason); err != nil {
+		return fmt.Errorf("dead letter message failed, err: %v", err)
+	}
+	if err := q.rdb.SRem(ctx, q.inflightKey(q.instanceID), m.ID).Err(); err != nil {
+		return fmt.Errorf("remove in-flight message failed, err: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mzcabc/dq/bench"
+	"github.com/redis/go-redis/v9"
+)
+
+// runBench runs the bench subcommand, e.g. `dq bench -n 100000 -size 1024`.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	addr := fs.String("redis", "127.0.0.1:6379", "redis address")
+	var c bench.Config
+	fs.IntVar(&c.Messages, "n", 10000, "number of messages")
+	fs.IntVar(&c.PayloadSize, "size", 128, "payload size in bytes")
+	fs.DurationVar(&c.Delay, "delay", 0, "deliver messages after delay")
+	fs.Float64Var(&c.FailureRate, "failure", 0, "handler failure rate, 0 to 1")
+	fs.IntVar(&c.Producers, "producers", 10, "number of concurrent producers")
+	fs.IntVar(&c.Consumers, "consumers", 10, "number of consume workers")
+	fs.DurationVar(&c.RetryInterval, "retry", 0, "retry interval of failed messages")
+	fs.DurationVar(&c.Timeout, "timeout", 0, "timeout of the whole bench")
+	_ = fs.Parse(args)
+
+	c.Redis = redis.NewClient(&redis.Options{Addr: *addr})
+	res, err := bench.Run(context.Background(), c)
+	if err != nil {
+		fmt.Println("bench failed, err:", err)
+		os.Exit(1)
+	}
+	fmt.Println(res)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"strconv"
 	"time"
 
@@ -11,6 +12,15 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "tail" {
+		runTail(os.Args[2:])
+		return
+	}
+
 	ctx := context.Background()
 
 	q := dq.New()
@@ -23,20 +33,20 @@ func main() {
 
 	// produce realtime message
 	for i := 0; i < 10; i++ {
-		id, err := q.Produce(ctx, &dq.ProducerMessage{
+		r, err := q.Produce(ctx, &dq.ProducerMessage{
 			Payload: []byte("realtime message, i =" + strconv.Itoa(i)),
 		})
-		fmt.Println(time.Now(), "produce realtime message:", id, "err:", err)
+		fmt.Println(time.Now(), "produce realtime message:", r, "err:", err)
 	}
 
 	// produce delay message
 	for i := 0; i < 10; i++ {
 		at := time.Now().Add(3 * time.Second)
-		id, err := q.Produce(ctx, &dq.ProducerMessage{
+		r, err := q.Produce(ctx, &dq.ProducerMessage{
 			Payload:   []byte("delay message, i =" + strconv.Itoa(i)),
 			DeliverAt: &at,
 		})
-		fmt.Println(time.Now(), "produce delay message:", id, "err:", err)
+		fmt.Println(time.Now(), "produce delay message:", r, "err:", err)
 	}
 
 	<-time.After(10 * time.Second)
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/mzcabc/dq"
+	"github.com/redis/go-redis/v9"
+)
+
+// runTail runs the tail subcommand, e.g. `dq tail -name orders`, printing the
+// events of a queue produced and consumed with dq.WithLiveTail until interrupted.
+func runTail(args []string) {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	addr := fs.String("redis", "127.0.0.1:6379", "redis address")
+	prefix := fs.String("prefix", "dq", "redis key prefix")
+	name := fs.String("name", "default", "queue name")
+	_ = fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	q := dq.New(
+		dq.WithRedis(redis.NewClient(&redis.Options{Addr: *addr})),
+		dq.WithRedisKeyPrefix(*prefix),
+		dq.WithName(*name),
+	)
+	events, err := q.Tail(ctx)
+	if err != nil {
+		fmt.Println("tail failed, err:", err)
+		os.Exit(1)
+	}
+	for e := range events {
+		fmt.Println(e.At.Format(time.RFC3339Nano), e.Type, e.ID)
+	}
+}
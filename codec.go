@@ -0,0 +1,83 @@
+package dq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Codec encodes payload before it is stored and decodes it after it is taken.
+// The codec name is stored with the message, so consumers can decode messages
+// produced with any codec they have registered.
+type Codec interface {
+	Name() string
+	Encode([]byte) ([]byte, error)
+	Decode([]byte) ([]byte, error)
+}
+
+var (
+	// Identity stores payload as it is.
+	Identity Codec = identityCodec{}
+	// Gzip compresses payload with gzip.
+	Gzip Codec = gzipCodec{}
+)
+
+type identityCodec struct{}
+
+func (identityCodec) Name() string                    { return "identity" }
+func (identityCodec) Encode(b []byte) ([]byte, error) { return b, nil }
+func (identityCodec) Decode(b []byte) ([]byte, error) { return b, nil }
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Encode(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (q *Queue) encode(payload []byte) ([]byte, error) {
+	bs, err := q.codec.Encode(payload)
+	if err != nil {
+		return nil, fmt.Errorf("codec %s encode failed, err: %v", q.codec.Name(), err)
+	}
+	return bs, nil
+}
+
+// decode decodes the payload with the codec recorded in the message,
+// messages produced without codec are treated as Identity.
+func (q *Queue) decode(m *Message) error {
+	if m.Codec == "" || m.Codec == Identity.Name() {
+		return nil
+	}
+
+	c, ok := q.codecs[m.Codec]
+	if !ok {
+		return fmt.Errorf("codec %s not registered", m.Codec)
+	}
+
+	bs, err := c.Decode(m.Payload)
+	if err != nil {
+		return fmt.Errorf("codec %s decode failed, err: %v", m.Codec, err)
+	}
+	m.Payload = bs
+	return nil
+}
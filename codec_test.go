@@ -0,0 +1,102 @@
+package dq
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGzipCodec(t *testing.T) {
+	payload := []byte("gzip payload")
+
+	bs, err := Gzip.Encode(payload)
+	assert.Nil(t, err)
+
+	bs, err = Gzip.Decode(bs)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, bs)
+}
+
+func TestConsumeCodecNegotiation(t *testing.T) {
+	// init, producer uses gzip while consumer keeps the default codec
+	p := New(append(testOpts(t), WithCodec(Gzip))...)
+	c := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, p) })
+
+	// produce
+	_, err := p.Produce(context.Background(), &ProducerMessage{Payload: []byte("gzip payload")})
+	assert.Nil(t, err)
+
+	// consume
+	got := make(chan *Message, 1)
+	c.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- m
+		return nil
+	}))
+	defer closeQueue(t, c)
+
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatal("consume timeout")
+	case m := <-got:
+		assert.Equal(t, Gzip.Name(), m.Codec)
+		assert.Equal(t, "gzip payload", string(m.Payload))
+	}
+}
+
+func TestAESGCMRotation(t *testing.T) {
+	k1 := []byte("0123456789abcdef")
+	k2 := []byte("fedcba9876543210")
+	c1, err := NewAESGCM("k1", map[string][]byte{"k1": k1})
+	assert.Nil(t, err)
+	c2, err := NewAESGCM("k2", map[string][]byte{"k1": k1, "k2": k2})
+	assert.Nil(t, err)
+	c3, err := NewAESGCM("k2", map[string][]byte{"k2": k2})
+	assert.Nil(t, err)
+
+	// produce with the old key
+	q := New(append(testOpts(t), WithCodec(c1))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	at := time.Now().Add(1 * time.Hour)
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("secret"), DeliverAt: &at})
+	require.NoError(t, err)
+	g, err := q.ProduceGrouped(ctx, "group", time.Hour, &ProducerMessage{Payload: []byte("grouped")})
+	require.NoError(t, err)
+
+	// a message of a queue named with the name as a prefix, left from before
+	// such names were rejected, is not recoded
+	sibling := q.key(kData) + ":sibling:" + r.ID
+	assert.Nil(t, q.rdb.HSet(ctx, sibling, "id", r.ID, "payload", base64.StdEncoding.EncodeToString([]byte("sibling"))).Err())
+
+	// the retired key is unknown
+	q3 := New(append(testOpts(t), WithCodec(c3))...)
+	_, err = q3.getMessage(ctx, r.ID)
+	assert.NotNil(t, err)
+
+	// rotate, then the old key can be retired
+	q2 := New(append(testOpts(t), WithCodec(c2))...)
+	cnt, err := q2.Recode(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cnt)
+	cnt, err = q2.Recode(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, cnt)
+
+	m, err := q3.getMessage(ctx, r.ID)
+	require.NoError(t, err)
+	require.NotNil(t, m)
+	assert.Equal(t, []byte("secret"), m.Payload)
+	items, err := q3.rdb.LRange(ctx, q3.key(kBatch)+":"+g.ID, 0, -1).Result()
+	assert.Nil(t, err)
+	if assert.Len(t, items, 1) {
+		payload, err := q3.decodeItem("", []byte(items[0]))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("grouped"), payload)
+	}
+}
@@ -0,0 +1,132 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// commit acknowledges the processed message, retrying transient failures with backoff.
+// If it still fails, the message is marked processed in its data, so the handler
+// is not called again when the message is redelivered to any instance.
+func (q *Queue) commit(ctx context.Context, m *Message) error {
+	interval := q.commitRetryInterval
+	for i := 0; ; i++ {
+		drop, err := q.injectCommit()
+		if err == nil && drop {
+			return nil
+		}
+		if err == nil {
+			res, expSec := q.commitResult(m)
+			_, err = q.rdb.runCommit(ctx, q.key(kRetry), q.key(kData), q.inflightKey(q.instanceID), q.key(kResult), q.key(kBatch), m.ID, res, expSec)
+		}
+		if err == nil {
+			q.committed(ctx, m)
+			return nil
+		}
+
+		if i >= q.commitRetryTimes {
+			q.markProcessed(ctx, m)
+			return err
+		}
+		q.log(ctx, Warn, "commit message %s failed, retry after %s, err: %v", m.ID, interval, err)
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			q.markProcessed(ctx, m)
+			return err
+		case <-timer.C:
+		}
+		interval *= 2
+	}
+}
+
+// markProcessed saves the processed mark and the result of the uncommitted message.
+func (q *Queue) markProcessed(ctx context.Context, m *Message) {
+	values := []interface{}{"processed_at", time.Now().UnixMilli()}
+	if m.result != nil {
+		values = append(values, "processed_status", m.result.Status, "processed_output", m.result.Output)
+	}
+	if err := q.rdb.runMarkProcessed(context.Background(), q.key(kData), m.ID, values); err != nil {
+		q.log(ctx, Warn, "mark message %s processed failed, err: %v", m.ID, err)
+	}
+}
+
+// commitResult returns the result saved with the acknowledgement and its expiration.
+func (q *Queue) commitResult(m *Message) (*Result, int) {
+	res, expSec := m.result, int(q.resultSaveTime.Seconds())
+	if m.StagedTx != "" {
+		staged := Result{}
+		if res != nil {
+			staged = *res
+		}
+		staged.StagedTx = m.StagedTx
+		res, expSec = &staged, q.handoffSaveSec()
+	}
+	return res, expSec
+}
+
+func (q *Queue) committed(ctx context.Context, m *Message) {
+	q.counters.processed.Add(1)
+	q.audit(ctx, EventCommitted, m.ID)
+	q.complete(ctx, OutcomeCommitted, m.ID)
+	q.finishChild(ctx, m, false)
+}
+
+const (
+	asyncCommitBatch    = 100
+	asyncCommitInterval = 10 * time.Millisecond
+)
+
+// commitAsync acknowledges the processed messages from ms in batches, each
+// batch in a pipeline. Messages failed in the pipeline are committed one by
+// one. It flushes the messages left and returns when ms is closed.
+func (q *Queue) commitAsync(ms <-chan *Message) {
+	ticker := time.NewTicker(asyncCommitInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Message, 0, asyncCommitBatch)
+	for {
+		select {
+		case m, ok := <-ms:
+			if !ok {
+				q.flushCommits(batch)
+				return
+			}
+			if batch = append(batch, m); len(batch) < asyncCommitBatch {
+				continue
+			}
+		case <-ticker.C:
+		}
+		q.flushCommits(batch)
+		batch = batch[:0]
+	}
+}
+
+func (q *Queue) flushCommits(ms []*Message) {
+	if len(ms) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	pipe := q.rdb.Pipeline()
+	cmds := make([]*redis.Cmd, len(ms))
+	for i, m := range ms {
+		res, expSec := q.commitResult(m)
+		cmds[i] = q.rdb.runCommitPipe(ctx, pipe, q.key(kRetry), q.key(kData), q.inflightKey(q.instanceID), q.key(kResult), q.key(kBatch), m.ID, res, expSec)
+	}
+	_, _ = pipe.Exec(ctx)
+
+	for i, m := range ms {
+		if cmds[i].Err() == nil {
+			q.committed(ctx, m)
+			continue
+		}
+		if err := q.commit(ctx, m); err != nil {
+			q.consumeError(fmt.Errorf("commit message failed, err: %v", err))
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+)
+
+// Outcome is how a message is completed.
+type Outcome string
+
+const (
+	OutcomeCommitted Outcome = "committed"
+	OutcomeDead      Outcome = "dead"
+	OutcomeCanceled  Outcome = "canceled"
+)
+
+// doneChannel is the pub/sub channel the completion of the message is published to.
+func (q *Queue) doneChannel(id string) string {
+	return q.component("done") + ":" + id
+}
+
+// complete publishes the completion of messages if enabled by WithCompletionNotify.
+func (q *Queue) complete(ctx context.Context, o Outcome, ids ...string) {
+	if !q.completionNotify || len(ids) == 0 {
+		return
+	}
+	pipe := q.rdb.Pipeline()
+	for _, id := range ids {
+		pipe.Publish(ctx, q.doneChannel(id), string(o))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		q.log(ctx, Warn, "notify completion of %d messages failed, err: %v", len(ids), err)
+	}
+}
+
+// WaitCompletion waits until the message is committed, dead or canceled,
+// consumers must enable WithCompletionNotify. A message already missing
+// is reported as committed, e.g. it is consumed or expired.
+func (q *Queue) WaitCompletion(ctx context.Context, id string) (Outcome, error) {
+	sub := q.rdb.Subscribe(ctx, q.doneChannel(id))
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		return "", fmt.Errorf("subscribe completion failed, err: %v", err)
+	}
+
+	// completed before subscribed
+	m, err := q.getMessage(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case m != nil && m.DeadAt != nil:
+		return OutcomeDead, nil
+	case m == nil:
+		if q.rdb.ZScore(ctx, q.key(kTrash), id).Err() == nil {
+			return OutcomeCanceled, nil
+		}
+		return OutcomeCommitted, nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case msg, ok := <-sub.Channel():
+		if !ok {
+			return "", fmt.Errorf("completion subscription of %s closed", id)
+		}
+		return Outcome(msg.Payload), nil
+	}
+}
@@ -0,0 +1,193 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// fields of the config hash shared by all instances of a queue
+const (
+	confPaused        = "paused"
+	confRateLimit     = "rate_limit"
+	confRateBurst     = "rate_burst"
+	confRetryInterval = "retry_interval"
+)
+
+// remoteConf holds the settings reloaded from redis,
+// zero values mean the local options are used.
+type remoteConf struct {
+	paused        atomic.Bool
+	retryInterval atomic.Int64
+
+	limitSet bool
+	limit    rate.Limit
+	burst    int
+
+	baseLimit rate.Limit
+	baseBurst int
+}
+
+// Pause stops all consumers of the queue from taking messages until Resume is called.
+func (q *Queue) Pause(ctx context.Context) error {
+	return q.setConfig(ctx, confPaused, 1)
+}
+
+// Resume resumes the consumers paused by Pause.
+func (q *Queue) Resume(ctx context.Context) error {
+	return q.rdb.HDel(ctx, q.key(kConfig), confPaused).Err()
+}
+
+// SetRateLimit overrides the limiter of all consumers of the queue.
+func (q *Queue) SetRateLimit(ctx context.Context, limit rate.Limit, burst int) error {
+	if burst < 1 && limit != rate.Inf {
+		return fmt.Errorf("burst must be positive, got %d", burst)
+	}
+	return q.setConfig(ctx,
+		confRateLimit, strconv.FormatFloat(float64(limit), 'g', -1, 64),
+		confRateBurst, burst)
+}
+
+// SetRetryInterval overrides the retry interval of all consumers of the queue.
+func (q *Queue) SetRetryInterval(ctx context.Context, interval time.Duration) error {
+	return q.setConfig(ctx, confRetryInterval, interval.Milliseconds())
+}
+
+// ResetConfig removes all overrides, consumers fall back to their local options.
+func (q *Queue) ResetConfig(ctx context.Context) error {
+	return q.rdb.Del(ctx, q.key(kConfig)).Err()
+}
+
+// DisableKind stops all consumers of the queue from processing messages of kind
+// until EnableKind is called. Taken messages of the kind are postponed by the
+// retry interval without counting the delivery.
+func (q *Queue) DisableKind(ctx context.Context, kind string) error {
+	if err := q.rdb.SAdd(ctx, q.key(kDisabled), kind).Err(); err != nil {
+		return fmt.Errorf("disable kind failed, err: %v", err)
+	}
+	return nil
+}
+
+// EnableKind resumes processing messages of kind disabled by DisableKind.
+func (q *Queue) EnableKind(ctx context.Context, kind string) error {
+	if err := q.rdb.SRem(ctx, q.key(kDisabled), kind).Err(); err != nil {
+		return fmt.Errorf("enable kind failed, err: %v", err)
+	}
+	return nil
+}
+
+// DisabledKinds returns the kinds disabled by DisableKind.
+func (q *Queue) DisabledKinds(ctx context.Context) ([]string, error) {
+	kinds, err := q.rdb.reader().SMembers(ctx, q.key(kDisabled)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get disabled kinds failed, err: %v", err)
+	}
+	return kinds, nil
+}
+
+func (q *Queue) setConfig(ctx context.Context, values ...interface{}) error {
+	if err := q.rdb.HSet(ctx, q.key(kConfig), values...).Err(); err != nil {
+		return fmt.Errorf("set config failed, err: %v", err)
+	}
+	return nil
+}
+
+// loadConfig applies the config before consuming starts.
+func (q *Queue) loadConfig(ctx context.Context) {
+	q.conf.baseLimit, q.conf.baseBurst = q.lim.Limit(), q.lim.Burst()
+	q.reloadConfig(ctx)
+}
+
+func (q *Queue) watchConfig(ctx context.Context) {
+	var reload, schedule <-chan time.Time
+	if q.configReloadInterval > 0 {
+		ticker := time.NewTicker(q.configReloadInterval)
+		defer ticker.Stop()
+		reload = ticker.C
+	}
+	if len(q.rateSchedule) > 0 {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		schedule = ticker.C
+	}
+	if reload == nil && schedule == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			q.reloadConfig(ctx)
+		case <-schedule:
+			q.applyLimit(time.Now())
+		}
+	}
+}
+
+func (q *Queue) reloadConfig(ctx context.Context) {
+	values, err := q.rdb.HGetAll(ctx, q.key(kConfig)).Result()
+	if err != nil {
+		q.log(ctx, Warn, "reload config failed, err: %v", err)
+		return
+	}
+
+	q.conf.paused.Store(values[confPaused] == "1")
+
+	interval, _ := strconv.ParseInt(values[confRetryInterval], 10, 64)
+	q.conf.retryInterval.Store(int64(time.Duration(interval) * time.Millisecond))
+
+	_, q.conf.limitSet = values[confRateLimit]
+	if q.conf.limitSet {
+		f, _ := strconv.ParseFloat(values[confRateLimit], 64)
+		q.conf.limit = rate.Limit(f)
+		q.conf.burst, _ = strconv.Atoi(values[confRateBurst])
+		// a limit set without burst would block every take
+		if q.conf.burst < 1 {
+			q.conf.burst = 1
+		}
+	}
+	q.applyLimit(time.Now())
+}
+
+// applyLimit sets the limiter, the remote config overrides the rate schedule,
+// which overrides the local limiter.
+func (q *Queue) applyLimit(now time.Time) {
+	limit, burst := q.conf.baseLimit, q.conf.baseBurst
+	for _, rw := range q.rateSchedule {
+		if rw.Contains(now) {
+			limit, burst = rw.Limit, rw.Burst
+			// a window without burst would block every take
+			if burst < 1 {
+				burst = 1
+			}
+			break
+		}
+	}
+	if q.conf.limitSet {
+		limit, burst = q.conf.limit, q.conf.burst
+	}
+
+	if q.lim.Limit() != limit {
+		q.lim.SetLimit(limit)
+	}
+	if q.lim.Burst() != burst {
+		q.lim.SetBurst(burst)
+	}
+}
+
+func (q *Queue) paused() bool {
+	return q.conf.paused.Load()
+}
+
+func (q *Queue) currentRetryInterval() time.Duration {
+	if d := q.conf.retryInterval.Load(); d > 0 {
+		return time.Duration(d)
+	}
+	return q.retryInterval
+}
@@ -20,20 +20,152 @@ func (h HandlerFunc) Process(ctx context.Context, m *Message) error {
 
 type middlewareFunc func(Handler) Handler
 
+// DequeueOrder is the order ready messages are taken in.
+type DequeueOrder int
+
+const (
+	// FIFO takes the oldest ready message first.
+	FIFO DequeueOrder = iota
+	// LIFO takes the newest ready message first, e.g. for cache refresh
+	// where stale requests are the least valuable.
+	LIFO
+)
+
+// LimiterStrategy is how consumer workers are paced by the limiter.
+type LimiterStrategy int
+
+const (
+	// LimiterWait waits for the limiter before each take, pacing precisely.
+	LimiterWait LimiterStrategy = iota
+	// LimiterSkipTick takes only if the limiter allows at once, otherwise the
+	// worker skips the consume worker interval, so fewer takes hit redis.
+	LimiterSkipTick
+	// LimiterReserve takes at once and waits for the reserved token after
+	// processing, so time spent in slow handlers is caught up by a burst.
+	LimiterReserve
+)
+
+// Role is the part of the work run by Consume.
+type Role int
+
+const (
+	// SchedulerAndWorker runs the daemon moving due messages and the workers.
+	SchedulerAndWorker Role = iota
+	// SchedulerOnly runs the daemon only, Handler of Consume may be nil.
+	SchedulerOnly
+	// WorkerOnly only takes and processes messages, due messages are moved
+	// by SchedulerOnly or SchedulerAndWorker instances of the queue.
+	WorkerOnly
+)
+
 // Consume use Handler to process message
 func (q *Queue) Consume(h Handler) {
+	if err := q.start(h); err != nil {
+		q.log(context.Background(), Error, "consume start failed, err: %v", err)
+		if q.onConsumeError != nil {
+			q.onConsumeError(err)
+		}
+	}
+}
+
+// ConsumeContext consumes like Consume until ctx is done, then closes the
+// queue and returns the error of Close, e.g. to run in an errgroup.
+// Unlike Consume, it verifies redis and loads the scripts before starting,
+// and returns startup failures.
+func (q *Queue) ConsumeContext(ctx context.Context, h Handler) error {
+	if !q.inline {
+		if err := q.preflight(ctx); err != nil {
+			return err
+		}
+	}
+	if err := q.start(h); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return q.Close(context.Background())
+}
+
+// preflight verifies redis is reachable and loads the scripts run by workers.
+func (q *Queue) preflight(ctx context.Context) error {
+	if err := q.rdb.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("ping redis failed, err: %v", err)
+	}
+	for _, s := range workerScripts {
+		if err := s.Load(ctx, q.rdb).Err(); err != nil {
+			return fmt.Errorf("load script failed, err: %v", err)
+		}
+	}
+	return nil
+}
+
+// start starts the daemon and the workers of the role.
+func (q *Queue) start(h Handler) error {
+	if q.inline {
+		h = q.wrap(h)
+		q.inlineHandler.Store(&h)
+		return nil
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	q.shutdownFunc = cancel
 
-	q.done = make(chan struct{})
+	q.done = make(chan struct{}, 1)
 
-	go q.daemon(ctx)
+	q.loadConfig(ctx)
+	go q.watchConfig(ctx)
+	regCtx, stop := context.WithCancel(context.Background())
+	q.stopRegistry = stop
+	q.registryDone = make(chan struct{})
+	q.startedAt = time.Now()
+	err := checkName(q.name)
+	if err == nil {
+		err = q.initPools()
+	}
+	if err == nil {
+		err = q.startSide(ctx, "consumer")
+	}
+	if err != nil {
+		// neither daemon nor workers are started, Close returns at once
+		cancel()
+		stop()
+		close(q.registryDone)
+		q.done <- struct{}{}
+		return err
+	}
+	go q.register(regCtx)
+	if q.role == SchedulerOnly {
+		go func() {
+			q.daemon(ctx)
+			q.done <- struct{}{}
+		}()
+		return nil
+	}
+	if q.role != WorkerOnly && !q.noDaemon {
+		go q.daemon(ctx)
+	}
 	go q.consume(ctx, h)
+	return nil
+}
+
+// wrap wraps h with the transformers and middlewares.
+func (q *Queue) wrap(h Handler) Handler {
+	h = q.transform(h)
+	chain := q.chain()
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i].Wrap(h)
+	}
+	return h
 }
 
 func (q *Queue) consume(ctx context.Context, h Handler) {
-	for i := len(q.mws) - 1; i >= 0; i-- {
-		h = q.mws[i](h)
+	h = q.wrap(h)
+	if q.asyncCommit {
+		q.commits = make(chan *Message, q.consumeWorkerNum)
+		q.commitsDone = make(chan struct{})
+		go func() {
+			q.commitAsync(q.commits)
+			close(q.commitsDone)
+		}()
 	}
 
 	var wg sync.WaitGroup
@@ -58,6 +190,10 @@ func (q *Queue) consume(ctx context.Context, h Handler) {
 
 	wg.Wait()
 	q.log(context.Background(), Trace, "all consume worker exited")
+	if q.commits != nil {
+		close(q.commits)
+		<-q.commitsDone
+	}
 	q.done <- struct{}{}
 }
 
@@ -66,6 +202,7 @@ func (q *Queue) consumeWithTicker(ctx context.Context, h Handler) {
 	defer ticker.Stop()
 
 	immed := make(chan struct{}, 1)
+	var panics int
 	for {
 		select {
 		case <-ctx.Done():
@@ -76,6 +213,10 @@ func (q *Queue) consumeWithTicker(ctx context.Context, h Handler) {
 			}
 		}
 
+		if q.suspended() {
+			continue
+		}
+
 		err := q.process(h)
 		if errors.Is(err, skip) {
 			immed <- struct{}{}
@@ -84,10 +225,15 @@ func (q *Queue) consumeWithTicker(ctx context.Context, h Handler) {
 		if errors.Is(err, wait) {
 			continue
 		}
+		if errors.Is(err, panicked) {
+			q.backoffPanic(ctx, &panics)
+			continue
+		}
 		if err != nil {
-			q.log(context.Background(), Warn, "process message failed, err: %v", err)
+			q.consumeError(err)
 			continue
 		}
+		panics = 0
 
 		immed <- struct{}{}
 	}
@@ -95,21 +241,40 @@ func (q *Queue) consumeWithTicker(ctx context.Context, h Handler) {
 
 func (q *Queue) consumeWithLimiter(ctx context.Context, h Handler) {
 	immed := make(chan struct{}, 1)
+	var panics int
 	for {
+		var delay time.Duration
 		select {
 		case <-ctx.Done():
 			return
 		case <-immed:
 		default:
-			if err := q.lim.Wait(ctx); err != nil {
-				q.log(ctx, Warn, "limiter wait failed, err: %v", err)
+			ok, d := q.pace(ctx)
+			if !ok {
 				continue
 			}
+			delay = d
 			for ; len(immed) > 0; <-immed {
 			}
 		}
 
+		if q.suspended() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(q.consumeWorkerInterval):
+			}
+			continue
+		}
+
 		err := q.process(h)
+		if delay > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
 		if errors.Is(err, skip) {
 			immed <- struct{}{}
 			continue
@@ -117,29 +282,100 @@ func (q *Queue) consumeWithLimiter(ctx context.Context, h Handler) {
 		if errors.Is(err, wait) {
 			continue
 		}
+		if errors.Is(err, panicked) {
+			q.backoffPanic(ctx, &panics)
+			continue
+		}
 		if err != nil {
-			q.log(context.Background(), Warn, "process message failed, err: %v", err)
+			q.consumeError(err)
+			continue
 		}
+		panics = 0
+	}
+}
+
+// pace applies the limiter strategy before a take, it returns false if the
+// worker should not take now, and the delay to be waited after processing.
+func (q *Queue) pace(ctx context.Context) (bool, time.Duration) {
+	switch q.limiterStrategy {
+	case LimiterSkipTick:
+		if q.lim.Allow() {
+			return true, 0
+		}
+		q.idle(ctx)
+		return false, 0
+	case LimiterReserve:
+		r := q.lim.Reserve()
+		if !r.OK() {
+			q.log(ctx, Warn, "limiter reserve failed, burst is %d", q.lim.Burst())
+			q.idle(ctx)
+			return false, 0
+		}
+		return true, r.Delay()
+	}
+	if err := q.lim.Wait(ctx); err != nil {
+		q.log(ctx, Warn, "limiter wait failed, err: %v", err)
+		q.idle(ctx)
+		return false, 0
+	}
+	return true, 0
+}
+
+// idle sleeps the worker for the consume worker interval, e.g. so a limiter
+// which never allows does not spin it.
+func (q *Queue) idle(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(q.consumeWorkerInterval):
+	}
+}
+
+// consumeError reports take, parse and commit failures of workers.
+func (q *Queue) consumeError(err error) {
+	q.logSampled(context.Background(), Warn, "process message failed, err: %v", err)
+	if q.onConsumeError != nil {
+		q.onConsumeError(err)
 	}
 }
 
 var (
-	skip = errors.New("skip")
-	wait = errors.New("wait")
+	skip     = errors.New("skip")
+	wait     = errors.New("wait")
+	panicked = errors.New("panicked")
 )
 
 func (q *Queue) process(h Handler) error {
 	rq := q.key(kReady) // list
-	pq := q.key(kRetry) // zset
+	pq := q.retryKey()  // zset
 	mq := q.key(kData)
 
 	ctx := context.Background()
-	s, err := q.rdb.runTakeMsg(ctx, rq, pq, mq, q.retryInterval, q.retryTimes)
+	if err := q.injectTake(); err != nil {
+		return fmt.Errorf("take message failed, err: %v", err)
+	}
+	held, ok := q.reservePools()
+	if !ok {
+		return wait
+	}
+	s, err := q.rdb.runTakeMsg(ctx, rq, pq, mq, q.key(kDead), q.inflightKey(q.instanceID), q.key(kAffinity), q.key(kDisabled), q.key(kDelay), q.instanceID, q.currentRetryInterval(), q.affinityTTL, q.retryTimes, q.dequeueOrder, q.poolArgs(held))
+	release := q.keepPool(held, fieldOf(s, "kind"), err == nil)
+	defer release()
 
 	if err != nil {
 		switch {
-		case errors.Is(err, dataMiss),
-			errors.Is(err, deliverCntExceed):
+		case errors.Is(err, dataMiss), errors.Is(err, kindDisabled), errors.Is(err, affinityHeld):
+			return skip
+		case errors.Is(err, poolBusy), errors.Is(err, retryNotDue):
+			return wait
+		case errors.Is(err, deliverCntExceed):
+			q.audit(ctx, EventDead, s...)
+			q.complete(ctx, OutcomeDead, s...)
+			for _, id := range s {
+				if m, err := q.getMessage(ctx, id); err == nil && m != nil {
+					q.finishChild(ctx, m, true)
+				}
+				q.redriveDead(ctx, id)
+			}
 			return skip
 		case errors.Is(err, listEmpty):
 			return wait
@@ -152,17 +388,77 @@ func (q *Queue) process(h Handler) error {
 	if err = m.parse(s); err != nil {
 		return fmt.Errorf("parse message failed, err: %v", err)
 	}
+	if err = verifyChecksum(&m); err != nil {
+		q.log(ctx, Error, "message %s is corrupted, quarantined, err: %v", m.ID, err)
+		if cm, ok := q.opts.metric.(ChecksumMetric); ok {
+			q.emitMetric(cm.Corrupted)
+		}
+		return q.quarantine(ctx, &m, err.Error())
+	}
+	if err = q.decode(&m); err != nil {
+		return fmt.Errorf("decode message failed, err: %v", err)
+	}
+	if m.Group != "" {
+		if err = q.loadBatch(ctx, &m); err != nil {
+			return fmt.Errorf("load batch failed, err: %v", err)
+		}
+		if err = q.decodeBatch(&m); err != nil {
+			q.log(ctx, Error, "batch %s is corrupted, quarantined, err: %v", m.ID, err)
+			return q.quarantine(ctx, &m, err.Error())
+		}
+	}
+	if q.enabled(Trace) {
+		q.log(ctx, Trace, "take message %s, payload: %s", m.ID, q.redact(m.Payload))
+	}
+	q.audit(ctx, EventTaken, m.ID)
+	q.record(ctx, &m)
+
+	if m.processed && !q.dryRun {
+		q.log(ctx, Info, "message %s is processed but not committed, commit it without processing", m.ID)
+		if err = q.commit(ctx, &m); err != nil {
+			return fmt.Errorf("commit message failed, err: %v", err)
+		}
+		return nil
+	}
 
+	if m.StagedTx != "" && q.stagedVerifier != nil && !q.dryRun {
+		ok, err := q.commitHandedOff(ctx, &m, q.stagedVerifier)
+		if err != nil {
+			q.log(ctx, Warn, "message %s staged by %s, %v, process it", m.ID, m.StagedTx, err)
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	if err = q.validate(ValidateOnConsume, m.Kind, m.Payload); err != nil {
+		if q.dryRun {
+			return q.rollback(ctx, &m, err)
+		}
+		return q.quarantine(ctx, &m, err.Error())
+	}
+
+	m.stage = q.stager(m.ID)
+	m.save = q.saver(m.ID)
+
+	var herr error
+	var isPanic bool
+	begin := time.Now()
 	func() {
 		defer func() {
 			if r := recover(); r != nil {
-				err = fmt.Errorf("process message panic: %v", r)
+				herr = newProcessError(&m, time.Since(begin), fmt.Errorf("panic: %v", r))
+				err = fmt.Errorf("process message panic: %v", herr)
+				isPanic = true
 			}
 		}()
 
-		ctx, c := context.WithTimeout(ctx, q.consumeTimeout)
+		ctx, c := context.WithTimeout(ctx, q.timeoutOf(&m))
 		defer c()
 		err = h.Process(ctx, &m)
+		if err != nil {
+			err = newProcessError(&m, time.Since(begin), err)
+		}
 		if q.opts.metric != nil {
 			start := time.Now()
 			delay := start.Sub(m.CreateAt)
@@ -172,26 +468,100 @@ func (q *Queue) process(h Handler) error {
 			if m.ReDeliverAt != nil {
 				delay = start.Sub(*m.ReDeliverAt)
 			}
-			go q.opts.metric.Consume(delay, m.DeliverCnt, err)
+			retried, redelivered, cerr := m.ErrRetryCnt, m.RedeliverCnt, err
+			q.emitMetric(func() { q.opts.metric.Consume(delay, retried, cerr) })
+			if rm, ok := q.opts.metric.(RedeliveryMetric); ok && redelivered > 0 {
+				q.emitMetric(func() { rm.Redelivered(redelivered) })
+			}
 		}
 		if err != nil {
+			herr = err
 			err = fmt.Errorf("process message failed, err: %v", err)
 		}
 	}()
+	q.counters.busy.Add(int64(time.Since(begin)))
+
+	if q.dryRun {
+		if err = q.rollback(ctx, &m, herr); err != nil {
+			return err
+		}
+		if isPanic {
+			return panicked
+		}
+		return nil
+	}
 
 	// if err occurs, not commit message
 	if err != nil {
+		q.counters.failed.Add(1)
+		var d retryDecision
+		if d, err = q.retry(ctx, &m, herr); err != nil {
+			return fmt.Errorf("retry message failed, err: %v", err)
+		}
+		if q.noDaemon && !d.dead {
+			err = q.rdb.runRequeue(ctx, q.key(kData), q.inflightKey(q.instanceID), rq, m.ID, time.Now().Add(d.after), q.dequeueOrder)
+		} else {
+			err = q.rdb.runFail(ctx, q.key(kData), q.inflightKey(q.instanceID), m.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("fail message failed, err: %v", err)
+		}
+		if isPanic {
+			return panicked
+		}
 		return nil
 	}
 
-	_, err = q.rdb.runCommit(ctx, q.key(kRetry), q.key(kData), m.ID)
-	if err != nil {
+	if q.commits != nil {
+		q.commits <- &m
+		q.checkSLA(ctx, &m)
+		return nil
+	}
+	if err = q.commit(ctx, &m); err != nil {
 		return fmt.Errorf("commit message failed, err: %v", err)
 	}
-
+	q.checkSLA(ctx, &m)
 	return nil
 }
 
+// timeoutOf returns the consume timeout of the attempt of the message.
+func (q *Queue) timeoutOf(m *Message) time.Duration {
+	if q.attemptTimeout != nil {
+		if d := q.attemptTimeout(m.DeliverCnt); d > 0 {
+			return d
+		}
+	}
+	return q.consumeTimeout
+}
+
+// backoffPanic slows down the worker whose handler keeps panicking,
+// the backoff doubles from consumeWorkerInterval up to maxPanicBackoff.
+func (q *Queue) backoffPanic(ctx context.Context, panics *int) {
+	*panics++
+	if *panics < 2 {
+		return
+	}
+
+	d := q.consumeWorkerInterval
+	for i := 2; i < *panics && d < q.maxPanicBackoff; i++ {
+		d *= 2
+	}
+	if d > q.maxPanicBackoff {
+		d = q.maxPanicBackoff
+	}
+
+	q.log(ctx, Error, "handler panics %d times in a row, worker backs off %s", *panics, d)
+	if pm, ok := q.opts.metric.(PanicMetric); ok {
+		panics := *panics
+		q.emitMetric(func() { pm.PanicBackoff(panics, d) })
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
 func (q *Queue) RedeliveryAfter(ctx context.Context, id string, dur time.Duration) error {
 	return q.RedeliveryAt(ctx, id, time.Now().Add(dur))
 }
@@ -1,15 +1,26 @@
 package dq
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
 )
 
@@ -35,11 +46,11 @@ func TestConsumeRealtime(t *testing.T) {
 	num := 5
 	var sendIDs []string
 	for i := 0; i < num; i++ {
-		id, err := q.Produce(context.Background(), &ProducerMessage{
+		r, err := q.Produce(context.Background(), &ProducerMessage{
 			Payload: []byte("ready_" + strconv.Itoa(i)),
 		})
 		assert.Nil(t, err)
-		sendIDs = append(sendIDs, id)
+		sendIDs = append(sendIDs, r.ID)
 	}
 
 	// consume
@@ -75,12 +86,12 @@ func TestConsumeDelay(t *testing.T) {
 	var sendIDs []string
 	for i := 0; i < num; i++ {
 		at := time.Now().Add(100 * time.Millisecond)
-		id, err := q.Produce(context.Background(), &ProducerMessage{
+		r, err := q.Produce(context.Background(), &ProducerMessage{
 			Payload:   []byte("delay_" + strconv.Itoa(i)),
 			DeliverAt: &at,
 		})
 		assert.Nil(t, err)
-		sendIDs = append(sendIDs, id)
+		sendIDs = append(sendIDs, r.ID)
 	}
 
 	// consume
@@ -119,11 +130,11 @@ func TestConsumeErrRetry(t *testing.T) {
 	num := 10
 	var sendIDs []string
 	for i := 0; i < num; i++ {
-		id, err := q.Produce(context.Background(), &ProducerMessage{
+		r, err := q.Produce(context.Background(), &ProducerMessage{
 			Payload: []byte("ready_" + strconv.Itoa(i)),
 		})
 		assert.Nil(t, err)
-		sendIDs = append(sendIDs, id)
+		sendIDs = append(sendIDs, r.ID)
 	}
 
 	// consume
@@ -162,11 +173,11 @@ func TestConsumeRedeliver(t *testing.T) {
 	num := 10
 	var sendIDs []string
 	for i := 0; i < num; i++ {
-		id, err := q.Produce(context.Background(), &ProducerMessage{
+		r, err := q.Produce(context.Background(), &ProducerMessage{
 			Payload: []byte("ready_" + strconv.Itoa(i)),
 		})
 		assert.Nil(t, err)
-		sendIDs = append(sendIDs, id)
+		sendIDs = append(sendIDs, r.ID)
 	}
 
 	// consume
@@ -207,11 +218,11 @@ func TestConsumePanicRetry(t *testing.T) {
 	num := 5
 	var sendIDs []string
 	for i := 0; i < num; i++ {
-		id, err := q.Produce(context.Background(), &ProducerMessage{
+		r, err := q.Produce(context.Background(), &ProducerMessage{
 			Payload: []byte("ready_" + strconv.Itoa(i)),
 		})
 		assert.Nil(t, err)
-		sendIDs = append(sendIDs, id)
+		sendIDs = append(sendIDs, r.ID)
 	}
 
 	// consume
@@ -228,7 +239,6 @@ func TestConsumePanicRetry(t *testing.T) {
 		t.Log("consume:", m.DeliverCnt, string(m.Payload))
 		wg.Done()
 		panic("mock panic")
-		return nil
 	}))
 
 	select {
@@ -238,6 +248,40 @@ func TestConsumePanicRetry(t *testing.T) {
 	}
 }
 
+type panicMetric struct {
+	Metric
+	backoffs []time.Duration
+	done     chan struct{}
+}
+
+func (m *panicMetric) PanicBackoff(panics int, backoff time.Duration) {
+	m.backoffs = append(m.backoffs, backoff)
+	m.done <- struct{}{}
+}
+
+func TestPanicBackoff(t *testing.T) {
+	// init
+	m := &panicMetric{done: make(chan struct{})}
+	q := New(
+		WithConsumerWorkerInterval(100*time.Millisecond),
+		WithMaxPanicBackoff(300*time.Millisecond),
+		WithMetric(m),
+	)
+
+	// canceled ctx doesn't wait
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the first panic doesn't back off
+	var panics int
+	q.backoffPanic(ctx, &panics)
+	for i := 0; i < 3; i++ {
+		q.backoffPanic(ctx, &panics)
+		<-m.done
+	}
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}, m.backoffs)
+}
+
 func TestGracefulShutdown(t *testing.T) {
 	// init
 	q := New(append(testOpts(t),
@@ -259,9 +303,9 @@ func TestGracefulShutdown(t *testing.T) {
 	}))
 
 	// produce
-	id, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("payload")})
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("payload")})
 	assert.Nil(t, err)
-	t.Log("produce:", id)
+	t.Log("produce:", r.ID)
 
 	// graceful shutdown success
 	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
@@ -269,6 +313,41 @@ func TestGracefulShutdown(t *testing.T) {
 	assert.Nil(t, q.Close(ctx))
 }
 
+func TestGracefulShutdownHook(t *testing.T) {
+	// init, the hook runs while the handler is in flight
+	var inflight atomic.Bool
+	var hooked bool
+	flushErr := fmt.Errorf("mock flush failed")
+	q := New(append(testOpts(t),
+		WithOnShutdown(func(ctx context.Context) error {
+			hooked = inflight.Load()
+			return flushErr
+		}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// consume
+	taken := make(chan struct{})
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		inflight.Store(true)
+		defer inflight.Store(false)
+		close(taken)
+		<-time.After(100 * time.Millisecond)
+		return nil
+	}))
+
+	// produce
+	_, err := q.Produce(context.Background(), &ProducerMessage{Payload: []byte("payload")})
+	assert.Nil(t, err)
+	<-taken
+
+	// the hook error is returned
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	assert.Equal(t, flushErr, q.Close(ctx))
+	assert.True(t, hooked)
+}
+
 func TestGracefulShutdownWithError(t *testing.T) {
 	// init
 	q := New(append(testOpts(t),
@@ -290,9 +369,9 @@ func TestGracefulShutdownWithError(t *testing.T) {
 	}))
 
 	// produce
-	id, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("payload")})
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("payload")})
 	assert.Nil(t, err)
-	t.Log("produce:", id)
+	t.Log("produce:", r.ID)
 
 	<-time.After(10 * time.Millisecond)
 
@@ -325,11 +404,11 @@ func TestConsumeLimit(t *testing.T) {
 	num := 5
 	var sendIDs []string
 	for i := 0; i < num; i++ {
-		id, err := q.Produce(context.Background(), &ProducerMessage{
+		r, err := q.Produce(context.Background(), &ProducerMessage{
 			Payload: []byte("ready_" + strconv.Itoa(i)),
 		})
 		assert.Nil(t, err)
-		sendIDs = append(sendIDs, id)
+		sendIDs = append(sendIDs, r.ID)
 	}
 
 	go func() {
@@ -353,3 +432,1980 @@ func TestConsumeLimit(t *testing.T) {
 
 	<-time.After(interval*time.Duration(num) + 100*time.Millisecond)
 }
+
+func TestConsumeLimiterStrategy(t *testing.T) {
+	interval := 20 * time.Millisecond
+	for name, s := range map[string]LimiterStrategy{
+		"wait":      LimiterWait,
+		"skip_tick": LimiterSkipTick,
+		"reserve":   LimiterReserve,
+	} {
+		t.Run(name, func(t *testing.T) {
+			// init
+			q := New(append(testOpts(t),
+				WithConsumerWorkerNum(1),
+				WithConsumerWorkerInterval(5*time.Millisecond),
+				WithLimiter(rate.Every(interval), 1),
+				WithLimiterStrategy(s),
+			)...)
+			defer t.Cleanup(func() { cleanup(t, q) })
+			assert.Equal(t, s, q.Options().LimiterStrategy)
+
+			// produce
+			num := 6
+			for i := 0; i < num; i++ {
+				_, err := q.Produce(context.Background(), &ProducerMessage{Payload: []byte(strconv.Itoa(i))})
+				assert.Nil(t, err)
+			}
+
+			// consume, paced by the limiter
+			var cnt int32
+			begin := time.Now()
+			q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+				atomic.AddInt32(&cnt, 1)
+				return nil
+			}))
+			defer closeQueue(t, q)
+			assert.Eventually(t, func() bool { return atomic.LoadInt32(&cnt) == int32(num) }, 2*time.Second, 5*time.Millisecond)
+			assert.GreaterOrEqual(t, time.Since(begin), time.Duration(num-2)*interval)
+		})
+	}
+}
+
+func TestConsumePause(t *testing.T) {
+	// init
+	q := New(append(testOpts(t),
+		WithConfigReloadInterval(10*time.Millisecond),
+		WithConsumerWorkerInterval(10*time.Millisecond),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	assert.Nil(t, q.Pause(ctx))
+	defer func() { assert.Nil(t, q.ResetConfig(ctx)) }()
+
+	// consume
+	var dataCh = make(chan string, 1)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		dataCh <- m.ID
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	// produce
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("paused")})
+	assert.Nil(t, err)
+
+	select {
+	case <-time.After(200 * time.Millisecond):
+	case <-dataCh:
+		t.Fatal("consumed while paused")
+	}
+
+	// resume
+	assert.Nil(t, q.Resume(ctx))
+
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatal("consume timeout")
+	case <-dataCh:
+	}
+}
+
+func TestConsumeDisableKind(t *testing.T) {
+	// init
+	q := New(append(testOpts(t),
+		WithRetryInterval(50*time.Millisecond),
+		WithConsumerWorkerInterval(10*time.Millisecond),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	assert.Nil(t, q.DisableKind(ctx, "bad"))
+	kinds, err := q.DisabledKinds(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bad"}, kinds)
+
+	// consume
+	var dataCh = make(chan string, 2)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		dataCh <- m.Kind
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	// produce
+	bad, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("bad"), Kind: "bad"})
+	assert.Nil(t, err)
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("good"), Kind: "good"})
+	assert.Nil(t, err)
+
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatal("consume timeout")
+	case kind := <-dataCh:
+		assert.Equal(t, "good", kind)
+	}
+	select {
+	case <-time.After(200 * time.Millisecond):
+	case <-dataCh:
+		t.Fatal("consumed disabled kind")
+	}
+	m, err := q.GetMessage(ctx, bad.ID)
+	assert.Nil(t, err)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, 0, m.DeliverCnt)
+	}
+
+	// enable
+	assert.Nil(t, q.EnableKind(ctx, "bad"))
+
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatal("consume timeout")
+	case kind := <-dataCh:
+		assert.Equal(t, "bad", kind)
+	}
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	assert.NotNil(t, q.SetRateLimit(ctx, 10, 0))
+
+	// a limit set without burst allows one
+	assert.Nil(t, q.rdb.HSet(ctx, q.key(kConfig), confRateLimit, "10").Err())
+	q.loadConfig(ctx)
+	assert.Equal(t, rate.Limit(10), q.lim.Limit())
+	assert.Equal(t, 1, q.lim.Burst())
+}
+
+func TestConsumeRetryAfter(t *testing.T) {
+	// init, the retry interval is too long to be waited
+	q := New(append(testOpts(t),
+		WithRetryInterval(10*time.Second),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	_, err := q.Produce(context.Background(), &ProducerMessage{Payload: []byte("retry_after")})
+	assert.Nil(t, err)
+
+	// consume
+	done := make(chan struct{})
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		if m.DeliverCnt == 1 {
+			return RetryAfter(fmt.Errorf("mock 429"), 50*time.Millisecond)
+		}
+		close(done)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatal("consume timeout")
+	case <-done:
+	}
+}
+
+func TestConsumeRetryMatrix(t *testing.T) {
+	// init
+	q := New(append(testOpts(t),
+		WithRetryInterval(10*time.Second),
+		WithRetryMatrix(map[ErrorClass]RetryPolicy{
+			ErrorClassTimeout:    {Interval: 10 * time.Millisecond, Multiplier: 2},
+			ErrorClassValidation: {DeadLetter: true},
+		}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("retry_matrix")})
+	assert.Nil(t, err)
+
+	// consume, timeout is retried with backoff then validation goes to dead letter
+	var cnt int32
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		atomic.AddInt32(&cnt, 1)
+		if m.DeliverCnt < 3 {
+			return context.DeadlineExceeded
+		}
+		return Classify(fmt.Errorf("mock invalid"), ErrorClassValidation)
+	}))
+	defer closeQueue(t, q)
+
+	assert.Eventually(t, func() bool {
+		return q.rdb.ZScore(ctx, q.key(kDead), r.ID).Err() == nil
+	}, 1*time.Second, 10*time.Millisecond)
+	<-time.After(50 * time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&cnt))
+}
+
+func TestConsumeRedrive(t *testing.T) {
+	// init
+	dlq := New(WithName("dq_test_TestConsumeRedrive_dlq"), WithCodec(Gzip))
+	q := New(append(testOpts(t),
+		WithCodec(Gzip),
+		WithRedrivePolicy(RedrivePolicy{MaxRetries: 5, Interval: 10 * time.Second, DeadLetterQueue: dlq.name}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q, dlq) })
+
+	// produce, the message is retried once after 10ms
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{
+		Payload: []byte("redrive"),
+		Redrive: &RedrivePolicy{MaxRetries: 1, Interval: 10 * time.Millisecond},
+	})
+	assert.Nil(t, err)
+
+	// consume, the dead message is redriven to the dead letter queue
+	var cnt int32
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		atomic.AddInt32(&cnt, 1)
+		return fmt.Errorf("mock error")
+	}))
+	defer closeQueue(t, q)
+
+	assert.Eventually(t, func() bool {
+		s, err := dlq.Stats(ctx)
+		return err == nil && s.Ready == 1
+	}, 1*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&cnt))
+	assert.NotNil(t, q.rdb.ZScore(ctx, q.key(kDead), r.ID).Err())
+	m, err := q.GetMessage(ctx, r.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+
+	// the payload is kept encoded by the codec of the queue
+	ids, err := dlq.rdb.LRange(ctx, dlq.key(kReady), 0, -1).Result()
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+	codec, err := dlq.rdb.HGet(ctx, dlq.key(kData)+":"+ids[0], "codec").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, Gzip.Name(), codec)
+	m, err = dlq.GetMessage(ctx, ids[0])
+	require.NoError(t, err)
+	require.NotNil(t, m)
+	assert.Equal(t, "redrive", string(m.Payload))
+}
+
+func TestConsumeSchemaValidator(t *testing.T) {
+	// init
+	v := ValidateKinds(map[string]Validator{
+		"order": ValidateJSON("id", "user.id"),
+	})
+	q := New(append(testOpts(t), WithSchemaValidator(v, ValidateOnProduce|ValidateOnConsume))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce, invalid payload is rejected
+	ctx := context.Background()
+	_, err := q.Produce(ctx, &ProducerMessage{Kind: "order", Payload: []byte(`{"id":1}`)})
+	assert.True(t, errors.Is(err, ErrInvalidPayload))
+	assert.Contains(t, err.Error(), "user.id")
+
+	// consume, invalid payload produced by an older producer goes to dead letter
+	old := New(testOpts(t)...)
+	r, err := old.Produce(ctx, &ProducerMessage{Kind: "order", Payload: []byte(`{"id":1}`)})
+	assert.Nil(t, err)
+
+	var cnt int32
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		atomic.AddInt32(&cnt, 1)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	assert.Eventually(t, func() bool {
+		return q.rdb.ZScore(ctx, q.key(kDead), r.ID).Err() == nil
+	}, 1*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&cnt))
+}
+
+func TestConsumeLIFO(t *testing.T) {
+	// init
+	q := New(append(testOpts(t),
+		WithConsumerWorkerNum(1),
+		WithDequeueOrder(LIFO),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	num := 3
+	for i := 0; i < num; i++ {
+		_, err := q.Produce(context.Background(), &ProducerMessage{Payload: []byte(strconv.Itoa(i))})
+		assert.Nil(t, err)
+	}
+
+	// consume, the newest first
+	got := make(chan string, num)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- string(m.Payload)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	for i := num - 1; i >= 0; i-- {
+		select {
+		case <-time.After(1 * time.Second):
+			t.Fatal("consume timeout")
+		case p := <-got:
+			assert.Equal(t, strconv.Itoa(i), p)
+		}
+	}
+}
+
+func TestConsumeResult(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithResultSaveTime(1*time.Minute))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("result")})
+	assert.Nil(t, err)
+
+	// consume
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		m.SetResult(Result{Status: 200, Output: "output_" + m.ID})
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	// assert
+	var res *Result
+	assert.Eventually(t, func() bool {
+		res, err = q.Result(ctx, r.ID)
+		return err == nil && res != nil
+	}, 1*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 200, res.Status)
+	assert.Equal(t, "output_"+r.ID, res.Output)
+	assert.False(t, res.CommitAt.IsZero())
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{Interval: 1 * time.Second, Multiplier: 2, MaxInterval: 5 * time.Second}
+	assert.Equal(t, 1*time.Second, p.delay(1))
+	assert.Equal(t, 2*time.Second, p.delay(2))
+	assert.Equal(t, 4*time.Second, p.delay(3))
+	assert.Equal(t, 5*time.Second, p.delay(4))
+}
+
+func TestRetryDecisionLast(t *testing.T) {
+	q := New(WithRetryTimes(5), WithRetryMatrix(map[ErrorClass]RetryPolicy{
+		ErrorClassValidation: {DeadLetter: true},
+	}))
+	err := errors.New("mock error")
+
+	m := &Message{DeliverCnt: 2}
+	assert.False(t, q.lastAttempt(m, err))
+	assert.True(t, q.lastAttempt(m, Classify(err, ErrorClassValidation)))
+
+	// the retries of the message override the queue retry times
+	m.Redrive = &RedrivePolicy{MaxRetries: 1}
+	assert.True(t, q.lastAttempt(m, err))
+}
+
+func TestGracefulShutdownReclaim(t *testing.T) {
+	// init
+	q := New(append(testOpts(t),
+		WithRetryInterval(10*time.Second),
+		WithConsumerWorkerInterval(10*time.Millisecond),
+		WithHeartbeatInterval(10*time.Millisecond),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+
+	// consume
+	taken := make(chan struct{})
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		close(taken)
+		<-time.After(1000 * time.Millisecond)
+		return nil
+	}))
+
+	// produce
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("payload")})
+	assert.Nil(t, err)
+	<-taken
+
+	// shutdown timeout, the handling message is left in flight and the instance draining
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, q.Close(ctx), context.DeadlineExceeded)
+
+	ctx = context.Background()
+	assert.Equal(t, int64(0), q.rdb.LLen(ctx, q.key(kReady)).Val())
+	assert.True(t, q.rdb.SIsMember(ctx, q.inflightKey(q.instanceID), r.ID).Val())
+	bs, err := q.rdb.HGet(ctx, q.key(kInstances), q.instanceID).Bytes()
+	assert.Nil(t, err)
+	var ins Instance
+	assert.Nil(t, json.Unmarshal(bs, &ins))
+	assert.True(t, ins.Draining)
+
+	// reclaimed to ready once the instance expires
+	<-time.After(50 * time.Millisecond)
+	q.reclaimExpired(ctx)
+	assert.Equal(t, int64(1), q.rdb.LLen(ctx, q.key(kReady)).Val())
+	assert.Equal(t, int64(0), q.rdb.ZCard(ctx, q.key(kRetry)).Val())
+	assert.Equal(t, int64(0), q.rdb.Exists(ctx, q.inflightKey(q.instanceID)).Val())
+}
+
+func TestConsumeFaultInjector(t *testing.T) {
+	// init, commits are always dropped
+	q := New(append(testOpts(t),
+		WithRetryInterval(10*time.Millisecond),
+		WithFaultInjector(&FaultInjector{DropCommit: 1}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	_, err := q.Produce(context.Background(), &ProducerMessage{Payload: []byte("fault")})
+	assert.Nil(t, err)
+
+	// consume, the message is redelivered although the handler succeeded
+	done := make(chan struct{})
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		if m.DeliverCnt == 2 {
+			close(done)
+		}
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatal("consume timeout")
+	case <-done:
+	}
+}
+
+func TestConsumeOnError(t *testing.T) {
+	// init, takes always fail
+	errs := make(chan error, 1)
+	q := New(append(testOpts(t),
+		WithConsumerWorkerNum(1),
+		WithFaultInjector(&FaultInjector{TakeFailure: 1}),
+		WithOnConsumeError(func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// consume
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatal("consume error timeout")
+	case err := <-errs:
+		assert.Contains(t, err.Error(), ErrInjectedFault.Error())
+	}
+}
+
+type errMetric struct {
+	Metric
+	errs chan error
+}
+
+func (m *errMetric) Produce(isDelayMsg bool, err error) {}
+
+func (m *errMetric) Consume(delay time.Duration, retried int, err error) {
+	if err != nil {
+		m.errs <- err
+	}
+}
+
+func (m *errMetric) Queue(ready, delay, retry int) {}
+
+type countMetric struct {
+	errMetric
+	produced, consumed atomic.Int64
+}
+
+func (m *countMetric) Produce(isDelayMsg bool, err error) { m.produced.Add(1) }
+
+func (m *countMetric) Consume(delay time.Duration, retried int, err error) { m.consumed.Add(1) }
+
+func TestConsumeMetricBuffer(t *testing.T) {
+	// init
+	m := &countMetric{}
+	q := New(append(testOpts(t), WithMetric(m))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce, flushed in the background
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte(strconv.Itoa(i))})
+		assert.Nil(t, err)
+	}
+	assert.Eventually(t, func() bool { return m.produced.Load() == 20 }, time.Second, 10*time.Millisecond)
+
+	// consume, flushed on close
+	var cnt int32
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		atomic.AddInt32(&cnt, 1)
+		return nil
+	}))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&cnt) == 20 }, time.Second, 10*time.Millisecond)
+	closeQueue(t, q)
+	assert.Equal(t, int64(20), m.consumed.Load())
+
+	// sync
+	m2 := &countMetric{}
+	q2 := New(append(testOpts(t), WithMetric(m2), WithSyncMetric())...)
+	_, err := q2.Produce(ctx, &ProducerMessage{Payload: []byte("sync")})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), m2.produced.Load())
+}
+
+func TestConsumeProcessError(t *testing.T) {
+	// init
+	m := &errMetric{errs: make(chan error, 10)}
+	q := New(append(testOpts(t), WithMetric(m), WithRetryInterval(time.Minute))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	r, err := q.Produce(context.Background(), &ProducerMessage{Payload: []byte("process_error"), Kind: "kind"})
+	assert.Nil(t, err)
+
+	// consume
+	mockErr := fmt.Errorf("mock error")
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		return mockErr
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatal("consume timeout")
+	case err := <-m.errs:
+		var pe *ProcessError
+		assert.True(t, errors.As(err, &pe))
+		assert.Equal(t, r.ID, pe.MsgID)
+		assert.Equal(t, "kind", pe.Kind)
+		assert.Equal(t, 1, pe.Attempt)
+		assert.True(t, errors.Is(err, mockErr))
+	}
+}
+
+func TestConsumeRetryCnt(t *testing.T) {
+	// init, the first commit is dropped as if the consumer crashed
+	var drops int32
+	q := New(append(testOpts(t),
+		WithRetryInterval(10*time.Millisecond),
+		WithFaultInjector(&FaultInjector{
+			DropCommit: 0.5,
+			Rand: func() float64 {
+				if atomic.AddInt32(&drops, 1) == 1 {
+					return 0
+				}
+				return 1
+			},
+		}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	_, err := q.Produce(context.Background(), &ProducerMessage{Payload: []byte("retry_cnt")})
+	assert.Nil(t, err)
+
+	// consume, failed by the handler once then redelivered once
+	got := make(chan *Message, 1)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		switch m.DeliverCnt {
+		case 1:
+			return fmt.Errorf("mock error")
+		case 3:
+			got <- m
+		}
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatal("consume timeout")
+	case m := <-got:
+		assert.Equal(t, 1, m.ErrRetryCnt)
+		assert.Equal(t, 1, m.RedeliverCnt)
+	}
+}
+
+func TestConsumeCommitRetry(t *testing.T) {
+	// init, the first 2 commits fail
+	var commits int32
+	q := New(append(testOpts(t),
+		WithRetryInterval(10*time.Millisecond),
+		WithCommitRetry(1, time.Millisecond),
+		WithFaultInjector(&FaultInjector{
+			CommitFailure: 0.5,
+			Rand: func() float64 {
+				if atomic.AddInt32(&commits, 1) <= 2 {
+					return 0
+				}
+				return 1
+			},
+		}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("commit_retry")})
+	assert.Nil(t, err)
+
+	// consume, the redelivered message is committed without processing
+	var cnt int32
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		atomic.AddInt32(&cnt, 1)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	assert.Eventually(t, func() bool {
+		return q.rdb.Exists(ctx, q.key(kData)+":"+r.ID).Val() == 0
+	}, 1*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cnt))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&commits))
+}
+
+func TestConsumeCommitFailedElsewhere(t *testing.T) {
+	// init, every commit fails
+	q := New(append(testOpts(t),
+		WithCommitRetry(0, time.Millisecond),
+		WithFaultInjector(&FaultInjector{CommitFailure: 1}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce, then fail to commit the processed message
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("commit_failed")})
+	assert.Nil(t, err)
+	m := &Message{ID: r.ID}
+	m.SetResult(Result{Status: 201})
+	assert.ErrorIs(t, q.commit(ctx, m), ErrInjectedFault)
+	assert.True(t, q.rdb.HExists(ctx, q.key(kData)+":"+r.ID, "processed_at").Val())
+
+	// another instance commits it without processing
+	other := New(testOpts(t)...)
+	var cnt int32
+	other.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		atomic.AddInt32(&cnt, 1)
+		return nil
+	}))
+	defer closeQueue(t, other)
+
+	assert.Eventually(t, func() bool {
+		return q.rdb.Exists(ctx, q.key(kData)+":"+r.ID).Val() == 0
+	}, 1*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&cnt))
+}
+
+func TestMiddlewares(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return Named(name, func(h Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, m *Message) error {
+				order = append(order, name)
+				return h.Process(ctx, m)
+			})
+		})
+	}
+
+	// init, insertions may refer to middlewares added later
+	q := New(
+		WithMiddlewareBefore("log", mw("trace")),
+		WithNamedMiddleware(mw("auth"), mw("log")),
+		WithMiddlewareAfter("auth", mw("metric")),
+		WithMiddlewareAfter("missing", mw("last")),
+	)
+	assert.Equal(t, []string{"auth", "metric", "trace", "log", "last"}, q.Middlewares())
+
+	// assert the chain runs in order
+	var h Handler = HandlerFunc(func(ctx context.Context, m *Message) error { return nil })
+	chain := q.chain()
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i].Wrap(h)
+	}
+	assert.Nil(t, h.Process(context.Background(), &Message{}))
+	assert.Equal(t, q.Middlewares(), order)
+}
+
+func TestReportErrors(t *testing.T) {
+	// sentry
+	events := make(chan map[string]interface{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/42/store/", r.URL.Path)
+		assert.Contains(t, r.Header.Get("X-Sentry-Auth"), "sentry_key=public")
+		event := map[string]interface{}{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&event))
+		events <- event
+	}))
+	defer srv.Close()
+
+	reporter, err := NewSentryReporter(strings.Replace(srv.URL, "://", "://public@", 1) + "/42")
+	assert.Nil(t, err)
+
+	// init
+	q := New(append(testOpts(t), WithRetryInterval(time.Minute), WithNamedMiddleware(ReportErrors(reporter)))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	r, err := q.Produce(context.Background(), &ProducerMessage{Payload: []byte("error"), Kind: "kind"})
+	assert.Nil(t, err)
+	_, err = q.Produce(context.Background(), &ProducerMessage{Payload: []byte("panic"), Kind: "kind"})
+	assert.Nil(t, err)
+
+	// consume
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		if string(m.Payload) == "panic" {
+			panic("mock panic")
+		}
+		return fmt.Errorf("mock error")
+	}))
+	defer closeQueue(t, q)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-time.After(1 * time.Second):
+			t.Fatal("report timeout")
+		case event := <-events:
+			assert.Equal(t, "kind", event["tags"].(map[string]interface{})["dq.kind"])
+			extra := event["extra"].(map[string]interface{})
+			if event["level"] == "fatal" {
+				assert.Contains(t, event["message"], "mock panic")
+				assert.NotEmpty(t, extra["stack"])
+			} else {
+				assert.Contains(t, event["message"], "mock error")
+				assert.Equal(t, r.ID, extra["dq.message_id"])
+			}
+		}
+	}
+}
+
+func TestSentryReporterSlow(t *testing.T) {
+	// sentry never responds
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	reporter, err := NewSentryReporter(strings.Replace(srv.URL, "://", "://public@", 1) + "/42")
+	assert.Nil(t, err)
+
+	// reports beyond the buffer are dropped at once
+	begin := time.Now()
+	for i := 0; i < sentryBuffer+10; i++ {
+		reporter.Report(context.Background(), fmt.Errorf("mock error"), &Message{ID: strconv.Itoa(i)}, nil)
+	}
+	assert.Less(t, time.Since(begin), time.Second)
+	assert.GreaterOrEqual(t, reporter.Dropped(), int64(9))
+
+	// close gives up once ctx is done, later reports are dropped
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, reporter.Close(ctx))
+	dropped := reporter.Dropped()
+	reporter.Report(context.Background(), fmt.Errorf("mock error"), &Message{ID: "closed"}, nil)
+	assert.Equal(t, dropped+1, reporter.Dropped())
+}
+
+func TestWebhook(t *testing.T) {
+	// server
+	secret := []byte("secret")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get("X-Dq-Timestamp"), 10, 64)
+		assert.Equal(t, WebhookSignature(secret, ts, payload), r.Header.Get("X-Dq-Signature"))
+		assert.Equal(t, "id", r.Header.Get("X-Dq-Message-Id"))
+
+		switch string(payload) {
+		case "unavailable":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "bad":
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	h := &Webhook{URL: srv.URL, Secret: secret}
+	process := func(payload string) error {
+		return h.Process(context.Background(), &Message{ProducerMessage: ProducerMessage{Payload: []byte(payload)}, ID: "id", DeliverCnt: 1})
+	}
+
+	assert.Nil(t, process("ok"))
+
+	err := process("unavailable")
+	assert.Equal(t, ErrorClassDefault, defaultClassifier(err))
+	d, ok := retryAfterOf(err)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+
+	assert.Equal(t, ErrorClassValidation, defaultClassifier(process("bad")))
+}
+
+func TestConsumeAffinity(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// the affinity is held by another instance for a while
+	ctx := context.Background()
+	held := time.Now().Add(300 * time.Millisecond)
+	assert.Nil(t, q.rdb.Set(ctx, q.key(kAffinity)+":user1", "other", 300*time.Millisecond).Err())
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("user1"), Affinity: "user1"})
+	assert.Nil(t, err)
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("user2"), Affinity: "user2"})
+	assert.Nil(t, err)
+
+	// consume
+	got := make(chan string, 2)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- m.Affinity
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	for _, want := range []string{"user2", "user1"} {
+		select {
+		case <-time.After(2 * time.Second):
+			t.Fatal("consume timeout")
+		case affinity := <-got:
+			assert.Equal(t, want, affinity)
+			if affinity == "user1" {
+				assert.False(t, time.Now().Before(held))
+			}
+		}
+	}
+	assert.Equal(t, q.instanceID, q.rdb.Get(ctx, q.key(kAffinity)+":user1").Val())
+}
+
+func TestConsumeAffinityRedelay(t *testing.T) {
+	// init, the affinity is held by another instance
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	assert.Nil(t, q.rdb.Set(ctx, q.key(kAffinity)+":user1", "other", time.Minute).Err())
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("user1"), Affinity: "user1"})
+	assert.Nil(t, err)
+
+	// the message is delayed briefly instead of blocking ready
+	assert.ErrorIs(t, q.process(HandlerFunc(func(ctx context.Context, m *Message) error { return nil })), skip)
+	assert.Equal(t, int64(0), q.rdb.LLen(ctx, q.key(kReady)).Val())
+	score, err := q.rdb.ZScore(ctx, q.key(kDelay), r.ID).Result()
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, int64(score), time.Now().Add(affinityRedelay).UnixMilli())
+}
+
+func TestConsumeWorkerPools(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithWorkerPools(1, 2), WithKindPool(PoolCPU, "cpu"))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+	assert.Equal(t, 3, q.consumeWorkerNum)
+
+	// produce
+	for i := 0; i < 3; i++ {
+		_, err := q.Produce(context.Background(), &ProducerMessage{Payload: []byte("cpu"), Kind: "cpu"})
+		assert.Nil(t, err)
+	}
+
+	// consume
+	var running, maxRunning, processed int32
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&processed, 1)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&processed) == 3 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxRunning))
+}
+
+func TestConsumeWorkerPoolsEmpty(t *testing.T) {
+	q := New(append(testOpts(t), WithWorkerPools(0, 2))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NotNil(t, q.ConsumeContext(ctx, HandlerFunc(func(ctx context.Context, m *Message) error {
+		return nil
+	})))
+}
+
+func TestConsumeWorkerPoolsBusy(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithWorkerPools(1, 1), WithKindPool(PoolCPU, "cpu"))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce, cpu messages ahead of an io one
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("cpu"), Kind: "cpu"})
+		assert.Nil(t, err)
+	}
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("io"), Kind: "io"})
+	assert.Nil(t, err)
+
+	// consume, the io message is not starved by the busy cpu pool
+	io := make(chan struct{})
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		if m.Kind == "io" {
+			close(io)
+			return nil
+		}
+		time.Sleep(300 * time.Millisecond)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(250 * time.Millisecond):
+		t.Fatal("io message starved")
+	case <-io:
+	}
+}
+
+func TestConsumeWorkerPoolsFull(t *testing.T) {
+	// init
+	var consumeErrs int32
+	q := New(append(testOpts(t), WithWorkerPools(1, 1), WithKindPool(PoolCPU, "cpu"), WithOnConsumeError(func(err error) {
+		atomic.AddInt32(&consumeErrs, 1)
+	}))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce, more cpu messages than the cpu pool runs at once
+	for i := 0; i < 5; i++ {
+		_, err := q.Produce(context.Background(), &ProducerMessage{Payload: []byte("cpu"), Kind: "cpu"})
+		assert.Nil(t, err)
+	}
+
+	// consume, a full pool is waited for, not reported as a failure
+	var processed int32
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&processed, 1)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&processed) == 5 }, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&consumeErrs))
+}
+
+func TestConsumeChecksum(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithChecksum())...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce, the first payload is corrupted
+	ctx := context.Background()
+	corrupted, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("corrupted")})
+	assert.Nil(t, err)
+	assert.Nil(t, q.rdb.HSet(ctx, q.key(kData)+":"+corrupted.ID, "payload", base64.StdEncoding.EncodeToString([]byte("c0rrupted"))).Err())
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("intact")})
+	assert.Nil(t, err)
+
+	// consume
+	got := make(chan string, 2)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- string(m.Payload)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("consume timeout")
+	case payload := <-got:
+		assert.Equal(t, "intact", payload)
+	}
+	assert.Eventually(t, func() bool {
+		m, err := q.GetMessage(ctx, corrupted.ID)
+		return err == nil && m.DeadAt != nil && strings.Contains(m.DeadReason, "checksum mismatch")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestConsumeStaged(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithRetryInterval(time.Minute))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("staged")})
+	assert.Nil(t, err)
+
+	// consume, the handoff is staged but the handler fails before acknowledged
+	staged := make(chan struct{}, 1)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		assert.Nil(t, m.Staged(ctx, "tx-1"))
+		staged <- struct{}{}
+		return fmt.Errorf("mock crash")
+	}))
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("consume timeout")
+	case <-staged:
+	}
+	closeQueue(t, q)
+
+	// reconcile, the retry is not due yet
+	verify := func(ctx context.Context, m *Message) (bool, error) {
+		return m.StagedTx == "tx-1", nil
+	}
+	n, err := q.Reconcile(ctx, verify)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// reconcile once due
+	assert.Nil(t, q.rdb.ZAddXX(ctx, q.key(kRetry), redis.Z{Score: float64(time.Now().Add(-time.Second).UnixMilli()), Member: r.ID}).Err())
+	n, err = q.Reconcile(ctx, verify)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	res, err := q.Result(ctx, r.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "tx-1", res.StagedTx)
+	assert.Equal(t, int64(0), q.rdb.ZCard(ctx, q.key(kRetry)).Val())
+}
+
+func TestConsumeStagedVerifier(t *testing.T) {
+	// init, staged messages are verified as they are taken again
+	q := New(append(testOpts(t),
+		WithRetryInterval(10*time.Millisecond),
+		WithStagedVerifier(func(ctx context.Context, m *Message) (bool, error) {
+			return m.StagedTx == "tx-1", nil
+		}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("staged")})
+	assert.Nil(t, err)
+
+	// consume, the handoff is staged but the handler fails before acknowledged
+	var cnt int32
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		atomic.AddInt32(&cnt, 1)
+		assert.Nil(t, m.Staged(ctx, "tx-1"))
+		return fmt.Errorf("mock crash")
+	}))
+	defer closeQueue(t, q)
+
+	// committed without calling the handler again
+	assert.Eventually(t, func() bool {
+		res, err := q.Result(ctx, r.ID)
+		return err == nil && res != nil && res.StagedTx == "tx-1"
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cnt))
+}
+
+func TestConsumeFunc(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	got := make(chan string, 1)
+	RegisterFunc("greet", func(ctx context.Context, args json.RawMessage) error {
+		var name string
+		if err := json.Unmarshal(args, &name); err != nil {
+			return err
+		}
+		got <- "hello " + name
+		return nil
+	})
+
+	// produce
+	_, err := q.After(context.Background(), 100*time.Millisecond, "greet", "dq")
+	assert.Nil(t, err)
+
+	// consume
+	q.Consume(FuncHandler())
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("consume timeout")
+	case s := <-got:
+		assert.Equal(t, "hello dq", s)
+	}
+}
+
+func TestConsumeTask(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	type emailArgs struct {
+		To string `json:"to"`
+	}
+	got := make(chan string, 1)
+	Register("send_welcome_email", func(ctx context.Context, args emailArgs) error {
+		got <- args.To
+		return nil
+	})
+
+	// produce
+	_, err := q.Enqueue(context.Background(), "send_welcome_email", emailArgs{To: "a@example.com"}, WithDedupID("welcome:a"))
+	assert.Nil(t, err)
+
+	// consume
+	q.Consume(FuncHandler())
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("consume timeout")
+	case to := <-got:
+		assert.Equal(t, "a@example.com", to)
+	}
+}
+
+func TestConsumeWorkflow(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithRetryTimes(0))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	var mu sync.Mutex
+	var ran []string
+	Register("workflow_step", func(ctx context.Context, name string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, name)
+		if name == "fail" {
+			return fmt.Errorf("mock error")
+		}
+		return nil
+	})
+
+	// submit, a -> b, c -> d
+	ctx := context.Background()
+	id, err := q.Submit(ctx, Workflow{Steps: []Step{
+		{Name: "d", Task: "workflow_step", Args: "d", DependsOn: []string{"b", "c"}},
+		{Name: "b", Task: "workflow_step", Args: "b", DependsOn: []string{"a"}},
+		{Name: "c", Task: "workflow_step", Args: "c", DependsOn: []string{"a"}},
+		{Name: "a", Task: "workflow_step", Args: "a"},
+	}})
+	assert.Nil(t, err)
+	failed, err := q.Submit(ctx, Workflow{Steps: []Step{
+		{Name: "a", Task: "workflow_step", Args: "fail"},
+		{Name: "b", Task: "workflow_step", Args: "b", DependsOn: []string{"a"}},
+	}})
+	assert.Nil(t, err)
+	_, err = q.Submit(ctx, Workflow{Steps: []Step{
+		{Name: "a", Task: "workflow_step", DependsOn: []string{"b"}},
+		{Name: "b", Task: "workflow_step", DependsOn: []string{"a"}},
+	}})
+	assert.NotNil(t, err)
+
+	// consume
+	q.Consume(q.WorkflowHandler())
+	defer closeQueue(t, q)
+
+	assert.Eventually(t, func() bool {
+		s, err := q.WorkflowStatus(ctx, id)
+		return err == nil && s.State == StepSucceeded
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		s, err := q.WorkflowStatus(ctx, failed)
+		return err == nil && s.State == StepFailed && s.Steps["b"] == StepPending
+	}, 2*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, ran, 5)
+	pos := make(map[string]int)
+	for i, name := range ran {
+		pos[name] = i
+	}
+	assert.True(t, pos["a"] < pos["b"] && pos["a"] < pos["c"])
+	assert.True(t, pos["b"] < pos["d"] && pos["c"] < pos["d"])
+}
+
+func TestConsumeSaga(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithRetryTimes(0))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ran := make(chan string, 10)
+	Register("saga_step", func(ctx context.Context, name string) error {
+		ran <- name
+		if name == "charge" {
+			return fmt.Errorf("mock error")
+		}
+		return nil
+	})
+
+	// submit, reserve -> ship -> charge
+	ctx := context.Background()
+	id, err := q.Submit(ctx, Workflow{Steps: []Step{
+		{Name: "reserve", Task: "saga_step", Args: "reserve", Compensate: "saga_step", CompensateArgs: "release"},
+		{Name: "ship", Task: "saga_step", Args: "ship", DependsOn: []string{"reserve"}, Compensate: "saga_step", CompensateArgs: "recall"},
+		{Name: "charge", Task: "saga_step", Args: "charge", DependsOn: []string{"ship"}},
+	}})
+	assert.Nil(t, err)
+
+	// consume
+	q.Consume(q.WorkflowHandler())
+	defer closeQueue(t, q)
+
+	for _, want := range []string{"reserve", "ship", "charge", "recall", "release"} {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("consume timeout")
+		case name := <-ran:
+			assert.Equal(t, want, name)
+		}
+	}
+	assert.Eventually(t, func() bool {
+		s, err := q.WorkflowStatus(ctx, id)
+		return err == nil && s.State == StepFailed && s.Steps["reserve"] == StepCompensated
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestConsumeSagaLate(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithRetryTimes(0))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ran := make(chan string, 10)
+	Register("saga_late_step", func(ctx context.Context, name string) error {
+		switch name {
+		case "fail":
+			return fmt.Errorf("mock error")
+		case "slow":
+			time.Sleep(100 * time.Millisecond)
+		}
+		ran <- name
+		return nil
+	})
+
+	// submit, slow succeeds after fail failed
+	ctx := context.Background()
+	id, err := q.Submit(ctx, Workflow{Steps: []Step{
+		{Name: "fail", Task: "saga_late_step", Args: "fail"},
+		{Name: "slow", Task: "saga_late_step", Args: "slow", Compensate: "saga_late_step", CompensateArgs: "undo"},
+		{Name: "after", Task: "saga_late_step", Args: "after", DependsOn: []string{"slow"}},
+	}})
+	assert.Nil(t, err)
+
+	// consume
+	q.Consume(q.WorkflowHandler())
+	defer closeQueue(t, q)
+
+	// the late step is compensated and its dependents are not started
+	for _, want := range []string{"slow", "undo"} {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("consume timeout")
+		case name := <-ran:
+			assert.Equal(t, want, name)
+		}
+	}
+	assert.Eventually(t, func() bool {
+		s, err := q.WorkflowStatus(ctx, id)
+		return err == nil && s.Steps["slow"] == StepCompensated && s.Steps["after"] == StepPending
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestConsumeGrouped(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	ctx := context.Background()
+	var id string
+	for _, p := range []string{"a", "b", "c"} {
+		r, err := q.ProduceGrouped(ctx, "u1", 200*time.Millisecond, &ProducerMessage{Payload: []byte(p)})
+		assert.Nil(t, err)
+		if id == "" {
+			id = r.ID
+		}
+		assert.Equal(t, id, r.ID)
+	}
+	_, err := q.ProduceGrouped(ctx, "u2", 200*time.Millisecond, &ProducerMessage{Payload: []byte("d")})
+	assert.Nil(t, err)
+
+	// consume
+	batches := make(chan *Message, 2)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		batches <- m
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	got := map[string][][]byte{}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-time.After(2 * time.Second):
+			t.Fatal("consume timeout")
+		case m := <-batches:
+			got[m.Group] = m.Batch
+		}
+	}
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, got["u1"])
+	assert.Equal(t, [][]byte{[]byte("d")}, got["u2"])
+}
+
+func TestConsumeGroupedEncoded(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithCodec(Gzip), WithChecksum())...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce, the payload is stored encoded
+	ctx := context.Background()
+	payload := []byte(strings.Repeat("grouped", 100))
+	r, err := q.ProduceGrouped(ctx, "u1", 50*time.Millisecond, &ProducerMessage{Payload: payload})
+	assert.Nil(t, err)
+	batch := q.key(kBatch) + ":" + r.ID
+	items, err := q.rdb.LRange(ctx, batch, 0, -1).Result()
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.NotContains(t, items[0], string(payload))
+
+	// consume
+	batches := make(chan *Message, 1)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		batches <- m
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("consume timeout")
+	case m := <-batches:
+		assert.Equal(t, [][]byte{payload}, m.Batch)
+	}
+
+	// the batch is deleted with the commit
+	assert.Eventually(t, func() bool {
+		n, err := q.rdb.Exists(ctx, batch).Result()
+		return err == nil && n == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestConsumeRoles(t *testing.T) {
+	// init
+	worker := New(append(testOpts(t), WithRole(WorkerOnly))...)
+	scheduler := New(append(testOpts(t), WithRole(SchedulerOnly))...)
+	defer t.Cleanup(func() { cleanup(t, worker) })
+
+	ctx := context.Background()
+	at := time.Now().Add(50 * time.Millisecond)
+	_, err := worker.Produce(ctx, &ProducerMessage{Payload: []byte("delay"), DeliverAt: &at})
+	assert.Nil(t, err)
+
+	// the worker doesn't move due messages
+	done := make(chan struct{}, 1)
+	worker.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		done <- struct{}{}
+		return nil
+	}))
+	defer closeQueue(t, worker)
+
+	select {
+	case <-time.After(300 * time.Millisecond):
+	case <-done:
+		t.Fatal("consumed without scheduler")
+	}
+
+	// the scheduler does
+	scheduler.Consume(nil)
+	defer closeQueue(t, scheduler)
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("consume timeout")
+	case <-done:
+	}
+}
+
+func TestConsumeWithoutDaemon(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithoutDaemon(), WithRetryTimes(2), WithRetryInterval(100*time.Millisecond))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	ok, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("ok")})
+	assert.Nil(t, err)
+	failed, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("fail")})
+	assert.Nil(t, err)
+
+	// consume
+	var mu sync.Mutex
+	var attempts []time.Time
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		if string(m.Payload) == "fail" {
+			mu.Lock()
+			attempts = append(attempts, time.Now())
+			mu.Unlock()
+			return fmt.Errorf("mock error")
+		}
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	// the failed message is retried after the retry interval, then dead,
+	// no retry key is created
+	assert.Eventually(t, func() bool {
+		dead, err := q.rdb.ZRange(ctx, q.key(kDead), 0, -1).Result()
+		return err == nil && len(dead) == 1 && dead[0] == failed.ID
+	}, 2*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	if assert.Len(t, attempts, 3) {
+		assert.GreaterOrEqual(t, attempts[1].Sub(attempts[0]), 100*time.Millisecond)
+		assert.GreaterOrEqual(t, attempts[2].Sub(attempts[1]), 100*time.Millisecond)
+	}
+	mu.Unlock()
+	assert.Eventually(t, func() bool {
+		m, err := q.GetMessage(ctx, ok.ID)
+		return err == nil && m == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(0), q.rdb.Exists(ctx, q.key(kRetry)).Val())
+}
+
+func TestConsumeWithoutDaemonReclaim(t *testing.T) {
+	// init, a worker without daemon and a reclaimer with daemon in one fleet
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+	w := New(WithName(q.name), WithoutDaemon(), WithConsumerWorkerNum(1))
+
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("untracked")})
+	assert.Nil(t, err)
+
+	// the only worker takes the message without tracking it in retry
+	taken := make(chan struct{})
+	release := make(chan struct{})
+	w.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		// the internal mark is not an unknown field
+		assert.Nil(t, m.Extra)
+		close(taken)
+		<-release
+		return nil
+	}))
+	defer closeQueue(t, w)
+	defer close(release)
+	<-taken
+	assert.Equal(t, int64(0), q.rdb.ZCard(ctx, q.key(kRetry)).Val())
+
+	// reclaimed by the reclaimer with daemon
+	assert.Nil(t, q.deregisterInstance(ctx, w.instanceID))
+	ready, err := q.rdb.LRange(ctx, q.key(kReady), 0, -1).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{r.ID}, ready)
+}
+
+func TestConsumeTransform(t *testing.T) {
+	// init, payloads are compressed by the application and of schema v1
+	upgrade := func(ctx context.Context, m *Message) error {
+		m.Payload = append(m.Payload, []byte("_v2")...)
+		return nil
+	}
+	q := New(append(testOpts(t), WithTransformers("order", DecodeWith(Gzip), upgrade))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	payload, err := Gzip.Encode([]byte("order_v1"))
+	assert.Nil(t, err)
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: payload, Kind: "order"})
+	assert.Nil(t, err)
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("other")})
+	assert.Nil(t, err)
+
+	// consume
+	payloads := make(chan string, 2)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		payloads <- string(m.Payload)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("consume timeout")
+		case p := <-payloads:
+			got = append(got, p)
+		}
+	}
+	assert.ElementsMatch(t, []string{"order_v1_v2", "other"}, got)
+}
+
+func TestConsumeUnknownFields(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce, a newer version writes a field unknown to this one
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("unknown")})
+	assert.Nil(t, err)
+	assert.Nil(t, q.rdb.HSet(ctx, q.key(kData)+":"+r.ID, "future_field", "v").Err())
+
+	// consume, the field is kept when retried
+	extras := make(chan map[string]string, 2)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		extras <- m.Extra
+		if m.DeliverCnt == 1 {
+			return RetryAfter(fmt.Errorf("mock error"), 10*time.Millisecond)
+		}
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("consume timeout")
+		case extra := <-extras:
+			assert.Equal(t, map[string]string{"future_field": "v"}, extra)
+		}
+	}
+
+	// written again with the message
+	m := Message{ID: "id", Extra: map[string]string{"future_field": "v"}}
+	assert.Contains(t, m.values(), "future_field")
+}
+
+func TestConsumeSLA(t *testing.T) {
+	// init
+	missed := make(chan string, 2)
+	q := New(append(testOpts(t),
+		WithDefaultSLA(10*time.Second),
+		WithOnSLAMiss(func(ctx context.Context, m *Message, latency time.Duration) {
+			assert.Greater(t, latency, m.SLA)
+			missed <- m.ID
+		}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	late, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("late"), SLA: time.Millisecond})
+	assert.Nil(t, err)
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("in time")})
+	assert.Nil(t, err)
+
+	// consume
+	var cnt int32
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&cnt, 1)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("sla miss timeout")
+	case id := <-missed:
+		assert.Equal(t, late.ID, id)
+	}
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&cnt) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Empty(t, missed)
+}
+
+func TestConsumeInline(t *testing.T) {
+	// init, no redis is needed
+	q := New(append(testOpts(t),
+		WithRedis(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})),
+		WithInlineMode(),
+	)...)
+
+	ctx := context.Background()
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("early")})
+	assert.NotNil(t, err)
+
+	var got []string
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		if string(m.Payload) == "fail" {
+			return errors.New("fail")
+		}
+		got = append(got, string(m.Payload))
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	at := time.Now().Add(time.Hour)
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("a"), DeliverAt: &at})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, r.ID)
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("b"), DedupID: "b"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, got)
+
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("fail")})
+	assert.NotNil(t, err)
+}
+
+func TestConsumeRecordReplay(t *testing.T) {
+	// init
+	var buf bytes.Buffer
+	q := New(append(testOpts(t), WithRecorder(&buf))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	for _, p := range []string{"a", "b"} {
+		_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte(p), Kind: "k"})
+		assert.Nil(t, err)
+	}
+
+	// consume and record
+	var cnt int32
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		atomic.AddInt32(&cnt, 1)
+		return nil
+	}))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&cnt) == 2 }, time.Second, 10*time.Millisecond)
+	closeQueue(t, q)
+
+	// replay
+	var got []string
+	err := q.Replay(ctx, bytes.NewReader(buf.Bytes()), HandlerFunc(func(ctx context.Context, m *Message) error {
+		assert.Equal(t, "k", m.Kind)
+		assert.Equal(t, 1, m.DeliverCnt)
+		got = append(got, string(m.Payload))
+		return nil
+	}))
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, got)
+
+	err = q.Replay(ctx, bytes.NewReader(buf.Bytes()), HandlerFunc(func(ctx context.Context, m *Message) error {
+		return errors.New("bug")
+	}))
+	assert.NotNil(t, err)
+}
+
+func TestConsumeAsyncCommit(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithAsyncCommit())...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 20; i++ {
+		r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte(strconv.Itoa(i))})
+		assert.Nil(t, err)
+		ids = append(ids, r.ID)
+	}
+
+	// consume
+	var cnt int32
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		atomic.AddInt32(&cnt, 1)
+		return nil
+	}))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&cnt) == 20 }, time.Second, 10*time.Millisecond)
+	closeQueue(t, q)
+
+	// all committed before closed
+	assert.Equal(t, int64(20), q.counters.processed.Load())
+	for _, id := range ids {
+		m, err := q.GetMessage(ctx, id)
+		assert.Nil(t, err)
+		assert.Nil(t, m)
+	}
+}
+
+func TestConsumeWaitCompletion(t *testing.T) {
+	// init
+	q := New(append(testOpts(t),
+		WithCompletionNotify(),
+		WithRetryMatrix(map[ErrorClass]RetryPolicy{ErrorClassValidation: {DeadLetter: true}}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	ok, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("ok")})
+	assert.Nil(t, err)
+	bad, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("bad")})
+	assert.Nil(t, err)
+	at := time.Now().Add(time.Hour)
+	canceled, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("canceled"), DeliverAt: &at})
+	assert.Nil(t, err)
+
+	// wait before consumed
+	outcomes := make(chan Outcome, 2)
+	for _, id := range []string{ok.ID, bad.ID} {
+		go func(id string) {
+			ctx, c := context.WithTimeout(ctx, time.Second)
+			defer c()
+			o, err := q.WaitCompletion(ctx, id)
+			assert.Nil(t, err)
+			outcomes <- o
+		}(id)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		if string(m.Payload) == "bad" {
+			return Classify(errors.New("bad payload"), ErrorClassValidation)
+		}
+		return nil
+	}))
+	defer closeQueue(t, q)
+	assert.ElementsMatch(t, []Outcome{OutcomeCommitted, OutcomeDead}, []Outcome{<-outcomes, <-outcomes})
+
+	// wait after completed
+	o, err := q.WaitCompletion(ctx, bad.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, OutcomeDead, o)
+	assert.Nil(t, q.Cancel(ctx, canceled.ID))
+	o, err = q.WaitCompletion(ctx, canceled.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, OutcomeCanceled, o)
+
+	// wait before canceled without trash
+	nq := New(append(testOpts(t), WithCompletionNotify(), WithTrashWindow(0))...)
+	deleted, err := nq.Produce(ctx, &ProducerMessage{Payload: []byte("deleted"), DeliverAt: &at})
+	assert.Nil(t, err)
+	go func() {
+		ctx, c := context.WithTimeout(ctx, time.Second)
+		defer c()
+		o, err := nq.WaitCompletion(ctx, deleted.ID)
+		assert.Nil(t, err)
+		outcomes <- o
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, nq.Cancel(ctx, deleted.ID))
+	assert.Equal(t, OutcomeCanceled, <-outcomes)
+}
+
+func TestConsumeTimeoutFunc(t *testing.T) {
+	// init, the timeout doubles from 1s by attempt
+	q := New(append(testOpts(t),
+		WithConsumerTimeoutFunc(func(attempt int) time.Duration {
+			return time.Second << (attempt - 1)
+		}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	_, err := q.Produce(ctx, &ProducerMessage{
+		Payload: []byte("cold cache"),
+		Redrive: &RedrivePolicy{MaxRetries: 2, Interval: 10 * time.Millisecond},
+	})
+	assert.Nil(t, err)
+
+	// consume, fails on the first attempt only
+	timeouts := make(chan time.Duration, 2)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		deadline, _ := ctx.Deadline()
+		timeouts <- time.Until(deadline)
+		if m.DeliverCnt == 1 {
+			return errors.New("cold cache")
+		}
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	for _, want := range []time.Duration{time.Second, 2 * time.Second} {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("consume timeout")
+		case d := <-timeouts:
+			assert.InDelta(t, want, d, float64(100*time.Millisecond))
+		}
+	}
+}
+
+func TestConsumeAnnotate(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{
+		Payload: []byte("annotate"),
+		Redrive: &RedrivePolicy{MaxRetries: 2, Interval: 10 * time.Millisecond},
+	})
+	assert.Nil(t, err)
+
+	// consume, the retry sees how far the first attempt got
+	got := make(chan map[string]string, 2)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- m.Annotations
+		if m.DeliverCnt == 1 {
+			assert.Nil(t, m.Annotate(ctx, "stage", "validated"))
+			return errors.New("downstream failed")
+		}
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	for _, want := range []map[string]string{nil, {"stage": "validated"}} {
+		select {
+		case <-time.After(3 * time.Second):
+			t.Fatal("consume timeout")
+		case a := <-got:
+			assert.Equal(t, want, a)
+		}
+	}
+
+	m := &Message{ID: r.ID}
+	assert.NotNil(t, m.Annotate(ctx, "stage", "done"))
+
+	// the data of a committed message is not recreated
+	assert.Eventually(t, func() bool {
+		return q.rdb.Exists(ctx, q.key(kData)+":"+r.ID).Val() == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.NotNil(t, q.saver(r.ID)(ctx, annotationPrefix+"stage", "done"))
+	assert.Zero(t, q.rdb.Exists(ctx, q.key(kData)+":"+r.ID).Val())
+}
+
+func TestConsumeCheckpoint(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	_, err := q.Produce(ctx, &ProducerMessage{
+		Payload: []byte("stages"),
+		Redrive: &RedrivePolicy{MaxRetries: 3, Interval: 10 * time.Millisecond},
+	})
+	assert.Nil(t, err)
+
+	// consume, every attempt finishes a stage before failing
+	var stages []string
+	done := make(chan struct{})
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		stage, _ := strconv.Atoi(string(m.Checkpoint))
+		stages = append(stages, strconv.Itoa(stage))
+		if stage == 2 {
+			close(done)
+			return nil
+		}
+		assert.Nil(t, m.SaveCheckpoint(ctx, []byte(strconv.Itoa(stage+1))))
+		return errors.New("transient")
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(3 * time.Second):
+		t.Fatal("consume timeout")
+	case <-done:
+	}
+	assert.Equal(t, []string{"0", "1", "2"}, stages)
+}
+
+func TestConsumeDryRun(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithDryRun())...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("dry")})
+	assert.Nil(t, err)
+
+	// consume, fail every other delivery
+	var cnt int32
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		assert.Equal(t, 1, m.DeliverCnt)
+		if atomic.AddInt32(&cnt, 1)%2 == 0 {
+			return fmt.Errorf("mock err")
+		}
+		return nil
+	}))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&cnt) >= 4 }, 3*time.Second, 10*time.Millisecond)
+	closeQueue(t, q)
+
+	// the message is back in ready, neither committed nor retried
+	m, err := q.GetMessage(ctx, r.ID)
+	assert.Nil(t, err)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, 0, m.DeliverCnt)
+		assert.Equal(t, 0, m.ErrRetryCnt)
+	}
+	assert.Equal(t, []string{r.ID}, q.rdb.LRange(ctx, q.key(kReady), 0, -1).Val())
+	assert.Zero(t, q.rdb.ZCard(ctx, q.key(kRetry)).Val())
+}
+
+func TestConsumeDryRunNext(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithDryRun(), WithConsumerWorkerNum(1))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	for _, p := range []string{"first", "second"} {
+		_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte(p)})
+		assert.Nil(t, err)
+	}
+
+	// consume, the rolled back message is not taken again before the second one
+	var seen sync.Map
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		seen.Store(string(m.Payload), true)
+		return nil
+	}))
+	assert.Eventually(t, func() bool {
+		_, ok := seen.Load("second")
+		return ok
+	}, 1*time.Second, 10*time.Millisecond)
+	closeQueue(t, q)
+}
+
+func TestConsumeContext(t *testing.T) {
+	// startup failure is returned
+	ctx := context.Background()
+	bad := New(append(testOpts(t), WithRedis(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})))...)
+	assert.NotNil(t, bad.ConsumeContext(ctx, HandlerFunc(func(ctx context.Context, m *Message) error { return nil })))
+
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// consume until canceled
+	cctx, cancel := context.WithCancel(ctx)
+	dataCh := make(chan string, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.ConsumeContext(cctx, HandlerFunc(func(ctx context.Context, m *Message) error {
+			dataCh <- m.ID
+			return nil
+		}))
+	}()
+
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("context")})
+	assert.Nil(t, err)
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("consume timeout")
+	case id := <-dataCh:
+		assert.Equal(t, r.ID, id)
+	}
+
+	cancel()
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("close timeout")
+	case err := <-errCh:
+		assert.Nil(t, err)
+	}
+}
@@ -10,6 +10,14 @@ func (q *Queue) daemon(ctx context.Context) {
 	var wg sync.WaitGroup
 	wg.Add(q.daemonWorkerNum)
 
+	if q.retentionInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.retain(ctx)
+		}()
+	}
+
 	for i := 0; i < q.daemonWorkerNum; i++ {
 		go func(i int) {
 			ticker := time.NewTicker(q.daemonWorkerInterval)
@@ -25,35 +33,63 @@ func (q *Queue) daemon(ctx context.Context) {
 
 				go func() {
 					ctx := context.Background()
-					cnt, err := q.rdb.runZsetToList(ctx, q.key(kDelay), q.key(kReady), time.Now())
+					start := time.Now()
+					var ids []string
+					var earliest time.Time
+					var err error
+					if q.gate != nil {
+						// ticks outlasted by a slow gate are skipped,
+						// so the gate is not called twice for a message
+						if !q.gating.CompareAndSwap(false, true) {
+							return
+						}
+						defer q.gating.Store(false)
+						ids, earliest, err = q.gateDelayToReady(ctx, start)
+					} else {
+						ids, earliest, err = q.rdb.runZsetToList(ctx, q.key(kDelay), q.key(kReady), q.key(kAudit), q.auditMaxLen, EventDue, start)
+					}
 					if err != nil {
 						q.log(ctx, Warn, "daemon, delay to ready failed, err: %v", err)
 						return
 					}
-					if cnt > 0 {
-						q.log(ctx, Trace, "daemon, delay to ready, cnt: %d", cnt)
+					q.tick(ctx, "delay", ids, start, earliest)
+					if len(ids) > 0 {
+						q.trimReady(ctx)
 					}
 				}()
 
 				go func() {
 					ctx := context.Background()
-					cnt, err := q.rdb.runZsetToList(ctx, q.key(kRetry), q.key(kReady), time.Now())
+					start := time.Now()
+					ids, earliest, err := q.rdb.runZsetToList(ctx, q.key(kRetry), q.key(kReady), q.key(kAudit), 0, "", start)
 					if err != nil {
 						q.log(ctx, Warn, "daemon, retry to ready failed, err: %v", err)
 						return
 					}
+					q.tick(ctx, "retry", ids, start, earliest)
+				}()
+
+				// cold messages are promoted even without cold tier,
+				// as they may be produced by producers with one
+				go func() {
+					ctx := context.Background()
+					cnt, err := q.rdb.runZsetToZset(ctx, q.key(kCold), q.key(kDelay), time.Now().Add(q.promoteHorizon()))
+					if err != nil {
+						q.log(ctx, Warn, "daemon, cold to delay failed, err: %v", err)
+						return
+					}
 					if cnt > 0 {
-						q.log(ctx, Trace, "daemon, retry to ready, cnt: %d", cnt)
+						q.log(ctx, Trace, "daemon, cold to delay, cnt: %d", cnt)
 					}
 				}()
 
 				go func() {
 					ctx := context.Background()
 					if q.opts.metric != nil {
-						go q.opts.metric.Queue(
-							int(q.rdb.LLen(ctx, q.key(kReady)).Val()),
-							int(q.rdb.ZCard(ctx, q.key(kDelay)).Val()),
-							int(q.rdb.ZCard(ctx, q.key(kRetry)).Val()))
+						ready := int(q.rdb.LLen(ctx, q.key(kReady)).Val())
+						delay := int(q.rdb.ZCard(ctx, q.key(kDelay)).Val())
+						retry := int(q.rdb.ZCard(ctx, q.key(kRetry)).Val())
+						q.emitMetric(func() { q.opts.metric.Queue(ready, delay, retry) })
 					}
 				}()
 			}
@@ -63,3 +99,28 @@ func (q *Queue) daemon(ctx context.Context) {
 	wg.Wait()
 	q.log(context.Background(), Trace, "all daemon worker exited")
 }
+
+// defaultPromoteHorizon is the horizon cold messages are promoted within by
+// daemons without cold tier.
+const defaultPromoteHorizon = time.Minute
+
+// promoteHorizon is the horizon the daemon promotes cold messages within.
+func (q *Queue) promoteHorizon() time.Duration {
+	if q.coldHorizon > 0 {
+		return q.coldHorizon
+	}
+	return defaultPromoteHorizon
+}
+
+// tick logs and reports the due messages moved from the zset by a daemon tick started at start.
+func (q *Queue) tick(ctx context.Context, from string, ids []string, start, earliest time.Time) {
+	elapsed := time.Since(start)
+	var lag time.Duration
+	if len(ids) > 0 {
+		lag = start.Add(elapsed).Sub(earliest)
+		q.log(ctx, Trace, "daemon, %s to ready, cnt: %d, elapsed: %s, lag: %s", from, len(ids), elapsed, lag)
+	}
+	if dm, ok := q.opts.metric.(DaemonMetric); ok {
+		q.emitMetric(func() { dm.Tick(from, len(ids), elapsed, lag) })
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,12 +32,12 @@ func TestDaemonDelayToReady(t *testing.T) {
 	num := 10
 	at := time.Now().Add(10 * time.Millisecond)
 	for i := 0; i < num; i++ {
-		id, err := q.Produce(context.Background(), &ProducerMessage{
+		r, err := q.Produce(context.Background(), &ProducerMessage{
 			Payload:   []byte("delay_" + strconv.Itoa(i)),
 			DeliverAt: &at,
 		})
 		assert.Nil(t, err)
-		t.Log("produce:", id)
+		t.Log("produce:", r.ID)
 	}
 
 	// consume
@@ -75,11 +77,11 @@ func TestDaemonRetryToReady(t *testing.T) {
 	// produce
 	num := 10
 	for i := 0; i < num; i++ {
-		id, err := q.Produce(context.Background(), &ProducerMessage{
+		r, err := q.Produce(context.Background(), &ProducerMessage{
 			Payload: []byte("ready_" + strconv.Itoa(i)),
 		})
 		assert.Nil(t, err)
-		t.Log("produce:", id)
+		t.Log("produce:", r.ID)
 	}
 
 	// consume
@@ -107,3 +109,302 @@ func TestDaemonRetryToReady(t *testing.T) {
 	case <-done:
 	}
 }
+
+func TestDaemonGate(t *testing.T) {
+	// init, the gate postpones every message once
+	var mu sync.Mutex
+	gated := map[string]bool{}
+	q := New(append(testOpts(t),
+		WithGate(func(ctx context.Context, m *Message) (time.Time, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if gated[m.ID] {
+				return time.Time{}, nil
+			}
+			gated[m.ID] = true
+			return time.Now().Add(100 * time.Millisecond), nil
+		}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	at := time.Now().Add(10 * time.Millisecond)
+	r, err := q.Produce(context.Background(), &ProducerMessage{
+		Payload:   []byte("gated"),
+		DeliverAt: &at,
+	})
+	assert.Nil(t, err)
+
+	// consume
+	got := make(chan time.Time, 1)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- time.Now()
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatal("consume timeout")
+	case consumeAt := <-got:
+		assert.True(t, consumeAt.Sub(at) >= 100*time.Millisecond)
+		mu.Lock()
+		assert.True(t, gated[r.ID])
+		mu.Unlock()
+	}
+}
+
+func TestDaemonGateError(t *testing.T) {
+	// init, the gate fails the bad message
+	q := New(append(testOpts(t),
+		WithRetryInterval(time.Minute),
+		WithGate(func(ctx context.Context, m *Message) (time.Time, error) {
+			if string(m.Payload) == "bad" {
+				return time.Time{}, fmt.Errorf("mock err")
+			}
+			return time.Time{}, nil
+		}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce, the bad message is due first
+	ctx := context.Background()
+	at := time.Now().Add(50 * time.Millisecond)
+	bad, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("bad"), DeliverAt: &at})
+	assert.Nil(t, err)
+	at = at.Add(10 * time.Millisecond)
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("good"), DeliverAt: &at})
+	assert.Nil(t, err)
+
+	// consume
+	got := make(chan string, 2)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- string(m.Payload)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	// the good message is delivered, the bad one is postponed by the retry interval
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatal("consume timeout")
+	case p := <-got:
+		assert.Equal(t, "good", p)
+	}
+	score, err := q.rdb.ZScore(ctx, q.key(kDelay), bad.ID).Result()
+	assert.Nil(t, err)
+	assert.Greater(t, score, float64(time.Now().Add(30*time.Second).UnixMilli()))
+}
+
+func TestDaemonGateSlow(t *testing.T) {
+	// init, the gate outlasts several ticks
+	var running, overlaps int32
+	var mu sync.Mutex
+	calls := map[string]int{}
+	q := New(append(testOpts(t),
+		WithDaemonWorkerInterval(10*time.Millisecond),
+		WithGate(func(ctx context.Context, m *Message) (time.Time, error) {
+			if atomic.AddInt32(&running, 1) > 1 {
+				atomic.AddInt32(&overlaps, 1)
+			}
+			defer atomic.AddInt32(&running, -1)
+			mu.Lock()
+			calls[m.ID]++
+			mu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			return time.Time{}, nil
+		}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	ctx := context.Background()
+	at := time.Now().Add(100 * time.Millisecond)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte(strconv.Itoa(i)), DeliverAt: &at})
+		assert.Nil(t, err)
+		ids = append(ids, r.ID)
+	}
+
+	// consume
+	var cnt int32
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		atomic.AddInt32(&cnt, 1)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	// every message is gated once, one at a time
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&cnt) == 3 }, 2*time.Second, 10*time.Millisecond)
+	assert.Zero(t, atomic.LoadInt32(&overlaps))
+	mu.Lock()
+	defer mu.Unlock()
+	for _, id := range ids {
+		assert.Equal(t, 1, calls[id])
+	}
+}
+
+func TestDaemonColdToDelay(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithColdTier(200*time.Millisecond))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce beyond the horizon
+	at := time.Now().Add(500 * time.Millisecond)
+	r, err := q.Produce(context.Background(), &ProducerMessage{
+		Payload:   []byte("cold"),
+		DeliverAt: &at,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, -1, r.QueuePositionEstimate)
+
+	stats, err := q.Stats(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), stats.Cold)
+	assert.Equal(t, int64(0), stats.Delay)
+
+	// consume
+	got := make(chan time.Time, 1)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- time.Now()
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("consume timeout")
+	case consumeAt := <-got:
+		assert.True(t, !consumeAt.Before(at.Truncate(time.Millisecond)))
+	}
+}
+
+func TestDaemonColdWithoutTier(t *testing.T) {
+	// init, only the producer has a cold tier
+	p := New(append(testOpts(t), WithColdTier(200*time.Millisecond))...)
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	at := time.Now().Add(500 * time.Millisecond)
+	_, err := p.Produce(context.Background(), &ProducerMessage{Payload: []byte("cold"), DeliverAt: &at})
+	assert.Nil(t, err)
+
+	// consume, promoted by the daemon without cold tier
+	got := make(chan struct{}, 1)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- struct{}{}
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("consume timeout")
+	case <-got:
+	}
+}
+
+func TestDaemonRetention(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithRetention(time.Hour, time.Minute))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("dead")})
+		assert.Nil(t, err)
+		assert.Nil(t, q.rdb.runDeadLetter(ctx, q.key(kRetry), q.key(kDead), q.key(kData), r.ID, "mock"))
+		ids = append(ids, r.ID)
+	}
+	// the last one is recent
+	assert.Nil(t, q.rdb.ZAdd(ctx, q.key(kDead), redis.Z{Score: float64(time.Now().Add(2 * time.Hour).UnixMilli()), Member: ids[2]}).Err())
+
+	q.enforceRetention(ctx, time.Now().Add(2*time.Hour))
+
+	dead, err := q.rdb.ZRange(ctx, q.key(kDead), 0, -1).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{ids[2]}, dead)
+	assert.Equal(t, int64(0), q.rdb.Exists(ctx, q.key(kData)+":"+ids[0], q.key(kData)+":"+ids[1]).Val())
+	assert.Equal(t, int64(1), q.rdb.Exists(ctx, q.key(kData)+":"+ids[2]).Val())
+}
+
+func TestDaemonDeadLetterMaxLen(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithDeadLetterMaxLen(2))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("dead")})
+		assert.Nil(t, err)
+		assert.Nil(t, q.rdb.runDeadLetter(ctx, q.key(kRetry), q.key(kDead), q.key(kData), r.ID, "mock"))
+		assert.Nil(t, q.rdb.ZAdd(ctx, q.key(kDead), redis.Z{Score: float64(time.Now().UnixMilli() + int64(i)), Member: r.ID}).Err())
+		ids = append(ids, r.ID)
+	}
+
+	q.enforceRetention(ctx, time.Now())
+
+	// the oldest one is removed
+	dead, err := q.rdb.ZRange(ctx, q.key(kDead), 0, -1).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, ids[1:], dead)
+	assert.Equal(t, int64(0), q.rdb.Exists(ctx, q.key(kData)+":"+ids[0]).Val())
+	assert.Equal(t, int64(2), q.rdb.Exists(ctx, q.key(kData)+":"+ids[1], q.key(kData)+":"+ids[2]).Val())
+}
+
+func TestDaemonRetentionExpired(t *testing.T) {
+	// init, the messages are saved for a minute
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	now := time.Now()
+	old := float64(now.Add(-2 * time.Hour).UnixMilli())
+	assert.Nil(t, q.rdb.ZAdd(ctx, q.key(kDead), redis.Z{Score: old, Member: "expired"}, redis.Z{Score: float64(now.UnixMilli()), Member: "dead"}).Err())
+	assert.Nil(t, q.rdb.ZAdd(ctx, q.key(kTrash), redis.Z{Score: old, Member: "expired"}, redis.Z{Score: float64(now.UnixMilli()), Member: "canceled"}).Err())
+
+	q.enforceRetention(ctx, now)
+
+	// entries whose data has expired are pruned
+	assert.Equal(t, []string{"dead"}, q.rdb.ZRange(ctx, q.key(kDead), 0, -1).Val())
+	assert.Equal(t, []string{"canceled"}, q.rdb.ZRange(ctx, q.key(kTrash), 0, -1).Val())
+}
+
+type tickMetric struct {
+	errMetric
+	ticks chan [2]time.Duration
+}
+
+func (m *tickMetric) Tick(from string, moved int, elapsed, lag time.Duration) {
+	if from == "delay" && moved > 0 {
+		m.ticks <- [2]time.Duration{elapsed, lag}
+	}
+}
+
+func TestDaemonTick(t *testing.T) {
+	// init
+	m := &tickMetric{ticks: make(chan [2]time.Duration, 10)}
+	q := New(append(testOpts(t), WithMetric(m))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce a message due a second ago
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	at := time.Now().Add(time.Hour)
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("late"), DeliverAt: &at})
+	assert.Nil(t, err)
+	assert.Nil(t, q.rdb.ZAddXX(ctx, q.key(kDelay), redis.Z{Score: float64(time.Now().Add(-time.Second).UnixMilli()), Member: r.ID}).Err())
+
+	go q.daemon(ctx)
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("tick timeout")
+	case tick := <-m.ticks:
+		assert.Greater(t, tick[0], time.Duration(0))
+		assert.GreaterOrEqual(t, tick[1], time.Second)
+	}
+}
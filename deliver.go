@@ -0,0 +1,84 @@
+package dq
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrInvalidDeliverAt is returned by Produce if DeliverAt is out of the bounds
+// set by WithDeliverAtBounds, which is usually a zone or unit bug of the producer.
+var ErrInvalidDeliverAt = errors.New("invalid deliver at")
+
+// ErrMaxDelayExceeded is returned by Produce if DeliverAt is beyond the max delay,
+// it is also an ErrInvalidDeliverAt.
+var ErrMaxDelayExceeded = fmt.Errorf("%w: max delay exceeded", ErrInvalidDeliverAt)
+
+// DeliverAtIn parses value in the IANA time zone tz, e.g. "Asia/Shanghai",
+// rather than the zone of the producer machine.
+// The zone in value, if any, takes precedence as in time.ParseInLocation.
+func DeliverAtIn(layout, value, tz string) (*time.Time, error) {
+	loc, err := loadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("load location failed, err: %v", err)
+	}
+	t, err := time.ParseInLocation(layout, value, loc)
+	if err != nil {
+		return nil, fmt.Errorf("parse deliver at failed, err: %v", err)
+	}
+	return &t, nil
+}
+
+// checkDeliverAt rejects deliver at too far in the past or future of now.
+func (q *Queue) checkDeliverAt(now time.Time, at *time.Time) error {
+	if at == nil {
+		return nil
+	}
+	if q.deliverAtMaxPast > 0 && at.Before(now.Add(-q.deliverAtMaxPast)) {
+		return fmt.Errorf("%w: %s is more than %s in the past", ErrInvalidDeliverAt, at.Format(time.RFC3339), q.deliverAtMaxPast)
+	}
+	if future := q.maxFuture(); future > 0 && at.After(now.Add(future)) {
+		return fmt.Errorf("%w, %s is more than %s in the future", ErrMaxDelayExceeded, at.Format(time.RFC3339), future)
+	}
+	return nil
+}
+
+// maxFuture returns the stricter of the future bound and the max delay,
+// 0 if neither is set.
+func (q *Queue) maxFuture() time.Duration {
+	future := q.deliverAtMaxFuture
+	if q.maxDelay > 0 && (future <= 0 || q.maxDelay < future) {
+		future = q.maxDelay
+	}
+	return future
+}
+
+// zoneName returns the name of loc stored with the message,
+// empty if loc is not an IANA zone other machines can load.
+func zoneName(loc *time.Location) string {
+	name := loc.String()
+	if name == "Local" || name == "" {
+		return ""
+	}
+	if _, err := loadLocation(name); err != nil {
+		return ""
+	}
+	return name
+}
+
+// locations caches the loaded zones by name, time.LoadLocation reads
+// the zoneinfo database on every call.
+var locations sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
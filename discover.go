@@ -0,0 +1,48 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// QueueInfo describes a queue found by Discover.
+type QueueInfo struct {
+	Name  string
+	Stats *Stats
+}
+
+// Discover lists the queues under the redis key prefix with their stats,
+// a queue is found as long as any of its lists, zsets or registry exists.
+func Discover(ctx context.Context, client *redis.Client, prefix string) ([]QueueInfo, error) {
+	// the keys of the queue named "*" are patterns matching all queues
+	all := New(WithRedis(client), WithRedisKeyPrefix(prefix), WithName("*"))
+
+	names := map[string]struct{}{}
+	for _, k := range []redisKey{kReady, kDelay, kRetry, kCold, kDead, kInstances} {
+		pattern := all.key(k)
+		head := strings.TrimSuffix(pattern, "*")
+
+		iter := client.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			names[strings.TrimPrefix(iter.Val(), head)] = struct{}{}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, fmt.Errorf("scan queues failed, err: %v", err)
+		}
+	}
+
+	infos := make([]QueueInfo, 0, len(names))
+	for name := range names {
+		s, err := New(WithRedis(client), WithRedisKeyPrefix(prefix), WithName(name)).Stats(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("queue %s, %v", name, err)
+		}
+		infos = append(infos, QueueInfo{Name: name, Stats: s})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
@@ -0,0 +1,20 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+)
+
+// rollback pushes the message processed in dry-run back to the tail of ready
+// as if it was never taken, the handler error is only logged.
+func (q *Queue) rollback(ctx context.Context, m *Message, herr error) error {
+	if herr != nil {
+		q.log(ctx, Info, "dry-run message %s failed, err: %v", m.ID, herr)
+	} else {
+		q.log(ctx, Trace, "dry-run message %s succeeded", m.ID)
+	}
+	if err := q.rdb.runRollback(ctx, q.key(kReady), q.retryKey(), q.key(kData), q.inflightKey(q.instanceID), m.ID, q.dequeueOrder); err != nil {
+		return fmt.Errorf("rollback message failed, err: %v", err)
+	}
+	return nil
+}
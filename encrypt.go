@@ -0,0 +1,239 @@
+package dq
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// KeyedCodec is a Codec with multiple keys, the key ID is stored in the
+// encoded payload, so messages encoded with a retired key can still be decoded.
+type KeyedCodec interface {
+	Codec
+	// KeyID returns the ID of the key the payload is encoded with.
+	KeyID(payload []byte) (string, error)
+	// ActiveKeyID returns the ID of the key used to encode.
+	ActiveKeyID() string
+}
+
+// AESGCM encrypts payload with AES-GCM, the encoded payload is
+// len(key ID) | key ID | nonce | ciphertext.
+type AESGCM struct {
+	active string
+	aeads  map[string]cipher.AEAD
+}
+
+// NewAESGCM returns the codec encrypting with the active key and decrypting
+// with any of keys, keys are 16, 24 or 32 bytes.
+func NewAESGCM(active string, keys map[string][]byte) (*AESGCM, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %s not found", active)
+	}
+
+	c := &AESGCM{active: active, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s, new cipher failed, err: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %s, new gcm failed, err: %v", id, err)
+		}
+		c.aeads[id] = aead
+	}
+	return c, nil
+}
+
+func (c *AESGCM) Name() string { return "aesgcm" }
+
+func (c *AESGCM) ActiveKeyID() string { return c.active }
+
+func (c *AESGCM) Encode(b []byte) ([]byte, error) {
+	aead := c.aeads[c.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{byte(len(c.active))}, c.active...)
+	header = append(header, nonce...)
+	return aead.Seal(header, nonce, b, nil), nil
+}
+
+func (c *AESGCM) Decode(b []byte) ([]byte, error) {
+	id, err := c.KeyID(b)
+	if err != nil {
+		return nil, err
+	}
+	aead, ok := c.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %s", id)
+	}
+
+	b = b[1+len(id):]
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("payload too short")
+	}
+	return aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+}
+
+func (c *AESGCM) KeyID(b []byte) (string, error) {
+	if len(b) == 0 || len(b) < 1+int(b[0]) {
+		return "", errors.New("payload too short")
+	}
+	return string(b[1 : 1+int(b[0])]), nil
+}
+
+// Recode re-encodes the stored pending messages with the current codec,
+// e.g. after rotating the key of a KeyedCodec, so old keys can be retired.
+// The payloads of pending batches of grouped messages are re-encoded too.
+// Payloads already encoded with the current codec and key are skipped.
+// It returns the number of re-encoded payloads.
+func (q *Queue) Recode(ctx context.Context) (int, error) {
+	var cnt int
+	iter := q.rdb.Scan(ctx, 0, escapeGlob(q.key(kData))+":*", 100).Iterator()
+	for iter.Next(ctx) {
+		ok, err := q.recode(ctx, iter.Val())
+		if err != nil {
+			return cnt, err
+		}
+		if ok {
+			cnt++
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return cnt, fmt.Errorf("scan messages failed, err: %v", err)
+	}
+
+	iter = q.rdb.Scan(ctx, 0, escapeGlob(q.key(kBatch))+":*", 100).Iterator()
+	for iter.Next(ctx) {
+		n, err := q.recodeBatch(ctx, iter.Val())
+		cnt += n
+		if err != nil {
+			return cnt, err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return cnt, fmt.Errorf("scan batches failed, err: %v", err)
+	}
+	return cnt, nil
+}
+
+// recodeBatch re-encodes the items of the batch list key, and returns the
+// number of re-encoded items.
+func (q *Queue) recodeBatch(ctx context.Context, key string) (int, error) {
+	// the batches of the queues named with the name as a prefix are skipped
+	if strings.Contains(strings.TrimPrefix(key, q.key(kBatch)+":"), ":") {
+		return 0, nil
+	}
+	items, err := q.rdb.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return 0, fmt.Errorf("get batch failed, err: %v", err)
+	}
+
+	var cnt int
+	for i, old := range items {
+		var item batchItem
+		if err = json.Unmarshal([]byte(old), &item); err != nil {
+			return cnt, fmt.Errorf("batch %s item %d, unmarshal failed, err: %v", key, i, err)
+		}
+		m := Message{ProducerMessage: ProducerMessage{Payload: item.Payload}, Codec: item.Codec}
+		if q.encodedCurrent(&m) {
+			continue
+		}
+		if err = q.decode(&m); err != nil {
+			return cnt, fmt.Errorf("batch %s item %d, %v", key, i, err)
+		}
+		payload, err := q.encode(m.Payload)
+		if err != nil {
+			return cnt, fmt.Errorf("batch %s item %d, %v", key, i, err)
+		}
+
+		recoded := batchItem{Payload: payload, Codec: q.codec.Name()}
+		if item.Checksum != "" || q.checksum {
+			recoded.Checksum = checksum(payload)
+		}
+		bs, err := json.Marshal(recoded)
+		if err != nil {
+			return cnt, fmt.Errorf("marshal batch item failed, err: %v", err)
+		}
+		ok, err := q.rdb.runRecodeItem(ctx, key, i, old, string(bs))
+		if err != nil {
+			return cnt, err
+		}
+		if ok {
+			cnt++
+		}
+	}
+	return cnt, nil
+}
+
+func (q *Queue) recode(ctx context.Context, key string) (bool, error) {
+	values, err := q.rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return false, fmt.Errorf("get message failed, err: %v", err)
+	}
+	// the pattern also matches the messages of the queues named with the
+	// name as a prefix, e.g. a:b of a, which are told apart by the id
+	if len(values) == 0 || key != q.key(kData)+":"+values["id"] {
+		return false, nil
+	}
+	s := make([]string, 0, len(values)*2)
+	for k, v := range values {
+		s = append(s, k, v)
+	}
+
+	var m Message
+	if err = m.parse(s); err != nil {
+		return false, fmt.Errorf("parse message %s failed, err: %v", key, err)
+	}
+
+	// the payloads of grouped messages are in their batches
+	if m.Group != "" || q.encodedCurrent(&m) {
+		return false, nil
+	}
+
+	old := base64.StdEncoding.EncodeToString(m.Payload)
+	if err = q.decode(&m); err != nil {
+		return false, fmt.Errorf("message %s, %v", m.ID, err)
+	}
+	payload, err := q.encode(m.Payload)
+	if err != nil {
+		return false, fmt.Errorf("message %s, %v", m.ID, err)
+	}
+
+	var sum string
+	if m.checksum != "" || q.checksum {
+		sum = checksum(payload)
+	}
+	return q.rdb.runRecode(ctx, key, old, base64.StdEncoding.EncodeToString(payload), q.codec.Name(), sum)
+}
+
+// encodedCurrent reports whether the encoded payload of m is encoded with the current codec and key.
+func (q *Queue) encodedCurrent(m *Message) bool {
+	name := m.Codec
+	if name == "" {
+		name = Identity.Name()
+	}
+	if name != q.codec.Name() {
+		return false
+	}
+
+	kc, ok := q.codec.(KeyedCodec)
+	if !ok {
+		return true
+	}
+	id, err := kc.KeyID(m.Payload)
+	return err == nil && id == kc.ActiveKeyID()
+}
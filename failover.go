@@ -0,0 +1,131 @@
+package dq
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// failover is the hook routing the commands of the primary to the standby
+// while the standby is active.
+type failover struct {
+	standby *redis.Client
+	active  atomic.Bool
+}
+
+func (f *failover) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (f *failover) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if f.active.Load() {
+			return f.standby.Process(ctx, cmd)
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (f *failover) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !f.active.Load() {
+			return next(ctx, cmds)
+		}
+
+		// transactions are wrapped with MULTI and EXEC by the primary
+		pipe := f.standby.Pipeline()
+		if n := len(cmds); n >= 2 && cmds[0].Name() == "multi" && cmds[n-1].Name() == "exec" {
+			pipe = f.standby.TxPipeline()
+			cmds = cmds[1 : n-1]
+		}
+		for _, cmd := range cmds {
+			_ = pipe.Process(ctx, cmd)
+		}
+		_, err := pipe.Exec(ctx)
+		return err
+	}
+}
+
+// initFailover routes the commands of the queue through the failover hook,
+// the primary client is copied so other users of it are not affected.
+func (q *Queue) initFailover() {
+	if q.failoverInterval <= 0 {
+		q.failoverInterval = time.Second
+	}
+	if q.failoverChecks <= 0 {
+		q.failoverChecks = 3
+	}
+	q.failover = &failover{standby: q.standby}
+	q.rdb.Client = redis.NewClient(q.rdb.Client.Options())
+	q.rdb.Client.AddHook(q.failover)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.stopFailover = cancel
+	go q.watchPrimary(ctx)
+}
+
+// watchPrimary checks the primary every failover interval, it fails over
+// to the standby after failoverChecks failed checks in a row, and fails
+// back after as many passed checks in a row.
+func (q *Queue) watchPrimary(ctx context.Context) {
+	ticker := time.NewTicker(q.failoverInterval)
+	defer ticker.Stop()
+
+	opts := q.rdb.Client.Options()
+	var fails, passes int
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// a new connection every check, pooled ones may outlive the primary
+		c := redis.NewClient(opts)
+		err := c.Ping(ctx).Err()
+		_ = c.Close()
+		if err != nil {
+			fails, passes = fails+1, 0
+		} else {
+			fails, passes = 0, passes+1
+		}
+
+		switch {
+		case !q.failover.active.Load() && fails >= q.failoverChecks:
+			q.failover.active.Store(true)
+			q.log(ctx, Error, "queue %s primary failed %d checks, fail over to standby, err: %v", q.name, fails, err)
+		case q.failover.active.Load() && passes >= q.failoverChecks:
+			q.failover.active.Store(false)
+			q.log(ctx, Warn, "queue %s primary recovered, fail back", q.name)
+			q.resync(ctx)
+		}
+	}
+}
+
+// resync moves the messages produced to the standby during the failover
+// back to the primary, and removes the queue from the standby once every key
+// of it is migrated, otherwise the standby is kept for the keys to be moved by hand.
+func (q *Queue) resync(ctx context.Context) {
+	s := New(WithRedis(q.standby), WithRedisKeyPrefix(q.redisPrefix), WithKeyNamer(q.keyNamer), WithName(q.name))
+	n, err := s.MigrateTo(ctx, q.rdb.Client, 1000)
+	s.StopDualWrite()
+	if err != nil {
+		q.log(ctx, Error, "queue %s resync from standby failed, err: %v", q.name, err)
+		return
+	}
+	keys, err := s.unmigrated(ctx)
+	switch {
+	case err != nil:
+		q.log(ctx, Error, "queue %s resync from standby failed, err: %v", q.name, err)
+		return
+	case len(keys) > 0:
+		q.log(ctx, Error, "queue %s resync %d messages from standby, standby kept for keys not migrated: %v", q.name, n, keys)
+		return
+	}
+	if err = s.Destroy(ctx); err != nil {
+		q.log(ctx, Warn, "queue %s remove from standby failed, err: %v", q.name, err)
+	}
+	q.log(ctx, Info, "queue %s resync %d messages from standby", q.name, n)
+}
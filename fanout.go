@@ -0,0 +1,197 @@
+package dq
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// FanOut is a large job split into child messages, e.g. a task for every
+// chunk of a million user IDs, tracked until all of them are finished.
+type FanOut struct {
+	// Kind is the kind of the child messages.
+	Kind string
+	// Items are split into chunks of ChunkSize items, the payload of
+	// a child message is the JSON array of its chunk.
+	Items     []string
+	ChunkSize int
+	// Completion is produced with the job ID as its ID once all the children
+	// are committed or dead, only its Kind and Payload are kept.
+	Completion *ProducerMessage
+}
+
+// jobKey is the hash tracking the children of the job.
+func (q *Queue) jobKey(id string) string {
+	return q.key(kJob) + ":" + id
+}
+
+// childID is derived from the job and the chunk, so a chunk is produced once.
+func childID(job string, i int) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(job+":"+strconv.Itoa(i))).String()
+}
+
+// FanOut produces the child messages of the job with Parent set to the
+// returned job ID, the children are counted as they are committed or dead.
+// If it fails, the children produced are still processed, but the job never completes.
+func (q *Queue) FanOut(ctx context.Context, job FanOut) (string, error) {
+	if len(job.Items) == 0 || job.ChunkSize <= 0 {
+		return "", fmt.Errorf("invalid fan-out of %d items by %d", len(job.Items), job.ChunkSize)
+	}
+
+	id := uuid.NewString()
+	total := (len(job.Items) + job.ChunkSize - 1) / job.ChunkSize
+	values := []interface{}{"total", total, "done", 0, "failed", 0, "create_at", time.Now().UnixMilli()}
+	if c := job.Completion; c != nil {
+		values = append(values, "completion_kind", c.Kind, "completion_payload", base64.StdEncoding.EncodeToString(c.Payload))
+	}
+	tx := q.rdb.TxPipeline()
+	tx.HSet(ctx, q.jobKey(id), values...)
+	tx.Expire(ctx, q.jobKey(id), q.messageSaveTime)
+	if _, err := tx.Exec(ctx); err != nil {
+		return "", fmt.Errorf("create fan-out job failed, err: %v", err)
+	}
+
+	for i := 0; i < total; i++ {
+		end := (i + 1) * job.ChunkSize
+		if end > len(job.Items) {
+			end = len(job.Items)
+		}
+		payload, err := json.Marshal(job.Items[i*job.ChunkSize : end])
+		if err != nil {
+			return id, fmt.Errorf("marshal chunk %d failed, err: %v", i, err)
+		}
+		_, err = q.Produce(ctx, &ProducerMessage{
+			Payload: payload,
+			Kind:    job.Kind,
+			DedupID: childID(id, i),
+			Parent:  id,
+		})
+		if err != nil {
+			return id, fmt.Errorf("produce chunk %d of job %s failed, err: %v", i, id, err)
+		}
+	}
+	q.log(ctx, Info, "fan out job %s of %d items to %d messages", id, len(job.Items), total)
+	return id, nil
+}
+
+// ChildState is the state of a child message of a fan-out job.
+type ChildState string
+
+const (
+	// ChildPending children wait to be taken.
+	ChildPending ChildState = "pending"
+	// ChildRunning children are taken, or failed and wait to be retried.
+	ChildRunning ChildState = "running"
+	ChildDone    ChildState = "done"
+	ChildFailed  ChildState = "failed"
+	// ChildMissing children are neither finished nor pending, e.g. canceled or expired.
+	ChildMissing ChildState = "missing"
+)
+
+// JobTree is the progress of a fan-out job.
+type JobTree struct {
+	ID       string
+	CreateAt time.Time
+	Total    int
+	Children map[ChildState]int
+	// Failures are the reasons of the failed children by their IDs,
+	// reasons are empty once the data of the children expired.
+	Failures map[string]string
+	// Completed jobs have all their children done or failed.
+	Completed bool
+}
+
+// GetJobTree returns the progress of the fan-out job, nil if it does not
+// exist or expired.
+func (q *Queue) GetJobTree(ctx context.Context, id string) (*JobTree, error) {
+	c := q.rdb.reader()
+	values, err := c.HGetAll(ctx, q.jobKey(id)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get job failed, err: %v", err)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	t := &JobTree{ID: id, Children: map[ChildState]int{}, Failures: map[string]string{}}
+	t.Total, _ = strconv.Atoi(values["total"])
+	ms, _ := strconv.ParseInt(values["create_at"], 10, 64)
+	t.CreateAt = time.UnixMilli(ms)
+
+	type unfinished struct {
+		id    string
+		retry *redis.FloatCmd
+		data  *redis.IntCmd
+	}
+	var pending []unfinished
+	reasons := map[string]*redis.StringCmd{}
+	pipe := c.Pipeline()
+	for i := 0; i < t.Total; i++ {
+		cid := childID(id, i)
+		switch values["child:"+cid] {
+		case "done":
+			t.Children[ChildDone]++
+		case "failed":
+			t.Children[ChildFailed]++
+			reasons[cid] = pipe.HGet(ctx, q.key(kData)+":"+cid, "dead_reason")
+		default:
+			pending = append(pending, unfinished{cid, pipe.ZScore(ctx, q.key(kRetry), cid), pipe.Exists(ctx, q.key(kData)+":"+cid)})
+		}
+	}
+	if _, err = pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("get job children failed, err: %v", err)
+	}
+
+	for cid, r := range reasons {
+		t.Failures[cid] = r.Val()
+	}
+	for _, u := range pending {
+		switch {
+		case u.retry.Err() == nil:
+			t.Children[ChildRunning]++
+		case u.data.Val() == 1:
+			t.Children[ChildPending]++
+		default:
+			t.Children[ChildMissing]++
+		}
+	}
+	t.Completed = t.Children[ChildDone]+t.Children[ChildFailed] == t.Total
+	return t, nil
+}
+
+// finishChild counts the finished child message of its job, and produces
+// the completion message of the job once all its children are finished.
+func (q *Queue) finishChild(ctx context.Context, m *Message, failed bool) {
+	if m.Parent == "" {
+		return
+	}
+	last, err := q.rdb.runFinishChild(ctx, q.jobKey(m.Parent), m.ID, failed)
+	if err != nil {
+		q.log(ctx, Warn, "finish child %s of job %s failed, err: %v", m.ID, m.Parent, err)
+		return
+	}
+	if !last {
+		return
+	}
+
+	q.log(ctx, Info, "all children of job %s are finished", m.Parent)
+	values, err := q.rdb.HMGet(ctx, q.jobKey(m.Parent), "completion_kind", "completion_payload").Result()
+	if err != nil {
+		q.log(ctx, Error, "load completion of job %s failed, err: %v", m.Parent, err)
+		return
+	}
+	if values[1] == nil {
+		return
+	}
+	kind, _ := values[0].(string)
+	payload, _ := base64.StdEncoding.DecodeString(values[1].(string))
+	if _, err = q.produce(ctx, &ProducerMessage{Payload: payload, Kind: kind, DedupID: m.Parent}, "job:"+m.Parent); err != nil {
+		q.log(ctx, Error, "produce completion of job %s failed, err: %v", m.Parent, err)
+	}
+}
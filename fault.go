@@ -0,0 +1,68 @@
+package dq
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// FaultInjector injects broker faults with the given probabilities,
+// it is meant for tests verifying handler idempotency and redelivery.
+type FaultInjector struct {
+	// TakeFailure fails taking message before it reaches redis.
+	TakeFailure float64
+	// CommitFailure fails committing message before it reaches redis.
+	CommitFailure float64
+	// DropCommit skips committing message but reports success,
+	// the message is redelivered after the retry interval.
+	DropCommit float64
+	// SlowScript delays taking and committing message by SlowDelay.
+	SlowScript float64
+	SlowDelay  time.Duration
+
+	// Rand defaults to math/rand.
+	Rand func() float64
+}
+
+// ErrInjectedFault is returned by faults injected by FaultInjector.
+var ErrInjectedFault = errors.New("injected fault")
+
+func (f *FaultInjector) hit(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	if f.Rand != nil {
+		return f.Rand() < p
+	}
+	return rand.Float64() < p
+}
+
+func (f *FaultInjector) slow() {
+	if f.hit(f.SlowScript) {
+		time.Sleep(f.SlowDelay)
+	}
+}
+
+func (q *Queue) injectTake() error {
+	f := q.faultInjector
+	if f == nil {
+		return nil
+	}
+	f.slow()
+	if f.hit(f.TakeFailure) {
+		return ErrInjectedFault
+	}
+	return nil
+}
+
+func (q *Queue) injectCommit() (drop bool, err error) {
+	f := q.faultInjector
+	if f == nil {
+		return false, nil
+	}
+	f.slow()
+	if f.hit(f.CommitFailure) {
+		return false, ErrInjectedFault
+	}
+	return f.hit(f.DropCommit), nil
+}
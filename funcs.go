@@ -0,0 +1,82 @@
+package dq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kindFunc prefixes the Kind of messages scheduled by After and At.
+const kindFunc = "dq.func:"
+
+// Func is a named function scheduled by After and At, args are JSON encoded.
+type Func func(ctx context.Context, args json.RawMessage) error
+
+var funcs sync.Map // name -> Func
+
+// RegisterFunc registers fn by name to be run by FuncHandler,
+// registering a name again replaces its function.
+func RegisterFunc(name string, fn Func) {
+	funcs.Store(name, fn)
+}
+
+// Register registers the task fn by name, its args are JSON decoded into T,
+// args failed to decode fail with ErrorClassValidation.
+func Register[T any](name string, fn func(ctx context.Context, args T) error) {
+	RegisterFunc(name, func(ctx context.Context, bs json.RawMessage) error {
+		var args T
+		if err := json.Unmarshal(bs, &args); err != nil {
+			return Classify(fmt.Errorf("unmarshal args of %s failed, err: %v", name, err), ErrorClassValidation)
+		}
+		return fn(ctx, args)
+	})
+}
+
+// Enqueue produces the task registered by name with args, run by FuncHandler,
+// e.g. q.Enqueue(ctx, "send_welcome_email", EmailArgs{To: to}, WithDeliverAt(t)).
+func (q *Queue) Enqueue(ctx context.Context, name string, args interface{}, opts ...ProduceOption) (*Receipt, error) {
+	return q.produceFunc(ctx, name, args, opts...)
+}
+
+// After schedules the function registered by name to run with args after d.
+func (q *Queue) After(ctx context.Context, d time.Duration, name string, args interface{}) (*Receipt, error) {
+	return q.At(ctx, time.Now().Add(d), name, args)
+}
+
+// At schedules the function registered by name to run with args at t,
+// args are JSON encoded.
+func (q *Queue) At(ctx context.Context, t time.Time, name string, args interface{}) (*Receipt, error) {
+	return q.produceFunc(ctx, name, args, WithDeliverAt(t))
+}
+
+func (q *Queue) produceFunc(ctx context.Context, name string, args interface{}, opts ...ProduceOption) (*Receipt, error) {
+	bs, err := json.Marshal(args)
+	if err != nil {
+		return nil, fmt.Errorf("marshal args of %s failed, err: %v", name, err)
+	}
+
+	m := &ProducerMessage{Payload: bs, Kind: kindFunc + name}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return q.Produce(ctx, m)
+}
+
+// FuncHandler returns the handler running the functions scheduled by After and At,
+// messages of other kinds or unregistered functions fail with ErrorClassValidation.
+func FuncHandler() Handler {
+	return HandlerFunc(func(ctx context.Context, m *Message) error {
+		name := strings.TrimPrefix(m.Kind, kindFunc)
+		if name == m.Kind {
+			return Classify(fmt.Errorf("kind %s is not a function", m.Kind), ErrorClassValidation)
+		}
+		fn, ok := funcs.Load(name)
+		if !ok {
+			return Classify(fmt.Errorf("function %s is not registered", name), ErrorClassValidation)
+		}
+		return fn.(Func)(ctx, m.Payload)
+	})
+}
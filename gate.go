@@ -0,0 +1,99 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Gate is called by the daemon before a due delay message becomes ready.
+// It returns a zero time to deliver the message now, or the time to postpone it to.
+// Messages are postponed with backoff if Gate returns an error, as are the
+// messages failed to be loaded, so they don't hold back the later due messages.
+type Gate func(context.Context, *Message) (time.Time, error)
+
+// gateMaxBackoff caps the backoff of the messages failed by the gate.
+const gateMaxBackoff = 10 * time.Minute
+
+// gateDelayToReady moves due delay messages to ready one by one through the gate,
+// earliest is the due time of the earliest moved message.
+func (q *Queue) gateDelayToReady(ctx context.Context, until time.Time) (moved []string, earliest time.Time, err error) {
+	zs, err := q.rdb.ZRangeByScoreWithScores(ctx, q.key(kDelay), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(until.UnixMilli(), 10),
+		Count: 1000,
+	}).Result()
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("range delay failed, err: %v", err)
+	}
+
+	if q.gateFails == nil {
+		q.gateFails = map[string]int{}
+	}
+	for _, z := range zs {
+		id := z.Member.(string)
+		m, err := q.getMessage(ctx, id)
+		if err != nil {
+			q.log(ctx, Warn, "daemon, gate get message %s failed, err: %v", id, err)
+			q.gateBackoff(ctx, id)
+			continue
+		}
+
+		// canceled message is moved as it is, the consumer skips it
+		var at time.Time
+		if m != nil {
+			at, err = q.gate(ctx, m)
+			if err != nil {
+				q.log(ctx, Warn, "daemon, gate message %s failed, err: %v", id, err)
+				q.gateBackoff(ctx, id)
+				continue
+			}
+		}
+		delete(q.gateFails, id)
+
+		if !at.IsZero() {
+			if err = q.rdb.ZAddXX(ctx, q.key(kDelay), redis.Z{Score: float64(at.UnixMilli()), Member: id}).Err(); err != nil {
+				q.log(ctx, Warn, "daemon, gate postpone message %s failed, err: %v", id, err)
+			}
+			continue
+		}
+
+		cnt, err := q.rdb.runMoveToList(ctx, q.key(kDelay), q.key(kReady), q.key(kAudit), q.auditMaxLen, EventDue, id)
+		if err != nil {
+			q.log(ctx, Warn, "daemon, gate move message %s failed, err: %v", id, err)
+			continue
+		}
+		if cnt > 0 {
+			if len(moved) == 0 {
+				earliest = time.UnixMilli(int64(z.Score))
+			}
+			moved = append(moved, id)
+		}
+	}
+
+	return moved, earliest, nil
+}
+
+// gateBackoff postpones the message failed by the gate, the delay grows from
+// the retry interval on every failure in a row.
+func (q *Queue) gateBackoff(ctx context.Context, id string) {
+	q.gateFails[id]++
+	d := RetryPolicy{Interval: q.currentRetryInterval(), Multiplier: 2, MaxInterval: gateMaxBackoff}.delay(q.gateFails[id])
+	at := time.Now().Add(d)
+	n, err := q.rdb.ZAddArgs(ctx, q.key(kDelay), redis.ZAddArgs{
+		XX:      true,
+		Ch:      true,
+		Members: []redis.Z{{Score: float64(at.UnixMilli()), Member: id}},
+	}).Result()
+	if err != nil {
+		q.log(ctx, Warn, "daemon, gate postpone message %s failed, err: %v", id, err)
+		return
+	}
+	// the message is gone from delay meanwhile
+	if n == 0 {
+		delete(q.gateFails, id)
+	}
+}
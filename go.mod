@@ -7,6 +7,7 @@ require (
 	github.com/redis/go-redis/v9 v9.0.5
 	github.com/stretchr/testify v1.8.1
 	golang.org/x/time v0.5.0
+	google.golang.org/protobuf v1.33.0
 )
 
 require (
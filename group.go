@@ -0,0 +1,161 @@
+package dq
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProduceGrouped adds the payload of m to the open batch of group, the batch is
+// opened by the first message of the group and delivered after window as one
+// message with Group set and the payloads in Batch, its Kind is the Kind of
+// the first message. Payloads are validated and encoded, with their checksum
+// if WithChecksum, like the payload of Produce. The receipt is of the batch message.
+// Grouped messages are rejected in inline mode, with a mirror, during a migration,
+// and with a Tenant or DeliverAt, and the window is checked as the max delay.
+func (q *Queue) ProduceGrouped(ctx context.Context, group string, window time.Duration, m *ProducerMessage) (*Receipt, error) {
+	if group == "" {
+		return nil, fmt.Errorf("group is empty")
+	}
+	if m.Payload == nil {
+		return nil, fmt.Errorf("payload is nil")
+	}
+	if err := checkName(q.name); err != nil {
+		return nil, err
+	}
+	if err := q.checkGrouped(m); err != nil {
+		return nil, err
+	}
+	if err := q.validate(ValidateOnProduce, m.Kind, m.Payload); err != nil {
+		return nil, err
+	}
+	item, err := q.encodeItem(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	at := now.Add(window)
+	if err = q.checkDeliverAt(now, &at); err != nil {
+		return nil, err
+	}
+	cm := &Message{
+		ProducerMessage: ProducerMessage{
+			Payload:   []byte(base64.StdEncoding.EncodeToString([]byte(group))),
+			DeliverAt: &at,
+			Kind:      m.Kind,
+		},
+		ID:       uuid.NewString(),
+		CreateAt: now,
+		Group:    group,
+	}
+	expSec := int((q.messageSaveTime + window).Seconds())
+	id, n, created, err := q.rdb.runProduceGrouped(ctx, q.key(kDelay), q.key(kData), q.groupKey(group), q.key(kBatch), cm, window, expSec, item)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		q.audit(ctx, EventProduced, id)
+	}
+	q.log(ctx, Trace, "produce message to batch %s of group %s, size: %d", id, group, n)
+	return &Receipt{ID: id, DeliverAt: at, QueuePositionEstimate: -1}, nil
+}
+
+// checkGrouped rejects the options applied by Produce which batches do not support.
+func (q *Queue) checkGrouped(m *ProducerMessage) error {
+	switch {
+	case q.inline:
+		return fmt.Errorf("grouped message is not supported in inline mode")
+	case q.mirrorTo != nil:
+		return fmt.Errorf("grouped message is not supported with mirror")
+	case q.migrateTarget.Load() != nil:
+		return fmt.Errorf("grouped message is not supported during migration")
+	case m.Tenant != "":
+		return fmt.Errorf("grouped message does not support tenant")
+	case m.DeliverAt != nil:
+		return fmt.Errorf("grouped message does not support deliver at, it is delivered after the window")
+	}
+	return nil
+}
+
+// batchItem is a payload in a batch, encoded like the payload of a message.
+type batchItem struct {
+	Payload  []byte `json:"payload"`
+	Codec    string `json:"codec,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// encodeItem encodes the payload of m as a batch item.
+func (q *Queue) encodeItem(ctx context.Context, m *ProducerMessage) ([]byte, error) {
+	payload, err := q.encode(m.Payload)
+	if err != nil {
+		return nil, err
+	}
+	q.checkPayloadSize(ctx, m, len(payload))
+
+	item := batchItem{Payload: payload, Codec: q.codec.Name()}
+	if q.checksum {
+		item.Checksum = checksum(payload)
+	}
+	bs, err := json.Marshal(item)
+	if err != nil {
+		return nil, fmt.Errorf("marshal batch item failed, err: %v", err)
+	}
+	return bs, nil
+}
+
+// decodeItem verifies and decodes the batch item, the kind is validated on consume.
+func (q *Queue) decodeItem(kind string, bs []byte) ([]byte, error) {
+	var item batchItem
+	if err := json.Unmarshal(bs, &item); err != nil {
+		return nil, fmt.Errorf("unmarshal batch item failed, err: %v", err)
+	}
+	m := Message{
+		ProducerMessage: ProducerMessage{Payload: item.Payload, Kind: kind},
+		Codec:           item.Codec,
+		checksum:        item.Checksum,
+	}
+	if err := verifyChecksum(&m); err != nil {
+		return nil, err
+	}
+	if err := q.decode(&m); err != nil {
+		return nil, err
+	}
+	if err := q.validate(ValidateOnConsume, kind, m.Payload); err != nil {
+		return nil, err
+	}
+	return m.Payload, nil
+}
+
+func (q *Queue) groupKey(group string) string {
+	return q.key(kGroup) + ":" + group
+}
+
+// loadBatch closes the batch of the taken group message and loads its encoded payloads.
+func (q *Queue) loadBatch(ctx context.Context, m *Message) error {
+	items, err := q.rdb.runCloseBatch(ctx, q.groupKey(m.Group), q.key(kBatch)+":"+m.ID, m.ID)
+	if err != nil {
+		return err
+	}
+	m.Batch = make([][]byte, len(items))
+	for i, item := range items {
+		m.Batch[i] = []byte(item)
+	}
+	return nil
+}
+
+// decodeBatch decodes the loaded payloads of the batch in place.
+func (q *Queue) decodeBatch(m *Message) error {
+	for i, item := range m.Batch {
+		bs, err := q.decodeItem(m.Kind, item)
+		if err != nil {
+			return fmt.Errorf("batch item %d, %v", i, err)
+		}
+		m.Batch[i] = bs
+	}
+	return nil
+}
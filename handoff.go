@@ -0,0 +1,115 @@
+package dq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Staged records txID, the ID of the downstream transaction the message is
+// handed off by, before the handler calls downstream with it as the
+// idempotency token. A redelivered message has the txID in StagedTx, so its
+// handler can reuse it, and the txID is saved with the result once committed.
+// It can only be called by handlers.
+func (m *Message) Staged(ctx context.Context, txID string) error {
+	if m.stage == nil {
+		return errors.New("message is not being processed")
+	}
+	if err := m.stage(ctx, txID); err != nil {
+		return fmt.Errorf("stage message failed, err: %v", err)
+	}
+	m.StagedTx = txID
+	return nil
+}
+
+// stager returns the function recording the staged txID of the message,
+// unless the message is gone.
+func (q *Queue) stager(id string) func(context.Context, string) error {
+	save := q.saver(id)
+	return func(ctx context.Context, txID string) error {
+		return save(ctx, "staged_tx", txID)
+	}
+}
+
+// reconcileBatch is the number of retry messages read at once by Reconcile.
+const reconcileBatch = 100
+
+// Reconcile verifies the messages staged but not committed whose retry is due,
+// e.g. after their consumers crashed, and commits those verify reports as handed
+// off, so they are not delivered again. It returns the number of committed messages.
+// The daemon moves due retries to ready within a tick, so with a daemon running
+// staged messages are rather verified as they are taken, see WithStagedVerifier.
+func (q *Queue) Reconcile(ctx context.Context, verify func(ctx context.Context, m *Message) (bool, error)) (int, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	cnt := 0
+	for offset := int64(0); ; {
+		ids, err := q.rdb.ZRangeByScore(ctx, q.key(kRetry), &redis.ZRangeBy{
+			Min:    "-inf",
+			Max:    now,
+			Offset: offset,
+			Count:  reconcileBatch,
+		}).Result()
+		if err != nil {
+			return cnt, fmt.Errorf("get retry messages failed, err: %v", err)
+		}
+
+		// committed messages leave the retry set, the others are skipped
+		offset += int64(len(ids))
+		for _, id := range ids {
+			ok, err := q.reconcile(ctx, id, verify)
+			if err != nil {
+				return cnt, err
+			}
+			if ok {
+				cnt++
+				offset--
+			}
+		}
+		if len(ids) < reconcileBatch {
+			return cnt, nil
+		}
+	}
+}
+
+func (q *Queue) reconcile(ctx context.Context, id string, verify func(ctx context.Context, m *Message) (bool, error)) (bool, error) {
+	m, err := q.getMessage(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if m == nil || m.StagedTx == "" {
+		return false, nil
+	}
+	return q.commitHandedOff(ctx, m, verify)
+}
+
+// commitHandedOff commits the staged message if verify reports it as handed off.
+func (q *Queue) commitHandedOff(ctx context.Context, m *Message, verify func(ctx context.Context, m *Message) (bool, error)) (bool, error) {
+	id := m.ID
+	ok, err := verify(ctx, m)
+	if err != nil {
+		return false, fmt.Errorf("verify message %s failed, err: %v", id, err)
+	}
+	if !ok {
+		return false, nil
+	}
+	if _, err = q.rdb.runCommit(ctx, q.key(kRetry), q.key(kData), q.inflightKey(q.instanceID), q.key(kResult), q.key(kBatch), id, &Result{StagedTx: m.StagedTx}, q.handoffSaveSec()); err != nil {
+		return false, fmt.Errorf("commit message %s failed, err: %v", id, err)
+	}
+	q.log(ctx, Info, "reconcile message %s handed off by %s", id, m.StagedTx)
+	q.audit(ctx, EventCommitted, id)
+	q.complete(ctx, OutcomeCommitted, id)
+	q.finishChild(ctx, m, false)
+	return true, nil
+}
+
+// handoffSaveSec is how long the staged txID is saved with the result.
+func (q *Queue) handoffSaveSec() int {
+	if q.resultSaveTime > 0 {
+		return int(q.resultSaveTime.Seconds())
+	}
+	return int(q.tokenSaveTime.Seconds())
+}
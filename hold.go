@@ -0,0 +1,38 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Hold freezes the pending message, it is not delivered until Release,
+// e.g. while a problematic message is being investigated.
+// Messages being processed or retried can not be held.
+func (q *Queue) Hold(ctx context.Context, id string) error {
+	n, err := q.rdb.runHold(ctx, q.key(kData), q.key(kReady), q.key(kDelay), q.key(kCold), q.key(kHeld), id, time.Now())
+	switch {
+	case err != nil:
+		return fmt.Errorf("hold message failed, err: %v", err)
+	case n == 0:
+		return fmt.Errorf("message %s not found", id)
+	case n < 0:
+		return fmt.Errorf("message %s is not pending", id)
+	}
+	return nil
+}
+
+// Release moves the held message back to the queue,
+// it is delivered at its deliver at, or at once if that is past.
+func (q *Queue) Release(ctx context.Context, id string) error {
+	n, err := q.rdb.runRelease(ctx, q.key(kHeld), q.key(kData), q.key(kReady), q.key(kDelay), id, time.Now(), int(q.messageSaveTime.Seconds()))
+	switch {
+	case err != nil:
+		return fmt.Errorf("release message failed, err: %v", err)
+	case n == 0:
+		return fmt.Errorf("message %s is not held", id)
+	case n < 0:
+		return fmt.Errorf("message %s is canceled", id)
+	}
+	return nil
+}
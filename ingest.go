@@ -0,0 +1,291 @@
+package dq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// IngestSource is a Redis Stream or list written by legacy producers,
+// exactly one of Stream and List is set.
+type IngestSource struct {
+	// Stream is read by the consumer group Group, entries are acked once produced
+	// and produced once per entry ID.
+	Stream string
+	Group  string
+	// ClaimIdle is the time entries read by another consumer of Group stay
+	// pending before they are claimed, e.g. read by a crashed instance,
+	// defaults to 1m.
+	ClaimIdle time.Duration
+	// List is popped from the right into List+":ingesting", elements are
+	// removed from there once produced.
+	List string
+	// ListJSON decodes list elements as JSON objects into fields,
+	// otherwise the element is the "payload" field.
+	ListJSON bool
+	// Convert converts the fields of an entry, defaults to IngestFields{}.Convert.
+	// Entries failed to convert are logged and dropped.
+	Convert func(fields map[string]string) (*ProducerMessage, error)
+	// Block is the time to wait for entries, defaults to 1s.
+	Block time.Duration
+	// Count is the number of stream entries read at once, defaults to 100.
+	Count int64
+}
+
+// IngestFields converts entries by field names, empty names use the defaults.
+type IngestFields struct {
+	// Payload defaults to "payload".
+	Payload string
+	// Kind defaults to "kind".
+	Kind string
+	// DeliverAt is unix seconds or RFC3339, defaults to "deliver_at".
+	DeliverAt string
+	// Delay is seconds or a duration like "5m", defaults to "delay".
+	Delay string
+}
+
+func (f IngestFields) Convert(fields map[string]string) (*ProducerMessage, error) {
+	name := func(n, def string) string {
+		if n == "" {
+			return def
+		}
+		return n
+	}
+
+	payload, ok := fields[name(f.Payload, "payload")]
+	if !ok {
+		return nil, fmt.Errorf("field %s not found", name(f.Payload, "payload"))
+	}
+	m := &ProducerMessage{Payload: []byte(payload), Kind: fields[name(f.Kind, "kind")]}
+
+	if v := fields[name(f.DeliverAt, "deliver_at")]; v != "" {
+		at, err := parseIngestTime(v)
+		if err != nil {
+			return nil, fmt.Errorf("parse deliver at %q failed, err: %v", v, err)
+		}
+		m.DeliverAt = &at
+	} else if v := fields[name(f.Delay, "delay")]; v != "" {
+		delay, err := parseIngestDelay(v)
+		if err != nil {
+			return nil, fmt.Errorf("parse delay %q failed, err: %v", v, err)
+		}
+		at := time.Now().Add(delay)
+		m.DeliverAt = &at
+	}
+	return m, nil
+}
+
+func parseIngestTime(v string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func parseIngestDelay(v string) (time.Duration, error) {
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Duration(sec) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// Ingest produces the entries of src until ctx is done or producing fails,
+// entries not produced yet are ingested again by the next Ingest.
+func (q *Queue) Ingest(ctx context.Context, src IngestSource) error {
+	if (src.Stream == "") == (src.List == "") {
+		return fmt.Errorf("exactly one of stream and list is required")
+	}
+	if src.Convert == nil {
+		src.Convert = IngestFields{}.Convert
+	}
+	if src.Block <= 0 {
+		src.Block = time.Second
+	}
+	if src.Count <= 0 {
+		src.Count = 100
+	}
+	if src.ClaimIdle <= 0 {
+		src.ClaimIdle = time.Minute
+	}
+
+	var err error
+	if src.Stream != "" {
+		err = q.ingestStream(ctx, src)
+	} else {
+		err = q.ingestList(ctx, src)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (q *Queue) ingestStream(ctx context.Context, src IngestSource) error {
+	if src.Group == "" {
+		return fmt.Errorf("group is required")
+	}
+	err := q.rdb.XGroupCreateMkStream(ctx, src.Stream, src.Group, "0").Err()
+	if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
+		return fmt.Errorf("create group failed, err: %v", err)
+	}
+
+	// entries pending from the last ingest and claimed from other consumers first
+	start := "0"
+	if _, err := q.claimIngest(ctx, src); err != nil {
+		return err
+	}
+	for ctx.Err() == nil {
+		streams, err := q.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    src.Group,
+			Consumer: q.instanceID,
+			Streams:  []string{src.Stream, start},
+			Count:    src.Count,
+			Block:    src.Block,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			claimed, err := q.claimIngest(ctx, src)
+			if err != nil {
+				return err
+			}
+			if claimed > 0 {
+				start = "0"
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("read stream failed, err: %v", err)
+		}
+
+		var entries []redis.XMessage
+		if len(streams) > 0 {
+			entries = streams[0].Messages
+		}
+		if start == "0" && len(entries) == 0 {
+			start = ">"
+			continue
+		}
+		for _, e := range entries {
+			fields := make(map[string]string, len(e.Values))
+			for k, v := range e.Values {
+				fields[k] = fmt.Sprint(v)
+			}
+			if err := q.ingest(ctx, src, src.Stream+":"+e.ID, fields); err != nil {
+				return err
+			}
+			if err := q.rdb.XAck(ctx, src.Stream, src.Group, e.ID).Err(); err != nil {
+				return fmt.Errorf("ack stream entry failed, err: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// claimIngest claims the entries pending longer than the claim idle in the
+// other consumers of the group, they are read as pending entries of this one.
+func (q *Queue) claimIngest(ctx context.Context, src IngestSource) (int, error) {
+	var claimed int
+	start := "0-0"
+	for {
+		ids, next, err := q.rdb.XAutoClaimJustID(ctx, &redis.XAutoClaimArgs{
+			Stream:   src.Stream,
+			Group:    src.Group,
+			MinIdle:  src.ClaimIdle,
+			Start:    start,
+			Count:    src.Count,
+			Consumer: q.instanceID,
+		}).Result()
+		if err != nil {
+			return claimed, fmt.Errorf("claim stream entries failed, err: %v", err)
+		}
+		claimed += len(ids)
+		if next == "0-0" {
+			return claimed, nil
+		}
+		start = next
+	}
+}
+
+func (q *Queue) ingestList(ctx context.Context, src IngestSource) error {
+	ingesting := src.List + ":ingesting"
+
+	// elements left by the last ingest first
+	left, err := q.rdb.LRange(ctx, ingesting, 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("read ingesting list failed, err: %v", err)
+	}
+	for i := len(left) - 1; i >= 0; i-- {
+		if err := q.ingestListElem(ctx, src, ingesting, left[i]); err != nil {
+			return err
+		}
+	}
+
+	for ctx.Err() == nil {
+		elem, err := q.rdb.BLMove(ctx, src.List, ingesting, "RIGHT", "LEFT", src.Block).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("pop list failed, err: %v", err)
+		}
+		if err := q.ingestListElem(ctx, src, ingesting, elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Queue) ingestListElem(ctx context.Context, src IngestSource, ingesting, elem string) error {
+	fields := map[string]string{"payload": elem}
+	if src.ListJSON {
+		var values map[string]interface{}
+		if err := json.Unmarshal([]byte(elem), &values); err != nil {
+			q.log(ctx, Warn, "ingest, decode list element failed, err: %v", err)
+			return q.rdb.LRem(ctx, ingesting, 1, elem).Err()
+		}
+		fields = make(map[string]string, len(values))
+		for k, v := range values {
+			if s, ok := v.(string); ok {
+				fields[k] = s
+				continue
+			}
+			bs, _ := json.Marshal(v)
+			fields[k] = string(bs)
+		}
+	}
+
+	if err := q.ingest(ctx, src, "", fields); err != nil {
+		return err
+	}
+	if err := q.rdb.LRem(ctx, ingesting, 1, elem).Err(); err != nil {
+		return fmt.Errorf("remove ingesting element failed, err: %v", err)
+	}
+	return nil
+}
+
+// ingest produces the entry, with the token if the entry has an ID.
+func (q *Queue) ingest(ctx context.Context, src IngestSource, token string, fields map[string]string) error {
+	m, err := src.Convert(fields)
+	if err != nil {
+		q.log(ctx, Warn, "ingest, convert entry failed, dropped, err: %v", err)
+		return nil
+	}
+
+	if token != "" {
+		_, err = q.ProduceWithToken(ctx, token, m)
+	} else {
+		_, err = q.Produce(ctx, m)
+	}
+	if errors.Is(err, ErrInvalidPayload) || errors.Is(err, ErrInvalidDeliverAt) {
+		q.log(ctx, Warn, "ingest, produce entry rejected, dropped, err: %v", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ingest produce failed, err: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// produceInline processes the message by the handler of Consume at once,
+// without redis. Deliver at is ignored and handler errors are returned.
+func (q *Queue) produceInline(ctx context.Context, m *ProducerMessage) (*Receipt, error) {
+	h := q.inlineHandler.Load()
+	if h == nil {
+		return nil, fmt.Errorf("inline mode, consume is not called")
+	}
+
+	id := m.DedupID
+	if id == "" {
+		id = uuid.NewString()
+	}
+	now := time.Now()
+	cm := &Message{ProducerMessage: *m, ID: id, CreateAt: now, DeliverCnt: 1}
+	if q.enabled(Trace) {
+		q.log(ctx, Trace, "inline process message %s, payload: %s", id, q.redact(m.Payload))
+	}
+	if err := (*h).Process(ctx, cm); err != nil {
+		return nil, fmt.Errorf("inline process message %s failed, err: %w", id, err)
+	}
+	return &Receipt{ID: id, DeliverAt: now}, nil
+}
@@ -2,7 +2,10 @@ package dq
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"sync"
+	"time"
 )
 
 type LogLevel int
@@ -23,8 +26,14 @@ type Logger interface {
 	Trace(context.Context, string, ...interface{})
 }
 
+// enabled reports whether logs of level are written, e.g. to skip
+// formatting their arguments.
+func (q *Queue) enabled(level LogLevel) bool {
+	return q.opts.logger != nil && level <= q.logMode
+}
+
 func (q *Queue) log(ctx context.Context, level LogLevel, msg string, data ...interface{}) {
-	if q.opts.logger == nil || level > q.logMode {
+	if !q.enabled(level) {
 		return
 	}
 
@@ -41,6 +50,71 @@ func (q *Queue) log(ctx context.Context, level LogLevel, msg string, data ...int
 	}
 }
 
+// logSampled logs like log, but identical lines repeated within the sampling
+// window are suppressed and counted, e.g. a poisoned message retried quickly.
+func (q *Queue) logSampled(ctx context.Context, level LogLevel, msg string, data ...interface{}) {
+	if q.opts.logger == nil || level > q.logMode {
+		return
+	}
+	if q.logSampling <= 0 {
+		q.log(ctx, level, msg, data...)
+		return
+	}
+
+	line := fmt.Sprintf(msg, data...)
+	suppressed, ok := q.sampler.allow(line, q.logSampling, time.Now())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		q.log(ctx, level, "%s (suppressed %d times)", line, suppressed)
+		return
+	}
+	q.log(ctx, level, "%s", line)
+}
+
+// logSampler remembers when lines are logged and how many times they are suppressed since.
+type logSampler struct {
+	mu    sync.Mutex
+	lines map[string]*sampledLine
+}
+
+type sampledLine struct {
+	at         time.Time
+	suppressed int
+}
+
+// allow reports whether line is logged, with the times it is suppressed since last logged.
+func (s *logSampler) allow(line string, window time.Duration, now time.Time) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lines == nil {
+		s.lines = map[string]*sampledLine{}
+	}
+	l, ok := s.lines[line]
+	if ok && now.Sub(l.at) < window {
+		l.suppressed++
+		return 0, false
+	}
+
+	// forget lines not repeated within the window
+	if !ok && len(s.lines) >= 1000 {
+		for k, v := range s.lines {
+			if now.Sub(v.at) >= window {
+				delete(s.lines, k)
+			}
+		}
+	}
+
+	var suppressed int
+	if ok {
+		suppressed = l.suppressed
+	}
+	s.lines[line] = &sampledLine{at: now}
+	return suppressed, true
+}
+
 type defaultLogger struct{}
 
 func (l defaultLogger) Error(ctx context.Context, msg string, data ...interface{}) {
@@ -1,25 +1,131 @@
 package dq
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type ProducerMessage struct {
 	Payload   []byte
 	DeliverAt *time.Time
+	// DedupID is used as the message ID if set,
+	// producing a message whose ID is still pending is deduplicated.
+	DedupID string
+	// Kind tells the type of payload, e.g. to select its schema.
+	Kind string
+	// Affinity routes messages with the same affinity to the same consumer
+	// instance when possible, see WithAffinityTTL.
+	Affinity string
+	// Tenant is the key of the quota of the message, see WithTenantQuota.
+	Tenant string
+	// Redrive overrides the redrive policy of the queue for the message.
+	Redrive *RedrivePolicy
+	// SLA is the target latency from the due time to the completion, see WithOnSLAMiss.
+	SLA time.Duration
+	// Parent is the ID of the fan-out job of child messages, see FanOut.
+	Parent string
+}
+
+// ProduceOption sets optional fields of messages produced by ProduceProto.
+type ProduceOption func(*ProducerMessage)
+
+// WithDeliverAt delivers the message at t.
+func WithDeliverAt(t time.Time) ProduceOption {
+	return func(m *ProducerMessage) {
+		m.DeliverAt = &t
+	}
+}
+
+// WithDedupID deduplicates the message by id.
+func WithDedupID(id string) ProduceOption {
+	return func(m *ProducerMessage) {
+		m.DedupID = id
+	}
+}
+
+// WithAffinity routes the message to the consumer instance of the affinity when possible.
+func WithAffinity(affinity string) ProduceOption {
+	return func(m *ProducerMessage) {
+		m.Affinity = affinity
+	}
+}
+
+// WithTenant counts the message to the quota of tenant.
+func WithTenant(tenant string) ProduceOption {
+	return func(m *ProducerMessage) {
+		m.Tenant = tenant
+	}
+}
+
+// WithRedrive overrides the redrive policy of the queue for the message.
+func WithRedrive(p RedrivePolicy) ProduceOption {
+	return func(m *ProducerMessage) {
+		m.Redrive = &p
+	}
+}
+
+// WithSLA sets the target latency of the message from its due time.
+func WithSLA(target time.Duration) ProduceOption {
+	return func(m *ProducerMessage) {
+		m.SLA = target
+	}
 }
 
 type Message struct {
 	ProducerMessage
 
-	ID          string
-	CreateAt    time.Time
-	DeliverCnt  int
-	ReDeliverAt *time.Time
+	ID         string
+	CreateAt   time.Time
+	DeliverCnt int
+	// ErrRetryCnt is the number of previous deliveries failed by the handler.
+	ErrRetryCnt int
+	// RedeliverCnt is the number of previous deliveries not finished,
+	// e.g. the consumer timed out or crashed.
+	RedeliverCnt int
+	ReDeliverAt  *time.Time
+	Codec        string
+	DeadAt       *time.Time
+	DeadReason   string
+	// StagedTx is the downstream transaction ID recorded by Staged.
+	StagedTx string
+	// Group is the group key of messages produced by ProduceGrouped,
+	// their payloads are delivered together in Batch.
+	Group string
+	Batch [][]byte
+	// Extra are the fields unknown to this version, e.g. written by a newer
+	// version during a rolling upgrade, they are kept when the message is written.
+	Extra map[string]string
+	// Annotations are attached by handlers of previous attempts, see Annotate.
+	Annotations map[string]string
+	// Checkpoint is saved by the handler of a previous attempt, see SaveCheckpoint.
+	Checkpoint []byte
+
+	checksum string
+	result   *Result
+	// processed is marked if the handler succeeded but the commit failed
+	processed bool
+	stage     func(context.Context, string) error
+	save      func(context.Context, string, string) error
+}
+
+// SetResult sets the result saved with the acknowledgement of the message
+// if the handler succeeds, see WithResultSaveTime.
+func (m *Message) SetResult(r Result) {
+	m.result = &r
+}
+
+// envelopeFields are the fields of message data except payload.
+var envelopeFields = []string{
+	"id", "create_at", "deliver_at", "deliver_tz", "deliver_cnt", "err_retry_cnt",
+	"re_deliver_at", "codec", "kind", "affinity", "tenant", "sla", "checksum", "staged_tx", "group", "parent", "dead_at", "dead_reason",
+	"redrive_retries", "redrive_interval", "redrive_multiplier", "redrive_max_interval", "redrive_dlq",
+	"checkpoint",
 }
 
 func (m *Message) values() []interface{} {
@@ -30,6 +136,55 @@ func (m *Message) values() []interface{} {
 	}
 	if m.DeliverAt != nil {
 		values = append(values, "deliver_at", m.DeliverAt.UnixMilli())
+		if tz := zoneName(m.DeliverAt.Location()); tz != "" {
+			values = append(values, "deliver_tz", tz)
+		}
+	}
+	if m.Codec != "" {
+		values = append(values, "codec", m.Codec)
+	}
+	if m.Kind != "" {
+		values = append(values, "kind", m.Kind)
+	}
+	if m.Affinity != "" {
+		values = append(values, "affinity", m.Affinity)
+	}
+	if m.Tenant != "" {
+		values = append(values, "tenant", m.Tenant)
+	}
+	if m.SLA > 0 {
+		values = append(values, "sla", m.SLA.Milliseconds())
+	}
+	if m.checksum != "" {
+		values = append(values, "checksum", m.checksum)
+	}
+	if m.Group != "" {
+		values = append(values, "group", m.Group)
+	}
+	if m.Parent != "" {
+		values = append(values, "parent", m.Parent)
+	}
+	if m.Redrive != nil {
+		values = append(values, m.Redrive.values()...)
+	}
+	extra := make([]string, 0, len(m.Extra))
+	for f := range m.Extra {
+		extra = append(extra, f)
+	}
+	sort.Strings(extra)
+	for _, f := range extra {
+		values = append(values, f, m.Extra[f])
+	}
+	if m.Checkpoint != nil {
+		values = append(values, "checkpoint", base64.StdEncoding.EncodeToString(m.Checkpoint))
+	}
+	annotations := make([]string, 0, len(m.Annotations))
+	for k := range m.Annotations {
+		annotations = append(annotations, k)
+	}
+	sort.Strings(annotations)
+	for _, k := range annotations {
+		values = append(values, annotationPrefix+k, m.Annotations[k])
 	}
 
 	return values
@@ -44,6 +199,7 @@ func (m *Message) parse(values []string) error {
 		return errors.New("invalid values")
 	}
 
+	var tz string
 	for i := 0; i < len(values); i += 2 {
 		switch values[i] {
 		case "id":
@@ -51,7 +207,7 @@ func (m *Message) parse(values []string) error {
 		case "payload":
 			bs, err := base64.StdEncoding.DecodeString(values[i+1])
 			if err != nil {
-				return fmt.Errorf("base64 decode failed, str: %s, err: %v", values[i+1], err)
+				return fmt.Errorf("base64 decode failed, len: %d, err: %v", len(values[i+1]), err)
 			}
 			m.Payload = bs
 		case "create_at":
@@ -61,13 +217,98 @@ func (m *Message) parse(values []string) error {
 			i, _ := strconv.ParseInt(values[i+1], 10, 64)
 			t := time.UnixMilli(i)
 			m.DeliverAt = &t
+		case "deliver_tz":
+			tz = values[i+1]
 		case "deliver_cnt":
 			i, _ := strconv.ParseInt(values[i+1], 10, 64)
 			m.DeliverCnt = int(i)
+		case "err_retry_cnt":
+			i, _ := strconv.ParseInt(values[i+1], 10, 64)
+			m.ErrRetryCnt = int(i)
 		case "re_deliver_at":
 			i, _ := strconv.ParseInt(values[i+1], 10, 64)
 			t := time.UnixMilli(i)
 			m.ReDeliverAt = &t
+		case "codec":
+			m.Codec = values[i+1]
+		case "kind":
+			m.Kind = values[i+1]
+		case "affinity":
+			m.Affinity = values[i+1]
+		case "tenant":
+			m.Tenant = values[i+1]
+		case "sla":
+			i, _ := strconv.ParseInt(values[i+1], 10, 64)
+			m.SLA = time.Duration(i) * time.Millisecond
+		case "checksum":
+			m.checksum = values[i+1]
+		case "staged_tx":
+			m.StagedTx = values[i+1]
+		case "group":
+			m.Group = values[i+1]
+		case "parent":
+			m.Parent = values[i+1]
+		case "dead_at":
+			i, _ := strconv.ParseInt(values[i+1], 10, 64)
+			t := time.UnixMilli(i)
+			m.DeadAt = &t
+		case "dead_reason":
+			m.DeadReason = values[i+1]
+		case "untracked":
+			// marked by the take script without daemon for reclaiming, internal
+		case "retry_at":
+			// set by requeuing without daemon for the take script, internal
+		case "processed_at":
+			m.processed = true
+		case "processed_status":
+			if m.result == nil {
+				m.result = &Result{}
+			}
+			m.result.Status, _ = strconv.Atoi(values[i+1])
+		case "processed_output":
+			if m.result == nil {
+				m.result = &Result{}
+			}
+			m.result.Output = values[i+1]
+		case "checkpoint":
+			bs, err := base64.StdEncoding.DecodeString(values[i+1])
+			if err != nil {
+				return fmt.Errorf("checkpoint base64 decode failed, err: %v", err)
+			}
+			m.Checkpoint = bs
+		default:
+			var p RedrivePolicy
+			if m.Redrive != nil {
+				p = *m.Redrive
+			}
+			if p.parse(values[i], values[i+1]) {
+				m.Redrive = &p
+				continue
+			}
+			if k := strings.TrimPrefix(values[i], annotationPrefix); k != values[i] {
+				if m.Annotations == nil {
+					m.Annotations = map[string]string{}
+				}
+				m.Annotations[k] = values[i+1]
+				continue
+			}
+			if m.Extra == nil {
+				m.Extra = map[string]string{}
+			}
+			m.Extra[values[i]] = values[i+1]
+		}
+	}
+
+	// the current delivery is neither retried nor redelivered
+	if m.DeliverCnt > 1 {
+		m.RedeliverCnt = m.DeliverCnt - 1 - m.ErrRetryCnt
+	}
+
+	// deliver at is shown in the zone of the producer
+	if m.DeliverAt != nil && tz != "" {
+		if loc, err := loadLocation(tz); err == nil {
+			t := m.DeliverAt.In(loc)
+			m.DeliverAt = &t
 		}
 	}
 	return nil
@@ -0,0 +1,127 @@
+package dq
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the version of the library written to the queue metadata,
+// versions of another major, or minor before v1, may have incompatible
+// scripts or message envelopes.
+const Version = "v0.1.0"
+
+// ErrVersionSkew is returned if the queue is used by an incompatible version,
+// see WithStrictVersioning.
+var ErrVersionSkew = errors.New("version skew")
+
+// Metadata describes the queue for tooling, producers and consumers write
+// their library version and options fingerprint when they start.
+type Metadata struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Owner     string    `json:"owner"`
+
+	ProducerVersion     string `json:"producer_version"`
+	ProducerFingerprint string `json:"producer_fingerprint"`
+	ConsumerVersion     string `json:"consumer_version"`
+	ConsumerFingerprint string `json:"consumer_fingerprint"`
+}
+
+// VersionSkew tells whether producers and consumers run different versions.
+func (m *Metadata) VersionSkew() bool {
+	return m.ProducerVersion != "" && m.ConsumerVersion != "" && m.ProducerVersion != m.ConsumerVersion
+}
+
+// compatible tells whether the version v shares scripts and envelopes with Version.
+func compatible(v string) bool {
+	series := func(v string) string {
+		parts := strings.SplitN(strings.TrimPrefix(v, "v"), ".", 3)
+		if parts[0] == "0" && len(parts) > 1 {
+			return "0." + parts[1]
+		}
+		return parts[0]
+	}
+	return series(v) == series(Version)
+}
+
+// checkVersion compares the versions recorded in the metadata with Version.
+func (q *Queue) checkVersion(ctx context.Context) error {
+	m, err := q.Metadata(ctx)
+	if err != nil {
+		return err
+	}
+	if v := m.ProducerVersion; v != "" && !compatible(v) {
+		return fmt.Errorf("%w: queue %s has producer of %s, running %s", ErrVersionSkew, q.name, v, Version)
+	}
+	if v := m.ConsumerVersion; v != "" && !compatible(v) {
+		return fmt.Errorf("%w: queue %s has consumer of %s, running %s", ErrVersionSkew, q.name, v, Version)
+	}
+	return nil
+}
+
+// startSide checks the version when the producer or consumer side starts
+// and writes its metadata. Version skew is only logged unless versioning is strict.
+func (q *Queue) startSide(ctx context.Context, side string) error {
+	err := q.checkVersion(ctx)
+	if err != nil && q.strictVersioning && errors.Is(err, ErrVersionSkew) {
+		q.log(ctx, Error, "queue %s refuses to start %s, err: %v", q.name, side, err)
+		return err
+	}
+	if err != nil {
+		q.log(ctx, Warn, "queue %s check version failed, err: %v", q.name, err)
+	}
+	q.writeMeta(ctx, side)
+	return nil
+}
+
+// fingerprint is the short hash of the effective options.
+func (q *Queue) fingerprint() string {
+	bs, _ := json.Marshal(q.Options())
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:8])
+}
+
+// writeMeta writes the metadata of the producer or consumer side,
+// the creation time is kept once written.
+func (q *Queue) writeMeta(ctx context.Context, side string) {
+	key := q.key(kMeta)
+	values := []interface{}{side + "_version", Version, side + "_fingerprint", q.fingerprint()}
+	if q.owner != "" {
+		values = append(values, "owner", q.owner)
+	}
+	tx := q.rdb.TxPipeline()
+	tx.HSetNX(ctx, key, "created_at", time.Now().UnixMilli())
+	tx.HSet(ctx, key, values...)
+	if _, err := tx.Exec(ctx); err != nil {
+		q.log(ctx, Warn, "queue %s write %s metadata failed, err: %v", q.name, side, err)
+	}
+}
+
+// Metadata loads the metadata of the queue.
+func (q *Queue) Metadata(ctx context.Context) (*Metadata, error) {
+	values, err := q.rdb.reader().HGetAll(ctx, q.key(kMeta)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get metadata failed, err: %v", err)
+	}
+
+	m := &Metadata{
+		Name:                q.name,
+		Owner:               values["owner"],
+		ProducerVersion:     values["producer_version"],
+		ProducerFingerprint: values["producer_fingerprint"],
+		ConsumerVersion:     values["consumer_version"],
+		ConsumerFingerprint: values["consumer_fingerprint"],
+	}
+	if v, ok := values["created_at"]; ok {
+		i, _ := strconv.ParseInt(v, 10, 64)
+		m.CreatedAt = time.UnixMilli(i)
+	}
+	return m, nil
+}
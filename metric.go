@@ -1,10 +1,99 @@
 package dq
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 // Metric defines the interface for metrics
 type Metric interface {
 	Produce(isDelayMsg bool, err error)
+	// Consume reports the message processed, retried is the number of
+	// previous handler errors of the message.
 	Consume(delay time.Duration, retried int, err error)
 	Queue(ready, delay, retry int)
 }
+
+// RedeliveryMetric is optionally implemented by Metric, Redelivered reports a message
+// redelivered redelivered times because its consumers timed out or crashed.
+type RedeliveryMetric interface {
+	Redelivered(redelivered int)
+}
+
+// PanicMetric is optionally implemented by Metric, PanicBackoff reports a worker
+// backing off for backoff after its handler panicked panics times in a row.
+type PanicMetric interface {
+	PanicBackoff(panics int, backoff time.Duration)
+}
+
+// SizeMetric is optionally implemented by Metric, PayloadSize reports the
+// encoded payload size of a produced message.
+type SizeMetric interface {
+	PayloadSize(size int)
+}
+
+// ChecksumMetric is optionally implemented by Metric, Corrupted reports a taken
+// message whose payload does not match its checksum.
+type ChecksumMetric interface {
+	Corrupted()
+}
+
+// RetentionMetric is optionally implemented by Metric, Reclaimed reports the
+// dead letters removed and the data and result keys deleted by retention.
+type RetentionMetric interface {
+	Reclaimed(dead, keys int)
+}
+
+// DaemonMetric is optionally implemented by Metric, Tick reports a daemon tick
+// moving moved due messages from the delay or retry zset to ready in elapsed,
+// lag is the time from the due time of the earliest moved message to the move.
+type DaemonMetric interface {
+	Tick(from string, moved int, elapsed, lag time.Duration)
+}
+
+const (
+	metricBatch         = 256
+	metricFlushInterval = 100 * time.Millisecond
+)
+
+// metricBuffer batches the metric calls, so they are run by a goroutine per
+// batch rather than per message.
+type metricBuffer struct {
+	mu    sync.Mutex
+	calls []func()
+}
+
+func (b *metricBuffer) add(f func()) {
+	b.mu.Lock()
+	b.calls = append(b.calls, f)
+	n := len(b.calls)
+	b.mu.Unlock()
+
+	switch {
+	case n >= metricBatch:
+		go b.flush()
+	case n == 1:
+		time.AfterFunc(metricFlushInterval, b.flush)
+	}
+}
+
+func (b *metricBuffer) flush() {
+	b.mu.Lock()
+	calls := b.calls
+	b.calls = nil
+	b.mu.Unlock()
+
+	for _, f := range calls {
+		f()
+	}
+}
+
+// emitMetric runs f calling the metric, at once if enabled by WithSyncMetric,
+// otherwise in the next flush of the metric buffer.
+func (q *Queue) emitMetric(f func()) {
+	if q.syncMetric {
+		f()
+		return
+	}
+	q.metrics.add(f)
+}
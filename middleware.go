@@ -0,0 +1,63 @@
+package dq
+
+import (
+	"reflect"
+	"runtime"
+)
+
+// Middleware is a named middleware, the name is used to place other
+// middlewares before or after it and to introspect the chain.
+type Middleware struct {
+	Name string
+	Wrap func(Handler) Handler
+}
+
+// Named names the middleware.
+func Named(name string, wrap func(Handler) Handler) Middleware {
+	return Middleware{Name: name, Wrap: wrap}
+}
+
+// middlewareInsert inserts middlewares before or after the middleware named anchor.
+type middlewareInsert struct {
+	anchor string
+	after  bool
+	mws    []Middleware
+}
+
+// funcName names middlewares without name by their function.
+func funcName(f interface{}) string {
+	if fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return "unknown"
+}
+
+// chain returns the effective middlewares, the outermost first.
+// Middlewares inserted around a missing anchor are appended to the chain.
+func (q *Queue) chain() []Middleware {
+	chain := append([]Middleware(nil), q.mws...)
+	for _, ins := range q.mwInserts {
+		i := len(chain)
+		for j, mw := range chain {
+			if mw.Name == ins.anchor {
+				i = j
+				if ins.after {
+					i++
+				}
+				break
+			}
+		}
+		chain = append(chain[:i], append(append([]Middleware(nil), ins.mws...), chain[i:]...)...)
+	}
+	return chain
+}
+
+// Middlewares returns the names of the effective middlewares, the outermost first.
+func (q *Queue) Middlewares() []string {
+	chain := q.chain()
+	names := make([]string, 0, len(chain))
+	for _, mw := range chain {
+		names = append(names, mw.Name)
+	}
+	return names
+}
@@ -0,0 +1,322 @@
+package dq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// migrateZsets are the zsets of messages copied with their data
+	migrateZsets = []redisKey{kDelay, kCold, kRetry, kDead, kHeld, kTrash}
+	// migrateKeyed are the components whose keys of messages, groups and so on are copied
+	migrateKeyed = []redisKey{kToken, kResult, kGroup, kBatch, kJob, kWorkflow, kQuota}
+	// migrateWhole are the keys copied as they are
+	migrateWhole = []redisKey{kDisabled, kAudit}
+	// migrateSkipped are the keys of instances, they are not copied
+	migrateSkipped = []redisKey{kInstances, kInflight, kAffinity, kMeta}
+)
+
+// migrated reports whether the keys of component k are copied by MigrateTo
+// or left out on purpose.
+func migrated(k redisKey) bool {
+	switch k {
+	case kReady, kData, kConfig:
+		return true
+	}
+	for _, ks := range [][]redisKey{migrateZsets, migrateKeyed, migrateWhole, migrateSkipped} {
+		for _, m := range ks {
+			if k == m {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unmigrated returns the keys of the queue MigrateTo does not know, they are
+// lost if the queue is destroyed after the migration.
+func (q *Queue) unmigrated(ctx context.Context) ([]string, error) {
+	keys, err := q.ownKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var s []string
+	for _, key := range keys {
+		for k := redisKey(0); k < numKey; k++ {
+			if own := q.key(k); (key == own || strings.HasPrefix(key, own+":")) && !migrated(k) {
+				s = append(s, key)
+				break
+			}
+		}
+	}
+	return s, nil
+}
+
+// MigrateTo copies the config, ready, delay, cold, retry, dead, held and
+// trashed messages with the dedup tokens and results to target, e.g. a new
+// Redis instance, batchSize messages at a time, and returns the number of
+// messages copied. The batches of grouped messages, fan-out jobs, workflows,
+// tenant quotas, disabled kinds and audit trail are copied as they are by
+// DUMP and RESTORE, so target must run the same or a newer Redis version.
+// The keys of instances, e.g. their in-flight messages and affinities, are
+// not copied, the messages are redelivered from retry.
+//
+// Only producers stay live during the migration: new messages are also
+// produced to target from the start of the migration until StopDualWrite.
+// Consumers and daemons must be stopped before MigrateTo, as their changes
+// to copied messages are not replicated, e.g. a commit would be delivered
+// again by target. The cutover is:
+//  1. stop consumers and daemons on the source,
+//  2. MigrateTo target,
+//  3. switch producers to target, then StopDualWrite,
+//  4. start consumers and daemons on target.
+func (q *Queue) MigrateTo(ctx context.Context, target *redis.Client, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return 0, fmt.Errorf("batch size must be positive")
+	}
+	t := &rdb{Client: target, redisPrefix: q.redisPrefix, keyNamer: q.keyNamer}
+	q.migrateTarget.Store(t)
+
+	conf, err := q.rdb.HGetAll(ctx, q.key(kConfig)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("read config failed, err: %v", err)
+	}
+	if len(conf) > 0 {
+		if err := target.HSet(ctx, q.key(kConfig), conf).Err(); err != nil {
+			return 0, fmt.Errorf("write config failed, err: %v", err)
+		}
+	}
+
+	total, err := q.migrateList(ctx, t, batchSize)
+	if err != nil {
+		return total, err
+	}
+	for _, k := range migrateZsets {
+		n, err := q.migrateZset(ctx, t, k, batchSize)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	keys := 0
+	for _, k := range migrateKeyed {
+		n, err := q.migrateKeys(ctx, t, k, batchSize)
+		keys += n
+		if err != nil {
+			return total, err
+		}
+	}
+	for _, k := range migrateWhole {
+		n, err := q.migrateDumps(ctx, t, []string{q.key(k)})
+		keys += n
+		if err != nil {
+			return total, err
+		}
+	}
+	q.log(ctx, Info, "migrate %d messages, %d keys", total, keys)
+	return total, nil
+}
+
+// migrateKeys copies the keys of the messages, e.g. token strings and result
+// hashes, with their ttl, keys already written to target, e.g. by dual write,
+// are kept.
+func (q *Queue) migrateKeys(ctx context.Context, t *rdb, k redisKey, batchSize int) (int, error) {
+	total := 0
+	iter := q.rdb.Scan(ctx, 0, escapeGlob(q.key(k))+":*", int64(batchSize)).Iterator()
+	for {
+		var keys []string
+		for len(keys) < batchSize && iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return total, fmt.Errorf("scan %s failed, err: %v", q.key(k), err)
+		}
+		if len(keys) == 0 {
+			return total, nil
+		}
+		if k != kToken && k != kResult {
+			n, err := q.migrateDumps(ctx, t, keys)
+			total += n
+			if err != nil {
+				return total, err
+			}
+			continue
+		}
+
+		pipe := q.rdb.Pipeline()
+		tokens := make([]*redis.StringCmd, len(keys))
+		results := make([]*redis.MapStringStringCmd, len(keys))
+		ttls := make([]*redis.DurationCmd, len(keys))
+		for i, key := range keys {
+			if k == kToken {
+				tokens[i] = pipe.Get(ctx, key)
+			} else {
+				results[i] = pipe.HGetAll(ctx, key)
+			}
+			ttls[i] = pipe.PTTL(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return total, fmt.Errorf("read %s failed, err: %v", q.key(k), err)
+		}
+
+		for i, key := range keys {
+			ttl := ttls[i].Val()
+			if ttl < 0 {
+				ttl = 0
+			}
+			var ok bool
+			var err error
+			if k == kToken {
+				// expired meanwhile
+				if tokens[i].Err() != nil {
+					continue
+				}
+				ok, err = t.SetNX(ctx, key, tokens[i].Val(), ttl).Result()
+			} else {
+				if len(results[i].Val()) == 0 {
+					continue
+				}
+				values := make([]interface{}, 0, len(results[i].Val())*2)
+				for f, v := range results[i].Val() {
+					values = append(values, f, v)
+				}
+				ok, err = t.runMigrateHash(ctx, key, ttl, values)
+			}
+			if err != nil {
+				return total, fmt.Errorf("write %s failed, err: %v", key, err)
+			}
+			if ok {
+				total++
+			}
+		}
+	}
+}
+
+// migrateDumps copies the keys of any type by DUMP and RESTORE with their ttl,
+// keys already written to target are kept.
+func (q *Queue) migrateDumps(ctx context.Context, t *rdb, keys []string) (int, error) {
+	pipe := q.rdb.Pipeline()
+	dumps := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		dumps[i] = pipe.Dump(ctx, key)
+		ttls[i] = pipe.PTTL(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return 0, fmt.Errorf("dump keys failed, err: %v", err)
+	}
+
+	n := 0
+	for i, key := range keys {
+		// expired meanwhile
+		if dumps[i].Err() != nil {
+			continue
+		}
+		ttl := ttls[i].Val()
+		if ttl < 0 {
+			ttl = 0
+		}
+		err := t.Restore(ctx, key, ttl, dumps[i].Val()).Err()
+		if err != nil && strings.HasPrefix(err.Error(), "BUSYKEY") {
+			continue
+		}
+		if err != nil {
+			return n, fmt.Errorf("restore %s failed, err: %v", key, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// StopDualWrite stops producing new messages to the target of MigrateTo.
+func (q *Queue) StopDualWrite() {
+	q.migrateTarget.Store(nil)
+}
+
+// dualWrite produces the message to the migration target if migrating.
+func (q *Queue) dualWrite(ctx context.Context, cm *Message, token string) {
+	t := q.migrateTarget.Load()
+	if t == nil {
+		return
+	}
+	if _, err := q.enqueueTo(ctx, t, cm, token); err != nil {
+		q.log(ctx, Warn, "dual write message %s failed, err: %v", cm.ID, err)
+	}
+}
+
+// migrateList copies the ready list from the left, the newest first,
+// so concurrent produces only shift the messages not copied yet.
+func (q *Queue) migrateList(ctx context.Context, t *rdb, batchSize int) (int, error) {
+	total := 0
+	for start := int64(0); ; start += int64(batchSize) {
+		ids, err := q.rdb.LRange(ctx, q.key(kReady), start, start+int64(batchSize)-1).Result()
+		if err != nil {
+			return total, fmt.Errorf("read ready failed, err: %v", err)
+		}
+		scores := make([]string, len(ids))
+		n, err := q.migrateMsgs(ctx, t, kReady, ids, scores)
+		total += n
+		if err != nil || len(ids) < batchSize {
+			return total, err
+		}
+	}
+}
+
+func (q *Queue) migrateZset(ctx context.Context, t *rdb, k redisKey, batchSize int) (int, error) {
+	total := 0
+	for start := int64(0); ; start += int64(batchSize) {
+		zs, err := q.rdb.ZRangeWithScores(ctx, q.key(k), start, start+int64(batchSize)-1).Result()
+		if err != nil {
+			return total, fmt.Errorf("read %s failed, err: %v", q.key(k), err)
+		}
+		ids, scores := make([]string, len(zs)), make([]string, len(zs))
+		for i, z := range zs {
+			ids[i] = z.Member.(string)
+			scores[i] = strconv.FormatFloat(z.Score, 'f', -1, 64)
+		}
+		n, err := q.migrateMsgs(ctx, t, k, ids, scores)
+		total += n
+		if err != nil || len(zs) < batchSize {
+			return total, err
+		}
+	}
+}
+
+// migrateMsgs copies the messages with their data, messages without data are skipped.
+func (q *Queue) migrateMsgs(ctx context.Context, t *rdb, k redisKey, ids, scores []string) (int, error) {
+	pipe := q.rdb.Pipeline()
+	datas := make([]*redis.MapStringStringCmd, len(ids))
+	ttls := make([]*redis.DurationCmd, len(ids))
+	for i, id := range ids {
+		datas[i] = pipe.HGetAll(ctx, q.key(kData)+":"+id)
+		ttls[i] = pipe.PTTL(ctx, q.key(kData)+":"+id)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("read messages failed, err: %v", err)
+	}
+
+	n := 0
+	for i, id := range ids {
+		data := datas[i].Val()
+		if len(data) == 0 {
+			continue
+		}
+		values := make([]interface{}, 0, len(data)*2)
+		for f, v := range data {
+			values = append(values, f, v)
+		}
+		ok, err := t.runMigrateMsg(ctx, q.key(k), q.key(kData), id, scores[i], ttls[i].Val(), values)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
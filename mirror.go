@@ -0,0 +1,39 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+)
+
+// MirrorMode tells how failures to mirror produced messages are handled.
+type MirrorMode int
+
+const (
+	// MirrorBestEffort logs failures to mirror, the produce succeeds.
+	MirrorBestEffort MirrorMode = iota
+	// MirrorStrict fails the produce and cancels the message if it can't be mirrored.
+	MirrorStrict
+)
+
+// mirror produces the message to the mirror queue set by WithMirrorTo.
+func (q *Queue) mirror(ctx context.Context, r *Receipt, cm *Message, token string) error {
+	if q.mirrorTo == nil {
+		return nil
+	}
+	_, err := q.mirrorTo.enqueue(ctx, cm, token)
+	if err == nil {
+		return nil
+	}
+
+	err = fmt.Errorf("mirror message %s to %s failed, err: %w", cm.ID, q.mirrorTo.name, err)
+	if q.mirrorMode != MirrorStrict {
+		q.log(ctx, Warn, "%v", err)
+		return nil
+	}
+	if !r.Deduplicated {
+		if cerr := q.Cancel(ctx, cm.ID); cerr != nil {
+			q.log(ctx, Error, "cancel unmirrored message %s failed, err: %v", cm.ID, cerr)
+		}
+	}
+	return err
+}
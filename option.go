@@ -1,6 +1,8 @@
 package dq
 
 import (
+	"context"
+	"io"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -9,31 +11,126 @@ import (
 
 type opts struct {
 	// basic
-	name string
+	name             string
+	owner            string
+	strictVersioning bool
 
 	// daemon
 	daemonWorkerNum      int
 	daemonWorkerInterval time.Duration
+	noDaemon             bool
 
 	// consumer
+	role                  Role
 	consumeWorkerNum      int
 	consumeWorkerInterval time.Duration
 	consumeTimeout        time.Duration
+	attemptTimeout        func(attempt int) time.Duration
+	dequeueOrder          DequeueOrder
+	limiterStrategy       LimiterStrategy
+	affinityTTL           time.Duration
+	poolSizes             [numPool]int
+	kindPools             map[string]WorkerPool
+	onConsumeError        func(error)
+	maxPanicBackoff       time.Duration
 	retryTimes            int
 	retryInterval         time.Duration
+	retryMatrix           map[ErrorClass]RetryPolicy
+	commitRetryTimes      int
+	commitRetryInterval   time.Duration
+	asyncCommit           bool
+	classifier            func(error) ErrorClass
+	blackoutWindows       []Window
+	sla                   time.Duration
+	onSLAMiss             func(context.Context, *Message, time.Duration)
+	redrive               RedrivePolicy
+
+	// remote config
+	configReloadInterval time.Duration
+
+	// registry
+	heartbeatInterval time.Duration
+	queueTTL          time.Duration
+	busyThreshold     float64
+	onBusy            func(context.Context, float64)
+
+	// shutdown
+	onShutdown []func(context.Context) error
+
+	// rate schedule
+	rateSchedule []RateWindow
+
+	// daemon gate
+	gate Gate
+
+	// cold tier
+	coldHorizon time.Duration
+
+	// handoff
+	stagedVerifier func(context.Context, *Message) (bool, error)
+
+	// retention
+	retentionAge      time.Duration
+	retentionInterval time.Duration
+	deadMaxLen        int64
 
 	// middleware
-	mws []middlewareFunc
+	mws          []Middleware
+	mwInserts    []middlewareInsert
+	transformers map[string][]Transformer
 
 	// message
-	messageSaveTime time.Duration
+	messageSaveTime    time.Duration
+	deliverAtMaxPast   time.Duration
+	deliverAtMaxFuture time.Duration
+	maxDelay           time.Duration
+	trashWindow        time.Duration
+	codec              Codec
+	codecs             map[string]Codec
+	resultSaveTime     time.Duration
+	tokenSaveTime      time.Duration
+	payloadSizeWarning int
+	maxReadyLen        int64
+	overflowPolicy     OverflowPolicy
+	onDropped          func(context.Context, []string)
+	onLargePayload     func(context.Context, *ProducerMessage, int)
+	validator          Validator
+	validateStages     ValidateStage
+	checksum           bool
+	quota              Quota
+	tenantQuotas       map[string]Quota
+
+	// mirror
+	mirrorTo   *Queue
+	mirrorMode MirrorMode
+
+	// failover
+	standby          *redis.Client
+	failoverInterval time.Duration
+	failoverChecks   int
 
 	// logger
-	logMode LogLevel
-	logger  Logger
+	logMode     LogLevel
+	logger      Logger
+	logSampling time.Duration
+	redactor    Redactor
+
+	produceSampling *produceSampling
 
 	// metric
-	metric Metric
+	metric     Metric
+	syncMetric bool
+
+	// audit
+	auditMaxLen      int64
+	liveTail         bool
+	completionNotify bool
+	recorder         *recorder
+
+	// testing
+	faultInjector *FaultInjector
+	inline        bool
+	dryRun        bool
 }
 
 func defaultOpts() opts {
@@ -46,24 +143,63 @@ func defaultOpts() opts {
 		consumeWorkerNum:      2,
 		consumeWorkerInterval: 100 * time.Millisecond,
 		consumeTimeout:        3 * time.Second,
+		maxPanicBackoff:       30 * time.Second,
+		affinityTTL:           30 * time.Second,
 		retryTimes:            3,
 		retryInterval:         3 * time.Second,
+		commitRetryTimes:      3,
+		commitRetryInterval:   50 * time.Millisecond,
+		classifier:            defaultClassifier,
+
+		configReloadInterval: 1 * time.Second,
+
+		heartbeatInterval: 5 * time.Second,
+
+		retentionInterval: time.Minute,
 
 		mws: nil,
 
 		messageSaveTime: 30 * 24 * time.Hour,
+		tokenSaveTime:   24 * time.Hour,
+		trashWindow:     time.Hour,
+		codec:           Identity,
+		codecs: map[string]Codec{
+			Identity.Name(): Identity,
+			Gzip.Name():     Gzip,
+		},
 
-		logMode: Silent,
-		logger:  defaultLogger{},
+		logMode:     Silent,
+		logger:      defaultLogger{},
+		logSampling: 10 * time.Second,
 	}
 }
 
+// WithName sets the name of the queue, it must not contain ':', which
+// separates the keys of the queue from its keys of messages, queues named
+// so are rejected by Produce, Consume and Destroy.
 func WithName(name string) func(*Queue) {
 	return func(q *Queue) {
 		q.name = name
 	}
 }
 
+// WithOwner sets the owner label written to the queue metadata,
+// e.g. the team or service owning the queue.
+func WithOwner(owner string) func(*Queue) {
+	return func(q *Queue) {
+		q.owner = owner
+	}
+}
+
+// WithStrictVersioning refuses to produce or consume if the queue is used by
+// an incompatible version, instead of only logging a warning. Produce returns
+// ErrVersionSkew and Consume starts nothing.
+func WithStrictVersioning() func(*Queue) {
+	return func(q *Queue) {
+		q.strictVersioning = true
+	}
+}
+
 func WithDaemonWorkerNum(num int) func(*Queue) {
 	return func(q *Queue) {
 		q.daemonWorkerNum = num
@@ -76,6 +212,60 @@ func WithDaemonWorkerInterval(interval time.Duration) func(*Queue) {
 	}
 }
 
+// WithoutDaemon runs no daemon for realtime-only queues, taken messages are
+// not tracked in the retry zset so they are redelivered only once their
+// instance is deregistered, failed messages are pushed back to ready and
+// taken again once their retry delay passed, and delay messages are moved
+// by daemons of other instances only.
+func WithoutDaemon() func(*Queue) {
+	return func(q *Queue) {
+		q.noDaemon = true
+	}
+}
+
+// WithGate sets the gate checked before a due delay message becomes ready.
+func WithGate(g Gate) func(*Queue) {
+	return func(q *Queue) {
+		q.gate = g
+	}
+}
+
+// WithColdTier keeps messages delivered beyond horizon in a cold zset,
+// the daemon promotes them to the delay zset once they are within horizon.
+// Daemons without cold tier promote them too, within a minute of their due time.
+func WithColdTier(horizon time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.coldHorizon = horizon
+	}
+}
+
+// WithRetention makes the daemon delete dead letters dead longer than age,
+// with their data and results, every interval. Dead letters whose data has
+// expired and trash entries beyond the trash window are pruned regardless of age.
+func WithRetention(age, interval time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.retentionAge = age
+		q.retentionInterval = interval
+	}
+}
+
+// WithDeadLetterMaxLen makes the daemon keep at most n dead letters, deleting
+// the oldest with their data and results, by default or with a non-positive n
+// they are all kept.
+func WithDeadLetterMaxLen(n int64) func(*Queue) {
+	return func(q *Queue) {
+		q.deadMaxLen = n
+	}
+}
+
+// WithTrashWindow sets how long canceled messages are kept in the trash to be
+// restored, a non-positive window deletes them at once.
+func WithTrashWindow(window time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.trashWindow = window
+	}
+}
+
 func WithConsumerWorkerNum(num int) func(*Queue) {
 	return func(q *Queue) {
 		q.consumeWorkerNum = num
@@ -88,12 +278,109 @@ func WithConsumerTimeout(timeout time.Duration) func(*Queue) {
 	}
 }
 
+// WithConsumerTimeoutFunc sets the consume timeout by the attempt starting at 1,
+// e.g. to give retries more time after failures due to cold caches. It overrides
+// WithConsumerTimeout for positive durations, timeouts longer than the retry
+// interval let the message be redelivered while it is processed.
+func WithConsumerTimeoutFunc(timeout func(attempt int) time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.attemptTimeout = timeout
+	}
+}
+
+// WithOnConsumeError sets the hook called with take, parse and commit failures
+// of consumers, e.g. to alert on sustained broker errors. Handler errors are retried instead.
+func WithOnConsumeError(hook func(err error)) func(*Queue) {
+	return func(q *Queue) {
+		q.onConsumeError = hook
+	}
+}
+
+// WithRole sets the part of the work run by Consume, e.g. to scale a
+// SchedulerOnly deployment and WorkerOnly deployments independently.
+func WithRole(role Role) func(*Queue) {
+	return func(q *Queue) {
+		q.role = role
+	}
+}
+
+// WithDefaultSLA sets the target latency of messages without their own SLA.
+func WithDefaultSLA(target time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.sla = target
+	}
+}
+
+// WithOnSLAMiss sets the hook called with the latency of messages
+// completed later than their SLA after they were due.
+func WithOnSLAMiss(hook func(ctx context.Context, m *Message, latency time.Duration)) func(*Queue) {
+	return func(q *Queue) {
+		q.onSLAMiss = hook
+	}
+}
+
+// WithDequeueOrder sets the order ready messages are taken in, FIFO by default.
+func WithDequeueOrder(order DequeueOrder) func(*Queue) {
+	return func(q *Queue) {
+		q.dequeueOrder = order
+	}
+}
+
+// WithWorkerPools runs cpu handlers of PoolCPU kinds and io handlers of
+// PoolIO kinds at most at the same time, with cpu+io consumer workers.
+// Both sizes must be positive, otherwise consuming fails to start.
+// A message of a busy pool is delayed briefly instead of waiting for a slot,
+// so the messages of the other pool are taken meanwhile.
+func WithWorkerPools(cpu, io int) func(*Queue) {
+	return func(q *Queue) {
+		q.poolSizes[PoolCPU] = cpu
+		q.poolSizes[PoolIO] = io
+		q.consumeWorkerNum = cpu + io
+	}
+}
+
+// WithKindPool assigns the kinds to the pool, kinds are in PoolIO by default.
+func WithKindPool(pool WorkerPool, kinds ...string) func(*Queue) {
+	return func(q *Queue) {
+		if q.kindPools == nil {
+			q.kindPools = make(map[string]WorkerPool)
+		}
+		for _, kind := range kinds {
+			q.kindPools[kind] = pool
+		}
+	}
+}
+
+// WithAffinityTTL sets how long a consumer instance keeps the affinity of its
+// last taken message, messages of the affinity are left to other instances
+// until it expires.
+func WithAffinityTTL(ttl time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.affinityTTL = ttl
+	}
+}
+
+// WithMaxPanicBackoff caps the backoff of workers whose handler keeps panicking.
+func WithMaxPanicBackoff(max time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.maxPanicBackoff = max
+	}
+}
+
 func WithConsumerWorkerInterval(interval time.Duration) func(*Queue) {
 	return func(q *Queue) {
 		q.consumeWorkerInterval = interval
 	}
 }
 
+// WithBlackoutWindows stops consumers from taking messages inside the windows,
+// messages accumulate and are delivered after the window ends.
+func WithBlackoutWindows(ws ...Window) func(*Queue) {
+	return func(q *Queue) {
+		q.blackoutWindows = ws
+	}
+}
+
 func WithRetryTimes(times int) func(*Queue) {
 	return func(q *Queue) {
 		q.retryTimes = times
@@ -106,9 +393,138 @@ func WithRetryInterval(interval time.Duration) func(*Queue) {
 	}
 }
 
+// WithRedrivePolicy sets the retry times, retry interval and message save time
+// of the queue from the non-zero fields of p, together with its backoff
+// and dead letter queue.
+func WithRedrivePolicy(p RedrivePolicy) func(*Queue) {
+	return func(q *Queue) {
+		q.redrive = p
+		if p.MaxRetries > 0 {
+			q.retryTimes = p.MaxRetries
+		}
+		if p.Interval > 0 {
+			q.retryInterval = p.Interval
+		}
+		if p.Expiration > 0 {
+			q.messageSaveTime = p.Expiration
+		}
+	}
+}
+
+// WithCommitRetry retries failed commits times, the interval doubles on every retry.
+func WithCommitRetry(times int, interval time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.commitRetryTimes = times
+		q.commitRetryInterval = interval
+	}
+}
+
+// WithAsyncCommit acknowledges processed messages asynchronously in batches,
+// workers take the next message without waiting for the commit. Messages
+// not committed before a crash are delivered again, so handlers must be idempotent.
+func WithAsyncCommit() func(*Queue) {
+	return func(q *Queue) {
+		q.asyncCommit = true
+	}
+}
+
+// WithConfigReloadInterval sets how often the config stored in redis is reloaded,
+// a non-positive interval loads it only once when consuming starts.
+func WithConfigReloadInterval(interval time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.configReloadInterval = interval
+	}
+}
+
+// WithRetryMatrix sets the RetryPolicy of each ErrorClass.
+func WithRetryMatrix(matrix map[ErrorClass]RetryPolicy) func(*Queue) {
+	return func(q *Queue) {
+		q.retryMatrix = matrix
+	}
+}
+
+// WithErrorClassifier sets the classifier mapping handler errors to ErrorClass.
+func WithErrorClassifier(classifier func(error) ErrorClass) func(*Queue) {
+	return func(q *Queue) {
+		q.classifier = classifier
+	}
+}
+
+// WithOnShutdown adds hooks called by Close after consumers stop taking messages
+// but before waiting for in-flight handlers, within the same ctx deadline.
+func WithOnShutdown(hooks ...func(context.Context) error) func(*Queue) {
+	return func(q *Queue) {
+		q.onShutdown = append(q.onShutdown, hooks...)
+	}
+}
+
+// WithHeartbeatInterval sets how often the consumer instance refreshes itself in the registry.
+func WithHeartbeatInterval(interval time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.heartbeatInterval = interval
+	}
+}
+
+// WithQueueTTL expires the keys of the queue after ttl without produce or
+// consumer heartbeat, so abandoned ephemeral queues are removed by redis.
+// The TTL is refreshed by produce and heartbeat at most once per tenth of it,
+// keep it well above the heartbeat interval.
+func WithQueueTTL(ttl time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.queueTTL = ttl
+	}
+}
+
+// WithBusyThreshold sets the hook called every heartbeat interval while the
+// busy ratio of the workers is threshold or higher, e.g. to scale out consumers.
+// The hook runs in the background, calls are skipped while the previous one runs.
+func WithBusyThreshold(threshold float64, hook func(ctx context.Context, ratio float64)) func(*Queue) {
+	return func(q *Queue) {
+		q.busyThreshold = threshold
+		q.onBusy = hook
+	}
+}
+
 func WithMiddleware(mws ...middlewareFunc) func(*Queue) {
 	return func(q *Queue) {
-		q.mws = mws
+		q.mws = q.mws[:0]
+		for _, mw := range mws {
+			q.mws = append(q.mws, Named(funcName(mw), mw))
+		}
+	}
+}
+
+// WithNamedMiddleware appends the named middlewares to the chain.
+func WithNamedMiddleware(mws ...Middleware) func(*Queue) {
+	return func(q *Queue) {
+		q.mws = append(q.mws, mws...)
+	}
+}
+
+// WithMiddlewareBefore inserts the middlewares outside of the middleware named anchor,
+// the insertion is resolved when consuming starts, so anchor may be added later.
+func WithMiddlewareBefore(anchor string, mws ...Middleware) func(*Queue) {
+	return func(q *Queue) {
+		q.mwInserts = append(q.mwInserts, middlewareInsert{anchor: anchor, mws: mws})
+	}
+}
+
+// WithMiddlewareAfter inserts the middlewares inside of the middleware named anchor,
+// the insertion is resolved when consuming starts, so anchor may be added later.
+func WithMiddlewareAfter(anchor string, mws ...Middleware) func(*Queue) {
+	return func(q *Queue) {
+		q.mwInserts = append(q.mwInserts, middlewareInsert{anchor: anchor, after: true, mws: mws})
+	}
+}
+
+// WithTransformers appends transformers run in order on messages of kind
+// right before the handler, so handlers see the latest payload schema.
+func WithTransformers(kind string, ts ...Transformer) func(*Queue) {
+	return func(q *Queue) {
+		if q.transformers == nil {
+			q.transformers = map[string][]Transformer{}
+		}
+		q.transformers[kind] = append(q.transformers[kind], ts...)
 	}
 }
 
@@ -118,6 +534,118 @@ func WithMessageSaveTime(saveTime time.Duration) func(*Queue) {
 	}
 }
 
+// WithResultSaveTime saves the results set by handlers with Message.SetResult
+// for saveTime after the message is committed, see Queue.Result.
+func WithResultSaveTime(saveTime time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.resultSaveTime = saveTime
+	}
+}
+
+// WithTokenSaveTime sets how long produce tokens of ProduceWithToken are kept.
+func WithTokenSaveTime(saveTime time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.tokenSaveTime = saveTime
+	}
+}
+
+// WithMaxReadyLen limits the ready list to maxLen messages, the policy decides
+// whether new messages are rejected or the oldest ones are dropped.
+func WithMaxReadyLen(maxLen int64, policy OverflowPolicy) func(*Queue) {
+	return func(q *Queue) {
+		q.maxReadyLen = maxLen
+		q.overflowPolicy = policy
+	}
+}
+
+// WithOnDropped sets the hook called with the IDs of messages dropped by OverflowDropOldest.
+func WithOnDropped(hook func(ctx context.Context, ids []string)) func(*Queue) {
+	return func(q *Queue) {
+		q.onDropped = hook
+	}
+}
+
+// WithPayloadSizeWarning logs a warning and calls hook, if not nil, when the
+// encoded payload of a produced message exceeds size bytes.
+func WithPayloadSizeWarning(size int, hook func(ctx context.Context, m *ProducerMessage, size int)) func(*Queue) {
+	return func(q *Queue) {
+		q.payloadSizeWarning = size
+		q.onLargePayload = hook
+	}
+}
+
+// WithSchemaValidator validates payload at stages, e.g. ValidateOnProduce|ValidateOnConsume.
+func WithSchemaValidator(v Validator, stages ValidateStage) func(*Queue) {
+	return func(q *Queue) {
+		q.validator = v
+		q.validateStages = stages
+	}
+}
+
+// WithChecksum stores the checksum of produced payloads, taken messages with
+// a mismatched checksum are moved to dead letter without processing.
+func WithChecksum() func(*Queue) {
+	return func(q *Queue) {
+		q.checksum = true
+	}
+}
+
+// WithQuota sets the quota of every tenant without its own quota.
+func WithQuota(quota Quota) func(*Queue) {
+	return func(q *Queue) {
+		q.quota = quota
+	}
+}
+
+// WithTenantQuota sets the quota of tenant, messages are counted to the
+// quota of their Tenant, messages without tenant are not limited.
+func WithTenantQuota(tenant string, quota Quota) func(*Queue) {
+	return func(q *Queue) {
+		if q.tenantQuotas == nil {
+			q.tenantQuotas = map[string]Quota{}
+		}
+		q.tenantQuotas[tenant] = quota
+	}
+}
+
+// WithDeliverAtBounds rejects produced messages whose DeliverAt is more than past
+// before or future after now, a non-positive bound is not checked.
+// DeliverAt is not bounded by default.
+func WithDeliverAtBounds(past, future time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.deliverAtMaxPast = past
+		q.deliverAtMaxFuture = future
+	}
+}
+
+// WithMaxDelay rejects produced messages delivered more than d after now
+// with ErrMaxDelayExceeded, the stricter of d and the future bound of
+// WithDeliverAtBounds applies.
+func WithMaxDelay(d time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.maxDelay = d
+	}
+}
+
+// WithCodec sets the codec used to encode produced payload,
+// the codec is also registered for decoding.
+func WithCodec(c Codec) func(*Queue) {
+	return func(q *Queue) {
+		q.codec = c
+		q.codecs[c.Name()] = c
+	}
+}
+
+// WithCodecs registers codecs accepted when consuming, so consumers can be
+// upgraded before producers switch to a new codec.
+func WithCodecs(cs ...Codec) func(*Queue) {
+	return func(q *Queue) {
+		for _, c := range cs {
+			q.codecs[c.Name()] = c
+		}
+	}
+}
+
 func WithLogMode(mode LogLevel) func(*Queue) {
 	return func(q *Queue) {
 		q.logMode = mode
@@ -130,26 +658,338 @@ func WithLogger(logger Logger) func(*Queue) {
 	}
 }
 
+// WithLogSampling suppresses identical failure logs of consumers repeated within window,
+// the suppressed times are logged with the next line, 0 disables sampling.
+func WithLogSampling(window time.Duration) func(*Queue) {
+	return func(q *Queue) {
+		q.logSampling = window
+	}
+}
+
+// WithProduceSampling samples percent, from 0 to 100, of the produced messages
+// up to limit per second for traffic analysis. Samples are passed to sink,
+// or logged at the Info level if sink is nil.
+func WithProduceSampling(percent float64, limit rate.Limit, sink func(ctx context.Context, s ProduceSample)) func(*Queue) {
+	return func(q *Queue) {
+		q.produceSampling = &produceSampling{percent: percent, lim: rate.NewLimiter(limit, 1), sink: sink}
+	}
+}
+
+// WithRedactor masks payload wherever it is logged.
+func WithRedactor(r Redactor) func(*Queue) {
+	return func(q *Queue) {
+		q.redactor = r
+	}
+}
+
 func WithRedis(rdb *redis.Client) func(*Queue) {
 	return func(q *Queue) {
 		q.rdb.Client = rdb
 	}
 }
 
+// WithReadReplica serves Stats, Instances, GetMessage and AuditLog from a replica,
+// so inspection doesn't load the primary serving consumers.
+func WithReadReplica(rdb *redis.Client) func(*Queue) {
+	return func(q *Queue) {
+		q.rdb.replica = rdb
+	}
+}
+
+// WithMirrorTo also produces every message to other, e.g. another redis
+// cluster or queue name to be validated with real traffic during a migration.
+// The message is encoded by this queue, so other should have its codec.
+func WithMirrorTo(other *Queue, mode MirrorMode) func(*Queue) {
+	return func(q *Queue) {
+		q.mirrorTo = other
+		q.mirrorMode = mode
+	}
+}
+
+// WithStandby fails over to standby once the primary set by WithRedis fails
+// checks in a row, checked every interval, 3 checks every 1s by default,
+// e.g. for deployments without Sentinel. It fails back once the primary passes
+// checks in a row and moves the messages produced to standby meanwhile back.
+func WithStandby(standby *redis.Client, interval time.Duration, checks int) func(*Queue) {
+	return func(q *Queue) {
+		q.standby = standby
+		q.failoverInterval = interval
+		q.failoverChecks = checks
+	}
+}
+
 func WithRedisKeyPrefix(prefix string) func(*Queue) {
 	return func(q *Queue) {
 		q.rdb.redisPrefix = prefix
 	}
 }
 
+// WithKeyNamer names the redis keys of the queue by namer instead of
+// "<prefix>:<component>:<queue>", e.g. to add hash tags for redis cluster.
+// Keys of a message are derived by appending ":<id>" to the component key.
+// Queues named by a custom namer are not found by Discover.
+func WithKeyNamer(namer func(queue, component string) string) func(*Queue) {
+	return func(q *Queue) {
+		q.rdb.keyNamer = namer
+	}
+}
+
 func WithMetric(m Metric) func(*Queue) {
 	return func(q *Queue) {
 		q.metric = m
 	}
 }
 
+// WithSyncMetric calls the metric in the producing and consuming goroutines
+// rather than batched in the background, for metrics which never block,
+// e.g. atomic counters.
+func WithSyncMetric() func(*Queue) {
+	return func(q *Queue) {
+		q.syncMetric = true
+	}
+}
+
+// WithRateSchedule shapes the consume rate by time of day,
+// the first window containing now is used, otherwise the limiter set by WithLimiter.
+func WithRateSchedule(rws ...RateWindow) func(*Queue) {
+	return func(q *Queue) {
+		q.rateSchedule = rws
+	}
+}
+
+// WithRecorder writes the messages taken by the consumer to w as JSON lines,
+// e.g. an *os.File, they can be processed again offline by Replay.
+// Payloads are recorded decoded and are not redacted like in logs.
+func WithRecorder(w io.Writer) func(*Queue) {
+	return func(q *Queue) {
+		q.recorder = &recorder{w: w}
+	}
+}
+
+// WithInlineMode processes produced messages by the handler of Consume
+// in the producing goroutine without redis, e.g. for local development and
+// tests. Messages are delivered at once and handler errors are returned by Produce.
+func WithInlineMode() func(*Queue) {
+	return func(q *Queue) {
+		q.inline = true
+	}
+}
+
+// WithStagedVerifier verifies the taken messages staged by a previous attempt,
+// those verify reports as handed off are committed without calling the handler,
+// as Reconcile does for the messages whose retry is due.
+func WithStagedVerifier(verify func(ctx context.Context, m *Message) (bool, error)) func(*Queue) {
+	return func(q *Queue) {
+		q.stagedVerifier = verify
+	}
+}
+
+// WithDryRun runs the middlewares and the handler on the taken messages but
+// never commits, retries or dead-letters them. They are pushed back to ready
+// at once without counting the delivery, e.g. to validate a new consumer
+// build against live traffic.
+func WithDryRun() func(*Queue) {
+	return func(q *Queue) {
+		q.dryRun = true
+	}
+}
+
+// WithFaultInjector injects broker faults, for tests only.
+func WithFaultInjector(f *FaultInjector) func(*Queue) {
+	return func(q *Queue) {
+		q.faultInjector = f
+	}
+}
+
+// WithAuditLog appends every state transition of messages to a redis stream
+// capped at about maxLen events, see Queue.AuditLog.
+func WithAuditLog(maxLen int64) func(*Queue) {
+	return func(q *Queue) {
+		q.auditMaxLen = maxLen
+	}
+}
+
+// WithLiveTail publishes every state transition of messages by redis pub/sub,
+// e.g. to be watched by Queue.Tail while debugging.
+func WithLiveTail() func(*Queue) {
+	return func(q *Queue) {
+		q.liveTail = true
+	}
+}
+
+// WithCompletionNotify publishes the completion of messages by redis pub/sub,
+// e.g. for producers waiting by Queue.WaitCompletion.
+func WithCompletionNotify() func(*Queue) {
+	return func(q *Queue) {
+		q.completionNotify = true
+	}
+}
+
 func WithLimiter(limit rate.Limit, burst int) func(*Queue) {
 	return func(q *Queue) {
 		q.lim = rate.NewLimiter(limit, burst)
 	}
 }
+
+// WithLimiterStrategy sets how consumer workers are paced by the limiter,
+// LimiterWait by default.
+func WithLimiterStrategy(s LimiterStrategy) func(*Queue) {
+	return func(q *Queue) {
+		q.limiterStrategy = s
+	}
+}
+
+// Options is the effective configuration of a queue, e.g. to be logged at startup.
+type Options struct {
+	Name             string `json:"name"`
+	Owner            string `json:"owner"`
+	StrictVersioning bool   `json:"strict_versioning"`
+	RedisKeyPrefix   string `json:"redis_key_prefix"`
+	KeyNamer         bool   `json:"key_namer"`
+	ReadReplica      bool   `json:"read_replica"`
+
+	DaemonWorkerNum      int           `json:"daemon_worker_num"`
+	DaemonWorkerInterval time.Duration `json:"daemon_worker_interval"`
+	WithoutDaemon        bool          `json:"without_daemon"`
+	InlineMode           bool          `json:"inline_mode"`
+	DryRun               bool          `json:"dry_run"`
+
+	Role                  Role          `json:"role"`
+	ConsumeWorkerNum      int           `json:"consume_worker_num"`
+	ConsumeWorkerInterval time.Duration `json:"consume_worker_interval"`
+	ConsumeTimeout        time.Duration `json:"consume_timeout"`
+	AttemptTimeout        bool          `json:"attempt_timeout"`
+	DequeueOrder          DequeueOrder  `json:"dequeue_order"`
+	// RateLimit is -1 if unlimited.
+	RateLimit           float64                    `json:"rate_limit"`
+	RateBurst           int                        `json:"rate_burst"`
+	LimiterStrategy     LimiterStrategy            `json:"limiter_strategy"`
+	MaxPanicBackoff     time.Duration              `json:"max_panic_backoff"`
+	RetryTimes          int                        `json:"retry_times"`
+	RetryInterval       time.Duration              `json:"retry_interval"`
+	RetryMultiplier     float64                    `json:"retry_multiplier"`
+	RetryMaxInterval    time.Duration              `json:"retry_max_interval"`
+	DeadLetterQueue     string                     `json:"dead_letter_queue,omitempty"`
+	RetryMatrix         map[ErrorClass]RetryPolicy `json:"retry_matrix,omitempty"`
+	CommitRetryTimes    int                        `json:"commit_retry_times"`
+	CommitRetryInterval time.Duration              `json:"commit_retry_interval"`
+	AsyncCommit         bool                       `json:"async_commit"`
+	BlackoutWindows     int                        `json:"blackout_windows"`
+	RateWindows         int                        `json:"rate_windows"`
+	Middlewares         []string                   `json:"middlewares"`
+
+	ConfigReloadInterval time.Duration `json:"config_reload_interval"`
+	HeartbeatInterval    time.Duration `json:"heartbeat_interval"`
+	QueueTTL             time.Duration `json:"queue_ttl"`
+	ColdHorizon          time.Duration `json:"cold_horizon"`
+	RetentionAge         time.Duration `json:"retention_age"`
+	RetentionInterval    time.Duration `json:"retention_interval"`
+	DeadLetterMaxLen     int64         `json:"dead_letter_max_len"`
+
+	MessageSaveTime    time.Duration  `json:"message_save_time"`
+	ResultSaveTime     time.Duration  `json:"result_save_time"`
+	TokenSaveTime      time.Duration  `json:"token_save_time"`
+	DeliverAtMaxPast   time.Duration  `json:"deliver_at_max_past"`
+	DeliverAtMaxFuture time.Duration  `json:"deliver_at_max_future"`
+	MaxDelay           time.Duration  `json:"max_delay"`
+	TrashWindow        time.Duration  `json:"trash_window"`
+	Codec              string         `json:"codec"`
+	PayloadSizeWarning int            `json:"payload_size_warning"`
+	MaxReadyLen        int64          `json:"max_ready_len"`
+	OverflowPolicy     OverflowPolicy `json:"overflow_policy"`
+	ValidateStages     ValidateStage  `json:"validate_stages"`
+	Quota              Quota          `json:"quota"`
+	TenantQuotas       int            `json:"tenant_quotas"`
+
+	LogMode          LogLevel      `json:"log_mode"`
+	LogSampling      time.Duration `json:"log_sampling"`
+	ProduceSampling  float64       `json:"produce_sampling"`
+	AuditMaxLen      int64         `json:"audit_max_len"`
+	LiveTail         bool          `json:"live_tail"`
+	CompletionNotify bool          `json:"completion_notify"`
+	Metric           bool          `json:"metric"`
+	SyncMetric       bool          `json:"sync_metric"`
+}
+
+// Options returns the effective configuration after defaults,
+// settings reloaded from redis are not reflected.
+func (q *Queue) Options() Options {
+	limit := float64(q.lim.Limit())
+	if q.lim.Limit() == rate.Inf {
+		limit = -1
+	}
+	var sampling float64
+	if q.produceSampling != nil {
+		sampling = q.produceSampling.percent
+	}
+
+	return Options{
+		Name:             q.name,
+		Owner:            q.owner,
+		StrictVersioning: q.strictVersioning,
+		RedisKeyPrefix:   q.redisPrefix,
+		KeyNamer:         q.keyNamer != nil,
+		ReadReplica:      q.replica != nil,
+
+		DaemonWorkerNum:      q.daemonWorkerNum,
+		DaemonWorkerInterval: q.daemonWorkerInterval,
+		WithoutDaemon:        q.noDaemon,
+		InlineMode:           q.inline,
+		DryRun:               q.dryRun,
+
+		Role:                  q.role,
+		ConsumeWorkerNum:      q.consumeWorkerNum,
+		ConsumeWorkerInterval: q.consumeWorkerInterval,
+		ConsumeTimeout:        q.consumeTimeout,
+		AttemptTimeout:        q.attemptTimeout != nil,
+		DequeueOrder:          q.dequeueOrder,
+		RateLimit:             limit,
+		RateBurst:             q.lim.Burst(),
+		LimiterStrategy:       q.limiterStrategy,
+		MaxPanicBackoff:       q.maxPanicBackoff,
+		RetryTimes:            q.retryTimes,
+		RetryInterval:         q.retryInterval,
+		RetryMultiplier:       q.redrive.Multiplier,
+		RetryMaxInterval:      q.redrive.MaxInterval,
+		DeadLetterQueue:       q.redrive.DeadLetterQueue,
+		RetryMatrix:           q.retryMatrix,
+		CommitRetryTimes:      q.commitRetryTimes,
+		CommitRetryInterval:   q.commitRetryInterval,
+		AsyncCommit:           q.asyncCommit,
+		BlackoutWindows:       len(q.blackoutWindows),
+		RateWindows:           len(q.rateSchedule),
+		Middlewares:           q.Middlewares(),
+
+		ConfigReloadInterval: q.configReloadInterval,
+		HeartbeatInterval:    q.heartbeatInterval,
+		QueueTTL:             q.queueTTL,
+		ColdHorizon:          q.coldHorizon,
+		RetentionAge:         q.retentionAge,
+		RetentionInterval:    q.retentionInterval,
+		DeadLetterMaxLen:     q.deadMaxLen,
+
+		MessageSaveTime:    q.messageSaveTime,
+		ResultSaveTime:     q.resultSaveTime,
+		TokenSaveTime:      q.tokenSaveTime,
+		DeliverAtMaxPast:   q.deliverAtMaxPast,
+		DeliverAtMaxFuture: q.deliverAtMaxFuture,
+		MaxDelay:           q.maxDelay,
+		TrashWindow:        q.trashWindow,
+		Codec:              q.codec.Name(),
+		PayloadSizeWarning: q.payloadSizeWarning,
+		MaxReadyLen:        q.maxReadyLen,
+		OverflowPolicy:     q.overflowPolicy,
+		ValidateStages:     q.validateStages,
+		Quota:              q.quota,
+		TenantQuotas:       len(q.tenantQuotas),
+
+		LogMode:          q.logMode,
+		LogSampling:      q.logSampling,
+		ProduceSampling:  sampling,
+		AuditMaxLen:      q.auditMaxLen,
+		LiveTail:         q.liveTail,
+		CompletionNotify: q.completionNotify,
+		Metric:           q.opts.metric != nil,
+		SyncMetric:       q.syncMetric,
+	}
+}
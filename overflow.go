@@ -0,0 +1,50 @@
+package dq
+
+import (
+	"context"
+	"errors"
+)
+
+// OverflowPolicy decides what happens when the ready list reaches its max length.
+type OverflowPolicy int
+
+const (
+	// OverflowReject rejects produced realtime messages with ErrQueueFull.
+	OverflowReject OverflowPolicy = iota
+	// OverflowDropOldest evicts the oldest ready messages, e.g. for freshness
+	// sensitive workloads, see WithOnDropped.
+	OverflowDropOldest
+)
+
+// ErrQueueFull is returned by Produce if the ready list is full and the policy is OverflowReject.
+var ErrQueueFull = errors.New("queue full")
+
+// rejectLen is the max ready length checked by produce, 0 if not rejecting.
+func (q *Queue) rejectLen() int64 {
+	if q.overflowPolicy != OverflowReject {
+		return 0
+	}
+	return q.maxReadyLen
+}
+
+// trimReady evicts the oldest ready messages over the max length if the policy is OverflowDropOldest.
+func (q *Queue) trimReady(ctx context.Context) {
+	if q.maxReadyLen <= 0 || q.overflowPolicy != OverflowDropOldest {
+		return
+	}
+
+	ids, err := q.rdb.runTrimList(ctx, q.key(kReady), q.key(kData), q.maxReadyLen)
+	if err != nil {
+		q.log(ctx, Warn, "trim ready failed, err: %v", err)
+		return
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	q.log(ctx, Warn, "ready is full, drop %d oldest messages", len(ids))
+	q.audit(ctx, EventDropped, ids...)
+	if q.onDropped != nil {
+		q.onDropped(ctx, ids)
+	}
+}
@@ -0,0 +1,88 @@
+package dq
+
+import "fmt"
+
+// WorkerPool is the pool of workers running the handlers of a kind.
+type WorkerPool int
+
+const (
+	// PoolIO runs IO bound handlers, the default pool of kinds.
+	PoolIO WorkerPool = iota
+	// PoolCPU runs CPU bound handlers, e.g. sized by the number of cores.
+	PoolCPU
+	numPool
+)
+
+// initPools creates the pool slots if worker pools are configured.
+func (q *Queue) initPools() error {
+	if q.poolSizes == [numPool]int{} {
+		return nil
+	}
+	for p, size := range q.poolSizes {
+		if size < 1 {
+			return fmt.Errorf("worker pool %d size must be positive, got %d", p, size)
+		}
+		q.pools[p] = make(chan struct{}, size)
+	}
+	return nil
+}
+
+// reservePools takes a free slot of every pool without waiting before a message
+// is taken, so the taken message never waits for the slot of its pool.
+// It returns false if no slot is free.
+func (q *Queue) reservePools() (held [numPool]bool, ok bool) {
+	if q.pools[PoolIO] == nil {
+		return held, true
+	}
+	for p, slots := range q.pools {
+		select {
+		case slots <- struct{}{}:
+			held[p], ok = true, true
+		default:
+		}
+	}
+	return held, ok
+}
+
+// keepPool keeps the held slot of the pool of kind if taken, releases the other
+// held slots, and returns the release of the kept one.
+func (q *Queue) keepPool(held [numPool]bool, kind string, taken bool) func() {
+	keep := numPool
+	if taken {
+		keep = q.kindPools[kind]
+	}
+	for p, ok := range held {
+		if ok && WorkerPool(p) != keep {
+			<-q.pools[p]
+		}
+	}
+	if keep == numPool || !held[keep] {
+		return func() {}
+	}
+	return func() { <-q.pools[keep] }
+}
+
+// poolArgs returns the take arguments of the held pools followed by the PoolCPU kinds,
+// messages of a pool not held are delayed briefly, none if pools are not configured.
+func (q *Queue) poolArgs(held [numPool]bool) []interface{} {
+	if q.pools[PoolIO] == nil {
+		return nil
+	}
+	args := []interface{}{held[PoolCPU], held[PoolIO]}
+	for kind, p := range q.kindPools {
+		if p == PoolCPU {
+			args = append(args, kind)
+		}
+	}
+	return args
+}
+
+// fieldOf returns the field of the message taken as values.
+func fieldOf(values []string, field string) string {
+	for i := 0; i+1 < len(values); i += 2 {
+		if values[i] == field {
+			return values[i+1]
+		}
+	}
+	return ""
+}
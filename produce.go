@@ -9,53 +9,208 @@ import (
 	"github.com/google/uuid"
 )
 
-func (q *Queue) Produce(ctx context.Context, m *ProducerMessage) (id string, err error) {
+// Receipt describes a produced message.
+type Receipt struct {
+	ID        string
+	DeliverAt time.Time
+	// QueuePositionEstimate is the number of messages expected to be delivered
+	// before this one, -1 if unknown.
+	QueuePositionEstimate int
+	// Deduplicated reports whether a pending message with the same ID existed,
+	// in which case nothing was produced.
+	Deduplicated bool
+}
+
+func (q *Queue) Produce(ctx context.Context, m *ProducerMessage) (*Receipt, error) {
+	return q.produce(ctx, m, "")
+}
+
+// ProduceWithToken produces the message once for the token, a produce retried
+// with the same token, e.g. after the producer crashed, is deduplicated
+// for the token save time even if the message is consumed already.
+// The message ID is derived from the token.
+func (q *Queue) ProduceWithToken(ctx context.Context, token string, m *ProducerMessage) (*Receipt, error) {
+	if token == "" {
+		return nil, fmt.Errorf("token is empty")
+	}
+	cm := *m
+	cm.DedupID = uuid.NewSHA1(uuid.NameSpaceOID, []byte(q.name+":"+token)).String()
+	return q.produce(ctx, &cm, token)
+}
+
+func (q *Queue) produce(ctx context.Context, m *ProducerMessage, token string) (r *Receipt, err error) {
 	defer func() {
 		if q.opts.metric != nil {
-			go q.opts.metric.Produce(m.DeliverAt != nil, err)
+			isDelay := m.DeliverAt != nil
+			q.emitMetric(func() { q.opts.metric.Produce(isDelay, err) })
 		}
 	}()
 	if m.Payload == nil {
-		return "", fmt.Errorf("payload is nil")
+		return nil, fmt.Errorf("payload is nil")
+	}
+	if err = checkName(q.name); err != nil {
+		return nil, err
 	}
 
-	id = uuid.NewString()
-	err = q.enqueue(ctx,
-		id,
-		base64.StdEncoding.EncodeToString(m.Payload),
-		time.Now(),
-		m.DeliverAt)
-	if err != nil {
-		return "", fmt.Errorf("enqueue failed, err: %v", err)
+	if err = q.checkDeliverAt(time.Now(), m.DeliverAt); err != nil {
+		return nil, err
 	}
 
-	return id, nil
-}
+	if err = q.validate(ValidateOnProduce, m.Kind, m.Payload); err != nil {
+		return nil, err
+	}
+	if q.inline {
+		return q.produceInline(ctx, m)
+	}
+	q.produceMeta.Do(func() {
+		// only strict versioning delays the first message
+		if !q.strictVersioning {
+			go q.startSide(context.Background(), "producer")
+			return
+		}
+		q.produceErr = q.startSide(ctx, "producer")
+	})
+	if q.produceErr != nil {
+		return nil, q.produceErr
+	}
+
+	payload, err := q.encode(m.Payload)
+	if err != nil {
+		return nil, err
+	}
+	q.checkPayloadSize(ctx, m, len(payload))
 
-func (q *Queue) enqueue(ctx context.Context, id, msg string, createAt time.Time, deliverAt *time.Time) error {
-	cm := &Message{
+	id := m.DedupID
+	if id == "" {
+		id = uuid.NewString()
+	}
+	var sum string
+	if q.checksum {
+		sum = checksum(payload)
+	}
+	r, err = q.enqueue(ctx, &Message{
 		ProducerMessage: ProducerMessage{
-			Payload:   []byte(msg),
-			DeliverAt: deliverAt,
+			Payload:   []byte(base64.StdEncoding.EncodeToString(payload)),
+			DeliverAt: m.DeliverAt,
+			Kind:      m.Kind,
+			Affinity:  m.Affinity,
+			Tenant:    m.Tenant,
+			Redrive:   m.Redrive,
+			SLA:       m.SLA,
+			Parent:    m.Parent,
 		},
 
 		ID:       id,
 		CreateAt: time.Now(),
+		Codec:    q.codec.Name(),
+		checksum: sum,
+	}, token)
+	if err != nil {
+		return nil, fmt.Errorf("enqueue failed, err: %w", err)
+	}
+	if q.enabled(Trace) {
+		q.log(ctx, Trace, "produce message %s, payload: %s", r.ID, q.redact(m.Payload))
 	}
+	q.sampleProduce(ctx, r, m, len(payload))
+	if !r.Deduplicated {
+		q.audit(ctx, EventProduced, r.ID)
+	}
+
+	return r, nil
+}
 
-	if deliverAt == nil || deliverAt.Before(createAt) {
+func (q *Queue) enqueue(ctx context.Context, cm *Message, token string) (*Receipt, error) {
+	r, err := q.enqueueTo(ctx, &q.rdb, cm, token)
+	if err != nil {
+		return nil, err
+	}
+	q.touch(ctx)
+	q.dualWrite(ctx, cm, token)
+	if err = q.mirror(ctx, r, cm, token); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// enqueueTo enqueues the message into c, the primary or the migration target.
+func (q *Queue) enqueueTo(ctx context.Context, c *rdb, cm *Message, token string) (*Receipt, error) {
+	tokenKey, tokenSec := q.key(kToken)+":"+token, 0
+	if token != "" {
+		tokenSec = int(q.tokenSaveTime.Seconds())
+	}
+	qa := q.quotaOf(cm.Tenant, cm.CreateAt)
+	save := q.redriveOf(cm).Expiration
+
+	if cm.DeliverAt == nil || cm.DeliverAt.Before(cm.CreateAt) {
 		// realtime message
-		return q.runProduceRealtimeMsg(ctx, q.key(kReady), q.key(kData), cm, int(q.messageSaveTime.Seconds()))
+		r, err := c.runProduceRealtimeMsg(ctx, q.key(kReady), q.key(kData), tokenKey, qa, cm, int(save.Seconds()), tokenSec, q.rejectLen())
+		if err == nil && !r.Deduplicated && c == &q.rdb {
+			q.trimReady(ctx)
+		}
+		return r, err
 	}
 
-	// delay message
-	return q.runProduceDelayMsg(ctx, q.key(kDelay), q.key(kData), cm, int(q.messageSaveTime.Seconds()))
+	// delay message, saved until its expiration after it is delivered
+	expSec := int((save + cm.DeliverAt.Sub(cm.CreateAt)).Seconds())
+	if q.coldHorizon > 0 && cm.DeliverAt.After(cm.CreateAt.Add(q.coldHorizon)) {
+		r, err := c.runProduceDelayMsg(ctx, q.key(kCold), q.key(kReady), q.key(kData), tokenKey, qa, cm, expSec, tokenSec)
+		if r != nil && !r.Deduplicated {
+			r.QueuePositionEstimate = -1
+		}
+		return r, err
+	}
+	return c.runProduceDelayMsg(ctx, q.key(kDelay), q.key(kReady), q.key(kData), tokenKey, qa, cm, expSec, tokenSec)
 }
 
+// checkPayloadSize reports the encoded payload size to metric and warns if it is too large.
+func (q *Queue) checkPayloadSize(ctx context.Context, m *ProducerMessage, size int) {
+	if sm, ok := q.opts.metric.(SizeMetric); ok {
+		q.emitMetric(func() { sm.PayloadSize(size) })
+	}
+	if q.payloadSizeWarning > 0 && size > q.payloadSizeWarning {
+		q.log(ctx, Warn, "produce payload size %d exceeds %d, kind: %s", size, q.payloadSizeWarning, m.Kind)
+		if q.onLargePayload != nil {
+			q.onLargePayload(ctx, m, size)
+		}
+	}
+}
+
+// Cancel removes the pending message, it is kept in the trash for the trash
+// window and can be restored by Restore meanwhile, see WithTrashWindow.
 func (q *Queue) Cancel(ctx context.Context, id string) error {
-	_, err := q.rdb.Del(ctx, q.key(kData)+":"+id).Result()
+	if q.trashWindow <= 0 {
+		n, err := q.rdb.Del(ctx, q.key(kData)+":"+id).Result()
+		if err != nil {
+			return fmt.Errorf("del message failed, err: %v", err)
+		}
+		if n > 0 {
+			q.audit(ctx, EventCanceled, id)
+			q.complete(ctx, OutcomeCanceled, id)
+		}
+		return nil
+	}
+	ok, err := q.rdb.runTrash(ctx, q.key(kData), q.key(kReady), q.key(kDelay), q.key(kCold), q.key(kTrash), q.key(kRetry), id, time.Now(), q.trashWindow)
 	if err != nil {
-		return fmt.Errorf("del message failed, err: %v", err)
+		return fmt.Errorf("trash message failed, err: %v", err)
+	}
+	if ok {
+		q.audit(ctx, EventCanceled, id)
+		q.complete(ctx, OutcomeCanceled, id)
+	}
+	return nil
+}
+
+// Restore moves the message canceled within the trash window back to the queue,
+// it is delivered at its deliver at, or at once if that is past.
+func (q *Queue) Restore(ctx context.Context, id string) error {
+	n, err := q.rdb.runRestore(ctx, q.key(kTrash), q.key(kData), q.key(kReady), q.key(kDelay), id, time.Now(), int(q.messageSaveTime.Seconds()))
+	switch {
+	case err != nil:
+		return fmt.Errorf("restore message failed, err: %v", err)
+	case n == 0:
+		return fmt.Errorf("message %s is not in trash", id)
+	case n < 0:
+		return fmt.Errorf("message %s is produced again", id)
 	}
 	return nil
 }
@@ -2,11 +2,17 @@ package dq
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
 )
 
 func TestProduceReady(t *testing.T) {
@@ -18,11 +24,11 @@ func TestProduceReady(t *testing.T) {
 	num := 5
 	var sendIDs []string
 	for i := 0; i < num; i++ {
-		id, err := q.Produce(context.Background(), &ProducerMessage{
+		r, err := q.Produce(context.Background(), &ProducerMessage{
 			Payload: []byte("ready_" + strconv.Itoa(i)),
 		})
 		assert.Nil(t, err)
-		sendIDs = append(sendIDs, id)
+		sendIDs = append(sendIDs, r.ID)
 	}
 
 	// assert
@@ -38,14 +44,665 @@ func TestProduceDelay(t *testing.T) {
 	var sendIDs []string
 	for i := 0; i < num; i++ {
 		at := time.Now().Add(1 * time.Second)
-		id, err := q.Produce(context.Background(), &ProducerMessage{
+		r, err := q.Produce(context.Background(), &ProducerMessage{
 			Payload:   []byte("delay_" + strconv.Itoa(i)),
 			DeliverAt: &at,
 		})
 		assert.Nil(t, err)
-		sendIDs = append(sendIDs, id)
+		sendIDs = append(sendIDs, r.ID)
 	}
 
 	// assert
 	assert.Equal(t, num, len(sendIDs))
 }
+
+func TestProduceDedup(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce twice with the same id
+	id := uuid.NewString()
+	at := time.Now().Add(1 * time.Second)
+	r, err := q.Produce(context.Background(), &ProducerMessage{
+		Payload:   []byte("dedup"),
+		DeliverAt: &at,
+		DedupID:   id,
+	})
+	assert.Nil(t, err)
+	assert.False(t, r.Deduplicated)
+	assert.Equal(t, 0, r.QueuePositionEstimate)
+
+	r, err = q.Produce(context.Background(), &ProducerMessage{
+		Payload: []byte("dedup"),
+		DedupID: id,
+	})
+	assert.Nil(t, err)
+
+	// assert
+	assert.True(t, r.Deduplicated)
+	assert.Equal(t, id, r.ID)
+	assert.Equal(t, at.UnixMilli(), r.DeliverAt.UnixMilli())
+}
+
+func TestProduceDeliverAt(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithDeliverAtBounds(30*24*time.Hour, 10*365*24*time.Hour))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// zero time is rejected
+	var zero time.Time
+	_, err := q.Produce(context.Background(), &ProducerMessage{
+		Payload:   []byte("zero"),
+		DeliverAt: &zero,
+	})
+	assert.True(t, errors.Is(err, ErrInvalidDeliverAt))
+
+	// deliver at keeps its zone
+	tomorrow := time.Now().Add(24*time.Hour).UTC().Format("2006-01-02") + " 09:00"
+	at, err := DeliverAtIn("2006-01-02 15:04", tomorrow, "Asia/Tokyo")
+	assert.Nil(t, err)
+	r, err := q.Produce(context.Background(), &ProducerMessage{
+		Payload:   []byte("tokyo"),
+		DeliverAt: at,
+	})
+	assert.Nil(t, err)
+
+	m, err := q.getMessage(context.Background(), r.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "Asia/Tokyo", m.DeliverAt.Location().String())
+	assert.Equal(t, tomorrow, m.DeliverAt.Format("2006-01-02 15:04"))
+}
+
+func TestMaxFuture(t *testing.T) {
+	// the stricter bound applies whatever the order of the options
+	q := New(WithMaxDelay(time.Hour), WithDeliverAtBounds(0, 24*time.Hour))
+	assert.Equal(t, time.Hour, q.maxFuture())
+	q = New(WithDeliverAtBounds(0, time.Hour), WithMaxDelay(24*time.Hour))
+	assert.Equal(t, time.Hour, q.maxFuture())
+	q = New(WithDeliverAtBounds(0, 24*time.Hour), WithMaxDelay(0))
+	assert.Equal(t, 24*time.Hour, q.maxFuture())
+	q = New()
+	assert.Equal(t, time.Duration(0), q.maxFuture())
+}
+
+func TestLoadLocation(t *testing.T) {
+	loc, err := loadLocation("Asia/Tokyo")
+	assert.Nil(t, err)
+	cached, err := loadLocation("Asia/Tokyo")
+	assert.Nil(t, err)
+	assert.Same(t, loc, cached)
+
+	_, err = loadLocation("Mars/Olympus")
+	assert.NotNil(t, err)
+	_, ok := locations.Load("Mars/Olympus")
+	assert.False(t, ok)
+}
+
+func TestProduceMaxDelay(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithMaxDelay(time.Hour))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	at := time.Now().Add(2 * time.Hour)
+	_, err := q.Produce(context.Background(), &ProducerMessage{
+		Payload:   []byte("too late"),
+		DeliverAt: &at,
+	})
+	assert.True(t, errors.Is(err, ErrMaxDelayExceeded))
+	assert.True(t, errors.Is(err, ErrInvalidDeliverAt))
+
+	at = time.Now().Add(30 * time.Minute)
+	_, err = q.Produce(context.Background(), &ProducerMessage{
+		Payload:   []byte("in time"),
+		DeliverAt: &at,
+	})
+	assert.Nil(t, err)
+}
+
+func TestProduceWithToken(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	token := uuid.NewString()
+	r, err := q.ProduceWithToken(ctx, token, &ProducerMessage{Payload: []byte("token")})
+	assert.Nil(t, err)
+	assert.False(t, r.Deduplicated)
+
+	// retried after the message is consumed
+	assert.Nil(t, q.Cancel(ctx, r.ID))
+	r2, err := q.ProduceWithToken(ctx, token, &ProducerMessage{Payload: []byte("token")})
+	assert.Nil(t, err)
+	assert.True(t, r2.Deduplicated)
+	assert.Equal(t, r.ID, r2.ID)
+	assert.Equal(t, int64(0), q.rdb.Exists(ctx, q.key(kData)+":"+r.ID).Val())
+}
+
+func TestProducePayloadSize(t *testing.T) {
+	// init
+	var large []int
+	q := New(append(testOpts(t),
+		WithPayloadSizeWarning(10, func(ctx context.Context, m *ProducerMessage, size int) {
+			large = append(large, size)
+		}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	ctx := context.Background()
+	for _, p := range []string{"small", "large payload"} {
+		_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte(p)})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []int{13}, large)
+
+	// assert, sizes are of the stored base64 payload
+	s, err := q.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, s.PayloadSize.Sampled)
+	assert.Equal(t, int64(8), s.PayloadSize.P50)
+	assert.Equal(t, int64(20), s.PayloadSize.Max)
+}
+
+func TestProduceOverflow(t *testing.T) {
+	ctx := context.Background()
+
+	// reject
+	q := New(append(testOpts(t), WithMaxReadyLen(2, OverflowReject))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+	for i := 0; i < 2; i++ {
+		_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("reject")})
+		assert.Nil(t, err)
+	}
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("reject")})
+	assert.True(t, errors.Is(err, ErrQueueFull))
+	cleanup(t, q)
+
+	// drop oldest
+	var dropped []string
+	q = New(append(testOpts(t),
+		WithMaxReadyLen(2, OverflowDropOldest),
+		WithOnDropped(func(ctx context.Context, ids []string) {
+			dropped = append(dropped, ids...)
+		}),
+	)...)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("drop")})
+		assert.Nil(t, err)
+		ids = append(ids, r.ID)
+	}
+	assert.Equal(t, ids[:1], dropped)
+	assert.Equal(t, int64(2), q.rdb.LLen(ctx, q.key(kReady)).Val())
+	assert.Equal(t, int64(0), q.rdb.Exists(ctx, q.key(kData)+":"+ids[0]).Val())
+}
+
+func TestProduceQuota(t *testing.T) {
+	// init
+	q := New(append(testOpts(t),
+		WithQuota(Quota{PerDay: 3}),
+		WithTenantQuota("t1", Quota{Pending: 2}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	at := time.Now().Add(time.Minute)
+
+	// pending quota counts realtime and delay messages
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("t1"), Tenant: "t1"})
+	assert.Nil(t, err)
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("t1"), Tenant: "t1", DeliverAt: &at})
+	assert.Nil(t, err)
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("t1"), Tenant: "t1"})
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+
+	// finished message is not pending
+	assert.Nil(t, q.rdb.Del(ctx, q.key(kData)+":"+r.ID).Err())
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("t1"), Tenant: "t1"})
+	assert.Nil(t, err)
+
+	// daily quota of other tenants
+	for i := 0; i < 3; i++ {
+		_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("t2"), Tenant: "t2"})
+		assert.Nil(t, err)
+	}
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("t2"), Tenant: "t2", DeliverAt: &at})
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+
+	// messages without tenant are not limited
+	for i := 0; i < 4; i++ {
+		_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("none")})
+		assert.Nil(t, err)
+	}
+}
+
+func TestProduceQuotaPrune(t *testing.T) {
+	// init, the pending set of the tenant is full
+	q := New(append(testOpts(t), WithTenantQuota("t1", Quota{Pending: 300}))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 300; i++ {
+		r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("t1"), Tenant: "t1"})
+		assert.Nil(t, err)
+		ids = append(ids, r.ID)
+	}
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("t1"), Tenant: "t1"})
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+
+	// all finished, a produce prunes a batch only
+	for _, id := range ids {
+		assert.Nil(t, q.rdb.Del(ctx, q.key(kData)+":"+id).Err())
+	}
+	pending := q.quotaOf("t1", time.Now()).pending
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("t1"), Tenant: "t1"})
+	assert.Nil(t, err)
+	n := q.rdb.SCard(ctx, pending).Val()
+	assert.Greater(t, n, int64(1))
+	assert.Less(t, n, int64(300))
+
+	// the next prune resumes from the cursor
+	assert.NotEqual(t, "", q.rdb.Get(ctx, pending+":cursor").Val())
+}
+
+func TestProduceMirror(t *testing.T) {
+	// init, the mirror is full after one message
+	mirror := New(WithName("dq_test_TestProduceMirror_mirror"), WithMaxReadyLen(1, OverflowReject))
+	q := New(append(testOpts(t), WithMirrorTo(mirror, MirrorStrict))...)
+	defer t.Cleanup(func() { cleanup(t, q, mirror) })
+
+	ctx := context.Background()
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("mirror")})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), mirror.rdb.LLen(ctx, mirror.key(kReady)).Val())
+
+	// strict, the message not mirrored is canceled
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("mirror"), DedupID: "full"})
+	assert.True(t, errors.Is(err, ErrQueueFull))
+	m, err := q.GetMessage(ctx, "full")
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+
+	// best effort
+	q = New(append(testOpts(t), WithMirrorTo(mirror, MirrorBestEffort))...)
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("mirror")})
+	assert.Nil(t, err)
+}
+
+func TestIngest(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	stream, list := q.redisPrefix+":stream:"+q.name, q.redisPrefix+":list:"+q.name
+	assert.Nil(t, q.rdb.XAdd(ctx, &redis.XAddArgs{Stream: stream, Values: []string{"payload", "stream", "delay", "1m"}}).Err())
+	assert.Nil(t, q.rdb.XAdd(ctx, &redis.XAddArgs{Stream: stream, Values: []string{"body", "invalid"}}).Err())
+	assert.Nil(t, q.rdb.LPush(ctx, list, `{"payload":"list","kind":"legacy"}`).Err())
+
+	// ingest
+	ingestCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, src := range []IngestSource{
+		{Stream: stream, Group: "dq", Block: 10 * time.Millisecond},
+		{List: list, ListJSON: true},
+	} {
+		wg.Add(1)
+		go func(src IngestSource) {
+			defer wg.Done()
+			assert.Nil(t, q.Ingest(ingestCtx, src))
+		}(src)
+	}
+
+	assert.Eventually(t, func() bool {
+		stats, err := q.Stats(ctx)
+		pending, _ := q.rdb.XPending(ctx, stream, "dq").Result()
+		return err == nil && stats.Delay == 1 && stats.Ready == 1 &&
+			pending != nil && pending.Count == 0 && q.rdb.LLen(ctx, list+":ingesting").Val() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	cancel()
+	wg.Wait()
+}
+
+func TestIngestClaim(t *testing.T) {
+	// init, an entry is read by a crashed instance
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	stream := q.redisPrefix + ":stream:" + q.name
+	assert.Nil(t, q.rdb.XGroupCreateMkStream(ctx, stream, "dq", "0").Err())
+	assert.Nil(t, q.rdb.XAdd(ctx, &redis.XAddArgs{Stream: stream, Values: []string{"payload", "crashed"}}).Err())
+	assert.Nil(t, q.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "dq", Consumer: "crashed", Streams: []string{stream, ">"}}).Err())
+
+	// ingest, the entry is claimed once idle
+	ingestCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.Nil(t, q.Ingest(ingestCtx, IngestSource{Stream: stream, Group: "dq", Block: 10 * time.Millisecond, ClaimIdle: 50 * time.Millisecond}))
+	}()
+
+	assert.Eventually(t, func() bool {
+		stats, err := q.Stats(ctx)
+		pending, _ := q.rdb.XPending(ctx, stream, "dq").Result()
+		return err == nil && stats.Ready == 1 && pending != nil && pending.Count == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestProduceGroupedUnsupported(t *testing.T) {
+	ctx := context.Background()
+	at := time.Now().Add(time.Hour)
+
+	q := New(append(testOpts(t), WithMaxDelay(time.Minute))...)
+	for _, m := range []*ProducerMessage{
+		{Payload: []byte("tenant"), Tenant: "t1"},
+		{Payload: []byte("delay"), DeliverAt: &at},
+	} {
+		_, err := q.ProduceGrouped(ctx, "group", time.Second, m)
+		assert.NotNil(t, err)
+	}
+	_, err := q.ProduceGrouped(ctx, "group", time.Hour, &ProducerMessage{Payload: []byte("late")})
+	assert.True(t, errors.Is(err, ErrMaxDelayExceeded))
+
+	inline := New(append(testOpts(t), WithInlineMode())...)
+	_, err = inline.ProduceGrouped(ctx, "group", time.Second, &ProducerMessage{Payload: []byte("inline")})
+	assert.NotNil(t, err)
+}
+
+func TestCancelRestore(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	at := time.Now().Add(time.Hour)
+	ready, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("ready")})
+	assert.Nil(t, err)
+	delay, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("delay"), DeliverAt: &at})
+	assert.Nil(t, err)
+
+	// cancel
+	for _, id := range []string{ready.ID, delay.ID} {
+		assert.Nil(t, q.Cancel(ctx, id))
+		m, err := q.GetMessage(ctx, id)
+		assert.Nil(t, err)
+		assert.Nil(t, m)
+	}
+	assert.Equal(t, int64(0), q.rdb.LLen(ctx, q.key(kReady)).Val())
+	assert.Equal(t, int64(0), q.rdb.ZCard(ctx, q.key(kDelay)).Val())
+	assert.Equal(t, int64(2), q.rdb.ZCard(ctx, q.key(kTrash)).Val())
+
+	// restore
+	for _, id := range []string{ready.ID, delay.ID} {
+		assert.Nil(t, q.Restore(ctx, id))
+		m, err := q.GetMessage(ctx, id)
+		assert.Nil(t, err)
+		assert.NotNil(t, m)
+	}
+	assert.Equal(t, []string{ready.ID}, q.rdb.LRange(ctx, q.key(kReady), 0, -1).Val())
+	assert.Equal(t, []string{delay.ID}, q.rdb.ZRange(ctx, q.key(kDelay), 0, -1).Val())
+	assert.NotNil(t, q.Restore(ctx, ready.ID))
+
+	// without trash
+	q2 := New(append(testOpts(t), WithTrashWindow(0))...)
+	assert.Nil(t, q2.Cancel(ctx, ready.ID))
+	assert.NotNil(t, q2.Restore(ctx, ready.ID))
+}
+
+func TestCancelRestoreRetry(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithRetryInterval(time.Hour))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("retry")})
+	assert.Nil(t, err)
+
+	// consume, the failed message waits for retry
+	failed := make(chan struct{})
+	var once sync.Once
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		once.Do(func() { close(failed) })
+		return errors.New("mock error")
+	}))
+	<-failed
+	closeQueue(t, q)
+	assert.Equal(t, []string{r.ID}, q.rdb.ZRange(ctx, q.key(kRetry), 0, -1).Val())
+
+	// cancel, the message is not redelivered by the retry set after restore
+	assert.Nil(t, q.Cancel(ctx, r.ID))
+	assert.Equal(t, int64(0), q.rdb.ZCard(ctx, q.key(kRetry)).Val())
+	assert.Nil(t, q.Restore(ctx, r.ID))
+	assert.Equal(t, []string{r.ID}, q.rdb.LRange(ctx, q.key(kReady), 0, -1).Val())
+	assert.Equal(t, int64(0), q.rdb.ZCard(ctx, q.key(kRetry)).Val())
+}
+
+func TestHoldRelease(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	at := time.Now().Add(time.Hour)
+	ready, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("ready")})
+	assert.Nil(t, err)
+	delay, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("delay"), DeliverAt: &at})
+	assert.Nil(t, err)
+
+	// hold
+	for _, id := range []string{ready.ID, delay.ID} {
+		assert.Nil(t, q.Hold(ctx, id))
+		assert.Equal(t, time.Duration(-1), q.rdb.TTL(ctx, q.key(kData)+":"+id).Val())
+	}
+	assert.Equal(t, int64(0), q.rdb.LLen(ctx, q.key(kReady)).Val())
+	assert.Equal(t, int64(0), q.rdb.ZCard(ctx, q.key(kDelay)).Val())
+	assert.Equal(t, int64(2), q.rdb.ZCard(ctx, q.key(kHeld)).Val())
+	assert.NotNil(t, q.Hold(ctx, ready.ID))
+	assert.NotNil(t, q.Hold(ctx, "missing"))
+
+	// release
+	for _, id := range []string{ready.ID, delay.ID} {
+		assert.Nil(t, q.Release(ctx, id))
+		assert.True(t, q.rdb.TTL(ctx, q.key(kData)+":"+id).Val() > 0)
+	}
+	assert.Equal(t, []string{ready.ID}, q.rdb.LRange(ctx, q.key(kReady), 0, -1).Val())
+	assert.Equal(t, []string{delay.ID}, q.rdb.ZRange(ctx, q.key(kDelay), 0, -1).Val())
+	assert.NotNil(t, q.Release(ctx, ready.ID))
+}
+
+func TestFanOut(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	_, err := q.FanOut(ctx, FanOut{Items: []string{"1"}})
+	assert.NotNil(t, err)
+
+	items := make([]string, 10)
+	for i := range items {
+		items[i] = strconv.Itoa(i)
+	}
+	id, err := q.FanOut(ctx, FanOut{
+		Kind:       "chunk",
+		Items:      items,
+		ChunkSize:  3,
+		Completion: &ProducerMessage{Payload: []byte("all done"), Kind: "reduce"},
+	})
+	assert.Nil(t, err)
+
+	// consume the children, then the completion
+	var mu sync.Mutex
+	var got []string
+	done := make(chan *Message, 1)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		if m.Kind == "reduce" {
+			done <- m
+			return nil
+		}
+		assert.Equal(t, id, m.Parent)
+		var chunk []string
+		assert.Nil(t, json.Unmarshal(m.Payload, &chunk))
+		mu.Lock()
+		got = append(got, chunk...)
+		mu.Unlock()
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(3 * time.Second):
+		t.Fatal("completion timeout")
+	case m := <-done:
+		assert.Equal(t, id, m.ID)
+		assert.Equal(t, "all done", string(m.Payload))
+	}
+	mu.Lock()
+	assert.ElementsMatch(t, items, got)
+	mu.Unlock()
+}
+
+func TestGetJobTree(t *testing.T) {
+	// init
+	q := New(append(testOpts(t),
+		WithRetryMatrix(map[ErrorClass]RetryPolicy{ErrorClassValidation: {DeadLetter: true}}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	tree, err := q.GetJobTree(ctx, "missing")
+	assert.Nil(t, err)
+	assert.Nil(t, tree)
+
+	id, err := q.FanOut(ctx, FanOut{Items: []string{"a", "b", "c"}, ChunkSize: 1})
+	assert.Nil(t, err)
+	tree, err = q.GetJobTree(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, tree.Total)
+	assert.Equal(t, map[ChildState]int{ChildPending: 3}, tree.Children)
+	assert.False(t, tree.Completed)
+
+	// consume, a child fails
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		if string(m.Payload) == `["b"]` {
+			return Classify(errors.New("bad item"), ErrorClassValidation)
+		}
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	assert.Eventually(t, func() bool {
+		tree, err = q.GetJobTree(ctx, id)
+		return err == nil && tree.Completed
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[ChildState]int{ChildDone: 2, ChildFailed: 1}, tree.Children)
+	assert.Len(t, tree.Failures, 1)
+	for _, reason := range tree.Failures {
+		assert.Contains(t, reason, "bad item")
+	}
+}
+
+func TestBulkOperations(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithAuditLog(100), WithCompletionNotify())...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	at := time.Now().Add(time.Hour)
+	var ids []string
+	for i := 0; i < 8; i++ {
+		m := &ProducerMessage{Payload: []byte(strconv.Itoa(i)), Kind: "keep"}
+		if i%4 == 0 {
+			m.Kind = "drop"
+		}
+		if i >= 5 {
+			m.DeliverAt = &at
+		}
+		r, err := q.Produce(ctx, m)
+		assert.Nil(t, err)
+		ids = append(ids, r.ID)
+	}
+
+	// cancel where
+	n, err := q.CancelWhere(ctx, func(m *Message) bool { return m.Kind == "drop" }, BulkOptions{BatchSize: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	// purge in rate-limited batches
+	outcome := make(chan Outcome, 1)
+	go func() {
+		ctx, c := context.WithTimeout(ctx, time.Second)
+		defer c()
+		o, err := q.WaitCompletion(ctx, ids[1])
+		assert.Nil(t, err)
+		outcome <- o
+	}()
+	time.Sleep(50 * time.Millisecond)
+	var progress []int
+	n, err = q.Purge(ctx, BulkOptions{BatchSize: 2, Rate: 100, Progress: func(done int) { progress = append(progress, done) }})
+	assert.Nil(t, err)
+	assert.Equal(t, 6, n)
+	assert.NotEmpty(t, progress)
+	assert.Equal(t, OutcomeCanceled, <-outcome)
+	events, err := q.AuditLog(ctx, ids[1], 100)
+	assert.Nil(t, err)
+	if assert.NotEmpty(t, events) {
+		assert.Equal(t, EventCanceled, events[0].Type)
+	}
+	s, err := q.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Zero(t, s.Ready+s.Delay)
+	assert.Nil(t, q.Restore(ctx, ids[1]))
+
+	// requeue dead, as if they were taken and dead
+	for _, id := range ids[2:4] {
+		assert.Nil(t, q.Restore(ctx, id))
+		assert.Nil(t, q.rdb.LRem(ctx, q.key(kReady), 0, id).Err())
+		assert.Nil(t, q.rdb.runDeadLetter(ctx, q.key(kRetry), q.key(kDead), q.key(kData), id, "mock"))
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = q.RequeueAllDead(cctx, BulkOptions{})
+	assert.NotNil(t, err)
+	n, err = q.RequeueAllDead(ctx, BulkOptions{BatchSize: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	m, err := q.GetMessage(ctx, ids[2])
+	assert.Nil(t, err)
+	assert.Nil(t, m.DeadAt)
+	assert.Equal(t, int64(3), q.rdb.LLen(ctx, q.key(kReady)).Val())
+}
+
+func TestProduceSampling(t *testing.T) {
+	for _, c := range []struct {
+		percent float64
+		limit   rate.Limit
+		want    int
+	}{{100, rate.Inf, 5}, {0, rate.Inf, 0}, {100, 1, 1}} {
+		// init
+		var samples []ProduceSample
+		q := New(append(testOpts(t), WithProduceSampling(c.percent, c.limit, func(ctx context.Context, s ProduceSample) {
+			samples = append(samples, s)
+		}))...)
+
+		ctx := context.Background()
+		at := time.Now().Add(time.Minute)
+		for i := 0; i < 5; i++ {
+			_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("sampled"), Kind: "k", DeliverAt: &at})
+			assert.Nil(t, err)
+		}
+		assert.Len(t, samples, c.want)
+		for _, s := range samples {
+			assert.Equal(t, "k", s.Kind)
+			assert.Equal(t, len("sampled"), s.Size)
+			assert.InDelta(t, time.Minute, s.Delay, float64(time.Second))
+		}
+		cleanup(t, q)
+	}
+}
@@ -0,0 +1,62 @@
+package dq
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Profiles are preset bundles of options, options passed after a profile override it,
+// e.g. New(ProfileLowLatency(), WithConsumerWorkerNum(8)).
+// The consumer timeout of a profile is at most its retry interval, as a taken
+// message is redelivered once the retry interval passes.
+
+// ProfileLowLatency polls often with a few workers, so messages are delivered
+// within milliseconds of being due at the cost of more redis calls.
+func ProfileLowLatency() func(*Queue) {
+	return profile(
+		WithConsumerWorkerNum(4),
+		WithConsumerWorkerInterval(10*time.Millisecond),
+		WithDaemonWorkerNum(1),
+		WithDaemonWorkerInterval(10*time.Millisecond),
+		WithConsumerTimeout(3*time.Second),
+		WithLimiter(rate.Inf, 0),
+	)
+}
+
+// ProfileHighThroughput runs many workers without rate limit and moves due
+// messages by more daemon workers, for short handlers of busy queues.
+func ProfileHighThroughput() func(*Queue) {
+	return profile(
+		WithConsumerWorkerNum(32),
+		WithConsumerWorkerInterval(100*time.Millisecond),
+		WithDaemonWorkerNum(2),
+		WithDaemonWorkerInterval(50*time.Millisecond),
+		WithConsumerTimeout(10*time.Second),
+		WithRetryInterval(10*time.Second),
+		WithLimiter(rate.Inf, 0),
+		WithLogSampling(time.Minute),
+	)
+}
+
+// ProfileBatch polls rarely and rate limits consumers to spare downstream
+// services, for long running jobs where latency of seconds is fine.
+func ProfileBatch() func(*Queue) {
+	return profile(
+		WithConsumerWorkerNum(4),
+		WithConsumerWorkerInterval(time.Second),
+		WithDaemonWorkerNum(1),
+		WithDaemonWorkerInterval(time.Second),
+		WithConsumerTimeout(5*time.Minute),
+		WithRetryInterval(5*time.Minute),
+		WithLimiter(100, 100),
+	)
+}
+
+func profile(options ...func(*Queue)) func(*Queue) {
+	return func(q *Queue) {
+		for _, opt := range options {
+			opt(q)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+//go:build !dq_noproto
+
+package dq
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// protoTypeURL is the type URL of the message, the same as in anypb.Any.
+func protoTypeURL(d protoreflect.MessageDescriptor) string {
+	return "type.googleapis.com/" + string(d.FullName())
+}
+
+// ProduceProto produces the marshalled v, the type URL of v is used as Kind.
+// Building with the dq_noproto tag leaves out protobuf support and its dependency.
+func (q *Queue) ProduceProto(ctx context.Context, v proto.Message, opts ...ProduceOption) (*Receipt, error) {
+	bs, err := proto.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("proto marshal failed, err: %v", err)
+	}
+
+	m := &ProducerMessage{
+		Payload: bs,
+		Kind:    protoTypeURL(v.ProtoReflect().Descriptor()),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return q.Produce(ctx, m)
+}
+
+// ProtoHandler processes messages produced by ProduceProto with the unmarshalled T,
+// messages of another type fail with ErrorClassValidation.
+type ProtoHandler[T proto.Message] func(context.Context, *Message, T) error
+
+func (h ProtoHandler[T]) Process(ctx context.Context, m *Message) error {
+	var zero T
+	v := zero.ProtoReflect().New().Interface().(T)
+
+	if want := protoTypeURL(v.ProtoReflect().Descriptor()); m.Kind != want {
+		return Classify(fmt.Errorf("proto type mismatch, want: %s, got: %s", want, m.Kind), ErrorClassValidation)
+	}
+	if err := proto.Unmarshal(m.Payload, v); err != nil {
+		return Classify(fmt.Errorf("proto unmarshal failed, err: %v", err), ErrorClassValidation)
+	}
+	return h(ctx, m, v)
+}
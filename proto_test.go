@@ -0,0 +1,44 @@
+//go:build !dq_noproto
+
+package dq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestConsumeProto(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	_, err := q.ProduceProto(context.Background(), wrapperspb.String("proto"))
+	assert.Nil(t, err)
+
+	// consume
+	got := make(chan string, 1)
+	q.Consume(ProtoHandler[*wrapperspb.StringValue](func(ctx context.Context, m *Message, v *wrapperspb.StringValue) error {
+		assert.Equal(t, "type.googleapis.com/google.protobuf.StringValue", m.Kind)
+		got <- v.GetValue()
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatal("consume timeout")
+	case v := <-got:
+		assert.Equal(t, "proto", v)
+	}
+
+	// mismatched type
+	err = ProtoHandler[*wrapperspb.Int64Value](func(ctx context.Context, m *Message, v *wrapperspb.Int64Value) error {
+		return nil
+	}).Process(context.Background(), &Message{ProducerMessage: ProducerMessage{Kind: "type.googleapis.com/google.protobuf.StringValue"}})
+	assert.Equal(t, ErrorClassValidation, defaultClassifier(err))
+}
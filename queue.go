@@ -2,6 +2,11 @@ package dq
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 	"golang.org/x/time/rate"
@@ -12,15 +17,70 @@ type Queue struct {
 	opts
 	rdb
 
-	lim *rate.Limiter
+	lim  *rate.Limiter
+	conf remoteConf
+
+	instanceID string
+	startedAt  time.Time
+	counters   counters
+	draining   atomic.Bool
+
+	produceMeta sync.Once
+	produceErr  error
+	sampler     logSampler
+
+	// slots of worker pools
+	pools [numPool]chan struct{}
+
+	// target of dual writes during migration
+	migrateTarget atomic.Pointer[rdb]
+
+	// queues dead letters are redriven to, by name
+	dlqs sync.Map
+
+	failover     *failover
+	stopFailover context.CancelFunc
+
+	// processed messages committed asynchronously
+	commits     chan *Message
+	commitsDone chan struct{}
+
+	// handler of the inline mode
+	inlineHandler atomic.Pointer[Handler]
+
+	// metric calls to be flushed
+	metrics metricBuffer
+
+	// set while the daemon moves due messages through the gate
+	gating atomic.Bool
+	// failures in a row of messages by the gate, only used while gating
+	gateFails map[string]int
+	// set while the busy hook runs
+	busyHooking atomic.Bool
+	// unix nano the TTL of the queue keys was last refreshed at
+	touchedAt atomic.Int64
 
 	shutdownFunc context.CancelFunc
 	done         chan struct{}
+	stopRegistry context.CancelFunc
+	registryDone chan struct{}
 }
 
 type rdb struct {
 	*redis.Client
 	redisPrefix string
+	keyNamer    func(queue, component string) string
+
+	// replica serves the read-only inspection if set
+	replica *redis.Client
+}
+
+// reader returns the client of read-only inspection, e.g. Stats.
+func (r *rdb) reader() redis.Cmdable {
+	if r.replica != nil {
+		return r.replica
+	}
+	return r.Client
 }
 
 func New(options ...func(*Queue)) *Queue {
@@ -28,6 +88,8 @@ func New(options ...func(*Queue)) *Queue {
 		opts: defaultOpts(),
 		rdb:  rdb{redisPrefix: "dq"},
 		lim:  rate.NewLimiter(rate.Inf, 0),
+
+		instanceID: newInstanceID(),
 	}
 
 	for _, opt := range options {
@@ -39,24 +101,263 @@ func New(options ...func(*Queue)) *Queue {
 			Addr: "127.0.0.1:6379",
 		})
 	}
+	if q.standby != nil {
+		q.initFailover()
+	}
 
 	return &q
 }
 
 func (q *Queue) Close(ctx context.Context) error {
+	if q.inline {
+		return nil
+	}
+	q.drain(ctx)
 	q.shutdownFunc()
 
+	// hooks flush the buffers of the application while in-flight handlers are finishing
+	var herr error
+	for _, hook := range q.onShutdown {
+		if err := hook(ctx); err != nil {
+			q.log(ctx, Warn, "queue %s shutdown hook failed, err: %v", q.name, err)
+			if herr == nil {
+				herr = err
+			}
+		}
+	}
+
+	var err error
 	select {
 	case <-q.done:
 		q.log(ctx, Info, "queue %s closed", q.name)
 	case <-ctx.Done():
-		q.log(ctx, Error, "queue %s closed with err: %v", q.name, ctx.Err())
-		return ctx.Err()
+		err = ctx.Err()
+		q.log(ctx, Error, "queue %s closed with err: %v", q.name, err)
+	}
+
+	q.stopRegistry()
+	<-q.registryDone
+	if err != nil {
+		// handlers may be still running, the instance is left draining for
+		// the others to reclaim its in-flight messages once it expires
+		q.log(ctx, Warn, "queue %s left draining with in-flight messages", q.name)
+	} else if err := q.deregister(context.Background()); err != nil {
+		q.log(ctx, Warn, "queue %s deregister failed, err: %v", q.name, err)
+	}
+
+	if q.stopFailover != nil {
+		q.stopFailover()
+	}
+
+	q.metrics.flush()
+
+	if err == nil {
+		err = herr
+	}
+	return err
+}
+
+// destroyPasses bounds the passes of Destroy deleting keys written meanwhile.
+const destroyPasses = 3
+
+// Destroy deletes all the keys of the queue, e.g. for ephemeral per-test or
+// per-tenant queues. The keys are found by a single SCAN and deleted in a
+// transaction, passes are repeated until no key is left so that keys written
+// meanwhile are deleted too. Consumers and producers of the queue should be
+// stopped, as keys written after the last pass are left.
+func (q *Queue) Destroy(ctx context.Context) error {
+	if err := checkName(q.name); err != nil {
+		return err
+	}
+	for i := 0; i < destroyPasses; i++ {
+		keys, err := q.ownKeys(ctx)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			break
+		}
+
+		_, err = q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i := 0; i < len(keys); i += 1000 {
+				j := i + 1000
+				if j > len(keys) {
+					j = len(keys)
+				}
+				pipe.Del(ctx, keys[i:j]...)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("delete keys failed, err: %v", err)
+		}
+	}
+	q.log(ctx, Info, "queue %s destroyed", q.name)
+	return nil
+}
+
+// ownKeys scans the keys of the queue, that is the keys of its components and
+// their keys of messages, instances, groups and so on.
+func (q *Queue) ownKeys(ctx context.Context) ([]string, error) {
+	pattern := "*"
+	if q.keyNamer == nil {
+		pattern = escapeGlob(q.redisPrefix) + ":*:" + escapeGlob(q.name) + "*"
+	}
+
+	var keys []string
+	iter := q.rdb.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		if key := iter.Val(); q.ownKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("scan keys failed, err: %v", err)
+	}
+	return keys, nil
+}
+
+func (q *Queue) ownKey(key string) bool {
+	for k := redisKey(0); k < numKey; k++ {
+		if own := q.key(k); key == own || strings.HasPrefix(key, own+":") {
+			return true
+		}
 	}
+	return false
+}
 
+// checkName rejects the names containing ':', which separates the keys of the
+// queue from its keys of messages, e.g. the keys of a:b are keys of a as well.
+func checkName(name string) error {
+	if strings.Contains(name, ":") {
+		return fmt.Errorf("queue name %q contains ':'", name)
+	}
 	return nil
 }
 
+// escapeGlob escapes the glob characters of s for SCAN MATCH.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// touchFraction is the fraction of the queue TTL the TTL is refreshed once in.
+const touchFraction = 10
+
+// touch refreshes the TTL of the queue keys set by WithQueueTTL at most once
+// per fraction of the TTL, keys of messages expire by the message save time.
+func (q *Queue) touch(ctx context.Context) {
+	if q.queueTTL <= 0 {
+		return
+	}
+	now, last := time.Now().UnixNano(), q.touchedAt.Load()
+	if now-last < int64(q.queueTTL/touchFraction) || !q.touchedAt.CompareAndSwap(last, now) {
+		return
+	}
+	pipe := q.rdb.Pipeline()
+	for k := redisKey(0); k < numKey; k++ {
+		pipe.Expire(ctx, q.key(k), q.queueTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		q.log(ctx, Warn, "queue %s refresh ttl failed, err: %v", q.name, err)
+	}
+}
+
+// GetMessage returns the message with decoded payload, nil if it does not exist.
+// It reads from the replica if set by WithReadReplica.
+func (q *Queue) GetMessage(ctx context.Context, id string) (*Message, error) {
+	return q.readMessage(ctx, q.rdb.reader(), id)
+}
+
+// getMessage loads the message from the primary, nil if it does not exist.
+func (q *Queue) getMessage(ctx context.Context, id string) (*Message, error) {
+	return q.readMessage(ctx, q.rdb.Client, id)
+}
+
+func (q *Queue) readMessage(ctx context.Context, c redis.Cmdable, id string) (*Message, error) {
+	values, err := c.HGetAll(ctx, q.key(kData)+":"+id).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get message failed, err: %v", err)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	s := make([]string, 0, len(values)*2)
+	for k, v := range values {
+		s = append(s, k, v)
+	}
+
+	var m Message
+	if err = m.parse(s); err != nil {
+		return nil, fmt.Errorf("parse message failed, err: %v", err)
+	}
+	if err = q.decode(&m); err != nil {
+		return nil, fmt.Errorf("decode message failed, err: %v", err)
+	}
+	return &m, nil
+}
+
+// GetEnvelope returns the message without payload, nil if it does not exist,
+// so inspecting messages doesn't transfer their payload. Annotations and the
+// checkpoint of previous attempts are included.
+// It reads from the replica if set by WithReadReplica.
+func (q *Queue) GetEnvelope(ctx context.Context, id string) (*Message, error) {
+	key := q.key(kData) + ":" + id
+	values, err := q.rdb.reader().HMGet(ctx, key, envelopeFields...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get envelope failed, err: %v", err)
+	}
+	m, err := parseEnvelope(values)
+	if err != nil || m == nil {
+		return m, err
+	}
+
+	// annotations are matched by redis, so the payload is not transferred
+	var cursor uint64
+	for {
+		var fields []string
+		fields, cursor, err = q.rdb.reader().HScan(ctx, key, cursor, annotationPrefix+"*", 100).Result()
+		if err != nil {
+			return nil, fmt.Errorf("get annotations failed, err: %v", err)
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			if m.Annotations == nil {
+				m.Annotations = map[string]string{}
+			}
+			m.Annotations[strings.TrimPrefix(fields[i], annotationPrefix)] = fields[i+1]
+		}
+		if cursor == 0 {
+			return m, nil
+		}
+	}
+}
+
+// parseEnvelope parses the values of envelopeFields, nil if the message does not exist.
+func parseEnvelope(values []interface{}) (*Message, error) {
+	s := make([]string, 0, len(values)*2)
+	for i, v := range values {
+		if v, ok := v.(string); ok {
+			s = append(s, envelopeFields[i], v)
+		}
+	}
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	var m Message
+	if err := m.parse(s); err != nil {
+		return nil, fmt.Errorf("parse envelope failed, err: %v", err)
+	}
+	return &m, nil
+}
+
 type redisKey int
 
 const (
@@ -64,18 +365,64 @@ const (
 	kDelay
 	kRetry
 	kData
+	kConfig
+	kDead
+	kInstances
+	kInflight
+	kAudit
+	kCold
+	kResult
+	kToken
+	kAffinity
+	kWorkflow
+	kGroup
+	kBatch
+	kQuota
+	kMeta
+	kTrash
+	kJob
+	kHeld
+	kDisabled
+	numKey
 )
 
+var keyComponents = [numKey]string{
+	kReady:     "ready",
+	kDelay:     "delay",
+	kRetry:     "retry",
+	kData:      "msg",
+	kConfig:    "config",
+	kDead:      "dead",
+	kInstances: "instances",
+	kInflight:  "inflight",
+	kAudit:     "audit",
+	kCold:      "cold",
+	kResult:    "result",
+	kToken:     "token",
+	kAffinity:  "affinity",
+	kWorkflow:  "workflow",
+	kGroup:     "group",
+	kBatch:     "batch",
+	kQuota:     "quota",
+	kMeta:      "meta",
+	kTrash:     "trash",
+	kJob:       "job",
+	kHeld:      "held",
+	kDisabled:  "disabled",
+}
+
 func (q *Queue) key(k redisKey) string {
-	switch k {
-	case kReady:
-		return q.redisPrefix + ":ready:" + q.name
-	case kDelay:
-		return q.redisPrefix + ":delay:" + q.name
-	case kRetry:
-		return q.redisPrefix + ":retry:" + q.name
-	case kData:
-		return q.redisPrefix + ":msg:" + q.name
-	}
-	return ""
+	if k < 0 || k >= numKey {
+		return ""
+	}
+	return q.component(keyComponents[k])
+}
+
+// component names the redis key of component c, through the key namer when
+// one is configured.
+func (q *Queue) component(c string) string {
+	if q.keyNamer != nil {
+		return q.keyNamer(q.name, c)
+	}
+	return q.redisPrefix + ":" + c + ":" + q.name
 }
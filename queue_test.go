@@ -2,12 +2,21 @@ package dq
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
 )
 
 func testOpts(t *testing.T) []func(*Queue) {
@@ -33,7 +42,7 @@ func cleanup(t *testing.T, qs ...*Queue) {
 		go func(q *Queue) {
 			defer wg.Done()
 
-			keys, err := q.rdb.Keys(ctx, q.redisPrefix+q.name+":*").Result()
+			keys, err := q.ownKeys(ctx)
 			assert.Nil(t, err)
 			if len(keys) == 0 {
 				return
@@ -46,6 +55,11 @@ func cleanup(t *testing.T, qs ...*Queue) {
 	wg.Wait()
 }
 
+// closeQueue stops the consumers, so they don't slow down the following tests.
+func closeQueue(t *testing.T, q *Queue) {
+	assert.Nil(t, q.Close(context.Background()))
+}
+
 var benchOnce = sync.Once{}
 var benchWg sync.WaitGroup
 
@@ -120,3 +134,791 @@ func BenchmarkConsume(b *testing.B) {
 	})
 	benchWg.Wait()
 }
+
+func TestStats(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithHeartbeatInterval(10*time.Millisecond))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	at := time.Now().Add(1 * time.Minute)
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("delay"), DeliverAt: &at})
+	assert.Nil(t, err)
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("ready")})
+	assert.Nil(t, err)
+
+	// consume
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		return nil
+	}))
+
+	s, err := q.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, DueStats{Minute: 1}, s.Due)
+
+	assert.Eventually(t, func() bool {
+		s, err := q.Stats(ctx)
+		return err == nil && s.Ready == 0 && s.Delay == 1 &&
+			len(s.Instances) == 1 && s.Instances[0].Processed == 1
+	}, 1*time.Second, 10*time.Millisecond)
+
+	// closed instance is removed from registry
+	assert.Nil(t, q.Close(ctx))
+	assert.Eventually(t, func() bool {
+		s, err := q.Stats(ctx)
+		return err == nil && len(s.Instances) == 0
+	}, 1*time.Second, 10*time.Millisecond)
+}
+
+func TestBusyRatio(t *testing.T) {
+	// init
+	busy := make(chan float64, 100)
+	q := New(append(testOpts(t),
+		WithConsumerWorkerNum(1),
+		WithHeartbeatInterval(50*time.Millisecond),
+		WithBusyThreshold(0.5, func(ctx context.Context, ratio float64) { busy <- ratio }),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("slow")})
+		assert.Nil(t, err)
+	}
+
+	// consume, the only worker keeps busy
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("busy hook timeout")
+	case ratio := <-busy:
+		assert.GreaterOrEqual(t, ratio, 0.5)
+	}
+	assert.Eventually(t, func() bool {
+		s, err := q.Stats(ctx)
+		return err == nil && s.BusyRatio >= 0.5
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBusyHookSlow(t *testing.T) {
+	// init, the hook blocks until released
+	calls := make(chan float64, 100)
+	release := make(chan struct{})
+	q := New(append(testOpts(t),
+		WithConsumerWorkerNum(1),
+		WithHeartbeatInterval(20*time.Millisecond),
+		WithBusyThreshold(0.5, func(ctx context.Context, ratio float64) {
+			calls <- ratio
+			<-release
+		}),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("slow")})
+		assert.Nil(t, err)
+	}
+
+	// consume, the only worker keeps busy
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("busy hook timeout")
+	case <-calls:
+	}
+
+	// the heartbeat goes on and the hook is not called again while it runs
+	hb := func() int64 {
+		ins, err := q.Instances(ctx)
+		assert.Nil(t, err)
+		for _, in := range ins {
+			if in.ID == q.instanceID {
+				return in.HeartbeatAt.UnixNano()
+			}
+		}
+		return 0
+	}
+	last := hb()
+	assert.Eventually(t, func() bool { return hb() > last }, time.Second, 10*time.Millisecond)
+	assert.Len(t, calls, 0)
+	close(release)
+}
+
+func TestInstancesExpired(t *testing.T) {
+	// init, an instance crashed a while ago
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	bs, err := json.Marshal(Instance{ID: "crashed", HeartbeatAt: time.Now().Add(-time.Hour)})
+	assert.Nil(t, err)
+	assert.Nil(t, q.rdb.HSet(ctx, q.key(kInstances), "crashed", bs).Err())
+	// another is alive with a longer heartbeat interval
+	bs, err = json.Marshal(Instance{ID: "slow", HeartbeatAt: time.Now().Add(-time.Minute), HeartbeatInterval: time.Hour})
+	assert.Nil(t, err)
+	assert.Nil(t, q.rdb.HSet(ctx, q.key(kInstances), "slow", bs).Err())
+
+	// listing skips it without removing it
+	instances, err := q.Instances(ctx)
+	assert.Nil(t, err)
+	if assert.Len(t, instances, 1) {
+		assert.Equal(t, "slow", instances[0].ID)
+	}
+	assert.True(t, q.rdb.HExists(ctx, q.key(kInstances), "crashed").Val())
+
+	// the registry loop removes it
+	q.reclaimExpired(ctx)
+	assert.False(t, q.rdb.HExists(ctx, q.key(kInstances), "crashed").Val())
+	assert.True(t, q.rdb.HExists(ctx, q.key(kInstances), "slow").Val())
+}
+
+func TestDestroy(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	other := New(WithName("dq_test_TestDestroyOther"))
+	defer t.Cleanup(func() { cleanup(t, q, other) })
+
+	ctx := context.Background()
+	at := time.Now().Add(time.Minute)
+	for _, m := range []*ProducerMessage{
+		{Payload: []byte("ready")},
+		{Payload: []byte("delay"), DeliverAt: &at},
+	} {
+		_, err := q.Produce(ctx, m)
+		assert.Nil(t, err)
+	}
+	_, err := q.ProduceWithToken(ctx, "token", &ProducerMessage{Payload: []byte("token")})
+	assert.Nil(t, err)
+	_, err = other.Produce(ctx, &ProducerMessage{Payload: []byte("other")})
+	assert.Nil(t, err)
+
+	// destroy
+	assert.Nil(t, q.Destroy(ctx))
+
+	for _, pattern := range []string{q.redisPrefix + ":*:" + q.name, q.redisPrefix + ":*:" + q.name + ":*"} {
+		keys, err := q.rdb.Keys(ctx, pattern).Result()
+		assert.Nil(t, err)
+		assert.Empty(t, keys)
+	}
+	s, err := other.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), s.Ready)
+}
+
+func TestDestroySibling(t *testing.T) {
+	// init, queues named with the name as a prefix
+	a := New(testOpts(t)...)
+	ab := New(WithName(a.name + "b"))
+	sibling := New(WithName(a.name + ":b"))
+	defer t.Cleanup(func() { cleanup(t, a, ab) })
+
+	ctx := context.Background()
+	for _, q := range []*Queue{a, ab} {
+		_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte(q.name)})
+		assert.Nil(t, err)
+		_, err = q.ProduceWithToken(ctx, "token", &ProducerMessage{Payload: []byte(q.name)})
+		assert.Nil(t, err)
+	}
+
+	// a:b shares the keys of a, so it is rejected
+	_, err := sibling.Produce(ctx, &ProducerMessage{Payload: []byte(sibling.name)})
+	assert.NotNil(t, err)
+	_, err = sibling.ProduceGrouped(ctx, "g", time.Second, &ProducerMessage{Payload: []byte(sibling.name)})
+	assert.NotNil(t, err)
+	assert.NotNil(t, sibling.start(HandlerFunc(func(ctx context.Context, m *Message) error { return nil })))
+	assert.NotNil(t, sibling.Destroy(ctx))
+	s, err := a.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), s.Ready)
+
+	// destroy a, the keys of ab are left
+	assert.Nil(t, a.Destroy(ctx))
+	keys, err := a.ownKeys(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+	s, err = ab.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), s.Ready)
+	assert.Equal(t, int64(1), a.rdb.Exists(ctx, ab.key(kToken)+":token").Val())
+}
+
+func TestQueueTTL(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithQueueTTL(time.Minute), WithHeartbeatInterval(10*time.Millisecond))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("ready")})
+	assert.Nil(t, err)
+	ttl, err := q.rdb.TTL(ctx, q.key(kReady)).Result()
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, 50*time.Second)
+
+	// consume, the registry is refreshed by heartbeat
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	assert.Eventually(t, func() bool {
+		ttl, err := q.rdb.TTL(ctx, q.key(kInstances)).Result()
+		return err == nil && ttl > 50*time.Second
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQueueTTLThrottle(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithQueueTTL(time.Minute))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("first")})
+	assert.Nil(t, err)
+	assert.Nil(t, q.rdb.Persist(ctx, q.key(kReady)).Err())
+
+	// not refreshed again within a tenth of the TTL
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("second")})
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-1), q.rdb.TTL(ctx, q.key(kReady)).Val())
+
+	// refreshed once it passed
+	q.touchedAt.Store(time.Now().Add(-7 * time.Second).UnixNano())
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("third")})
+	assert.Nil(t, err)
+	assert.Greater(t, q.rdb.TTL(ctx, q.key(kReady)).Val(), 50*time.Second)
+}
+
+func TestFailover(t *testing.T) {
+	// init, the primary is down until told otherwise
+	var down atomic.Bool
+	down.Store(true)
+	primary := redis.NewClient(&redis.Options{
+		Addr: "127.0.0.1:6379",
+		DB:   3,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if down.Load() {
+				return nil, errors.New("mock down")
+			}
+			return net.Dial(network, addr)
+		},
+	})
+	standby := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 4})
+	q := New(append(testOpts(t), WithRedis(primary), WithStandby(standby, 10*time.Millisecond, 2))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+	defer q.stopFailover()
+
+	// produced to the standby once failed over
+	ctx := context.Background()
+	assert.Eventually(t, func() bool {
+		_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("failover")})
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(1), standby.LLen(ctx, q.key(kReady)).Val())
+	held, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("held")})
+	assert.Nil(t, err)
+	assert.Nil(t, q.Hold(ctx, held.ID))
+
+	// resync to the primary once recovered, held messages included
+	down.Store(false)
+	assert.Eventually(t, func() bool {
+		return q.rdb.LLen(ctx, q.key(kReady)).Val() == 1 && standby.Exists(ctx, q.key(kReady)).Val() == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, q.rdb.ZScore(ctx, q.key(kHeld), held.ID).Err())
+}
+
+func TestReadReplica(t *testing.T) {
+	// init, the replica is another db so reads are told apart
+	replica := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 1})
+	q := New(append(testOpts(t), WithReadReplica(replica))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("ready")})
+	assert.Nil(t, err)
+
+	// assert
+	s, err := q.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), s.Ready)
+	m, err := q.GetMessage(ctx, r.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+
+	m, err = q.getMessage(ctx, r.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ready"), m.Payload)
+}
+
+func TestGetEnvelope(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	at := time.Now().Add(1 * time.Minute)
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("envelope"), DeliverAt: &at, Kind: "kind"})
+	assert.Nil(t, err)
+
+	// assert
+	m, err := q.GetEnvelope(ctx, r.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, r.ID, m.ID)
+	assert.Equal(t, "kind", m.Kind)
+	assert.Equal(t, at.UnixMilli(), m.DeliverAt.UnixMilli())
+	assert.Nil(t, m.Payload)
+
+	// with how far previous attempts got
+	assert.Nil(t, q.saver(r.ID)(ctx, annotationPrefix+"stage", "validated"))
+	assert.Nil(t, q.saver(r.ID)(ctx, "checkpoint", base64.StdEncoding.EncodeToString([]byte("1"))))
+	m, err = q.GetEnvelope(ctx, r.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"stage": "validated"}, m.Annotations)
+	assert.Equal(t, []byte("1"), m.Checkpoint)
+
+	m, err = q.GetEnvelope(ctx, "missing")
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+}
+
+func TestAuditLog(t *testing.T) {
+	// init
+	q := New(append(testOpts(t),
+		WithAuditLog(100),
+		WithRetryInterval(10*time.Millisecond),
+	)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	// produce
+	ctx := context.Background()
+	at := time.Now().Add(10 * time.Millisecond)
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("audit"), DeliverAt: &at})
+	assert.Nil(t, err)
+
+	// consume, fail once
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		if m.DeliverCnt == 1 {
+			return fmt.Errorf("mock err")
+		}
+		return nil
+	}))
+	defer closeQueue(t, q)
+
+	// assert
+	want := []EventType{EventCommitted, EventTaken, EventRetried, EventTaken, EventDue, EventProduced}
+	assert.Eventually(t, func() bool {
+		events, err := q.AuditLog(ctx, r.ID, 100)
+		if err != nil || len(events) != len(want) {
+			return false
+		}
+		for i, e := range events {
+			if e.Type != want[i] {
+				return false
+			}
+		}
+		return true
+	}, 1*time.Second, 10*time.Millisecond)
+}
+
+func TestDiscover(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	at := time.Now().Add(1 * time.Minute)
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("delay"), DeliverAt: &at})
+	assert.Nil(t, err)
+
+	// assert
+	infos, err := Discover(ctx, q.rdb.Client, q.redisPrefix)
+	assert.Nil(t, err)
+
+	var found bool
+	for _, info := range infos {
+		if info.Name == q.name {
+			found = true
+			assert.Equal(t, int64(1), info.Stats.Delay)
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestSnapshot(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("ready_" + strconv.Itoa(i))})
+		assert.Nil(t, err)
+		ids = append(ids, r.ID)
+	}
+	at := time.Now().Add(1 * time.Minute)
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("delay"), DeliverAt: &at})
+	assert.Nil(t, err)
+	held, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("held")})
+	assert.Nil(t, err)
+	assert.Nil(t, q.Hold(ctx, held.ID))
+	trashed, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("trashed")})
+	assert.Nil(t, err)
+	assert.Nil(t, q.Cancel(ctx, trashed.ID))
+
+	// assert, the oldest ready messages are sampled
+	s, err := q.Snapshot(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), s.Ready.Count)
+	assert.Equal(t, 2, len(s.Ready.Messages))
+	assert.Equal(t, ids[0], s.Ready.Messages[0].ID)
+	assert.Equal(t, ids[1], s.Ready.Messages[1].ID)
+	assert.Equal(t, int64(1), s.Delay.Count)
+	assert.Equal(t, 1, len(s.Delay.Messages))
+	if assert.Len(t, s.Held.Messages, 1) {
+		assert.Equal(t, held.ID, s.Held.Messages[0].ID)
+	}
+	if assert.Len(t, s.Trash.Messages, 1) {
+		assert.Equal(t, trashed.ID, s.Trash.Messages[0].ID)
+	}
+
+	name := t.TempDir() + "/snapshot.json"
+	assert.Nil(t, s.WriteFile(name))
+}
+
+type lineLogger struct {
+	defaultLogger
+	lines []string
+}
+
+func (l *lineLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(msg, data...))
+}
+
+func TestLogSampled(t *testing.T) {
+	// init
+	l := &lineLogger{}
+	q := New(WithLogger(l), WithLogMode(Warn), WithLogSampling(50*time.Millisecond))
+
+	// identical lines are suppressed within the window
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		q.logSampled(ctx, Warn, "failed, err: %v", "poison")
+	}
+	q.logSampled(ctx, Warn, "failed, err: %v", "other")
+	<-time.After(50 * time.Millisecond)
+	q.logSampled(ctx, Warn, "failed, err: %v", "poison")
+
+	assert.Equal(t, []string{
+		"failed, err: poison",
+		"failed, err: other",
+		"failed, err: poison (suppressed 2 times)",
+	}, l.lines)
+}
+
+type chanNotifier chan DeadLetterAlert
+
+func (n chanNotifier) Notify(ctx context.Context, a DeadLetterAlert) error {
+	n <- a
+	return nil
+}
+
+func TestWatchDeadLetters(t *testing.T) {
+	// init
+	q := New(testOpts(t)...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("dead")})
+		assert.Nil(t, err)
+		assert.Nil(t, q.rdb.runDeadLetter(ctx, q.key(kRetry), q.key(kDead), q.key(kData), r.ID, "mock"))
+	}
+
+	// watch
+	n := make(chanNotifier, 10)
+	go func() {
+		assert.Nil(t, q.WatchDeadLetters(ctx, n, DeadLetterThreshold{Total: 10, Rate: 3, Interval: 10 * time.Millisecond}))
+	}()
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("notify timeout")
+	case a := <-n:
+		assert.Equal(t, int64(3), a.Total)
+		assert.Equal(t, int64(3), a.Recent)
+	}
+
+	// notified once until crossed again
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, n, 0)
+}
+
+func TestMigrateTo(t *testing.T) {
+	// init, the target is another db
+	target := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379", DB: 2})
+	q := New(testOpts(t)...)
+	tq := New(append(testOpts(t), WithRedis(target))...)
+	defer t.Cleanup(func() { cleanup(t, q, tq) })
+
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 5; i++ {
+		r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("ready" + strconv.Itoa(i))})
+		assert.Nil(t, err)
+		ids = append(ids, r.ID)
+	}
+	at := time.Now().Add(time.Hour)
+	token, err := q.ProduceWithToken(ctx, "token", &ProducerMessage{Payload: []byte("delay"), DeliverAt: &at})
+	assert.Nil(t, err)
+	assert.Nil(t, q.rdb.HSet(ctx, q.key(kResult)+":committed", "status", 200).Err())
+	held, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("held")})
+	assert.Nil(t, err)
+	assert.Nil(t, q.Hold(ctx, held.ID))
+	batch, err := q.ProduceGrouped(ctx, "group", time.Hour, &ProducerMessage{Payload: []byte("item")})
+	assert.Nil(t, err)
+
+	// migrate
+	n, err := q.MigrateTo(ctx, target, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, n)
+
+	// held messages and batches are copied
+	assert.Nil(t, target.ZScore(ctx, tq.key(kHeld), held.ID).Err())
+	assert.Equal(t, int64(1), target.LLen(ctx, tq.key(kBatch)+":"+batch.ID).Val())
+	assert.Equal(t, int64(1), target.Exists(ctx, tq.groupKey("group")).Val())
+
+	// tokens and results are copied
+	r, err := tq.ProduceWithToken(ctx, "token", &ProducerMessage{Payload: []byte("delay"), DeliverAt: &at})
+	assert.Nil(t, err)
+	assert.True(t, r.Deduplicated)
+	assert.Equal(t, token.ID, r.ID)
+	res, err := tq.Result(ctx, "committed")
+	assert.Nil(t, err)
+	assert.Equal(t, 200, res.Status)
+
+	// dual write until stopped
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("dual")})
+	assert.Nil(t, err)
+	q.StopDualWrite()
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("source")})
+	assert.Nil(t, err)
+
+	s, err := tq.Stats(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), s.Ready)
+	assert.Equal(t, int64(2), s.Delay)
+
+	// the order is kept
+	ready, err := target.LRange(ctx, tq.key(kReady), 1, -1).Result()
+	assert.Nil(t, err)
+	for i, id := range ready {
+		assert.Equal(t, ids[len(ids)-1-i], id)
+	}
+	m, err := tq.GetMessage(ctx, ids[0])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ready0"), m.Payload)
+}
+
+func TestMigrated(t *testing.T) {
+	// every component is migrated or left out on purpose, so resync doesn't
+	// destroy keys of the standby not migrated
+	for k := redisKey(0); k < numKey; k++ {
+		assert.True(t, migrated(k), keyComponents[k])
+	}
+}
+
+func TestProfile(t *testing.T) {
+	q := New(ProfileBatch(), WithConsumerWorkerNum(8))
+	assert.Equal(t, 8, q.consumeWorkerNum)
+	assert.Equal(t, time.Second, q.daemonWorkerInterval)
+	assert.Equal(t, rate.Limit(100), q.lim.Limit())
+
+	// handlers of a profile are not redelivered while running
+	for _, p := range []func(*Queue){ProfileLowLatency(), ProfileHighThroughput(), ProfileBatch()} {
+		q := New(p)
+		assert.LessOrEqual(t, q.consumeTimeout, q.retryInterval)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	q := New(append(testOpts(t), WithConsumerWorkerNum(4), WithColdTier(time.Hour))...)
+
+	o := q.Options()
+	assert.Equal(t, q.name, o.Name)
+	assert.Equal(t, 4, o.ConsumeWorkerNum)
+	assert.Equal(t, time.Hour, o.ColdHorizon)
+	assert.Equal(t, float64(-1), o.RateLimit)
+	assert.Equal(t, Identity.Name(), o.Codec)
+
+	_, err := json.Marshal(o)
+	assert.Nil(t, err)
+}
+
+func TestMetadata(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithOwner("team-a"))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	m, err := q.Metadata(ctx)
+	assert.Nil(t, err)
+	assert.True(t, m.CreatedAt.IsZero())
+
+	// produce writes the producer side
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("a")})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		m, err = q.Metadata(ctx)
+		return err == nil && m.ProducerVersion != ""
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "team-a", m.Owner)
+	assert.Equal(t, Version, m.ProducerVersion)
+	assert.NotEmpty(t, m.ProducerFingerprint)
+	assert.Empty(t, m.ConsumerVersion)
+	createdAt := m.CreatedAt
+	assert.WithinDuration(t, time.Now(), createdAt, time.Second)
+
+	// consume writes the consumer side
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error { return nil }))
+	defer closeQueue(t, q)
+	m, err = q.Metadata(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, Version, m.ConsumerVersion)
+	assert.Equal(t, m.ProducerFingerprint, m.ConsumerFingerprint)
+	assert.Equal(t, createdAt, m.CreatedAt)
+	assert.False(t, m.VersionSkew())
+
+	// a producer of another version
+	assert.Nil(t, q.rdb.HSet(ctx, q.key(kMeta), "producer_version", "v0.0.1").Err())
+	m, err = q.Metadata(ctx)
+	assert.Nil(t, err)
+	assert.True(t, m.VersionSkew())
+}
+
+func TestVersionSkew(t *testing.T) {
+	// init, the queue is used by an incompatible consumer
+	q := New(append(testOpts(t), WithStrictVersioning())...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	assert.Nil(t, q.rdb.HSet(ctx, q.key(kMeta), "consumer_version", "v9.0.0").Err())
+
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("a")})
+	assert.ErrorIs(t, err, ErrVersionSkew)
+	cnt, err := q.rdb.LLen(ctx, q.key(kReady)).Result()
+	assert.Nil(t, err)
+	assert.Zero(t, cnt)
+
+	var consumeErr error
+	c := New(append(testOpts(t), WithStrictVersioning(), WithOnConsumeError(func(err error) { consumeErr = err }))...)
+	c.Consume(HandlerFunc(func(ctx context.Context, m *Message) error { return nil }))
+	closeQueue(t, c)
+	assert.ErrorIs(t, consumeErr, ErrVersionSkew)
+
+	// a compatible version only warns without strict versioning
+	assert.True(t, compatible("v0.1.9"))
+	assert.False(t, compatible("v0.2.0"))
+	w := New(testOpts(t)...)
+	_, err = w.Produce(ctx, &ProducerMessage{Payload: []byte("a")})
+	assert.Nil(t, err)
+}
+
+func TestKeyPatterns(t *testing.T) {
+	q := New(append(testOpts(t), WithRedisKeyPrefix("acl"))...)
+
+	all := q.KeyPatterns()
+	assert.Len(t, all, 2*int(numKey))
+	assert.Contains(t, all, "acl:msg:dq_test_TestKeyPatterns:*")
+	producer := q.ProducerKeyPatterns()
+	assert.Subset(t, all, producer)
+	assert.Contains(t, producer, "acl:ready:dq_test_TestKeyPatterns")
+	assert.NotContains(t, producer, "acl:dead:dq_test_TestKeyPatterns")
+
+	rule := q.ACLRule("producer", ACLProducer)
+	assert.True(t, strings.HasPrefix(rule, "ACL SETUSER producer resetkeys ~acl:ready:dq_test_TestKeyPatterns "))
+	assert.NotContains(t, rule, ":dead:")
+	assert.Contains(t, q.ACLRule("consumer", ACLConsumer), " ~acl:retry:dq_test_TestKeyPatterns ")
+}
+
+func TestKeyNamer(t *testing.T) {
+	// init
+	namer := func(queue, component string) string { return "{" + queue + "}:" + component }
+	q := New(append(testOpts(t), WithKeyNamer(namer))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+	name := "dq_test_TestKeyNamer"
+	assert.Equal(t, "{"+name+"}:ready", q.key(kReady))
+	assert.True(t, q.Options().KeyNamer)
+
+	// produce
+	ctx := context.Background()
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("a")})
+	assert.Nil(t, err)
+	n, err := q.rdb.Exists(ctx, "{"+name+"}:msg:"+r.ID, "{"+name+"}:ready").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	n, err = q.rdb.Exists(ctx, "dq:ready:"+name).Result()
+	assert.Nil(t, err)
+	assert.Zero(t, n)
+
+	// consume
+	got := make(chan string, 1)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error {
+		got <- m.ID
+		return nil
+	}))
+	defer closeQueue(t, q)
+	select {
+	case gid := <-got:
+		assert.Equal(t, r.ID, gid)
+	case <-time.After(3 * time.Second):
+		t.Fatal("message not consumed")
+	}
+}
+
+func TestTail(t *testing.T) {
+	// init
+	q := New(append(testOpts(t), WithLiveTail())...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := q.Tail(ctx)
+	assert.Nil(t, err)
+
+	// produce and consume
+	r, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("tail")})
+	assert.Nil(t, err)
+	q.Consume(HandlerFunc(func(ctx context.Context, m *Message) error { return nil }))
+	defer closeQueue(t, q)
+
+	// assert
+	for _, want := range []EventType{EventProduced, EventTaken, EventCommitted} {
+		select {
+		case e := <-events:
+			assert.Equal(t, want, e.Type)
+			assert.Equal(t, r.ID, e.ID)
+			assert.WithinDuration(t, time.Now(), e.At, time.Second)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%s event not received", want)
+		}
+	}
+
+	// stop tailing
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, ok := <-events
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,79 @@
+package dq
+
+import (
+	"errors"
+	"time"
+)
+
+// Quota limits the messages of a tenant, zero limits are disabled.
+type Quota struct {
+	// PerDay is the number of messages produced per UTC day.
+	PerDay int64 `json:"per_day"`
+	// Pending is the number of messages produced but neither acknowledged nor dead.
+	Pending int64 `json:"pending"`
+}
+
+// ErrQuotaExceeded is returned by Produce if the tenant of the message exceeded its quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// daily counters are kept for two days
+const quotaDaySec = 2 * 24 * 60 * 60
+
+// quota is the quota of a tenant with its counter keys.
+type quota struct {
+	Quota
+	day     string
+	pending string
+}
+
+func (q *Queue) quotaOf(tenant string, now time.Time) quota {
+	if tenant == "" {
+		return quota{}
+	}
+	qa, ok := q.tenantQuotas[tenant]
+	if !ok {
+		qa = q.quota
+	}
+	key := q.key(kQuota) + ":" + tenant
+	return quota{Quota: qa, day: key + ":" + now.UTC().Format("20060102"), pending: key + ":pending"}
+}
+
+// luaQuota is prepended to the produce scripts, the pending set holds the
+// data keys of messages. Once it is full, every produce prunes the members
+// finished or dead of the next SSCAN batch, resuming from the cursor saved
+// with the set, so a produce of a busy tenant never blocks redis long.
+const luaQuota = `
+local function quota_exceeded(day, pending, per_day, max_pending)
+	if per_day > 0 and tonumber(redis.call('GET', day) or '0') >= per_day then
+		return true;
+	end
+	if max_pending > 0 and redis.call('SCARD', pending) >= max_pending then
+		local cursor = pending .. ':cursor';
+		local res = redis.call('SSCAN', pending, redis.call('GET', cursor) or '0', 'COUNT', 100);
+		for _, k in ipairs(res[2]) do
+			if redis.call('EXISTS', k) == 0 or redis.call('HEXISTS', k, 'dead_at') == 1 then
+				redis.call('SREM', pending, k);
+			end
+		end
+		if res[1] == '0' then
+			redis.call('DEL', cursor);
+		else
+			redis.call('SET', cursor, res[1], 'PX', math.max(redis.call('PTTL', pending), 1));
+		end
+		return redis.call('SCARD', pending) >= max_pending;
+	end
+	return false;
+end
+local function quota_used(day, pending, data, per_day, max_pending, day_sec, exp_sec)
+	if per_day > 0 then
+		redis.call('INCR', day);
+		redis.call('EXPIRE', day, day_sec);
+	end
+	if max_pending > 0 then
+		redis.call('SADD', pending, data);
+		if redis.call('TTL', pending) < tonumber(exp_sec) then
+			redis.call('EXPIRE', pending, exp_sec);
+		end
+	end
+end
+`
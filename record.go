@@ -0,0 +1,59 @@
+package dq
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// recorder writes taken messages to w as JSON lines.
+type recorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// record writes the message before it is processed, failures are logged only.
+func (q *Queue) record(ctx context.Context, m *Message) {
+	if q.recorder == nil {
+		return
+	}
+	bs, err := json.Marshal(m)
+	if err != nil {
+		q.log(ctx, Warn, "record message %s failed, err: %v", m.ID, err)
+		return
+	}
+
+	q.recorder.mu.Lock()
+	defer q.recorder.mu.Unlock()
+	if _, err = q.recorder.w.Write(append(bs, '\n')); err != nil {
+		q.log(ctx, Warn, "record message %s failed, err: %v", m.ID, err)
+	}
+}
+
+// Replay feeds the messages recorded by WithRecorder through the
+// transformers, middlewares and h in order without redis, it stops at the
+// first message failed.
+func (q *Queue) Replay(ctx context.Context, r io.Reader, h Handler) error {
+	h = q.wrap(h)
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 64<<20)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var m Message
+		if err := json.Unmarshal(s.Bytes(), &m); err != nil {
+			return fmt.Errorf("unmarshal recorded message failed, err: %v", err)
+		}
+		if err := h.Process(ctx, &m); err != nil {
+			return fmt.Errorf("replay message %s failed, err: %w", m.ID, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("read recorded messages failed, err: %v", err)
+	}
+	return nil
+}
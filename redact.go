@@ -0,0 +1,62 @@
+package dq
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Redactor masks secrets in payload before it is logged.
+type Redactor func(payload []byte) []byte
+
+const redacted = "***"
+
+// RedactJSONFields returns a Redactor masking the fields of JSON payload,
+// nested fields are separated by dot, e.g. "user.password".
+// Payload which is not a JSON object is masked entirely.
+func RedactJSONFields(paths ...string) Redactor {
+	fields := make([][]string, 0, len(paths))
+	for _, p := range paths {
+		fields = append(fields, strings.Split(p, "."))
+	}
+
+	return func(payload []byte) []byte {
+		var v map[string]interface{}
+		if err := json.Unmarshal(payload, &v); err != nil {
+			return []byte(redacted)
+		}
+
+		for _, f := range fields {
+			redactField(v, f)
+		}
+
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return []byte(redacted)
+		}
+		return bs
+	}
+}
+
+func redactField(v map[string]interface{}, path []string) {
+	for i, k := range path {
+		val, ok := v[k]
+		if !ok {
+			return
+		}
+		if i == len(path)-1 {
+			v[k] = redacted
+			return
+		}
+		if v, ok = val.(map[string]interface{}); !ok {
+			return
+		}
+	}
+}
+
+// redact returns the payload safe to be logged.
+func (q *Queue) redact(payload []byte) string {
+	if q.redactor == nil {
+		return string(payload)
+	}
+	return string(q.redactor(payload))
+}
@@ -0,0 +1,37 @@
+package dq
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactJSONFields(t *testing.T) {
+	r := RedactJSONFields("password", "card.number", "missing.field")
+
+	bs := r([]byte(`{"user":"u","password":"p","card":{"number":"4242","exp":"12/30"}}`))
+	assert.JSONEq(t, `{"user":"u","password":"***","card":{"number":"***","exp":"12/30"}}`, string(bs))
+
+	assert.Equal(t, "***", string(r([]byte("not json"))))
+}
+
+func TestRedactorLogMode(t *testing.T) {
+	// init, the redactor runs only if the trace log is written
+	var calls int
+	q := New(append(testOpts(t), WithRedactor(func(payload []byte) []byte {
+		calls++
+		return payload
+	}))...)
+	defer t.Cleanup(func() { cleanup(t, q) })
+
+	ctx := context.Background()
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: []byte("silent")})
+	assert.Nil(t, err)
+	assert.Zero(t, calls)
+
+	WithLogMode(Trace)(q)
+	_, err = q.Produce(ctx, &ProducerMessage{Payload: []byte("trace")})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,172 @@
+package dq
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RedrivePolicy defines how failed messages are retried, where they go once
+// dead and how long they are kept. It is set for the queue by WithRedrivePolicy
+// and per message by ProducerMessage.Redrive, zero fields fall back to the queue.
+type RedrivePolicy struct {
+	// MaxRetries moves the message to dead letter once exceeded.
+	MaxRetries int
+	// Interval is the delay before the first retry.
+	Interval time.Duration
+	// Multiplier grows the interval on every attempt, 0 or 1 means fixed interval.
+	Multiplier float64
+	// MaxInterval caps the interval, 0 means no cap.
+	MaxInterval time.Duration
+	// DeadLetterQueue is the name of the queue dead letters are produced to,
+	// empty keeps them in the dead letters of this queue.
+	DeadLetterQueue string
+	// Expiration is the time the message is kept after it is due.
+	Expiration time.Duration
+}
+
+// values are the message data fields of the policy.
+func (p *RedrivePolicy) values() []interface{} {
+	var values []interface{}
+	if p.MaxRetries > 0 {
+		values = append(values, "redrive_retries", p.MaxRetries)
+	}
+	if p.Interval > 0 {
+		values = append(values, "redrive_interval", p.Interval.Milliseconds())
+	}
+	if p.Multiplier > 0 {
+		values = append(values, "redrive_multiplier", strconv.FormatFloat(p.Multiplier, 'f', -1, 64))
+	}
+	if p.MaxInterval > 0 {
+		values = append(values, "redrive_max_interval", p.MaxInterval.Milliseconds())
+	}
+	if p.DeadLetterQueue != "" {
+		values = append(values, "redrive_dlq", p.DeadLetterQueue)
+	}
+	return values
+}
+
+// parse parses the message data field of the policy, false if it is not one.
+func (p *RedrivePolicy) parse(field, value string) bool {
+	switch field {
+	case "redrive_retries":
+		p.MaxRetries, _ = strconv.Atoi(value)
+	case "redrive_interval":
+		ms, _ := strconv.ParseInt(value, 10, 64)
+		p.Interval = time.Duration(ms) * time.Millisecond
+	case "redrive_multiplier":
+		p.Multiplier, _ = strconv.ParseFloat(value, 64)
+	case "redrive_max_interval":
+		ms, _ := strconv.ParseInt(value, 10, 64)
+		p.MaxInterval = time.Duration(ms) * time.Millisecond
+	case "redrive_dlq":
+		p.DeadLetterQueue = value
+	default:
+		return false
+	}
+	return true
+}
+
+// redriveOf returns the policy of the message, fields unset by the message are of the queue.
+func (q *Queue) redriveOf(m *Message) RedrivePolicy {
+	p := q.redrive
+	p.MaxRetries = q.retryTimes
+	p.Interval = q.currentRetryInterval()
+	p.Expiration = q.messageSaveTime
+	r := m.Redrive
+	if r == nil {
+		return p
+	}
+
+	if r.MaxRetries > 0 {
+		p.MaxRetries = r.MaxRetries
+	}
+	if r.Interval > 0 {
+		p.Interval = r.Interval
+	}
+	if r.Multiplier > 0 {
+		p.Multiplier = r.Multiplier
+	}
+	if r.MaxInterval > 0 {
+		p.MaxInterval = r.MaxInterval
+	}
+	if r.DeadLetterQueue != "" {
+		p.DeadLetterQueue = r.DeadLetterQueue
+	}
+	if r.Expiration > 0 {
+		p.Expiration = r.Expiration
+	}
+	return p
+}
+
+// backoff is the delay before retrying the message failed attempt times,
+// 0 if the interval is fixed, so it is redelivered by the take script.
+func (p RedrivePolicy) backoff(attempt int) time.Duration {
+	if p.Multiplier <= 1 {
+		return 0
+	}
+	return RetryPolicy{Interval: p.Interval, Multiplier: p.Multiplier, MaxInterval: p.MaxInterval}.delay(attempt)
+}
+
+// redriveDead produces the dead message to the dead letter queue of its policy,
+// and removes it from this queue once produced. The payload is copied encoded,
+// along with its codec and checksum, so it is decoded by the consumers of the
+// dead letter queue configured with the same codec.
+func (q *Queue) redriveDead(ctx context.Context, id string) {
+	values, err := q.rdb.HMGet(ctx, q.key(kData)+":"+id, envelopeFields...).Result()
+	if err != nil {
+		return
+	}
+	m, err := parseEnvelope(values)
+	if err != nil || m == nil {
+		return
+	}
+	dlq := q.redriveOf(m).DeadLetterQueue
+	if dlq == "" {
+		return
+	}
+	payload, err := q.rdb.HGet(ctx, q.key(kData)+":"+id, "payload").Result()
+	if err != nil {
+		return
+	}
+
+	target := q.deadLetterQueue(dlq)
+	token := "dead:" + q.name + ":" + m.ID
+	_, err = target.enqueue(ctx, &Message{
+		ProducerMessage: ProducerMessage{
+			Payload:  []byte(payload),
+			Kind:     m.Kind,
+			Affinity: m.Affinity,
+			Tenant:   m.Tenant,
+		},
+		ID:       uuid.NewSHA1(uuid.NameSpaceOID, []byte(target.name+":"+token)).String(),
+		CreateAt: time.Now(),
+		Codec:    m.Codec,
+		checksum: m.checksum,
+	}, token)
+	if err != nil {
+		q.log(ctx, Warn, "redrive dead message %s to %s failed, err: %v", id, dlq, err)
+		return
+	}
+
+	pipe := q.rdb.TxPipeline()
+	pipe.ZRem(ctx, q.key(kDead), id)
+	pipe.Del(ctx, q.key(kData)+":"+id)
+	if _, err = pipe.Exec(ctx); err != nil {
+		q.log(ctx, Warn, "remove redriven dead message %s failed, err: %v", id, err)
+		return
+	}
+	q.log(ctx, Info, "dead message %s is redriven to %s", id, dlq)
+}
+
+// deadLetterQueue returns the queue named name dead letters are redriven to,
+// built once and kept for the later dead letters.
+func (q *Queue) deadLetterQueue(name string) *Queue {
+	if t, ok := q.dlqs.Load(name); ok {
+		return t.(*Queue)
+	}
+	t, _ := q.dlqs.LoadOrStore(name, New(WithRedis(q.rdb.Client), WithRedisKeyPrefix(q.redisPrefix), WithKeyNamer(q.keyNamer), WithName(name)))
+	return t.(*Queue)
+}
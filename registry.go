@@ -0,0 +1,215 @@
+package dq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Instance describes a consumer instance of the queue.
+type Instance struct {
+	ID          string    `json:"id"`
+	Hostname    string    `json:"hostname"`
+	PID         int       `json:"pid"`
+	Role        Role      `json:"role"`
+	WorkerNum   int       `json:"worker_num"`
+	StartedAt   time.Time `json:"started_at"`
+	HeartbeatAt time.Time `json:"heartbeat_at"`
+	Processed   int64     `json:"processed"`
+	Failed      int64     `json:"failed"`
+	// BusyRatio is the fraction of worker time spent in handlers
+	// over the last heartbeat interval.
+	BusyRatio float64 `json:"busy_ratio"`
+	// Draining instances are closing and take no new messages.
+	Draining bool `json:"draining"`
+	// HeartbeatInterval is the heartbeat interval of the instance, it expires
+	// after missing several heartbeats of its own interval.
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+}
+
+// counters of messages processed by this instance
+type counters struct {
+	processed atomic.Int64
+	failed    atomic.Int64
+	// busy is the total time spent in handlers, busyRatio is its share
+	// of the worker time in the last heartbeat interval, in float64 bits.
+	busy      atomic.Int64
+	busyRatio atomic.Uint64
+}
+
+func newInstanceID() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), uuid.NewString()[:8])
+}
+
+// register keeps the instance in the registry until ctx is done,
+// the instance is deregistered by Close once it is drained.
+func (q *Queue) register(ctx context.Context) {
+	defer close(q.registryDone)
+
+	ticker := time.NewTicker(q.heartbeatInterval)
+	defer ticker.Stop()
+
+	busy, at := q.counters.busy.Load(), time.Now()
+	for {
+		busy, at = q.sampleBusy(ctx, busy, at)
+		if err := q.heartbeat(context.Background()); err != nil {
+			q.log(ctx, Warn, "registry heartbeat failed, err: %v", err)
+		}
+		q.reclaimExpired(context.Background())
+		q.touch(context.Background())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sampleBusy updates the busy ratio since the last sample of busy at,
+// and calls the busy hook in the background if the ratio reaches the threshold,
+// unless the previous call is still running, so a slow hook never delays the heartbeat.
+func (q *Queue) sampleBusy(ctx context.Context, lastBusy int64, lastAt time.Time) (int64, time.Time) {
+	busy, now := q.counters.busy.Load(), time.Now()
+	elapsed := now.Sub(lastAt)
+	if elapsed <= 0 || q.consumeWorkerNum <= 0 {
+		return busy, now
+	}
+
+	ratio := float64(busy-lastBusy) / (float64(elapsed) * float64(q.consumeWorkerNum))
+	if ratio > 1 {
+		ratio = 1
+	}
+	q.counters.busyRatio.Store(math.Float64bits(ratio))
+	if q.onBusy != nil && ratio >= q.busyThreshold {
+		q.log(ctx, Info, "workers busy ratio %.2f reaches %.2f", ratio, q.busyThreshold)
+		if q.busyHooking.CompareAndSwap(false, true) {
+			go func() {
+				defer q.busyHooking.Store(false)
+				q.onBusy(ctx, ratio)
+			}()
+		}
+	}
+	return busy, now
+}
+
+func (q *Queue) heartbeat(ctx context.Context) error {
+	hostname, _ := os.Hostname()
+	workers := q.consumeWorkerNum
+	if q.role == SchedulerOnly {
+		workers = 0
+	}
+	bs, err := json.Marshal(Instance{
+		ID:          q.instanceID,
+		Hostname:    hostname,
+		PID:         os.Getpid(),
+		Role:        q.role,
+		WorkerNum:   workers,
+		StartedAt:   q.startedAt,
+		HeartbeatAt: time.Now(),
+		Processed:   q.counters.processed.Load(),
+		Failed:      q.counters.failed.Load(),
+		BusyRatio:   math.Float64frombits(q.counters.busyRatio.Load()),
+		Draining:    q.draining.Load(),
+
+		HeartbeatInterval: q.heartbeatInterval,
+	})
+	if err != nil {
+		return err
+	}
+	if q.queueTTL <= 0 {
+		return q.rdb.HSet(ctx, q.key(kInstances), q.instanceID, bs).Err()
+	}
+	// the registry may be created after the queue keys were touched
+	_, err = q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, q.key(kInstances), q.instanceID, bs)
+		pipe.Expire(ctx, q.key(kInstances), q.queueTTL)
+		return nil
+	})
+	return err
+}
+
+// drain marks the instance draining, so it is shown as terminating while
+// in-flight messages are finishing.
+func (q *Queue) drain(ctx context.Context) {
+	q.draining.Store(true)
+	if err := q.heartbeat(ctx); err != nil {
+		q.log(ctx, Warn, "registry mark draining failed, err: %v", err)
+	}
+}
+
+// deregister removes the instance from the registry and reclaims its
+// in-flight messages immediately instead of waiting for the retry interval.
+func (q *Queue) deregister(ctx context.Context) error {
+	return q.deregisterInstance(ctx, q.instanceID)
+}
+
+func (q *Queue) deregisterInstance(ctx context.Context, id string) error {
+	cnt, err := q.rdb.runReclaim(ctx, q.inflightKey(id), q.key(kRetry), q.key(kReady), q.key(kData))
+	if err != nil {
+		return fmt.Errorf("reclaim in-flight messages failed, err: %v", err)
+	}
+	if cnt > 0 {
+		q.log(ctx, Info, "instance %s deregistered, reclaim %d in-flight messages", id, cnt)
+	}
+	return q.rdb.HDel(ctx, q.key(kInstances), id).Err()
+}
+
+// reclaimExpired deregisters instances missing several heartbeats, e.g. crashed.
+func (q *Queue) reclaimExpired(ctx context.Context) {
+	if _, err := q.instances(ctx, q.rdb.Client, true); err != nil {
+		q.log(ctx, Warn, "registry reclaim expired instances failed, err: %v", err)
+	}
+}
+
+// heartbeatOf returns the heartbeat interval of the instance, the interval of
+// this instance if it is registered by a version not recording it.
+func (q *Queue) heartbeatOf(ins Instance) time.Duration {
+	if ins.HeartbeatInterval > 0 {
+		return ins.HeartbeatInterval
+	}
+	return q.heartbeatInterval
+}
+
+func (q *Queue) inflightKey(instanceID string) string {
+	return q.key(kInflight) + ":" + instanceID
+}
+
+// Instances lists the consumer instances with a recent heartbeat, instances
+// missing several heartbeats are skipped and left to the registry loop of
+// the running instances to remove.
+func (q *Queue) Instances(ctx context.Context) ([]Instance, error) {
+	return q.instances(ctx, q.rdb.reader(), false)
+}
+
+func (q *Queue) instances(ctx context.Context, c redis.Cmdable, prune bool) ([]Instance, error) {
+	values, err := c.HGetAll(ctx, q.key(kInstances)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get instances failed, err: %v", err)
+	}
+
+	now := time.Now()
+	instances := make([]Instance, 0, len(values))
+	for id, v := range values {
+		var ins Instance
+		if err := json.Unmarshal([]byte(v), &ins); err != nil || ins.HeartbeatAt.Before(now.Add(-3*q.heartbeatOf(ins))) {
+			if !prune {
+				continue
+			}
+			if err := q.deregisterInstance(ctx, id); err != nil {
+				q.log(ctx, Warn, "deregister expired instance %s failed, err: %v", id, err)
+			}
+			continue
+		}
+		instances = append(instances, ins)
+	}
+	return instances, nil
+}
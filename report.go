@@ -0,0 +1,37 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// ErrorReporter reports handler errors and panics, e.g. to Sentry.
+// err is a *ProcessError, stack is only set for panics. Report is called
+// in the handler goroutine, slow reporters should buffer the reports and
+// give up once ctx is done, as SentryReporter does.
+type ErrorReporter interface {
+	Report(ctx context.Context, err error, m *Message, stack []byte)
+}
+
+// ReportErrors returns the middleware reporting handler errors and panics to r,
+// panics are re-panicked after reported, so they are retried as usual.
+func ReportErrors(r ErrorReporter) Middleware {
+	return Named("dq.ReportErrors", func(h Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, m *Message) (err error) {
+			begin := time.Now()
+			defer func() {
+				if v := recover(); v != nil {
+					r.Report(ctx, newProcessError(m, time.Since(begin), fmt.Errorf("panic: %v", v)), m, debug.Stack())
+					panic(v)
+				}
+			}()
+
+			if err = h.Process(ctx, m); err != nil {
+				r.Report(ctx, newProcessError(m, time.Since(begin), err), m, nil)
+			}
+			return err
+		})
+	})
+}
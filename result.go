@@ -0,0 +1,50 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Result is the small metadata of a committed message,
+// e.g. a status code and a reference to the output.
+type Result struct {
+	Status   int
+	Output   string
+	CommitAt time.Time
+	// StagedTx is the downstream transaction ID the message was handed off by.
+	StagedTx string
+}
+
+func (r *Result) values() []interface{} {
+	values := []interface{}{
+		"status", r.Status,
+		"output", r.Output,
+		"commit_at", time.Now().UnixMilli(),
+	}
+	if r.StagedTx != "" {
+		values = append(values, "staged_tx", r.StagedTx)
+	}
+	return values
+}
+
+// Result returns the result of the committed message, nil if it is not
+// committed, has no result or the result expired.
+func (q *Queue) Result(ctx context.Context, id string) (*Result, error) {
+	values, err := q.rdb.reader().HGetAll(ctx, q.key(kResult)+":"+id).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get result failed, err: %v", err)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	var r Result
+	r.Status, _ = strconv.Atoi(values["status"])
+	r.Output = values["output"]
+	ms, _ := strconv.ParseInt(values["commit_at"], 10, 64)
+	r.CommitAt = time.UnixMilli(ms)
+	r.StagedTx = values["staged_tx"]
+	return &r, nil
+}
@@ -0,0 +1,83 @@
+package dq
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// retention dead letters removed by a script run
+const retentionBatch = 1000
+
+// retain runs the retention every interval until ctx is done.
+func (q *Queue) retain(ctx context.Context) {
+	ticker := time.NewTicker(q.retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		q.enforceRetention(context.Background(), time.Now())
+	}
+}
+
+// enforceRetention removes the dead letters dead before now minus the retention age,
+// then the oldest ones beyond the dead letter max length, and prunes the trash
+// entries beyond the trash window, whose data has expired.
+func (q *Queue) enforceRetention(ctx context.Context, now time.Time) {
+	var dead, keys int
+	for age := q.deadRetention(); age > 0; {
+		removed, deleted, err := q.rdb.runTrimDead(ctx, q.key(kDead), q.key(kData), q.key(kResult), now.Add(-age), retentionBatch)
+		if err != nil {
+			q.log(ctx, Warn, "daemon, retention failed, err: %v", err)
+			break
+		}
+		dead += removed
+		keys += deleted
+		if removed < retentionBatch {
+			break
+		}
+	}
+	for q.deadMaxLen > 0 {
+		removed, deleted, err := q.rdb.runCapDead(ctx, q.key(kDead), q.key(kData), q.key(kResult), q.deadMaxLen, retentionBatch)
+		if err != nil {
+			q.log(ctx, Warn, "daemon, retention failed, err: %v", err)
+			break
+		}
+		dead += removed
+		keys += deleted
+		if removed < retentionBatch {
+			break
+		}
+	}
+
+	var trash int64
+	if q.trashWindow > 0 {
+		var err error
+		before := strconv.FormatInt(now.Add(-q.trashWindow).UnixMilli(), 10)
+		if trash, err = q.rdb.ZRemRangeByScore(ctx, q.key(kTrash), "-inf", "("+before).Result(); err != nil {
+			q.log(ctx, Warn, "daemon, retention prune trash failed, err: %v", err)
+		}
+	}
+	if dead == 0 && trash == 0 {
+		return
+	}
+
+	q.log(ctx, Info, "daemon, retention removed %d dead letters, %d trash entries, deleted %d keys", dead, trash, keys)
+	if rm, ok := q.opts.metric.(RetentionMetric); ok && dead > 0 {
+		q.emitMetric(func() { rm.Reclaimed(dead, keys) })
+	}
+}
+
+// deadRetention returns the age dead letters are kept, the data of the older
+// ones has expired with the message save time anyway.
+func (q *Queue) deadRetention() time.Duration {
+	age := q.retentionAge
+	if q.messageSaveTime > 0 && (age <= 0 || age > q.messageSaveTime) {
+		age = q.messageSaveTime
+	}
+	return age
+}
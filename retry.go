@@ -0,0 +1,187 @@
+package dq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// retryAfter is implemented by handler errors knowing when to retry,
+// e.g. errors wrapping an HTTP 429 response.
+type retryAfter interface {
+	RetryAfter() time.Duration
+}
+
+type retryAfterError struct {
+	error
+	after time.Duration
+}
+
+func (e *retryAfterError) RetryAfter() time.Duration { return e.after }
+func (e *retryAfterError) Unwrap() error             { return e.error }
+
+// RetryAfter wraps err so the failed message is retried after d instead of the retry interval.
+func RetryAfter(err error, d time.Duration) error {
+	return &retryAfterError{error: err, after: d}
+}
+
+func retryAfterOf(err error) (time.Duration, bool) {
+	var ra retryAfter
+	if err == nil || !errors.As(err, &ra) {
+		return 0, false
+	}
+	return ra.RetryAfter(), ra.RetryAfter() > 0
+}
+
+// ErrorClass groups handler errors sharing a RetryPolicy.
+type ErrorClass string
+
+const (
+	ErrorClassDefault    ErrorClass = "default"
+	ErrorClassTimeout    ErrorClass = "timeout"
+	ErrorClassRateLimit  ErrorClass = "rate_limit"
+	ErrorClassValidation ErrorClass = "validation"
+)
+
+// RetryPolicy defines how messages failed with an ErrorClass are retried.
+type RetryPolicy struct {
+	// Interval is the delay before the first retry, 0 means the queue retry interval.
+	Interval time.Duration
+	// Multiplier grows the interval on every attempt, 0 or 1 means fixed interval.
+	Multiplier float64
+	// MaxInterval caps the interval, 0 means no cap.
+	MaxInterval time.Duration
+	// MaxRetries moves the message to dead letter once exceeded, 0 means the queue retry times.
+	MaxRetries int
+	// DeadLetter moves the message to dead letter without retrying.
+	DeadLetter bool
+}
+
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Interval
+	for i := 1; i < attempt && p.Multiplier > 1; i++ {
+		d = time.Duration(float64(d) * p.Multiplier)
+		if p.MaxInterval > 0 && d >= p.MaxInterval {
+			return p.MaxInterval
+		}
+	}
+	if p.MaxInterval > 0 && d > p.MaxInterval {
+		return p.MaxInterval
+	}
+	return d
+}
+
+type classError struct {
+	error
+	class ErrorClass
+}
+
+func (e *classError) Unwrap() error { return e.error }
+
+// Classify wraps err with the class recognized by the default classifier.
+func Classify(err error, class ErrorClass) error {
+	return &classError{error: err, class: class}
+}
+
+// defaultClassifier recognizes errors wrapped by Classify, timeouts and errors with RetryAfter.
+func defaultClassifier(err error) ErrorClass {
+	var ce *classError
+	switch {
+	case errors.As(err, &ce):
+		return ce.class
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassTimeout
+	}
+	if _, ok := retryAfterOf(err); ok {
+		return ErrorClassRateLimit
+	}
+	return ErrorClassDefault
+}
+
+// retryDecision is how retry handles a failed message.
+type retryDecision struct {
+	// dead moves the message to dead letter at once.
+	dead bool
+	// exhausted is set if the message exceeded its retries,
+	// so it is moved to dead letter once taken again.
+	exhausted bool
+	// after is the delay before the message is redelivered,
+	// 0 leaves it to the retry set scheduled on take.
+	after time.Duration
+}
+
+// decideRetry decides how the failed message is retried according to the handler error,
+// messages without a policy are retried after the retry interval.
+// Without daemon the message is always retried after a delay, as no retry set is scheduled.
+func (q *Queue) decideRetry(m *Message, err error) retryDecision {
+	p, ok := q.retryMatrix[q.classifier(err)]
+	if ok && (p.DeadLetter || p.MaxRetries > 0 && m.DeliverCnt > p.MaxRetries) {
+		return retryDecision{dead: true}
+	}
+
+	d, explicit := retryAfterOf(err)
+	switch {
+	case explicit:
+	case ok && p.Interval > 0:
+		d = p.delay(m.DeliverCnt)
+	case !ok:
+		d = q.redriveOf(m).backoff(m.DeliverCnt)
+	}
+	r := q.redriveOf(m)
+	if d <= 0 && q.noDaemon {
+		d = r.Interval
+	}
+	return retryDecision{after: d, exhausted: m.DeliverCnt > r.MaxRetries}
+}
+
+// last reports whether the message is not delivered again.
+func (d retryDecision) last() bool {
+	return d.dead || d.exhausted
+}
+
+// retry schedules the failed message as decided by decideRetry.
+// Without daemon the message is left to be requeued by the caller.
+func (q *Queue) retry(ctx context.Context, m *Message, err error) (retryDecision, error) {
+	d := q.decideRetry(m, err)
+	if d.dead {
+		return d, q.deadLetter(ctx, m, err.Error())
+	}
+	q.audit(ctx, EventRetried, m.ID)
+
+	if d.after <= 0 || q.noDaemon {
+		return d, nil
+	}
+	return d, q.RedeliveryAfter(ctx, m.ID, d.after)
+}
+
+// retryKey is the zset of taken messages to be redelivered,
+// empty without daemon, so taken messages are not tracked there
+// but marked untracked in their data to be reclaimed.
+func (q *Queue) retryKey() string {
+	if q.noDaemon {
+		return ""
+	}
+	return q.key(kRetry)
+}
+
+// ProcessError is the handler error with the context of the message,
+// it is passed to Metric.Consume and classifiers.
+type ProcessError struct {
+	MsgID string
+	Kind  string
+	// Attempt is the deliver count of the message, starts from 1.
+	Attempt int
+	Took    time.Duration
+	Err     error
+}
+
+func newProcessError(m *Message, took time.Duration, err error) *ProcessError {
+	return &ProcessError{MsgID: m.ID, Kind: m.Kind, Attempt: m.DeliverCnt, Took: took, Err: err}
+}
+
+func (e *ProcessError) Error() string {
+	return fmt.Sprintf("message %s, attempt: %d, took: %s, err: %v", e.MsgID, e.Attempt, e.Took, e.Err)
+}
+
+func (e *ProcessError) Unwrap() error { return e.Err }
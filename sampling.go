@@ -0,0 +1,47 @@
+package dq
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ProduceSample describes a sampled produced message for traffic analysis.
+type ProduceSample struct {
+	ID   string
+	Kind string
+	// Delay is from producing to the deliver at, 0 for realtime messages.
+	Delay time.Duration
+	// Size is of the encoded payload.
+	Size         int
+	Deduplicated bool
+}
+
+// produceSampling samples a percentage of the produced messages up to a rate.
+type produceSampling struct {
+	percent float64
+	lim     *rate.Limiter
+	sink    func(context.Context, ProduceSample)
+}
+
+// sampleProduce passes the produced message to the sink if it is sampled.
+func (q *Queue) sampleProduce(ctx context.Context, r *Receipt, m *ProducerMessage, size int) {
+	s := q.produceSampling
+	if s == nil || rand.Float64()*100 >= s.percent || !s.lim.Allow() {
+		return
+	}
+
+	ps := ProduceSample{ID: r.ID, Kind: m.Kind, Size: size, Deduplicated: r.Deduplicated}
+	if m.DeliverAt != nil {
+		if d := time.Until(*m.DeliverAt); d > 0 {
+			ps.Delay = d
+		}
+	}
+	if s.sink != nil {
+		s.sink(ctx, ps)
+		return
+	}
+	q.log(ctx, Info, "sampled produced message %s, kind: %s, delay: %s, size: %d, deduplicated: %t", ps.ID, ps.Kind, ps.Delay, ps.Size, ps.Deduplicated)
+}
@@ -4,73 +4,374 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 // scriptProduceRealtimeMsg is used to produce realtime message
-// 1. LPUSH list
-// 2. HSET msg
-// 3. EXPIRE msg
-var scriptProduceRealtimeMsg = redis.NewScript(`
-redis.call('LPUSH', KEYS[1], ARGV[1])
-redis.call('HSET', KEYS[2], unpack(ARGV, 3, #ARGV))
-redis.call('EXPIRE', KEYS[2], ARGV[2])`)
+// 1. EXISTS token, deduplicate if exists
+// 2. EXISTS msg, deduplicate if exists
+// 3. LPUSH list
+// 4. HSET msg
+// 5. EXPIRE msg
+// 6. SET token if ARGV[3] > 0
+// 7. INCR and SADD quota
+// the message is rejected if the list has ARGV[4] > 0 messages or the quota is exceeded
+var scriptProduceRealtimeMsg = redis.NewScript(luaQuota + `
+if tonumber(ARGV[3]) > 0 and redis.call('EXISTS', KEYS[3]) == 1 then
+	return {1, -1, 0};
+end
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return {1, -1, tonumber(redis.call('HGET', KEYS[2], 're_deliver_at') or redis.call('HGET', KEYS[2], 'deliver_at') or redis.call('HGET', KEYS[2], 'create_at'))};
+end
+if tonumber(ARGV[4]) > 0 and redis.call('LLEN', KEYS[1]) >= tonumber(ARGV[4]) then
+	return {2, -1, 0};
+end
+if quota_exceeded(KEYS[4], KEYS[5], tonumber(ARGV[5]), tonumber(ARGV[6])) then
+	return {3, -1, 0};
+end
+local n = redis.call('LPUSH', KEYS[1], ARGV[1]);
+redis.call('HSET', KEYS[2], unpack(ARGV, 8, #ARGV));
+redis.call('EXPIRE', KEYS[2], ARGV[2]);
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[3], ARGV[1], 'EX', ARGV[3]);
+end
+quota_used(KEYS[4], KEYS[5], KEYS[2], tonumber(ARGV[5]), tonumber(ARGV[6]), ARGV[7], ARGV[2]);
+return {0, n-1, 0};`)
 
-func (r *rdb) runProduceRealtimeMsg(ctx context.Context, list, data string, m *Message, expSec int) error {
-	err := scriptProduceRealtimeMsg.Run(ctx, r,
-		[]string{list, data + ":" + m.ID}, append([]interface{}{m.ID, expSec}, m.values()...)).Err()
-	if err != redis.Nil && err != nil {
-		return fmt.Errorf("script produce realtime msg failed, err: %s", err)
+func (r *rdb) runProduceRealtimeMsg(ctx context.Context, list, data, token string, qa quota, m *Message, expSec, tokenSec int, maxLen int64) (*Receipt, error) {
+	res, err := scriptProduceRealtimeMsg.Run(ctx, r,
+		[]string{list, data + ":" + m.ID, token, qa.day, qa.pending},
+		append([]interface{}{m.ID, expSec, tokenSec, maxLen, qa.PerDay, qa.Pending, quotaDaySec}, m.values()...)).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("script produce realtime msg failed, err: %s", err)
+	}
+	switch res[0] {
+	case 2:
+		return nil, ErrQueueFull
+	case 3:
+		return nil, ErrQuotaExceeded
 	}
-	return nil
+	return newReceipt(m.ID, m.CreateAt, res), nil
 }
 
 // scriptProduceDelayMsg is used to produce delay message
-// 1. ZADD delay
-// 2. HSET msg
-// 3. EXPIRE msg
-var scriptProduceDelayMsg = redis.NewScript(`
-redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
-redis.call('HSET', KEYS[2], unpack(ARGV, 4, #ARGV))
-redis.call('EXPIRE', KEYS[2], ARGV[3])`)
+// 1. EXISTS token, deduplicate if exists
+// 2. EXISTS msg, deduplicate if exists
+// 3. ZADD delay
+// 4. HSET msg
+// 5. EXPIRE msg
+// 6. SET token if ARGV[4] > 0
+// 7. INCR and SADD quota
+// the message is rejected if the quota is exceeded
+var scriptProduceDelayMsg = redis.NewScript(luaQuota + `
+if tonumber(ARGV[4]) > 0 and redis.call('EXISTS', KEYS[4]) == 1 then
+	return {1, -1, 0};
+end
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	return {1, -1, tonumber(redis.call('HGET', KEYS[3], 're_deliver_at') or redis.call('HGET', KEYS[3], 'deliver_at') or redis.call('HGET', KEYS[3], 'create_at'))};
+end
+if quota_exceeded(KEYS[5], KEYS[6], tonumber(ARGV[5]), tonumber(ARGV[6])) then
+	return {3, -1, 0};
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1]);
+redis.call('HSET', KEYS[3], unpack(ARGV, 8, #ARGV));
+redis.call('EXPIRE', KEYS[3], ARGV[3]);
+if tonumber(ARGV[4]) > 0 then
+	redis.call('SET', KEYS[4], ARGV[1], 'EX', ARGV[4]);
+end
+quota_used(KEYS[5], KEYS[6], KEYS[3], tonumber(ARGV[5]), tonumber(ARGV[6]), ARGV[7], ARGV[3]);
+return {0, redis.call('ZRANK', KEYS[1], ARGV[1]) + redis.call('LLEN', KEYS[2]), 0};`)
 
-func (r *rdb) runProduceDelayMsg(ctx context.Context, zset, data string, m *Message, expSec int) error {
-	err := scriptProduceDelayMsg.Run(ctx, r,
-		[]string{zset, data + ":" + m.ID}, append([]interface{}{m.ID, m.DeliverAt.UnixMilli(), expSec}, m.values()...)).Err()
-	if err != redis.Nil && err != nil {
-		return fmt.Errorf("script produce delay msg failed, err: %s", err)
+func (r *rdb) runProduceDelayMsg(ctx context.Context, zset, list, data, token string, qa quota, m *Message, expSec, tokenSec int) (*Receipt, error) {
+	res, err := scriptProduceDelayMsg.Run(ctx, r,
+		[]string{zset, list, data + ":" + m.ID, token, qa.day, qa.pending},
+		append([]interface{}{m.ID, m.DeliverAt.UnixMilli(), expSec, tokenSec, qa.PerDay, qa.Pending, quotaDaySec}, m.values()...)).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("script produce delay msg failed, err: %s", err)
+	}
+	if res[0] == 3 {
+		return nil, ErrQuotaExceeded
 	}
-	return nil
+	return newReceipt(m.ID, *m.DeliverAt, res), nil
 }
 
+// newReceipt builds receipt from the produce script result {deduplicated, position, deliver_at},
+// deliver_at is 0 if the message was produced with the same token and may be consumed.
+func newReceipt(id string, at time.Time, res []int64) *Receipt {
+	r := &Receipt{ID: id, DeliverAt: at, QueuePositionEstimate: int(res[1])}
+	if res[0] == 1 {
+		r.Deduplicated = true
+		r.DeliverAt = time.Time{}
+		if res[2] > 0 {
+			r.DeliverAt = time.UnixMilli(res[2])
+		}
+	}
+	return r
+}
+
+// scriptZsetToList moves due members from zset to list,
+// an event is appended to the audit stream for each member if ARGV[2] > 0.
 var scriptZsetToList = redis.NewScript(`
-local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 1000);
-if #members > 0 then
-	  for key, value in ipairs(members)
-  do
-	redis.call('ZREM', KEYS[1], value);
-	redis.call('LPUSH', KEYS[2], value);
-  end
-  return #members;
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'WITHSCORES', 'LIMIT', 0, 1000);
+for i = 1, #members, 2 do
+	redis.call('ZREM', KEYS[1], members[i]);
+	redis.call('LPUSH', KEYS[2], members[i]);
+	if tonumber(ARGV[2]) > 0 then
+		redis.call('XADD', KEYS[3], 'MAXLEN', '~', ARGV[2], '*', 'type', ARGV[3], 'id', members[i], 'at', ARGV[1]);
+	end
+end
+return members;`)
+
+// runZsetToList returns the moved members and the due time of the earliest one.
+func (r *rdb) runZsetToList(ctx context.Context, zset, list, audit string, auditMaxLen int64, event EventType, until time.Time) (members []string, earliest time.Time, err error) {
+	res, err := scriptZsetToList.Run(ctx, r, []string{zset, list, audit}, until.UnixMilli(), auditMaxLen, string(event)).StringSlice()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	for i := 0; i+1 < len(res); i += 2 {
+		members = append(members, res[i])
+	}
+	if len(res) > 1 {
+		ms, _ := strconv.ParseFloat(res[1], 64)
+		earliest = time.UnixMilli(int64(ms))
+	}
+	return members, earliest, nil
+}
+
+// scriptZsetToZset moves members due before ARGV[1] from zset to zset keeping their scores.
+var scriptZsetToZset = redis.NewScript(`
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'WITHSCORES', 'LIMIT', 0, 1000);
+for i = 1, #members, 2 do
+	redis.call('ZREM', KEYS[1], members[i]);
+	redis.call('ZADD', KEYS[2], members[i+1], members[i]);
+end
+return #members / 2;`)
+
+func (r *rdb) runZsetToZset(ctx context.Context, from, to string, until time.Time) (cnt int, err error) {
+	return scriptZsetToZset.Run(ctx, r, []string{from, to}, until.UnixMilli()).Int()
+}
+
+// scriptRecode replaces the payload, codec and checksum of the message,
+// unless it is deleted or its payload is changed since it is read.
+var scriptRecode = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'payload') ~= ARGV[1] then
+	return 0;
+end
+redis.call('HSET', KEYS[1], 'payload', ARGV[2], 'codec', ARGV[3]);
+if ARGV[4] ~= '' then
+	redis.call('HSET', KEYS[1], 'checksum', ARGV[4]);
+end
+return 1;`)
+
+func (r *rdb) runRecode(ctx context.Context, data, old, payload, codec, checksum string) (bool, error) {
+	n, err := scriptRecode.Run(ctx, r, []string{data}, old, payload, codec, checksum).Int()
+	if err != nil {
+		return false, fmt.Errorf("script recode failed, err: %v", err)
+	}
+	return n == 1, nil
+}
+
+// scriptRecodeItem replaces the item ARGV[1] of the batch list,
+// unless the batch is closed or the item is changed since it is read.
+var scriptRecodeItem = redis.NewScript(`
+if redis.call('LINDEX', KEYS[1], ARGV[1]) ~= ARGV[2] then
+	return 0;
+end
+redis.call('LSET', KEYS[1], ARGV[1], ARGV[3]);
+return 1;`)
+
+func (r *rdb) runRecodeItem(ctx context.Context, batch string, index int, old, item string) (bool, error) {
+	n, err := scriptRecodeItem.Run(ctx, r, []string{batch}, index, old, item).Int()
+	if err != nil {
+		return false, fmt.Errorf("script recode item failed, err: %v", err)
+	}
+	return n == 1, nil
+}
+
+// scriptTrimList pops the oldest members over ARGV[1] from list and deletes their data.
+var scriptTrimList = redis.NewScript(`
+local ids = {};
+while redis.call('LLEN', KEYS[1]) > tonumber(ARGV[1]) do
+	local id = redis.call('RPOP', KEYS[1]);
+	redis.call('DEL', KEYS[2] .. ':' .. id);
+	table.insert(ids, id);
+end
+return ids;`)
+
+func (r *rdb) runTrimList(ctx context.Context, list, data string, maxLen int64) ([]string, error) {
+	ids, err := scriptTrimList.Run(ctx, r, []string{list, data}, maxLen).StringSlice()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("script trim list failed, err: %v", err)
+	}
+	return ids, nil
+}
+
+// scriptTrimDead removes up to ARGV[2] dead letters dead before ARGV[1],
+// and deletes their data and results.
+var scriptTrimDead = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1], 'LIMIT', 0, ARGV[2]);
+local deleted = 0;
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id);
+	deleted = deleted + redis.call('DEL', KEYS[2] .. ':' .. id, KEYS[3] .. ':' .. id);
+end
+return {#ids, deleted};`)
+
+func (r *rdb) runTrimDead(ctx context.Context, dead, data, result string, before time.Time, limit int) (removed, deleted int, err error) {
+	res, err := scriptTrimDead.Run(ctx, r, []string{dead, data, result}, before.UnixMilli(), limit).Int64Slice()
+	if err != nil {
+		return 0, 0, fmt.Errorf("script trim dead failed, err: %v", err)
+	}
+	return int(res[0]), int(res[1]), nil
+}
+
+// scriptCapDead removes up to ARGV[2] of the oldest dead letters beyond the
+// first ARGV[1], and deletes their data and results.
+var scriptCapDead = redis.NewScript(`
+local over = redis.call('ZCARD', KEYS[1]) - tonumber(ARGV[1]);
+if over <= 0 then
+	return {0, 0};
+end
+if over > tonumber(ARGV[2]) then
+	over = tonumber(ARGV[2]);
+end
+local ids = redis.call('ZRANGE', KEYS[1], 0, over - 1);
+local deleted = 0;
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id);
+	deleted = deleted + redis.call('DEL', KEYS[2] .. ':' .. id, KEYS[3] .. ':' .. id);
+end
+return {#ids, deleted};`)
+
+func (r *rdb) runCapDead(ctx context.Context, dead, data, result string, maxLen int64, limit int) (removed, deleted int, err error) {
+	res, err := scriptCapDead.Run(ctx, r, []string{dead, data, result}, maxLen, limit).Int64Slice()
+	if err != nil {
+		return 0, 0, fmt.Errorf("script cap dead failed, err: %v", err)
+	}
+	return int(res[0]), int(res[1]), nil
+}
+
+// scriptMigrateMsg adds the message to the list, or the zset if ARGV[2] is set,
+// unless the message data exists, e.g. written by dual write.
+var scriptMigrateMsg = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return 0;
+end
+if ARGV[2] == '' then
+	redis.call('RPUSH', KEYS[1], ARGV[1]);
 else
-  return 0;
-end`)
+	redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1]);
+end
+redis.call('HSET', KEYS[2], unpack(ARGV, 4, #ARGV));
+if tonumber(ARGV[3]) > 0 then
+	redis.call('PEXPIRE', KEYS[2], ARGV[3]);
+end
+return 1;`)
+
+func (r *rdb) runMigrateMsg(ctx context.Context, key, data, id, score string, ttl time.Duration, values []interface{}) (bool, error) {
+	n, err := scriptMigrateMsg.Run(ctx, r, []string{key, data + ":" + id}, append([]interface{}{id, score, ttl.Milliseconds()}, values...)).Int()
+	if err != nil {
+		return false, fmt.Errorf("script migrate msg failed, err: %v", err)
+	}
+	return n == 1, nil
+}
+
+// scriptMigrateHash writes the hash with the ttl ARGV[1] if set,
+// unless it exists, e.g. written by dual write.
+var scriptMigrateHash = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0;
+end
+redis.call('HSET', KEYS[1], unpack(ARGV, 2, #ARGV));
+if tonumber(ARGV[1]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1]);
+end
+return 1;`)
+
+func (r *rdb) runMigrateHash(ctx context.Context, key string, ttl time.Duration, values []interface{}) (bool, error) {
+	n, err := scriptMigrateHash.Run(ctx, r, []string{key}, append([]interface{}{ttl.Milliseconds()}, values...)).Int()
+	if err != nil {
+		return false, fmt.Errorf("script migrate hash failed, err: %v", err)
+	}
+	return n == 1, nil
+}
+
+// scriptProduceGrouped appends ARGV[5] to the batch of the group, the batch is
+// created with its delay message if the group has no open batch.
+var scriptProduceGrouped = redis.NewScript(`
+local id = redis.call('GET', KEYS[3]);
+local created = 0;
+if not id then
+	id = ARGV[1];
+	created = 1;
+	redis.call('SET', KEYS[3], id, 'PX', ARGV[3]);
+	redis.call('ZADD', KEYS[1], ARGV[2], id);
+	redis.call('HSET', KEYS[2] .. ':' .. id, unpack(ARGV, 6, #ARGV));
+	redis.call('EXPIRE', KEYS[2] .. ':' .. id, ARGV[4]);
+end
+local n = redis.call('RPUSH', KEYS[4] .. ':' .. id, ARGV[5]);
+redis.call('EXPIRE', KEYS[4] .. ':' .. id, ARGV[4]);
+return {id, tostring(n), tostring(created)};`)
+
+func (r *rdb) runProduceGrouped(ctx context.Context, delay, data, group, batch string, m *Message, window time.Duration, expSec int, item []byte) (id string, n int, created bool, err error) {
+	res, err := scriptProduceGrouped.Run(ctx, r, []string{delay, data, group, batch},
+		append([]interface{}{m.ID, m.DeliverAt.UnixMilli(), window.Milliseconds(), expSec, item}, m.values()...)).StringSlice()
+	if err != nil {
+		return "", 0, false, fmt.Errorf("script produce grouped failed, err: %v", err)
+	}
+	n, _ = strconv.Atoi(res[1])
+	return res[0], n, res[2] == "1", nil
+}
+
+// scriptCloseBatch closes the batch if it is still open for the group and returns its items.
+var scriptCloseBatch = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('DEL', KEYS[1]);
+end
+return redis.call('LRANGE', KEYS[2], 0, -1);`)
 
-func (r *rdb) runZsetToList(ctx context.Context, zset, list string, until time.Time) (cnt int, err error) {
-	return scriptZsetToList.Run(ctx, r, []string{zset, list}, until.UnixMilli()).Int()
+func (r *rdb) runCloseBatch(ctx context.Context, group, batch, id string) ([]string, error) {
+	items, err := scriptCloseBatch.Run(ctx, r, []string{group, batch}, id).StringSlice()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("script close batch failed, err: %v", err)
+	}
+	return items, nil
+}
+
+// scriptMoveToList moves a single member from zset to list,
+// the member is only pushed if it is still in the zset.
+var scriptMoveToList = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 1 then
+	redis.call('LPUSH', KEYS[2], ARGV[1]);
+	if tonumber(ARGV[3]) > 0 then
+		redis.call('XADD', KEYS[3], 'MAXLEN', '~', ARGV[3], '*', 'type', ARGV[4], 'id', ARGV[1], 'at', ARGV[2]);
+	end
+	return 1;
+end
+return 0;`)
+
+func (r *rdb) runMoveToList(ctx context.Context, zset, list, audit string, auditMaxLen int64, event EventType, member string) (cnt int, err error) {
+	return scriptMoveToList.Run(ctx, r, []string{zset, list, audit}, member, time.Now().UnixMilli(), auditMaxLen, string(event)).Int()
 }
 
 // scriptTakeMessage is used to take message
-// 1. RPOP list
+// 1. RPOP list, LPOP if LIFO
 // 2. EXIST msg
-// 3. INCRBY msg
-// 4. ZADD retry
-// 5. HGETALL msg
+// 3. push back to the tail if the message is requeued without daemon to be retried after ARGV[3]
+// 4. ZADD delay at ARGV[1] if the kind is disabled
+// 5. ZADD delay at ARGV[7] if the worker holds no slot of the pool of the kind, ARGV[8] of
+// PoolCPU and ARGV[9] of PoolIO, with the PoolCPU kinds from ARGV[10]
+// 6. ZADD delay at ARGV[7] if the affinity is held by another instance, otherwise hold it
+// 7. INCRBY msg, ZADD dead if deliver cnt exceed the redrive retries of the message or ARGV[2]
+// 8. ZADD retry after the redrive interval of the message or at ARGV[1], unless the retry key is empty
+// 9. SADD inflight
+// 10. HGETALL msg
 var scriptTakeMsg = redis.NewScript(
 	fmt.Sprintf(`
-local id = redis.call('RPOP', KEYS[1]);
+local id = redis.call(ARGV[4], KEYS[1]);
 if id == false then
 	return {'%s'};
 end
@@ -80,36 +381,122 @@ if exist == 0 then
 	return {'%s'};
 end
 
-local cnt = redis.call('HINCRBY', KEYS[3] .. ':' .. id, 'deliver_cnt', 1);
-if cnt-1 > tonumber(ARGV[2]) then
-	redis.call('DEL', KEYS[3] .. ':' .. id);
+local retryAt = redis.call('HGET', KEYS[3] .. ':' .. id, 'retry_at');
+if retryAt and tonumber(retryAt) > tonumber(ARGV[3]) then
+	if ARGV[4] == 'RPOP' then
+		redis.call('LPUSH', KEYS[1], id);
+	else
+		redis.call('RPUSH', KEYS[1], id);
+	end
 	return {'%s'};
 end
 
-redis.call('ZADD', KEYS[2], ARGV[1], id);
+if redis.call('SCARD', KEYS[7]) > 0 then
+	local kind = redis.call('HGET', KEYS[3] .. ':' .. id, 'kind');
+	if kind and redis.call('SISMEMBER', KEYS[7], kind) == 1 then
+		redis.call('ZADD', KEYS[8], ARGV[1], id);
+		return {'%s'};
+	end
+end
+
+if ARGV[8] then
+	local kind = redis.call('HGET', KEYS[3] .. ':' .. id, 'kind');
+	local held = ARGV[9];
+	for i = 10, #ARGV do
+		if ARGV[i] == kind then
+			held = ARGV[8];
+			break;
+		end
+	end
+	if held ~= '1' then
+		redis.call('ZADD', KEYS[8], ARGV[7], id);
+		return {'%s'};
+	end
+end
+
+local affinity = redis.call('HGET', KEYS[3] .. ':' .. id, 'affinity');
+if affinity then
+	local holder = redis.call('GET', KEYS[6] .. ':' .. affinity);
+	if holder and holder ~= ARGV[5] then
+		redis.call('ZADD', KEYS[8], ARGV[7], id);
+		return {'%s'};
+	end
+	redis.call('SET', KEYS[6] .. ':' .. affinity, ARGV[5], 'PX', ARGV[6]);
+end
+
+local cnt = redis.call('HINCRBY', KEYS[3] .. ':' .. id, 'deliver_cnt', 1);
+local retries = tonumber(redis.call('HGET', KEYS[3] .. ':' .. id, 'redrive_retries') or ARGV[2]);
+if cnt-1 > retries then
+	redis.call('ZADD', KEYS[4], ARGV[3], id);
+	redis.call('HSET', KEYS[3] .. ':' .. id, 'dead_at', ARGV[3], 'dead_reason', '%s');
+	return {'%s', id};
+end
+
+if KEYS[2] ~= '' then
+	local interval = redis.call('HGET', KEYS[3] .. ':' .. id, 'redrive_interval');
+	if interval then
+		redis.call('ZADD', KEYS[2], tonumber(ARGV[3]) + tonumber(interval), id);
+	else
+		redis.call('ZADD', KEYS[2], ARGV[1], id);
+	end
+	redis.call('HDEL', KEYS[3] .. ':' .. id, 'untracked');
+else
+	redis.call('HSET', KEYS[3] .. ':' .. id, 'untracked', 1);
+end
+redis.call('SADD', KEYS[5], id);
 return redis.call('HGETALL', KEYS[3] .. ':' .. id);`,
 		listEmpty.Error(),
 		dataMiss.Error(),
+		retryNotDue.Error(),
+		kindDisabled.Error(),
+		poolBusy.Error(),
+		affinityHeld.Error(),
+		deliverCntExceed.Error(),
 		deliverCntExceed.Error()))
 
 var (
 	listEmpty        = errors.New("list empty")
 	dataMiss         = errors.New("data miss")
 	deliverCntExceed = errors.New("deliver cnt exceed")
+	affinityHeld     = errors.New("affinity held")
+	kindDisabled     = errors.New("kind disabled")
+	poolBusy         = errors.New("pool busy")
+	retryNotDue      = errors.New("retry not due")
 )
 
-func (r *rdb) runTakeMsg(ctx context.Context, list, retry, data string, retryInterval time.Duration, retryTimes int) ([]string, error) {
-	retryAt := time.Now().Add(retryInterval)
-	s, err := scriptTakeMsg.Run(ctx, r, []string{list, retry, data}, retryAt.UnixMilli(), retryTimes).StringSlice()
+// affinityRedelay is how long a message is delayed if its affinity is held
+// by another instance or its pool is busy, so the other messages are taken meanwhile.
+const affinityRedelay = 100 * time.Millisecond
+
+func (r *rdb) runTakeMsg(ctx context.Context, list, retry, data, dead, inflight, affinity, disabled, delay, instanceID string, retryInterval, affinityTTL time.Duration, retryTimes int, order DequeueOrder, poolArgs []interface{}) ([]string, error) {
+	now := time.Now()
+	retryAt := now.Add(retryInterval)
+	// messages are pushed to the left
+	pop := "RPOP"
+	if order == LIFO {
+		pop = "LPOP"
+	}
+	s, err := scriptTakeMsg.Run(ctx, r, []string{list, retry, data, dead, inflight, affinity, disabled, delay}, append([]interface{}{retryAt.UnixMilli(), retryTimes, now.UnixMilli(), pop, instanceID, affinityTTL.Milliseconds(), now.Add(affinityRedelay).UnixMilli()}, poolArgs...)...).StringSlice()
 	if err != nil && err != redis.Nil {
 		return nil, fmt.Errorf("script run failed, err: %v", err)
 	}
+	if len(s) == 2 && s[0] == deliverCntExceed.Error() {
+		return s[1:], deliverCntExceed
+	}
 	if len(s) == 1 {
 		switch s[0] {
 		case listEmpty.Error():
 			return nil, listEmpty
 		case dataMiss.Error():
 			return nil, dataMiss
+		case affinityHeld.Error():
+			return nil, affinityHeld
+		case kindDisabled.Error():
+			return nil, kindDisabled
+		case poolBusy.Error():
+			return nil, poolBusy
+		case retryNotDue.Error():
+			return nil, retryNotDue
 		case deliverCntExceed.Error():
 			return nil, deliverCntExceed
 		default:
@@ -120,15 +507,334 @@ func (r *rdb) runTakeMsg(ctx context.Context, list, retry, data string, retryInt
 }
 
 // ready list will be removed by the consumer,
-// so we only need to remove the message from the retry set and the data
+// so we only need to remove the message from the retry set, the data and
+// the batch of a grouped message, the result is saved with the acknowledgement if ARGV[2] > 0.
 var scriptCommit = redis.NewScript(`
 local id = ARGV[1];
 redis.call('ZREM', KEYS[1], id);
 redis.call('DEL', KEYS[2] .. ':' .. id);
+redis.call('SREM', KEYS[3], id);
+redis.call('DEL', KEYS[5] .. ':' .. id);
+if tonumber(ARGV[2]) > 0 then
+	redis.call('HSET', KEYS[4] .. ':' .. id, unpack(ARGV, 3, #ARGV));
+	redis.call('EXPIRE', KEYS[4] .. ':' .. id, ARGV[2]);
+end
+return 1;`)
+
+func (r *rdb) runCommit(ctx context.Context, retry, data, inflight, result, batch, id string, res *Result, expSec int) (int64, error) {
+	return scriptCommit.Run(ctx, r, []string{retry, data, inflight, result, batch}, commitArgs(id, res, expSec)...).Int64()
+}
+
+// runCommitPipe queues the commit in pipe, the script must be loaded.
+func (r *rdb) runCommitPipe(ctx context.Context, pipe redis.Pipeliner, retry, data, inflight, result, batch, id string, res *Result, expSec int) *redis.Cmd {
+	return scriptCommit.EvalSha(ctx, pipe, []string{retry, data, inflight, result, batch}, commitArgs(id, res, expSec)...)
+}
+
+func commitArgs(id string, res *Result, expSec int) []interface{} {
+	if res != nil && expSec > 0 {
+		return append([]interface{}{id, expSec}, res.values()...)
+	}
+	return []interface{}{id, 0}
+}
+
+// workerScripts are run by every consumer worker, loaded before consuming.
+var workerScripts = []*redis.Script{scriptTakeMsg, scriptCommit, scriptFail, scriptRequeue}
+
+// scriptFail counts the handler error of the taken message and removes it from in-flight,
+// the message is left in the retry set to be retried.
+var scriptFail = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1] .. ':' .. ARGV[1]) == 1 then
+	redis.call('HINCRBY', KEYS[1] .. ':' .. ARGV[1], 'err_retry_cnt', 1);
+end
+redis.call('SREM', KEYS[2], ARGV[1]);
+return 1;`)
+
+func (r *rdb) runFail(ctx context.Context, data, inflight, id string) error {
+	return scriptFail.Run(ctx, r, []string{data, inflight}, id).Err()
+}
+
+// scriptRequeue counts the handler error of the taken message taken without daemon,
+// and pushes it back to the tail of ready, to be retried once taken after ARGV[2].
+var scriptRequeue = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1] .. ':' .. ARGV[1]) == 1 then
+	redis.call('HINCRBY', KEYS[1] .. ':' .. ARGV[1], 'err_retry_cnt', 1);
+	redis.call('HSET', KEYS[1] .. ':' .. ARGV[1], 'retry_at', ARGV[2]);
+	redis.call(ARGV[3], KEYS[3], ARGV[1]);
+end
+redis.call('SREM', KEYS[2], ARGV[1]);
+return 1;`)
+
+func (r *rdb) runRequeue(ctx context.Context, data, inflight, list, id string, retryAt time.Time, order DequeueOrder) error {
+	// the tail is opposite to where take pops
+	push := "LPUSH"
+	if order == LIFO {
+		push = "RPUSH"
+	}
+	return scriptRequeue.Run(ctx, r, []string{data, inflight, list}, id, retryAt.UnixMilli(), push).Err()
+}
+
+// scriptSetIfExists sets the fields of the message data, unless the message
+// is gone, e.g. committed or expired, so its data is not recreated without ttl.
+// It returns 0 if the message is gone.
+var scriptSetIfExists = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0;
+end
+redis.call('HSET', KEYS[1], unpack(ARGV));
+return 1;`)
+
+// runMarkProcessed sets the processed mark on the message data, unless the
+// message is gone, e.g. committed by a retry reported as failed.
+func (r *rdb) runMarkProcessed(ctx context.Context, data, id string, values []interface{}) error {
+	return scriptSetIfExists.Run(ctx, r, []string{data + ":" + id}, values...).Err()
+}
+
+// runSaveFields sets the fields of the message data saved by handlers,
+// false if the message is gone.
+func (r *rdb) runSaveFields(ctx context.Context, data, id string, values ...interface{}) (bool, error) {
+	n, err := scriptSetIfExists.Run(ctx, r, []string{data + ":" + id}, values...).Int()
+	return n == 1, err
+}
+
+// scriptRollback pushes the taken message back to the tail of ready and
+// removes it from in-flight, the deliver cnt counted by take is reverted,
+// messages already retried are not in the retry set anymore.
+var scriptRollback = redis.NewScript(`
+if KEYS[2] == '' or redis.call('ZREM', KEYS[2], ARGV[1]) == 1 then
+	if redis.call('EXISTS', KEYS[3] .. ':' .. ARGV[1]) == 1 then
+		redis.call('HINCRBY', KEYS[3] .. ':' .. ARGV[1], 'deliver_cnt', -1);
+	end
+	redis.call(ARGV[2], KEYS[1], ARGV[1]);
+end
+redis.call('SREM', KEYS[4], ARGV[1]);
+return 1;`)
+
+func (r *rdb) runRollback(ctx context.Context, list, retry, data, inflight, id string, order DequeueOrder) error {
+	// the tail is opposite to where take pops, so the other messages are taken
+	// before the rolled back one again
+	push := "LPUSH"
+	if order == LIFO {
+		push = "RPUSH"
+	}
+	return scriptRollback.Run(ctx, r, []string{list, retry, data, inflight}, id, push).Err()
+}
+
+// scriptReclaim moves the in-flight messages of an instance no longer handling
+// them back to ready, messages the daemon already moved out of the retry set
+// are skipped, unless they are marked untracked by an instance taking them
+// without daemon, so both kinds are reclaimed in a mixed fleet.
+var scriptReclaim = redis.NewScript(`
+local ids = redis.call('SMEMBERS', KEYS[1]);
+local n = 0;
+for _, id in ipairs(ids) do
+	if redis.call('ZREM', KEYS[2], id) == 1 or redis.call('HEXISTS', KEYS[4] .. ':' .. id, 'untracked') == 1 then
+		redis.call('RPUSH', KEYS[3], id);
+		n = n + 1;
+	end
+end
+redis.call('DEL', KEYS[1]);
+return n;`)
+
+func (r *rdb) runReclaim(ctx context.Context, inflight, retry, list, data string) (int, error) {
+	return scriptReclaim.Run(ctx, r, []string{inflight, retry, list, data}).Int()
+}
+
+// scriptTrash moves the data of the pending message to the trash and removes it
+// from ready, delay, cold and retry, so a restored message is not redelivered by
+// the retry set too, entries of the trash older than the window are pruned.
+var scriptTrash = redis.NewScript(`
+local key = KEYS[1] .. ':' .. ARGV[1];
+if redis.call('EXISTS', key) == 0 then
+	return 0;
+end
+redis.call('LREM', KEYS[2], 0, ARGV[1]);
+redis.call('ZREM', KEYS[3], ARGV[1]);
+redis.call('ZREM', KEYS[4], ARGV[1]);
+redis.call('ZREM', KEYS[6], ARGV[1]);
+local trash = KEYS[5] .. ':' .. ARGV[1];
+redis.call('RENAME', key, trash);
+redis.call('PEXPIRE', trash, ARGV[3]);
+redis.call('ZREMRANGEBYSCORE', KEYS[5], '-inf', tonumber(ARGV[2]) - tonumber(ARGV[3]));
+redis.call('ZADD', KEYS[5], ARGV[2], ARGV[1]);
+return 1;`)
+
+func (r *rdb) runTrash(ctx context.Context, data, ready, delay, cold, trash, retry, id string, now time.Time, window time.Duration) (bool, error) {
+	n, err := scriptTrash.Run(ctx, r, []string{data, ready, delay, cold, trash, retry}, id, now.UnixMilli(), window.Milliseconds()).Int()
+	return n == 1, err
+}
+
+// scriptRestore moves the data of the message back from the trash,
+// the message is due at its deliver at again, or at once if it is past.
+var scriptRestore = redis.NewScript(`
+local trash = KEYS[1] .. ':' .. ARGV[1];
+redis.call('ZREM', KEYS[1], ARGV[1]);
+if redis.call('EXISTS', trash) == 0 then
+	return 0;
+end
+local key = KEYS[2] .. ':' .. ARGV[1];
+if redis.call('EXISTS', key) == 1 then
+	return -1;
+end
+redis.call('RENAME', trash, key);
+redis.call('EXPIRE', key, ARGV[3]);
+local at = tonumber(redis.call('HGET', key, 'deliver_at'));
+if at and at > tonumber(ARGV[2]) then
+	redis.call('ZADD', KEYS[4], at, ARGV[1]);
+else
+	redis.call('LPUSH', KEYS[3], ARGV[1]);
+end
+return 1;`)
+
+func (r *rdb) runRestore(ctx context.Context, trash, data, ready, delay, id string, now time.Time, saveSec int) (int, error) {
+	return scriptRestore.Run(ctx, r, []string{trash, data, ready, delay}, id, now.UnixMilli(), saveSec).Int()
+}
+
+// scriptHold parks the pending message in the held set out of ready, delay
+// and cold, the data is kept until released. It returns -1 if the message is
+// not pending, e.g. being processed or retried.
+var scriptHold = redis.NewScript(`
+local key = KEYS[1] .. ':' .. ARGV[1];
+if redis.call('EXISTS', key) == 0 then
+	return 0;
+end
+local n = redis.call('LREM', KEYS[2], 0, ARGV[1]) + redis.call('ZREM', KEYS[3], ARGV[1]) + redis.call('ZREM', KEYS[4], ARGV[1]);
+if n == 0 then
+	return -1;
+end
+redis.call('PERSIST', key);
+redis.call('ZADD', KEYS[5], ARGV[2], ARGV[1]);
+return 1;`)
+
+func (r *rdb) runHold(ctx context.Context, data, ready, delay, cold, held, id string, now time.Time) (int, error) {
+	return scriptHold.Run(ctx, r, []string{data, ready, delay, cold, held}, id, now.UnixMilli()).Int()
+}
+
+// scriptRelease moves the held message back to the queue,
+// the message is due at its deliver at again, or at once if it is past.
+var scriptRelease = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0;
+end
+local key = KEYS[2] .. ':' .. ARGV[1];
+if redis.call('EXISTS', key) == 0 then
+	return -1;
+end
+redis.call('EXPIRE', key, ARGV[3]);
+local at = tonumber(redis.call('HGET', key, 'deliver_at'));
+if at and at > tonumber(ARGV[2]) then
+	redis.call('ZADD', KEYS[4], at, ARGV[1]);
+else
+	redis.call('LPUSH', KEYS[3], ARGV[1]);
+end
+return 1;`)
+
+func (r *rdb) runRelease(ctx context.Context, held, data, ready, delay, id string, now time.Time, saveSec int) (int, error) {
+	return scriptRelease.Run(ctx, r, []string{held, data, ready, delay}, id, now.UnixMilli(), saveSec).Int()
+}
+
+// scriptFinishChild counts the child message of the job as done or failed once,
+// it returns 1 if all the children of the job are finished by this call.
+var scriptFinishChild = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0;
+end
+if redis.call('HSETNX', KEYS[1], 'child:' .. ARGV[1], ARGV[2]) == 0 then
+	return 0;
+end
+redis.call('HINCRBY', KEYS[1], ARGV[2], 1);
+local v = redis.call('HMGET', KEYS[1], 'total', 'done', 'failed');
+if tonumber(v[2]) + tonumber(v[3]) == tonumber(v[1]) then
+	return 1;
+end
+return 0;`)
+
+func (r *rdb) runFinishChild(ctx context.Context, job, id string, failed bool) (bool, error) {
+	field := "done"
+	if failed {
+		field = "failed"
+	}
+	n, err := scriptFinishChild.Run(ctx, r, []string{job}, id, field).Int()
+	return n == 1, err
+}
+
+// scriptRequeueDead moves a batch of dead letters back to ready with their
+// delivery counts reset, those whose data expired are dropped.
+var scriptRequeueDead = redis.NewScript(`
+local ids = redis.call('ZRANGE', KEYS[1], 0, tonumber(ARGV[1]) - 1);
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id);
+	local key = KEYS[2] .. ':' .. id;
+	if redis.call('EXISTS', key) == 1 then
+		redis.call('HDEL', key, 'dead_at', 'dead_reason');
+		redis.call('HSET', key, 'deliver_cnt', 0, 'err_retry_cnt', 0);
+		redis.call('LPUSH', KEYS[3], id);
+	end
+end
+return #ids;`)
+
+func (r *rdb) runRequeueDead(ctx context.Context, dead, data, ready string, batch int) (int, error) {
+	return scriptRequeueDead.Run(ctx, r, []string{dead, data, ready}, batch).Int()
+}
+
+// scriptPurge pops a batch of messages from the ready list or a zset and moves
+// their data to the trash, or deletes it without trash window. It returns the
+// number of popped messages followed by the IDs of the canceled ones.
+var scriptPurge = redis.NewScript(`
+local n = 0;
+local ids = {};
+for i = 1, tonumber(ARGV[1]) do
+	local id;
+	if ARGV[4] == '1' then
+		id = redis.call('RPOP', KEYS[1]);
+	else
+		id = redis.call('ZPOPMIN', KEYS[1])[1];
+	end
+	if not id then
+		break;
+	end
+	n = n + 1;
+	local key = KEYS[2] .. ':' .. id;
+	if redis.call('EXISTS', key) == 1 then
+		if tonumber(ARGV[3]) > 0 then
+			local trash = KEYS[3] .. ':' .. id;
+			redis.call('RENAME', key, trash);
+			redis.call('PEXPIRE', trash, ARGV[3]);
+			redis.call('ZADD', KEYS[3], ARGV[2], id);
+		else
+			redis.call('DEL', key);
+		end
+		table.insert(ids, id);
+	end
+end
+table.insert(ids, 1, tostring(n));
+return ids;`)
+
+func (r *rdb) runPurge(ctx context.Context, src, data, trash string, list bool, batch int, now time.Time, window time.Duration) (int, []string, error) {
+	isList := 0
+	if list {
+		isList = 1
+	}
+	res, err := scriptPurge.Run(ctx, r, []string{src, data, trash}, batch, now.UnixMilli(), window.Milliseconds(), isList).StringSlice()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, _ := strconv.Atoi(res[0])
+	return n, res[1:], nil
+}
+
+// scriptDeadLetter moves the taken message from retry to dead,
+// the message data is kept until it expires.
+var scriptDeadLetter = redis.NewScript(`
+redis.call('ZREM', KEYS[1], ARGV[1]);
+if redis.call('EXISTS', KEYS[3] .. ':' .. ARGV[1]) == 0 then
+	return 0;
+end
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1]);
+redis.call('HSET', KEYS[3] .. ':' .. ARGV[1], 'dead_at', ARGV[2], 'dead_reason', ARGV[3]);
 return 1;`)
 
-func (r *rdb) runCommit(ctx context.Context, retry, data, id string) (int64, error) {
-	return scriptCommit.Run(ctx, r, []string{retry, data}, id).Int64()
+func (r *rdb) runDeadLetter(ctx context.Context, retry, dead, data, id, reason string) error {
+	return scriptDeadLetter.Run(ctx, r, []string{retry, dead, data}, id, time.Now().UnixMilli(), reason).Err()
 }
 
 var scriptZaddAndHset = redis.NewScript(`
@@ -0,0 +1,178 @@
+package dq
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sentryBuffer is the number of events buffered to be sent to Sentry.
+const sentryBuffer = 100
+
+// SentryReporter is the ErrorReporter sending events to the store API of Sentry,
+// without depending on the Sentry SDK. Events are sent in the background,
+// Report drops the event if the buffer is full, e.g. while Sentry is slow or
+// down, so handlers are never stalled by it, see Dropped.
+type SentryReporter struct {
+	endpoint string
+	auth     string
+	client   *http.Client
+	events   chan []byte
+	dropped  atomic.Int64
+
+	// closed is set by Close under mu, so Report never sends to closed events
+	mu     sync.RWMutex
+	closed bool
+	stop   context.CancelFunc
+	done   chan struct{}
+
+	// Environment and Release are attached to every event if set.
+	Environment string
+	Release     string
+}
+
+// NewSentryReporter returns the reporter of the Sentry DSN, e.g.
+// https://<key>@o0.ingest.sentry.io/<project>.
+func NewSentryReporter(dsn string) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parse dsn failed, err: %v", err)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("dsn has no public key")
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	project := u.Path[i+1:]
+	if project == "" {
+		return nil, fmt.Errorf("dsn has no project")
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	s := &SentryReporter{
+		endpoint: fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, u.Path[:i], project),
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=dq, sentry_key=%s", u.User.Username()),
+		client:   &http.Client{Timeout: 5 * time.Second},
+		events:   make(chan []byte, sentryBuffer),
+		stop:     stop,
+		done:     make(chan struct{}),
+	}
+	go s.send(ctx)
+	return s, nil
+}
+
+// Dropped returns the number of events dropped as the buffer was full or the
+// reporter was closed.
+func (s *SentryReporter) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Close stops reporting and waits until the buffered events are sent,
+// the events not sent yet are dropped once ctx is done.
+func (s *SentryReporter) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.stop()
+		return ctx.Err()
+	}
+}
+
+func (s *SentryReporter) Report(ctx context.Context, err error, m *Message, stack []byte) {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	hostname, _ := os.Hostname()
+
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"level":       "error",
+		"platform":    "go",
+		"server_name": hostname,
+		"message":     err.Error(),
+		"tags": map[string]string{
+			"dq.kind": m.Kind,
+		},
+		"extra": map[string]interface{}{
+			"dq.message_id":    m.ID,
+			"dq.deliver_cnt":   m.DeliverCnt,
+			"dq.err_retry_cnt": m.ErrRetryCnt,
+			"dq.create_at":     m.CreateAt,
+		},
+		"exception": []map[string]string{
+			{"type": fmt.Sprintf("%T", unwrapProcessError(err)), "value": err.Error()},
+		},
+	}
+	if stack != nil {
+		event["level"] = "fatal"
+		event["extra"].(map[string]interface{})["stack"] = string(stack)
+	}
+	if s.Environment != "" {
+		event["environment"] = s.Environment
+	}
+	if s.Release != "" {
+		event["release"] = s.Release
+	}
+
+	bs, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		s.dropped.Add(1)
+		return
+	}
+	select {
+	case s.events <- bs:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// send posts the buffered events one by one, each bounded by the client
+// timeout, until the events are closed by Close.
+func (s *SentryReporter) send(ctx context.Context) {
+	defer close(s.done)
+	for bs := range s.events {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(bs))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sentry-Auth", s.auth)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+// unwrapProcessError returns the handler error of the ProcessError.
+func unwrapProcessError(err error) error {
+	if pe, ok := err.(*ProcessError); ok {
+		return pe.Err
+	}
+	return err
+}
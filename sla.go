@@ -0,0 +1,46 @@
+package dq
+
+import (
+	"context"
+	"time"
+)
+
+// SLAMetric is optionally implemented by Metric, SLA reports a message with
+// a target latency completed latency after it was due.
+type SLAMetric interface {
+	SLA(met bool, target, latency time.Duration)
+}
+
+// slaOf returns the target latency of the message, 0 if it has none.
+func (q *Queue) slaOf(m *Message) time.Duration {
+	if m.SLA > 0 {
+		return m.SLA
+	}
+	return q.sla
+}
+
+// checkSLA reports the latency of the completed message from its due time
+// and calls the SLA miss hook if it is over the target.
+func (q *Queue) checkSLA(ctx context.Context, m *Message) {
+	target := q.slaOf(m)
+	if target <= 0 {
+		return
+	}
+
+	due := m.CreateAt
+	if m.DeliverAt != nil && m.DeliverAt.After(due) {
+		due = *m.DeliverAt
+	}
+	latency := time.Since(due)
+	met := latency <= target
+	if sm, ok := q.opts.metric.(SLAMetric); ok {
+		q.emitMetric(func() { sm.SLA(met, target, latency) })
+	}
+	if met {
+		return
+	}
+	q.log(ctx, Warn, "message %s missed sla %s, latency: %s", m.ID, target, latency)
+	if q.onSLAMiss != nil {
+		q.onSLAMiss(ctx, m, latency)
+	}
+}
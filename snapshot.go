@@ -0,0 +1,104 @@
+package dq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Snapshot is the state of the queue at a moment, e.g. attached to incident reports.
+type Snapshot struct {
+	Queue string
+	At    time.Time
+	Ready StateSnapshot
+	Delay StateSnapshot
+	Retry StateSnapshot
+	Cold  StateSnapshot
+	Dead  StateSnapshot
+	Held  StateSnapshot
+	Trash StateSnapshot
+}
+
+// StateSnapshot is the count and a sample of the messages in a state,
+// sampled messages have no payload.
+type StateSnapshot struct {
+	Count    int64
+	Messages []*Message
+}
+
+// Snapshot captures the counts and up to sample messages of every state in a
+// transaction, messages due or taken first are sampled first, held messages
+// are sampled by the time they are held and trashed ones by the time they are canceled.
+func (q *Queue) Snapshot(ctx context.Context, sample int) (*Snapshot, error) {
+	if sample <= 0 {
+		return nil, fmt.Errorf("invalid sample %d", sample)
+	}
+
+	s := &Snapshot{Queue: q.name}
+	c := q.rdb.reader()
+	tx := c.TxPipeline()
+	states := []struct {
+		state *StateSnapshot
+		count *redis.IntCmd
+		ids   *redis.StringSliceCmd
+		// data is the key the message data is under, trashed data is moved
+		data string
+	}{
+		{&s.Ready, tx.LLen(ctx, q.key(kReady)), tx.LRange(ctx, q.key(kReady), -int64(sample), -1), q.key(kData)},
+		{&s.Delay, tx.ZCard(ctx, q.key(kDelay)), tx.ZRange(ctx, q.key(kDelay), 0, int64(sample)-1), q.key(kData)},
+		{&s.Retry, tx.ZCard(ctx, q.key(kRetry)), tx.ZRange(ctx, q.key(kRetry), 0, int64(sample)-1), q.key(kData)},
+		{&s.Cold, tx.ZCard(ctx, q.key(kCold)), tx.ZRange(ctx, q.key(kCold), 0, int64(sample)-1), q.key(kData)},
+		{&s.Dead, tx.ZCard(ctx, q.key(kDead)), tx.ZRange(ctx, q.key(kDead), 0, int64(sample)-1), q.key(kData)},
+		{&s.Held, tx.ZCard(ctx, q.key(kHeld)), tx.ZRange(ctx, q.key(kHeld), 0, int64(sample)-1), q.key(kData)},
+		{&s.Trash, tx.ZCard(ctx, q.key(kTrash)), tx.ZRange(ctx, q.key(kTrash), 0, int64(sample)-1), q.key(kTrash)},
+	}
+	if _, err := tx.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("snapshot failed, err: %v", err)
+	}
+	s.At = time.Now()
+
+	// the oldest ready message is at the tail
+	ready := states[0].ids.Val()
+	for i, j := 0, len(ready)-1; i < j; i, j = i+1, j-1 {
+		ready[i], ready[j] = ready[j], ready[i]
+	}
+
+	pipe := c.Pipeline()
+	envelopes := make([][]*redis.SliceCmd, len(states))
+	for i, st := range states {
+		st.state.Count = st.count.Val()
+		for _, id := range st.ids.Val() {
+			envelopes[i] = append(envelopes[i], pipe.HMGet(ctx, st.data+":"+id, envelopeFields...))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("snapshot messages failed, err: %v", err)
+	}
+
+	for i, st := range states {
+		for _, cmd := range envelopes[i] {
+			m, err := parseEnvelope(cmd.Val())
+			if err != nil {
+				return nil, err
+			}
+			// messages committed or canceled since the transaction are missing
+			if m != nil {
+				st.state.Messages = append(st.state.Messages, m)
+			}
+		}
+	}
+	return s, nil
+}
+
+// WriteFile writes the snapshot to the file as JSON.
+func (s *Snapshot) WriteFile(name string) error {
+	bs, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal snapshot failed, err: %v", err)
+	}
+	return os.WriteFile(name, bs, 0o644)
+}
@@ -0,0 +1,163 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Stats describes the state of the queue.
+type Stats struct {
+	Ready     int64
+	Delay     int64
+	Retry     int64
+	Cold      int64
+	Dead      int64
+	Instances []Instance
+	// BusyRatio is the busy ratio of all the workers of Instances.
+	BusyRatio float64
+	// Due buckets the delay and cold messages by when they are due.
+	Due DueStats
+	// PayloadSize is sampled from the stored payload of pending messages.
+	PayloadSize SizeStats
+}
+
+// SizeStats describes the distribution of stored payload size in bytes.
+type SizeStats struct {
+	Sampled int
+	P50     int64
+	P90     int64
+	P99     int64
+	Max     int64
+}
+
+// DueStats counts scheduled messages due within each horizon,
+// every bucket excludes the former ones.
+type DueStats struct {
+	Minute int64
+	Hour   int64
+	Day    int64
+	Week   int64
+	Later  int64
+}
+
+// Stats returns the message counts and consumer instances of the queue.
+func (q *Queue) Stats(ctx context.Context) (*Stats, error) {
+	pipe := q.rdb.reader().Pipeline()
+	ready := pipe.LLen(ctx, q.key(kReady))
+	delay := pipe.ZCard(ctx, q.key(kDelay))
+	retry := pipe.ZCard(ctx, q.key(kRetry))
+	cold := pipe.ZCard(ctx, q.key(kCold))
+	dead := pipe.ZCard(ctx, q.key(kDead))
+
+	// bucket i counts scores in [edges[i-1], edges[i])
+	now := time.Now()
+	edges := []string{"-inf"}
+	for _, d := range []time.Duration{time.Minute, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour} {
+		edges = append(edges, strconv.FormatInt(now.Add(d).UnixMilli(), 10))
+	}
+	var due [][2]*redis.IntCmd
+	for i := 1; i <= len(edges); i++ {
+		max := "+inf"
+		if i < len(edges) {
+			max = "(" + edges[i]
+		}
+		due = append(due, [2]*redis.IntCmd{
+			pipe.ZCount(ctx, q.key(kDelay), edges[i-1], max),
+			pipe.ZCount(ctx, q.key(kCold), edges[i-1], max),
+		})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("get stats failed, err: %v", err)
+	}
+
+	instances, err := q.Instances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := q.payloadSize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var busy float64
+	var workers int
+	for _, ins := range instances {
+		busy += ins.BusyRatio * float64(ins.WorkerNum)
+		workers += ins.WorkerNum
+	}
+	if workers > 0 {
+		busy /= float64(workers)
+	}
+
+	cnt := func(i int) int64 { return due[i][0].Val() + due[i][1].Val() }
+	return &Stats{
+		Ready:     ready.Val(),
+		Delay:     delay.Val(),
+		Retry:     retry.Val(),
+		Cold:      cold.Val(),
+		Dead:      dead.Val(),
+		Instances: instances,
+		BusyRatio: busy,
+		Due: DueStats{
+			Minute: cnt(0),
+			Hour:   cnt(1),
+			Day:    cnt(2),
+			Week:   cnt(3),
+			Later:  cnt(4),
+		},
+		PayloadSize: *size,
+	}, nil
+}
+
+// payload size is sampled from the oldest messages of ready and delay
+const payloadSizeSamples = 100
+
+func (q *Queue) payloadSize(ctx context.Context) (*SizeStats, error) {
+	c := q.rdb.reader()
+	ready, err := c.LRange(ctx, q.key(kReady), -payloadSizeSamples, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("sample ready failed, err: %v", err)
+	}
+	delay, err := c.ZRange(ctx, q.key(kDelay), 0, payloadSizeSamples-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("sample delay failed, err: %v", err)
+	}
+
+	pipe := c.Pipeline()
+	cmds := make([]*redis.Cmd, 0, len(ready)+len(delay))
+	for _, id := range append(ready, delay...) {
+		cmds = append(cmds, pipe.Do(ctx, "HSTRLEN", q.key(kData)+":"+id, "payload"))
+	}
+	if len(cmds) > 0 {
+		if _, err = pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("sample payload size failed, err: %v", err)
+		}
+	}
+
+	sizes := make([]int64, 0, len(cmds))
+	for _, cmd := range cmds {
+		// canceled messages have no payload
+		if n, _ := cmd.Int64(); n > 0 {
+			sizes = append(sizes, n)
+		}
+	}
+	if len(sizes) == 0 {
+		return &SizeStats{}, nil
+	}
+
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	p := func(p float64) int64 { return sizes[int(p*float64(len(sizes)-1))] }
+	return &SizeStats{
+		Sampled: len(sizes),
+		P50:     p(0.5),
+		P90:     p(0.9),
+		P99:     p(0.99),
+		Max:     sizes[len(sizes)-1],
+	}, nil
+}
@@ -0,0 +1,51 @@
+package dq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// tailChannel is the pub/sub channel events are published to if enabled by WithLiveTail.
+func (q *Queue) tailChannel() string {
+	return q.component("tail")
+}
+
+// Tail streams the events published by producers and consumers of the queue
+// with WithLiveTail until ctx is done. Events are not persisted, only events
+// published after subscribing are received.
+func (q *Queue) Tail(ctx context.Context) (<-chan Event, error) {
+	sub := q.rdb.Subscribe(ctx, q.tailChannel())
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, fmt.Errorf("subscribe events failed, err: %v", err)
+	}
+
+	events := make(chan Event, 100)
+	go func() {
+		defer close(events)
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				var e Event
+				if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+					q.log(ctx, Warn, "decode event failed, err: %v", err)
+					continue
+				}
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,39 @@
+package dq
+
+import (
+	"context"
+	"fmt"
+)
+
+// Transformer transforms the message before the handler, e.g. decrypts,
+// decompresses or upgrades the payload to the latest schema.
+type Transformer func(ctx context.Context, m *Message) error
+
+// DecodeWith returns the transformer decoding the payload with c,
+// e.g. payloads encrypted or compressed by the producer application.
+func DecodeWith(c Codec) Transformer {
+	return func(ctx context.Context, m *Message) error {
+		bs, err := c.Decode(m.Payload)
+		if err != nil {
+			return Classify(fmt.Errorf("codec %s decode failed, err: %v", c.Name(), err), ErrorClassValidation)
+		}
+		m.Payload = bs
+		return nil
+	}
+}
+
+// transform wraps h to run the transformers of the kind of the message in
+// order, transformer errors are retried like handler errors.
+func (q *Queue) transform(h Handler) Handler {
+	if len(q.transformers) == 0 {
+		return h
+	}
+	return HandlerFunc(func(ctx context.Context, m *Message) error {
+		for _, t := range q.transformers[m.Kind] {
+			if err := t(ctx, m); err != nil {
+				return fmt.Errorf("transform message failed, err: %w", err)
+			}
+		}
+		return h.Process(ctx, m)
+	})
+}
@@ -0,0 +1,99 @@
+package dq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Validator validates the payload of a message of kind,
+// e.g. against the JSON Schema of kind with a schema library.
+type Validator func(kind string, payload []byte) error
+
+// ValidateStage tells when payload is validated.
+type ValidateStage int
+
+const (
+	// ValidateOnProduce rejects invalid payload in Produce.
+	ValidateOnProduce ValidateStage = 1 << iota
+	// ValidateOnConsume moves invalid messages to dead letter without calling the handler.
+	ValidateOnConsume
+)
+
+// ErrInvalidPayload is returned by Produce if the payload fails validation.
+var ErrInvalidPayload = errors.New("invalid payload")
+
+// ValidateKinds returns a Validator dispatching by kind,
+// messages of kinds without a validator are valid.
+func ValidateKinds(vs map[string]Validator) Validator {
+	return func(kind string, payload []byte) error {
+		v, ok := vs[kind]
+		if !ok {
+			return nil
+		}
+		return v(kind, payload)
+	}
+}
+
+// ValidateJSON returns a Validator requiring payload to be a JSON object with
+// the required fields, nested fields are separated by dot, e.g. "user.id".
+func ValidateJSON(required ...string) Validator {
+	return func(kind string, payload []byte) error {
+		var v map[string]interface{}
+		if err := json.Unmarshal(payload, &v); err != nil {
+			return fmt.Errorf("payload is not a JSON object, err: %v", err)
+		}
+
+		var missing []string
+		for _, f := range required {
+			if !hasField(v, strings.Split(f, ".")) {
+				missing = append(missing, f)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("missing fields: %s", strings.Join(missing, ", "))
+		}
+		return nil
+	}
+}
+
+func hasField(v map[string]interface{}, path []string) bool {
+	for i, k := range path {
+		val, ok := v[k]
+		if !ok {
+			return false
+		}
+		if i == len(path)-1 {
+			return true
+		}
+		if v, ok = val.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return false
+}
+
+// validate runs the validator if it is enabled at stage.
+func (q *Queue) validate(stage ValidateStage, kind string, payload []byte) error {
+	if q.validator == nil || q.validateStages&stage == 0 {
+		return nil
+	}
+	if err := q.validator(kind, payload); err != nil {
+		return fmt.Errorf("%w, kind: %s, err: %v", ErrInvalidPayload, kind, err)
+	}
+	return nil
+}
+
+// deadLetter moves the taken message to dead letter with reason.
+func (q *Queue) deadLetter(ctx context.Context, m *Message, reason string) error {
+	q.audit(ctx, EventDead, m.ID)
+	if err := q.rdb.runDeadLetter(ctx, q.key(kRetry), q.key(kDead), q.key(kData), m.ID, reason); err != nil {
+		return err
+	}
+	q.complete(ctx, OutcomeDead, m.ID)
+	q.finishChild(ctx, m, true)
+	q.redriveDead(ctx, m.ID)
+	return nil
+}
@@ -0,0 +1,114 @@
+package dq
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Webhook is the Handler POSTing payloads to URL.
+// Requests carry the headers X-Dq-Message-Id, X-Dq-Kind, X-Dq-Attempt and,
+// if Secret is set, X-Dq-Timestamp and X-Dq-Signature, the hex encoded
+// HMAC-SHA256 of "<timestamp>.<payload>".
+type Webhook struct {
+	URL    string
+	Secret []byte
+	// ContentType defaults to application/json.
+	ContentType string
+	Header      http.Header
+	// Timeout of a request, defaults to 10s.
+	Timeout time.Duration
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	// ClassifyStatus maps the response status to the class of the error,
+	// "" means delivered, defaults to WebhookStatusClass.
+	ClassifyStatus func(code int) ErrorClass
+}
+
+// WebhookStatusClass delivers on 2xx, retries 408 as timeout and 429 as rate limit,
+// treats other 4xx as validation errors and the rest as default errors.
+// Retry-After of the response is respected.
+func WebhookStatusClass(code int) ErrorClass {
+	switch {
+	case code >= 200 && code < 300:
+		return ""
+	case code == http.StatusRequestTimeout:
+		return ErrorClassTimeout
+	case code == http.StatusTooManyRequests:
+		return ErrorClassRateLimit
+	case code >= 400 && code < 500:
+		return ErrorClassValidation
+	}
+	return ErrorClassDefault
+}
+
+// WebhookSignature returns the signature of the payload sent at timestamp.
+func WebhookSignature(secret []byte, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhook) Process(ctx context.Context, m *Message) error {
+	timeout := w.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(m.Payload))
+	if err != nil {
+		return Classify(fmt.Errorf("new webhook request failed, err: %v", err), ErrorClassValidation)
+	}
+	for k, vs := range w.Header {
+		req.Header[k] = vs
+	}
+	contentType := w.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Dq-Message-Id", m.ID)
+	req.Header.Set("X-Dq-Kind", m.Kind)
+	req.Header.Set("X-Dq-Attempt", strconv.Itoa(m.DeliverCnt))
+	if len(w.Secret) > 0 {
+		ts := time.Now().Unix()
+		req.Header.Set("X-Dq-Timestamp", strconv.FormatInt(ts, 10))
+		req.Header.Set("X-Dq-Signature", WebhookSignature(w.Secret, ts, m.Payload))
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed, err: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	classify := w.ClassifyStatus
+	if classify == nil {
+		classify = WebhookStatusClass
+	}
+	class := classify(resp.StatusCode)
+	if class == "" {
+		return nil
+	}
+
+	err = Classify(fmt.Errorf("webhook response status: %s", resp.Status), class)
+	if sec, e := strconv.Atoi(resp.Header.Get("Retry-After")); e == nil && sec > 0 {
+		err = RetryAfter(err, time.Duration(sec)*time.Second)
+	}
+	return err
+}
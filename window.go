@@ -0,0 +1,75 @@
+package dq
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Window is a daily time window from Start to End, both offsets from midnight.
+// A window with Start after End crosses midnight, e.g. 22:00 to 02:00.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+	// Weekdays limits the days the window starts on, empty means every day.
+	Weekdays []time.Weekday
+	// Location defaults to time.Local.
+	Location *time.Location
+}
+
+// Contains reports whether t is inside the window.
+func (w Window) Contains(t time.Time) bool {
+	if w.Location != nil {
+		t = t.In(w.Location)
+	} else {
+		t = t.Local()
+	}
+
+	// wall clock, so windows keep their hours on the days of DST transitions
+	h, m, s := t.Clock()
+	offset := time.Duration(h*3600+m*60+s)*time.Second + time.Duration(t.Nanosecond())
+
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End && w.onDay(t.Weekday())
+	}
+
+	// crosses midnight, the part after midnight belongs to the window started yesterday
+	if offset >= w.Start {
+		return w.onDay(t.Weekday())
+	}
+	return offset < w.End && w.onDay((t.Weekday()+6)%7)
+}
+
+func (w Window) onDay(d time.Weekday) bool {
+	if len(w.Weekdays) == 0 {
+		return true
+	}
+	for _, wd := range w.Weekdays {
+		if wd == d {
+			return true
+		}
+	}
+	return false
+}
+
+// RateWindow applies Limit and Burst to consumers inside the window,
+// a Burst below 1 is taken as 1.
+type RateWindow struct {
+	Window
+	Limit rate.Limit
+	Burst int
+}
+
+func (q *Queue) inBlackout(t time.Time) bool {
+	for _, w := range q.blackoutWindows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// suspended reports whether consumers should not take messages now.
+func (q *Queue) suspended() bool {
+	return q.paused() || q.inBlackout(time.Now())
+}
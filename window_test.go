@@ -0,0 +1,84 @@
+package dq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestWindowContains(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.UTC)
+	}
+
+	w := Window{Start: 1 * time.Hour, End: 3 * time.Hour, Location: time.UTC}
+	assert.False(t, w.Contains(at(1, 0, 59)))
+	assert.True(t, w.Contains(at(1, 1, 0)))
+	assert.True(t, w.Contains(at(1, 2, 59)))
+	assert.False(t, w.Contains(at(1, 3, 0)))
+
+	// crosses midnight, starts on Monday only
+	w = Window{Start: 22 * time.Hour, End: 2 * time.Hour, Weekdays: []time.Weekday{time.Monday}, Location: time.UTC}
+	assert.False(t, w.Contains(at(1, 1, 0)))
+	assert.True(t, w.Contains(at(1, 23, 0)))
+	assert.True(t, w.Contains(at(2, 1, 0)))
+	assert.False(t, w.Contains(at(2, 23, 0)))
+
+	// 2024-03-10 starts DST in New York, 09:30 is 8.5 hours after midnight
+	ny, err := time.LoadLocation("America/New_York")
+	if assert.Nil(t, err) {
+		w = Window{Start: 9 * time.Hour, End: 17 * time.Hour, Location: ny}
+		assert.True(t, w.Contains(time.Date(2024, 3, 10, 9, 30, 0, 0, ny)))
+		assert.False(t, w.Contains(time.Date(2024, 3, 10, 17, 30, 0, 0, ny)))
+		assert.True(t, w.Contains(time.Date(2024, 11, 3, 16, 30, 0, 0, ny)))
+	}
+}
+
+func TestRateSchedule(t *testing.T) {
+	q := New(append(testOpts(t),
+		WithLimiter(100, 10),
+		WithRateSchedule(RateWindow{
+			Window: Window{Start: 1 * time.Hour, End: 3 * time.Hour, Location: time.UTC},
+			Limit:  1,
+			Burst:  1,
+		}),
+	)...)
+	q.conf.baseLimit, q.conf.baseBurst = q.lim.Limit(), q.lim.Burst()
+
+	q.applyLimit(time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC))
+	assert.Equal(t, rate.Limit(1), q.lim.Limit())
+	assert.Equal(t, 1, q.lim.Burst())
+
+	q.applyLimit(time.Date(2024, 1, 1, 4, 0, 0, 0, time.UTC))
+	assert.Equal(t, rate.Limit(100), q.lim.Limit())
+	assert.Equal(t, 10, q.lim.Burst())
+
+	// a window without burst still lets takes through
+	q.rateSchedule[0].Burst = 0
+	q.applyLimit(time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC))
+	assert.Equal(t, 1, q.lim.Burst())
+}
+
+func TestNextBusinessHour(t *testing.T) {
+	// 2024-01-05 is a Friday, 2024-01-08 is a holiday Monday
+	at := func(day, hour int) time.Time {
+		return time.Date(2024, 1, day, hour, 0, 0, 0, time.UTC)
+	}
+	cal := WeekdayCalendar{
+		Start:    9 * time.Hour,
+		End:      17 * time.Hour,
+		Holidays: []time.Time{at(8, 0)},
+	}
+
+	assert.Equal(t, at(5, 9), NextBusinessHour(at(5, 8), time.UTC, cal))
+	assert.Equal(t, at(5, 10), NextBusinessHour(at(5, 10), time.UTC, cal))
+	assert.Equal(t, at(9, 9), NextBusinessHour(at(5, 17), time.UTC, cal))
+	assert.Equal(t, at(9, 9), NextBusinessDay(at(5, 8), time.UTC, cal))
+
+	// 08:00 UTC is 17:00 in Tokyo
+	tokyo := time.FixedZone("JST", 9*3600)
+	assert.Equal(t, time.Date(2024, 1, 4, 9, 0, 0, 0, tokyo), NextBusinessHour(at(3, 8), tokyo, cal))
+}
@@ -0,0 +1,380 @@
+package dq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// kinds of messages running workflow steps and compensations
+const (
+	kindStep       = "dq.step"
+	kindCompensate = "dq.compensate"
+)
+
+// Step is a task of a workflow, run once all the steps it depends on are done.
+type Step struct {
+	// Name is unique in the workflow.
+	Name string `json:"name"`
+	// Task is the name registered by Register or RegisterFunc.
+	Task string `json:"task"`
+	// Args are JSON encoded.
+	Args      interface{} `json:"args,omitempty"`
+	DependsOn []string    `json:"depends_on,omitempty"`
+	// Compensate is the task undoing the step, run with CompensateArgs
+	// if the step succeeded but a later step failed.
+	Compensate     string      `json:"compensate,omitempty"`
+	CompensateArgs interface{} `json:"compensate_args,omitempty"`
+}
+
+// Workflow is a DAG of steps.
+type Workflow struct {
+	Steps []Step `json:"steps"`
+}
+
+// StepState is the state of a workflow step.
+type StepState string
+
+const (
+	StepPending   StepState = "pending"
+	StepRunning   StepState = "running"
+	StepSucceeded StepState = "succeeded"
+	StepFailed    StepState = "failed"
+	// StepCompensated steps succeeded and are undone by their Compensate task.
+	StepCompensated StepState = "compensated"
+)
+
+// WorkflowStatus is the state of a workflow and its steps.
+type WorkflowStatus struct {
+	ID string
+	// State is StepRunning until all steps succeeded or a step failed.
+	State    StepState
+	Steps    map[string]StepState
+	CreateAt time.Time
+}
+
+// stepRef is the payload of step messages, Steps are the steps left to
+// compensate, in order, for compensation messages.
+type stepRef struct {
+	Workflow string   `json:"workflow"`
+	Step     string   `json:"step"`
+	Steps    []string `json:"steps,omitempty"`
+}
+
+// validate checks that step names are unique and the steps form a DAG.
+func (w Workflow) validate() error {
+	steps := make(map[string]Step, len(w.Steps))
+	for _, s := range w.Steps {
+		if s.Name == "" || s.Task == "" {
+			return fmt.Errorf("step name and task are required")
+		}
+		if _, ok := steps[s.Name]; ok {
+			return fmt.Errorf("step %s is duplicated", s.Name)
+		}
+		steps[s.Name] = s
+	}
+
+	// 0 unvisited, 1 visiting, 2 visited
+	marks := make(map[string]int, len(steps))
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case 1:
+			return fmt.Errorf("step %s is in a cycle", name)
+		case 2:
+			return nil
+		}
+		marks[name] = 1
+		for _, dep := range steps[name].DependsOn {
+			if _, ok := steps[dep]; !ok {
+				return fmt.Errorf("step %s depends on unknown step %s", name, dep)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		marks[name] = 2
+		return nil
+	}
+	for _, s := range w.Steps {
+		if err := visit(s.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w Workflow) step(name string) (Step, bool) {
+	for _, s := range w.Steps {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Step{}, false
+}
+
+// Submit saves the workflow and starts the steps without dependencies,
+// steps are run by WorkflowHandler and retried like other messages.
+// The workflow state is kept for the message save time.
+func (q *Queue) Submit(ctx context.Context, w Workflow) (string, error) {
+	if err := w.validate(); err != nil {
+		return "", fmt.Errorf("invalid workflow, err: %v", err)
+	}
+	def, err := json.Marshal(w)
+	if err != nil {
+		return "", fmt.Errorf("marshal workflow failed, err: %v", err)
+	}
+
+	id := uuid.NewString()
+	key := q.workflowKey(id)
+	values := []interface{}{"def", def, "create_at", time.Now().UnixMilli()}
+	for _, s := range w.Steps {
+		values = append(values, "state:"+s.Name, string(StepPending))
+	}
+	pipe := q.rdb.TxPipeline()
+	pipe.HSet(ctx, key, values...)
+	pipe.Expire(ctx, key, q.messageSaveTime)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", fmt.Errorf("save workflow failed, err: %v", err)
+	}
+
+	for _, s := range w.Steps {
+		if len(s.DependsOn) == 0 {
+			if err := q.startStep(ctx, id, s.Name); err != nil {
+				return id, err
+			}
+		}
+	}
+	return id, nil
+}
+
+// WorkflowStatus returns the status of the workflow, nil if it does not exist.
+func (q *Queue) WorkflowStatus(ctx context.Context, id string) (*WorkflowStatus, error) {
+	values, err := q.rdb.reader().HGetAll(ctx, q.workflowKey(id)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get workflow failed, err: %v", err)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	var w Workflow
+	if err = json.Unmarshal([]byte(values["def"]), &w); err != nil {
+		return nil, fmt.Errorf("unmarshal workflow failed, err: %v", err)
+	}
+	ms, _ := strconv.ParseInt(values["create_at"], 10, 64)
+	s := &WorkflowStatus{ID: id, State: StepSucceeded, Steps: make(map[string]StepState, len(w.Steps)), CreateAt: time.UnixMilli(ms)}
+	for _, step := range w.Steps {
+		state := StepState(values["state:"+step.Name])
+		s.Steps[step.Name] = state
+		switch {
+		case state == StepFailed:
+			s.State = StepFailed
+		case state != StepSucceeded && state != StepCompensated && s.State != StepFailed:
+			s.State = StepRunning
+		}
+	}
+	return s, nil
+}
+
+func (q *Queue) workflowKey(id string) string {
+	return q.key(kWorkflow) + ":" + id
+}
+
+// startStep produces the step once, even if its last dependencies are done concurrently.
+func (q *Queue) startStep(ctx context.Context, id, step string) error {
+	ok, err := q.rdb.HSetNX(ctx, q.workflowKey(id), "started:"+step, 1).Result()
+	if err != nil {
+		return fmt.Errorf("start step %s failed, err: %v", step, err)
+	}
+	if !ok {
+		return nil
+	}
+
+	bs, _ := json.Marshal(stepRef{Workflow: id, Step: step})
+	if _, err = q.Produce(ctx, &ProducerMessage{Payload: bs, Kind: kindStep, DedupID: id + ":" + step}); err != nil {
+		q.rdb.HDel(ctx, q.workflowKey(id), "started:"+step)
+		return fmt.Errorf("produce step %s failed, err: %v", step, err)
+	}
+	return nil
+}
+
+// WorkflowHandler returns the handler running workflow steps,
+// messages of other kinds are handled by FuncHandler.
+func (q *Queue) WorkflowHandler() Handler {
+	funcs := FuncHandler()
+	return HandlerFunc(func(ctx context.Context, m *Message) error {
+		switch m.Kind {
+		case kindStep:
+			return q.runStep(ctx, m)
+		case kindCompensate:
+			return q.runCompensate(ctx, m)
+		}
+		return funcs.Process(ctx, m)
+	})
+}
+
+func (q *Queue) runStep(ctx context.Context, m *Message) error {
+	var ref stepRef
+	if err := json.Unmarshal(m.Payload, &ref); err != nil {
+		return Classify(fmt.Errorf("unmarshal step failed, err: %v", err), ErrorClassValidation)
+	}
+	key := q.workflowKey(ref.Workflow)
+	values, err := q.rdb.HMGet(ctx, key, "def", "compensating").Result()
+	if err != nil {
+		return fmt.Errorf("get workflow %s failed, err: %v", ref.Workflow, err)
+	}
+	def, _ := values[0].(string)
+	var w Workflow
+	if err = json.Unmarshal([]byte(def), &w); err != nil {
+		return Classify(fmt.Errorf("unmarshal workflow failed, err: %v", err), ErrorClassValidation)
+	}
+	step, ok := w.step(ref.Step)
+	if !ok {
+		return Classify(fmt.Errorf("step %s not found", ref.Step), ErrorClassValidation)
+	}
+	// a step started before another failed is not run once compensating
+	if values[1] != nil {
+		q.log(ctx, Info, "workflow %s is compensating, step %s is skipped", ref.Workflow, step.Name)
+		return nil
+	}
+
+	if err = q.rdb.HSet(ctx, key, "state:"+step.Name, string(StepRunning)).Err(); err != nil {
+		return fmt.Errorf("save step %s failed, err: %v", step.Name, err)
+	}
+	args, _ := json.Marshal(step.Args)
+	err = FuncHandler().Process(ctx, &Message{ProducerMessage: ProducerMessage{Payload: args, Kind: kindFunc + step.Task}, ID: m.ID})
+	if err != nil {
+		if q.lastAttempt(m, err) {
+			if serr := q.rdb.HSet(ctx, key, "state:"+step.Name, string(StepFailed)).Err(); serr != nil {
+				q.log(ctx, Warn, "workflow %s save step %s failed, err: %v", ref.Workflow, step.Name, serr)
+			}
+			q.log(ctx, Warn, "workflow %s step %s failed, err: %v", ref.Workflow, step.Name, err)
+			if cerr := q.compensate(ctx, ref.Workflow, w); cerr != nil {
+				q.log(ctx, Warn, "workflow %s compensate failed, err: %v", ref.Workflow, cerr)
+			}
+		}
+		return err
+	}
+
+	pipe := q.rdb.TxPipeline()
+	pipe.HSet(ctx, key, "state:"+step.Name, string(StepSucceeded))
+	pipe.HSet(ctx, key, "seq:"+step.Name, time.Now().UnixNano())
+	if _, err = pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("save step %s failed, err: %v", step.Name, err)
+	}
+	states, err := q.rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("get workflow %s failed, err: %v", ref.Workflow, err)
+	}
+	// another step failed meanwhile, the compensation started may have missed this one
+	if states["compensating"] != "" {
+		if step.Compensate == "" {
+			return nil
+		}
+		return q.startCompensate(ctx, ref.Workflow, []string{step.Name})
+	}
+	for _, next := range w.Steps {
+		if states["started:"+next.Name] != "" || len(next.DependsOn) == 0 {
+			continue
+		}
+		ready := true
+		for _, dep := range next.DependsOn {
+			if StepState(states["state:"+dep]) != StepSucceeded {
+				ready = false
+				break
+			}
+		}
+		if ready {
+			if err = q.startStep(ctx, ref.Workflow, next.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lastAttempt reports whether the failed message is not going to be retried,
+// as decided by retry.
+func (q *Queue) lastAttempt(m *Message, err error) bool {
+	return q.decideRetry(m, err).last()
+}
+
+// compensate starts the compensation of the succeeded steps once,
+// in the reverse order they succeeded.
+func (q *Queue) compensate(ctx context.Context, id string, w Workflow) error {
+	key := q.workflowKey(id)
+	ok, err := q.rdb.HSetNX(ctx, key, "compensating", 1).Result()
+	if err != nil || !ok {
+		return err
+	}
+	values, err := q.rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	type done struct {
+		name string
+		seq  int64
+	}
+	var steps []done
+	for _, s := range w.Steps {
+		if s.Compensate == "" || StepState(values["state:"+s.Name]) != StepSucceeded {
+			continue
+		}
+		seq, _ := strconv.ParseInt(values["seq:"+s.Name], 10, 64)
+		steps = append(steps, done{name: s.Name, seq: seq})
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i].seq > steps[j].seq })
+
+	names := make([]string, 0, len(steps))
+	for _, s := range steps {
+		names = append(names, s.name)
+	}
+	return q.startCompensate(ctx, id, names)
+}
+
+// startCompensate produces the compensation of the first of steps,
+// the rest are compensated one by one after it.
+func (q *Queue) startCompensate(ctx context.Context, id string, steps []string) error {
+	if len(steps) == 0 {
+		return nil
+	}
+	bs, _ := json.Marshal(stepRef{Workflow: id, Step: steps[0], Steps: steps[1:]})
+	_, err := q.Produce(ctx, &ProducerMessage{Payload: bs, Kind: kindCompensate, DedupID: id + ":compensate:" + steps[0]})
+	return err
+}
+
+func (q *Queue) runCompensate(ctx context.Context, m *Message) error {
+	var ref stepRef
+	if err := json.Unmarshal(m.Payload, &ref); err != nil {
+		return Classify(fmt.Errorf("unmarshal compensation failed, err: %v", err), ErrorClassValidation)
+	}
+	key := q.workflowKey(ref.Workflow)
+	def, err := q.rdb.HGet(ctx, key, "def").Result()
+	if err != nil {
+		return fmt.Errorf("get workflow %s failed, err: %v", ref.Workflow, err)
+	}
+	var w Workflow
+	if err = json.Unmarshal([]byte(def), &w); err != nil {
+		return Classify(fmt.Errorf("unmarshal workflow failed, err: %v", err), ErrorClassValidation)
+	}
+	step, ok := w.step(ref.Step)
+	if !ok {
+		return Classify(fmt.Errorf("step %s not found", ref.Step), ErrorClassValidation)
+	}
+
+	args, _ := json.Marshal(step.CompensateArgs)
+	if err = FuncHandler().Process(ctx, &Message{ProducerMessage: ProducerMessage{Payload: args, Kind: kindFunc + step.Compensate}, ID: m.ID}); err != nil {
+		return err
+	}
+	if err = q.rdb.HSet(ctx, key, "state:"+step.Name, string(StepCompensated)).Err(); err != nil {
+		return fmt.Errorf("save step %s failed, err: %v", step.Name, err)
+	}
+	return q.startCompensate(ctx, ref.Workflow, ref.Steps)
+}